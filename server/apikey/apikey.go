@@ -0,0 +1,381 @@
+// Package apikey manages API keys, long-lived credentials for scripts and
+// devices that shouldn't hold the account password. Each key is limited to
+// a set of scopes, which are permissions of its owner's role, can be limited
+// to a set of photos, and can expire. Only a hash of each key is stored.
+package apikey
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+
+	"image-upload-server/auth"
+	"image-upload-server/tokenutil"
+)
+
+var (
+	// keysBucket maps the SHA-256 hash of a key to its JSON encoded Key
+	keysBucket = []byte("keys")
+	// byIDBucket maps a key's ID to its hash
+	byIDBucket = []byte("by_id")
+	// byOwnerBucket lists each owner's keys; keys are owner + "\x00" + ID
+	byOwnerBucket = []byte("by_owner")
+)
+
+// Prefix starts every API key, telling it apart from a JWT
+const Prefix = "ipk_"
+
+// keyBytes is the number of random bytes in a key
+const keyBytes = 32
+
+// lastUsedInterval is how often the last use of a key is recorded. Writing
+// it on every request would cost a disk sync each.
+const lastUsedInterval = time.Minute
+
+// MaxPhotos is the largest number of photos a key can be limited to
+const MaxPhotos = 1000
+
+// ContextKey is the key of the *Key a request was made with in the gin
+// context
+const ContextKey = "api_key"
+
+// Scopes are the permissions an API key can be given. Managing the account,
+// which includes its API keys, is never one of them, so a leaked key can't
+// create more.
+var Scopes = []auth.Permission{auth.PermissionUpload, auth.PermissionRead, auth.PermissionEdit, auth.PermissionShare}
+
+var (
+	// ErrInvalidKey is returned for unknown and revoked keys
+	ErrInvalidKey = errors.New("invalid API key")
+	// ErrExpired is returned for a key past its expiry
+	ErrExpired = errors.New("API key has expired")
+)
+
+var (
+	// DB is the global API key store
+	DB *Store
+)
+
+// Key is an API key, without the secret itself
+type Key struct {
+	// ID identifies the key in the API
+	ID    string `json:"id"`
+	Owner string `json:"owner"`
+	Name  string `json:"name"`
+	// Hint is the start of the key, to recognize it by
+	Hint   string            `json:"hint"`
+	Scopes []auth.Permission `json:"scopes"`
+	// Photos are the content hashes of the photos a key is limited to, like
+	// an album; nil for keys that may access the whole library
+	Photos    []string  `json:"photos,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is nil for keys that don't expire
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+}
+
+// Expired reports whether the key can no longer be used at the given time
+func (k *Key) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// Allows reports whether the key's scopes include the permission
+func (k *Key) Allows(permission auth.Permission) bool {
+	for _, scope := range k.Scopes {
+		if scope == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Restricted reports whether the key is limited to a set of photos
+func (k *Key) Restricted() bool {
+	return k.Photos != nil
+}
+
+// AllowsPhoto reports whether the key may access the photo with the content
+// hash. A key limited to photos allows no request that isn't about one.
+func (k *Key) AllowsPhoto(hash string) bool {
+	if !k.Restricted() {
+		return true
+	}
+	for _, photo := range k.Photos {
+		if photo == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// FromContext returns the key the request was made with, or nil for
+// requests made with a token
+func FromContext(c *gin.Context) *Key {
+	key, ok := c.Get(ContextKey)
+	if !ok {
+		return nil
+	}
+	return key.(*Key)
+}
+
+// ParseScopes checks scope names against Scopes
+func ParseScopes(names []string) ([]auth.Permission, error) {
+	if len(names) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	var scopes []auth.Permission
+	seen := map[auth.Permission]bool{}
+	for _, name := range names {
+		scope := auth.Permission(name)
+		valid := false
+		for _, s := range Scopes {
+			valid = valid || s == scope
+		}
+		if !valid {
+			return nil, fmt.Errorf("unknown scope %s", name)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+// Store keeps API keys in an embedded bbolt database
+type Store struct {
+	db *bolt.DB
+}
+
+// Init opens the API key store in the data directory
+func Init(dataDir string) error {
+	dbPath := filepath.Join(dataDir, "api_keys.db")
+	var err error
+	DB, err = Open(dbPath)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("API key store initialized at %s", dbPath)
+	return nil
+}
+
+// Open opens or creates the API key database at path
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening API key store: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{keysBucket, byIDBucket, byOwnerBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error initializing API key store: %w", err)
+	}
+
+	return &Store{db: db}, nil
+}
+
+// Close closes the underlying database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Create stores a new key, setting its ID and hint, and returns the secret
+// key. It is shown only this once.
+func (s *Store) Create(key *Key) (string, error) {
+	id, err := tokenutil.Random(12)
+	if err != nil {
+		return "", err
+	}
+	secret, err := tokenutil.Random(keyBytes)
+	if err != nil {
+		return "", err
+	}
+	secret = Prefix + secret
+	key.ID = id
+	key.Hint = secret[:len(Prefix)+6]
+
+	data, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		hash := tokenutil.Hash(secret)
+		if err := tx.Bucket(keysBucket).Put(hash, data); err != nil {
+			return err
+		}
+		if err := tx.Bucket(byIDBucket).Put([]byte(id), hash); err != nil {
+			return err
+		}
+		return tx.Bucket(byOwnerBucket).Put(ownerKey(key.Owner, id), nil)
+	})
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// Authenticate returns the key with the given secret and records its use
+// from the client IP
+func (s *Store) Authenticate(secret, clientIP string, now time.Time) (*Key, error) {
+	if !strings.HasPrefix(secret, Prefix) {
+		return nil, ErrInvalidKey
+	}
+	hash := tokenutil.Hash(secret)
+
+	var key *Key
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		key, err = getKey(tx, hash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, ErrInvalidKey
+	}
+	if key.Expired(now) {
+		return nil, ErrExpired
+	}
+
+	if key.LastUsedAt != nil && now.Sub(*key.LastUsedAt) < lastUsedInterval && key.LastUsedIP == clientIP {
+		return key, nil
+	}
+	key.LastUsedAt = &now
+	key.LastUsedIP = clientIP
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		// The key may have been revoked meanwhile
+		if tx.Bucket(keysBucket).Get(hash) == nil {
+			return ErrInvalidKey
+		}
+		return putKey(tx, hash, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// List returns the owner's keys, newest first
+func (s *Store) List(owner string) ([]Key, error) {
+	keys := []Key{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := ownerKey(owner, "")
+		cursor := tx.Bucket(byOwnerBucket).Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, _ = cursor.Next() {
+			hash := tx.Bucket(byIDBucket).Get(k[len(prefix):])
+			if hash == nil {
+				continue
+			}
+			key, err := getKey(tx, hash)
+			if err != nil {
+				return err
+			}
+			if key != nil {
+				keys = append(keys, *key)
+			}
+		}
+		return nil
+	})
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys, err
+}
+
+// Revoke deletes one of the owner's keys. It reports false if the owner has
+// no key with the ID.
+func (s *Store) Revoke(owner, id string) (bool, error) {
+	revoked := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		hash := tx.Bucket(byIDBucket).Get([]byte(id))
+		if hash == nil {
+			return nil
+		}
+		hash = append([]byte(nil), hash...)
+		key, err := getKey(tx, hash)
+		if err != nil || key == nil || key.Owner != owner {
+			return err
+		}
+		if err := tx.Bucket(keysBucket).Delete(hash); err != nil {
+			return err
+		}
+		if err := tx.Bucket(byIDBucket).Delete([]byte(id)); err != nil {
+			return err
+		}
+		revoked = true
+		return tx.Bucket(byOwnerBucket).Delete(ownerKey(owner, id))
+	})
+	return revoked, err
+}
+
+// RevokeAll deletes all of the owner's keys and returns how many there were
+func (s *Store) RevokeAll(owner string) (int, error) {
+	count := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		prefix := ownerKey(owner, "")
+		byOwner := tx.Bucket(byOwnerBucket)
+		var owned [][]byte
+		cursor := byOwner.Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, _ = cursor.Next() {
+			owned = append(owned, append([]byte(nil), k...))
+		}
+		for _, k := range owned {
+			id := k[len(prefix):]
+			if hash := tx.Bucket(byIDBucket).Get(id); hash != nil {
+				if err := tx.Bucket(keysBucket).Delete(append([]byte(nil), hash...)); err != nil {
+					return err
+				}
+				if err := tx.Bucket(byIDBucket).Delete(id); err != nil {
+					return err
+				}
+				count++
+			}
+			if err := byOwner.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+func getKey(tx *bolt.Tx, hash []byte) (*Key, error) {
+	data := tx.Bucket(keysBucket).Get(hash)
+	if data == nil {
+		return nil, nil
+	}
+	var key Key
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, fmt.Errorf("error decoding API key: %w", err)
+	}
+	return &key, nil
+}
+
+func putKey(tx *bolt.Tx, hash []byte, key *Key) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(keysBucket).Put(hash, data)
+}
+
+func ownerKey(owner, id string) []byte {
+	return []byte(owner + "\x00" + id)
+}
@@ -0,0 +1,182 @@
+package apikey
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+
+	"image-upload-server/auth"
+	"image-upload-server/tokenutil"
+)
+
+func openTestStore(t *testing.T) *Store {
+	store, err := Open(filepath.Join(t.TempDir(), "api_keys.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestCreateAndAuthenticate(t *testing.T) {
+	store := openTestStore(t)
+	key := &Key{Owner: "alice", Name: "NAS backup", Scopes: []auth.Permission{auth.PermissionUpload}, CreatedAt: time.Now()}
+	secret, err := store.Create(key)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(secret, Prefix))
+	assert.True(t, strings.HasPrefix(secret, key.Hint))
+	assert.NotEmpty(t, key.ID)
+
+	// Only the hash of the key is stored
+	require.NoError(t, store.db.View(func(tx *bolt.Tx) error {
+		assert.Nil(t, tx.Bucket(keysBucket).Get([]byte(secret)))
+		assert.NotNil(t, tx.Bucket(keysBucket).Get(tokenutil.Hash(secret)))
+		return nil
+	}))
+
+	now := time.Now()
+	authenticated, err := store.Authenticate(secret, "192.0.2.1", now)
+	require.NoError(t, err)
+	assert.Equal(t, key.ID, authenticated.ID)
+	assert.True(t, authenticated.Allows(auth.PermissionUpload))
+	assert.False(t, authenticated.Allows(auth.PermissionRead))
+
+	_, err = store.Authenticate(secret+"x", "192.0.2.1", now)
+	assert.ErrorIs(t, err, ErrInvalidKey)
+	_, err = store.Authenticate("eyJhbGciOi", "192.0.2.1", now)
+	assert.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func TestLastUse(t *testing.T) {
+	store := openTestStore(t)
+	secret, err := store.Create(&Key{Owner: "alice", Name: "camera", Scopes: []auth.Permission{auth.PermissionUpload}})
+	require.NoError(t, err)
+	lastUse := func() (time.Time, string) {
+		keys, err := store.List("alice")
+		require.NoError(t, err)
+		require.Len(t, keys, 1)
+		require.NotNil(t, keys[0].LastUsedAt)
+		return *keys[0].LastUsedAt, keys[0].LastUsedIP
+	}
+
+	now := time.Now()
+	_, err = store.Authenticate(secret, "192.0.2.1", now)
+	require.NoError(t, err)
+	usedAt, ip := lastUse()
+	assert.True(t, usedAt.Equal(now))
+	assert.Equal(t, "192.0.2.1", ip)
+
+	// Uses shortly after are not written
+	_, err = store.Authenticate(secret, "192.0.2.1", now.Add(10*time.Second))
+	require.NoError(t, err)
+	usedAt, _ = lastUse()
+	assert.True(t, usedAt.Equal(now))
+
+	// Unless they come from elsewhere
+	_, err = store.Authenticate(secret, "198.51.100.7", now.Add(20*time.Second))
+	require.NoError(t, err)
+	usedAt, ip = lastUse()
+	assert.True(t, usedAt.Equal(now.Add(20*time.Second)))
+	assert.Equal(t, "198.51.100.7", ip)
+
+	_, err = store.Authenticate(secret, "198.51.100.7", now.Add(2*time.Minute))
+	require.NoError(t, err)
+	usedAt, _ = lastUse()
+	assert.True(t, usedAt.Equal(now.Add(2*time.Minute)))
+}
+
+func TestExpiredKey(t *testing.T) {
+	store := openTestStore(t)
+	expiresAt := time.Now().Add(time.Hour)
+	secret, err := store.Create(&Key{Owner: "alice", Name: "temporary", Scopes: []auth.Permission{auth.PermissionRead}, ExpiresAt: &expiresAt})
+	require.NoError(t, err)
+
+	_, err = store.Authenticate(secret, "192.0.2.1", time.Now())
+	assert.NoError(t, err)
+	_, err = store.Authenticate(secret, "192.0.2.1", expiresAt)
+	assert.ErrorIs(t, err, ErrExpired)
+}
+
+func TestListAndRevoke(t *testing.T) {
+	store := openTestStore(t)
+	now := time.Now()
+	first, err := store.Create(&Key{Owner: "alice", Name: "first", Scopes: []auth.Permission{auth.PermissionRead}, CreatedAt: now})
+	require.NoError(t, err)
+	second := &Key{Owner: "alice", Name: "second", Scopes: []auth.Permission{auth.PermissionUpload}, CreatedAt: now.Add(time.Second)}
+	_, err = store.Create(second)
+	require.NoError(t, err)
+	_, err = store.Create(&Key{Owner: "bob", Name: "bob's", Scopes: []auth.Permission{auth.PermissionRead}, CreatedAt: now})
+	require.NoError(t, err)
+
+	keys, err := store.List("alice")
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.Equal(t, "second", keys[0].Name)
+	assert.Equal(t, "first", keys[1].Name)
+
+	// Users can only revoke their own keys
+	revoked, err := store.Revoke("bob", keys[1].ID)
+	require.NoError(t, err)
+	assert.False(t, revoked)
+	revoked, err = store.Revoke("alice", keys[1].ID)
+	require.NoError(t, err)
+	assert.True(t, revoked)
+	_, err = store.Authenticate(first, "192.0.2.1", time.Now())
+	assert.ErrorIs(t, err, ErrInvalidKey)
+
+	keys, err = store.List("alice")
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Equal(t, second.ID, keys[0].ID)
+}
+
+func TestRevokeAll(t *testing.T) {
+	store := openTestStore(t)
+	var secrets []string
+	for _, owner := range []string{"alice", "alice", "bob"} {
+		secret, err := store.Create(&Key{Owner: owner, Name: "key", Scopes: []auth.Permission{auth.PermissionRead}})
+		require.NoError(t, err)
+		secrets = append(secrets, secret)
+	}
+
+	count, err := store.RevokeAll("alice")
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	for _, secret := range secrets[:2] {
+		_, err = store.Authenticate(secret, "192.0.2.1", time.Now())
+		assert.ErrorIs(t, err, ErrInvalidKey)
+	}
+	keys, err := store.List("alice")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+	_, err = store.Authenticate(secrets[2], "192.0.2.1", time.Now())
+	assert.NoError(t, err)
+}
+
+func TestAllowsPhoto(t *testing.T) {
+	library := &Key{Scopes: []auth.Permission{auth.PermissionRead}}
+	assert.False(t, library.Restricted())
+	assert.True(t, library.AllowsPhoto("aaaa"))
+	assert.True(t, library.AllowsPhoto(""))
+
+	album := &Key{Scopes: []auth.Permission{auth.PermissionRead}, Photos: []string{"aaaa"}}
+	assert.True(t, album.Restricted())
+	assert.True(t, album.AllowsPhoto("aaaa"))
+	assert.False(t, album.AllowsPhoto("bbbb"))
+	// Requests that aren't about one photo
+	assert.False(t, album.AllowsPhoto(""))
+}
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := ParseScopes([]string{"photos:read", "photos:upload", "photos:read"})
+	require.NoError(t, err)
+	assert.Equal(t, []auth.Permission{auth.PermissionRead, auth.PermissionUpload}, scopes)
+
+	for _, names := range [][]string{nil, {"photos:delete"}, {"users:manage"}, {"account:manage"}} {
+		_, err := ParseScopes(names)
+		assert.Error(t, err, names)
+	}
+}
@@ -0,0 +1,178 @@
+package apikey
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"image-upload-server/auth"
+	"image-upload-server/index"
+)
+
+// maxNameLength is the longest name a key can be given
+const maxNameLength = 100
+
+// HandleCreateKey creates an API key for the authenticated user. The
+// request names the key, its scopes, which must be permissions of the
+// user's role, and optionally the photos it is limited to and the number of
+// seconds after which it expires. The response holds the key, which can't
+// be retrieved again.
+func HandleCreateKey(c *gin.Context) {
+	username := c.GetString("username")
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var request struct {
+		Name      string   `json:"name" binding:"required"`
+		Scopes    []string `json:"scopes" binding:"required"`
+		Photos    []string `json:"photos"`
+		ExpiresIn int64    `json:"expires_in"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" || len(request.Name) > maxNameLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name must be 1-100 characters"})
+		return
+	}
+	if request.ExpiresIn < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in must not be negative"})
+		return
+	}
+	scopes, err := ParseScopes(request.Scopes)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "scopes": Scopes})
+		return
+	}
+	role := c.GetString("role")
+	for _, scope := range scopes {
+		if !auth.HasPermission(role, scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Your role doesn't allow scope " + string(scope)})
+			return
+		}
+	}
+
+	var photos []string
+	if request.Photos != nil {
+		// Uploads, edits and shares reach beyond the listed photos, so
+		// limited keys can only read
+		if len(scopes) != 1 || scopes[0] != auth.PermissionRead {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Keys limited to photos can only have the photos:read scope"})
+			return
+		}
+		if len(request.Photos) == 0 || len(request.Photos) > MaxPhotos {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "photos must list 1-1000 content hashes"})
+			return
+		}
+		photos, err = ownedPhotos(username, request.Photos)
+		if errors.Is(err, errPhotoNotFound) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+			return
+		}
+	}
+
+	now := time.Now()
+	key := &Key{Owner: username, Name: request.Name, Scopes: scopes, Photos: photos, CreatedAt: now}
+	if request.ExpiresIn > 0 {
+		expiresAt := now.Add(time.Duration(request.ExpiresIn) * time.Second)
+		key.ExpiresAt = &expiresAt
+	}
+	secret, err := DB.Create(key)
+	if err != nil {
+		log.Printf("Error creating API key for %s: %v", username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, struct {
+		*Key
+		Secret string `json:"key"`
+	}{key, secret})
+}
+
+// errPhotoNotFound is returned for a photo the user doesn't own
+var errPhotoNotFound = errors.New("photo not found")
+
+// ownedPhotos checks that the user owns the photos and adds the other files
+// of stacked assets, such as the video of a Live Photo, which are listed
+// with them
+func ownedPhotos(owner string, hashes []string) ([]string, error) {
+	var photos []string
+	seen := map[string]bool{}
+	add := func(hash string) {
+		if !seen[hash] {
+			seen[hash] = true
+			photos = append(photos, hash)
+		}
+	}
+	for _, hash := range hashes {
+		record, found, err := index.DB.LookupOwned(owner, hash)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: %s", errPhotoNotFound, hash)
+		}
+		add(record.Hash)
+		if !record.Stacked {
+			continue
+		}
+		members, err := index.DB.Stack(owner, record.PairKey)
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range members {
+			add(member.Hash)
+		}
+	}
+	return photos, nil
+}
+
+// HandleListKeys returns the authenticated user's API keys
+func HandleListKeys(c *gin.Context) {
+	username := c.GetString("username")
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	keys, err := DB.List(username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// HandleRevokeKey deletes one of the authenticated user's API keys
+func HandleRevokeKey(c *gin.Context) {
+	username := c.GetString("username")
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	revoked, err := DB.Revoke(username, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+		return
+	}
+	if !revoked {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
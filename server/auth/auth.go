@@ -4,11 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"image-upload-server/config"
+	"image-upload-server/tokenutil"
 	"log"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 )
 
 // Claims represents the JWT claims
@@ -16,80 +17,68 @@ type Claims struct {
 	Username string `json:"username"`
 	Email    string `json:"email"`
 	Role     string `json:"role"`
-	jwt.StandardClaims
+	// SessionID is the session the token was issued in, empty for tokens
+	// issued without one. The token's own ID (jti) is RegisteredClaims.ID.
+	SessionID string `json:"sid,omitempty"`
+	jwt.RegisteredClaims
 }
 
-// HandleLogin handles user authentication
-func HandleLogin(c *gin.Context) {
-	var loginRequest struct {
-		Username string `json:"username" binding:"required"`
-		Password string `json:"password" binding:"required"`
-	}
+// issuer is the iss claim of all tokens
+const issuer = "image-upload-server"
 
-	if err := c.BindJSON(&loginRequest); err != nil {
-		c.JSON(400, gin.H{"error": "Invalid request format"})
-		return
-	}
+// HandleJWKS publishes the public keys tokens are signed with
+func HandleJWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(200, keyRing().JWKS())
+}
 
-	// In a real application, you would validate the username and password against a database.
-	// For this example, we'll just check if the username and password are not empty.
-	if loginRequest.Username == "" || loginRequest.Password == "" {
-		c.JSON(401, gin.H{"error": "Invalid credentials"})
-		return
-	}
+// GenerateToken creates a new JWT token for the given user and role. The
+// token can't be refreshed; sessions get theirs from SessionStore.Login.
+func GenerateToken(username, role string) (string, error) {
+	token, _, err := generateAccessToken(username, role, "", time.Now())
+	return token, err
+}
 
-	// Generate a token for the user
-	token, err := GenerateToken(loginRequest.Username)
+// generateAccessToken creates an access token valid for config.AccessTokenTTL
+// with a random ID, so it can be revoked
+func generateAccessToken(username, role, sessionID string, now time.Time) (string, *Claims, error) {
+	id, err := tokenutil.Random(16)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to generate token"})
-		return
+		return "", nil, err
 	}
 
-	// Return the token to the client
-	c.JSON(200, gin.H{"token": token, "identity": gin.H{"username": loginRequest.Username, "role": "default"}})
-}
-
-// GenerateToken creates a new JWT token for the given user
-func GenerateToken(username string) (string, error) {
-	// Set the expiration time for the token
-	expirationTime := time.Now().Add(12 * time.Hour)
-
 	// Create the JWT claims
 	claims := &Claims{
-		Username: username,
-		Email:    fmt.Sprintf("%s@example.com", username), // Mock email
-		Role:     "default",                               // Mock role
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-			IssuedAt:  time.Now().Unix(),
-			Issuer:    "image-upload-server",
+		Username:  username,
+		Email:     fmt.Sprintf("%s@example.com", username), // Mock email
+		Role:      role,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        id,
+			ExpiresAt: jwt.NewNumericDate(now.Add(config.AccessTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			Issuer:    issuer,
 		},
 	}
 
-	// Sign the token with the secret key
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(config.JWTSecret))
+	// Sign the token with the current key
+	tokenString, err := keyRing().sign(claims)
 	if err != nil {
 		log.Printf("Failed to sign token: %v", err)
-		return "", err
+		return "", nil, err
 	}
 
-	return tokenString, nil
+	return tokenString, claims, nil
 }
 
 // ParseToken parses and validates a JWT token
 func ParseToken(tokenString string) (*Claims, error) {
 	claims := &Claims{}
 
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		// Validate the signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-
-		// Return the secret key for signing
-		return []byte(config.JWTSecret), nil
-	})
+	// The key named by the kid header also decides the signing method
+	token, err := jwt.ParseWithClaims(tokenString, claims, keyRing().verificationKey,
+		jwt.WithValidMethods([]string{AlgorithmHS256, AlgorithmRS256, AlgorithmEdDSA}),
+		jwt.WithIssuer(issuer))
 	if err != nil {
 		return nil, err
 	}
@@ -97,10 +86,22 @@ func ParseToken(tokenString string) (*Claims, error) {
 	if !token.Valid {
 		return nil, errors.New("invalid token")
 	}
+	if claims.ExpiresAt == nil {
+		return nil, errors.New("token has no expiry")
+	}
 
 	return claims, nil
 }
 
+// keyRing returns the global key ring, or one with the configured secret
+// before InitKeys was called
+func keyRing() *KeyRing {
+	if Keys != nil {
+		return Keys
+	}
+	return NewHMACKeyRing(config.JWTSecret)
+}
+
 // GetUserClaimsFromContext extracts user claims from the Gin context
 func GetUserClaimsFromContext(c *gin.Context) (*Claims, error) {
 	// Get the Authorization header
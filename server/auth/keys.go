@@ -0,0 +1,311 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"image-upload-server/config"
+	"image-upload-server/tokenutil"
+)
+
+// Algorithms tokens can be signed with
+const (
+	AlgorithmHS256 = "HS256"
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+// rsaKeyBits is the size of generated RSA keys
+const rsaKeyBits = 2048
+
+// ErrDefaultSecret is returned when tokens would be signed with the default
+// JWT secret outside dev mode
+var ErrDefaultSecret = errors.New("JWT_SECRET is not set; set it to a secure random value, or set DEV_MODE=true for development")
+
+var (
+	// Keys is the global key ring
+	Keys *KeyRing
+)
+
+// KeyRing holds the keys tokens are signed and verified with. Every token
+// names its key in the kid header. The newest key signs; older keys only
+// verify, until the tokens they signed have expired.
+type KeyRing struct {
+	mu sync.RWMutex
+	// path is where generated keys are kept, empty for HMAC secrets
+	path      string
+	algorithm string
+	rotation  time.Duration
+	// keys are ordered newest first
+	keys []*signingKey
+}
+
+// signingKey is a key as it is stored
+type signingKey struct {
+	ID        string    `json:"kid"`
+	Algorithm string    `json:"alg"`
+	CreatedAt time.Time `json:"created_at"`
+	// RetiredAt is set once a newer key took over signing
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
+	// PrivateKey is the PKCS #8 encoded private key
+	PrivateKey []byte `json:"private_key,omitempty"`
+
+	secret []byte
+	signer crypto.Signer
+}
+
+// InitKeys sets up the keys configured by JWT_ALGORITHM. Generated keys are
+// kept in the data directory and replaced when they are due.
+func InitKeys(dataDir string) error {
+	var err error
+	switch config.JWTAlgorithm {
+	case AlgorithmHS256:
+		if config.JWTSecret == config.JWTSecretDefault && !config.DevMode {
+			return ErrDefaultSecret
+		}
+		Keys = NewHMACKeyRing(config.JWTSecret, config.JWTPreviousSecrets...)
+	case AlgorithmRS256, AlgorithmEdDSA:
+		path := filepath.Join(dataDir, "signing_keys.json")
+		Keys, err = LoadKeyRing(path, config.JWTAlgorithm, config.JWTKeyRotation)
+		if err != nil {
+			return err
+		}
+		log.Printf("Signing keys loaded from %s", path)
+	default:
+		return fmt.Errorf("unsupported JWT algorithm %q, use %s, %s or %s", config.JWTAlgorithm, AlgorithmHS256, AlgorithmRS256, AlgorithmEdDSA)
+	}
+
+	log.Printf("Signing tokens with %s key %s", config.JWTAlgorithm, Keys.CurrentID())
+	return nil
+}
+
+// NewHMACKeyRing returns a key ring signing with the HS256 secret, which
+// also accepts tokens signed with the previous secrets. Their key IDs are
+// derived from the secrets.
+func NewHMACKeyRing(secret string, previous ...string) *KeyRing {
+	ring := &KeyRing{algorithm: AlgorithmHS256}
+	for _, s := range append([]string{secret}, previous...) {
+		sum := sha256.Sum256([]byte("kid:" + s))
+		ring.keys = append(ring.keys, &signingKey{
+			ID:        hex.EncodeToString(sum[:8]),
+			Algorithm: AlgorithmHS256,
+			secret:    []byte(s),
+		})
+	}
+	return ring
+}
+
+// LoadKeyRing opens the generated keys stored at path, creating the file if
+// needed, and rotates them so the current key is of the algorithm and no
+// older than rotation
+func LoadKeyRing(path, algorithm string, rotation time.Duration) (*KeyRing, error) {
+	ring := &KeyRing{path: path, algorithm: algorithm, rotation: rotation}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading signing keys: %w", err)
+	}
+	if err == nil {
+		var stored struct {
+			Keys []*signingKey `json:"keys"`
+		}
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return nil, fmt.Errorf("error decoding signing keys: %w", err)
+		}
+		for _, key := range stored.Keys {
+			parsed, err := x509.ParsePKCS8PrivateKey(key.PrivateKey)
+			if err != nil {
+				return nil, fmt.Errorf("error decoding signing key %s: %w", key.ID, err)
+			}
+			signer, ok := parsed.(crypto.Signer)
+			if !ok {
+				return nil, fmt.Errorf("signing key %s is not a private key", key.ID)
+			}
+			key.signer = signer
+		}
+		ring.keys = stored.Keys
+	}
+
+	if err := ring.Rotate(time.Now()); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// Rotate replaces the signing key when it is older than the rotation
+// interval and forgets retired keys whose tokens have all expired. HMAC
+// secrets are rotated by changing JWT_SECRET instead.
+func (k *KeyRing) Rotate(now time.Time) error {
+	if k.path == "" {
+		return nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	changed := false
+	if len(k.keys) == 0 || k.keys[0].Algorithm != k.algorithm || !now.Before(k.keys[0].CreatedAt.Add(k.rotation)) {
+		key, err := generateKey(k.algorithm, now)
+		if err != nil {
+			return err
+		}
+		if len(k.keys) > 0 {
+			retired := now
+			k.keys[0].RetiredAt = &retired
+		}
+		k.keys = append([]*signingKey{key}, k.keys...)
+		changed = true
+		log.Printf("Generated %s signing key %s", key.Algorithm, key.ID)
+	}
+
+	// Tokens live at most config.AccessTokenTTL, so a key retired longer
+	// ago than that has nothing left to verify
+	kept := k.keys[:1]
+	for _, key := range k.keys[1:] {
+		if key.RetiredAt != nil && !now.Before(key.RetiredAt.Add(config.AccessTokenTTL)) {
+			changed = true
+			continue
+		}
+		kept = append(kept, key)
+	}
+	k.keys = kept
+
+	if !changed {
+		return nil
+	}
+	return k.save()
+}
+
+// CurrentID returns the ID of the key tokens are signed with
+func (k *KeyRing) CurrentID() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys[0].ID
+}
+
+// sign signs the claims with the current key
+func (k *KeyRing) sign(claims jwt.Claims) (string, error) {
+	k.mu.RLock()
+	key := k.keys[0]
+	k.mu.RUnlock()
+
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+	if key.secret != nil {
+		return token.SignedString(key.secret)
+	}
+	return token.SignedString(key.signer)
+}
+
+// verificationKey returns the key a token is verified with, as named by its
+// kid header. It is a jwt.Keyfunc.
+func (k *KeyRing) verificationKey(token *jwt.Token) (interface{}, error) {
+	id, _ := token.Header["kid"].(string)
+	if id == "" {
+		return nil, errors.New("token has no key ID")
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if key.ID != id {
+			continue
+		}
+		// The algorithm is the key's, whatever the token claims
+		if token.Method.Alg() != key.Algorithm {
+			return nil, fmt.Errorf("unexpected signing method %v for key %s", token.Header["alg"], id)
+		}
+		if key.secret != nil {
+			return key.secret, nil
+		}
+		return key.signer.Public(), nil
+	}
+	return nil, fmt.Errorf("unknown key %s", id)
+}
+
+// JWKS returns the public keys as a JSON Web Key Set, so other services can
+// verify tokens. HMAC secrets are never published.
+func (k *KeyRing) JWKS() map[string]interface{} {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	keys := []map[string]string{}
+	for _, key := range k.keys {
+		encoded := map[string]string{"kid": key.ID, "alg": key.Algorithm, "use": "sig"}
+		switch public := key.signer.(type) {
+		case *rsa.PrivateKey:
+			encoded["kty"] = "RSA"
+			encoded["n"] = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			encoded["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PrivateKey:
+			encoded["kty"] = "OKP"
+			encoded["crv"] = "Ed25519"
+			encoded["x"] = base64.RawURLEncoding.EncodeToString(public.Public().(ed25519.PublicKey))
+		default:
+			continue
+		}
+		keys = append(keys, encoded)
+	}
+	return map[string]interface{}{"keys": keys}
+}
+
+// save writes the keys to the key file, readable only by the server
+func (k *KeyRing) save() error {
+	data, err := json.MarshalIndent(struct {
+		Keys []*signingKey `json:"keys"`
+	}{k.keys}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := k.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("error writing signing keys: %w", err)
+	}
+	if err := os.Rename(tmp, k.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error writing signing keys: %w", err)
+	}
+	return nil
+}
+
+// generateKey creates a new private key for the algorithm
+func generateKey(algorithm string, now time.Time) (*signingKey, error) {
+	var signer crypto.Signer
+	var err error
+	switch algorithm {
+	case AlgorithmRS256:
+		signer, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case AlgorithmEdDSA:
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("can't generate keys for %s", algorithm)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error generating signing key: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding signing key: %w", err)
+	}
+	id, err := tokenutil.Random(12)
+	if err != nil {
+		return nil, err
+	}
+	return &signingKey{ID: id, Algorithm: algorithm, CreatedAt: now, PrivateKey: der, signer: signer}, nil
+}
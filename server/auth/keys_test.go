@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"image-upload-server/config"
+)
+
+// useKeys makes ring the global key ring for the test
+func useKeys(t *testing.T, ring *KeyRing) {
+	previous := Keys
+	Keys = ring
+	t.Cleanup(func() { Keys = previous })
+}
+
+func TestInitKeysRefusesDefaultSecret(t *testing.T) {
+	previous := Keys
+	t.Cleanup(func() {
+		Keys = previous
+		config.JWTSecret, config.JWTAlgorithm, config.DevMode = config.JWTSecretDefault, config.JWTAlgorithmDefault, false
+	})
+	config.JWTAlgorithm = AlgorithmHS256
+
+	config.JWTSecret = config.JWTSecretDefault
+	assert.ErrorIs(t, InitKeys(t.TempDir()), ErrDefaultSecret)
+	config.DevMode = true
+	assert.NoError(t, InitKeys(t.TempDir()))
+
+	config.DevMode = false
+	config.JWTSecret = "a-secure-secret"
+	assert.NoError(t, InitKeys(t.TempDir()))
+
+	config.JWTAlgorithm = "none"
+	assert.Error(t, InitKeys(t.TempDir()))
+}
+
+func TestHMACPreviousSecretsVerify(t *testing.T) {
+	useKeys(t, NewHMACKeyRing("old-secret"))
+	token, err := GenerateToken("alice", RoleMember)
+	require.NoError(t, err)
+
+	// The old secret still verifies after the secret changed
+	useKeys(t, NewHMACKeyRing("new-secret", "old-secret"))
+	claims, err := ParseToken(token)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", claims.Username)
+
+	// Until it is dropped
+	useKeys(t, NewHMACKeyRing("new-secret"))
+	_, err = ParseToken(token)
+	assert.Error(t, err)
+
+	// HMAC secrets are not published
+	assert.Empty(t, Keys.JWKS()["keys"])
+}
+
+func TestAsymmetricKeys(t *testing.T) {
+	for _, algorithm := range []string{AlgorithmRS256, AlgorithmEdDSA} {
+		t.Run(algorithm, func(t *testing.T) {
+			ring, err := LoadKeyRing(filepath.Join(t.TempDir(), "signing_keys.json"), algorithm, time.Hour)
+			require.NoError(t, err)
+			useKeys(t, ring)
+
+			token, err := GenerateToken("alice", RoleMember)
+			require.NoError(t, err)
+			claims, err := ParseToken(token)
+			require.NoError(t, err)
+			assert.Equal(t, "alice", claims.Username)
+
+			// The published key verifies the token
+			keys := ring.JWKS()["keys"].([]map[string]string)
+			require.Len(t, keys, 1)
+			jwk := keys[0]
+			assert.Equal(t, ring.CurrentID(), jwk["kid"])
+			assert.Equal(t, algorithm, jwk["alg"])
+			_, err = jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+				return publicKey(t, jwk), nil
+			}, jwt.WithValidMethods([]string{algorithm}))
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestTokensSignedWithAnotherAlgorithmAreRejected(t *testing.T) {
+	ring, err := LoadKeyRing(filepath.Join(t.TempDir(), "signing_keys.json"), AlgorithmRS256, time.Hour)
+	require.NoError(t, err)
+	useKeys(t, ring)
+
+	// An HS256 token using the public key as secret, with the RSA key's ID
+	public, err := base64.RawURLEncoding.DecodeString(ring.JWKS()["keys"].([]map[string]string)[0]["n"])
+	require.NoError(t, err)
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{
+		Username: "mallory",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	})
+	forged.Header["kid"] = ring.CurrentID()
+	token, err := forged.SignedString(public)
+	require.NoError(t, err)
+	_, err = ParseToken(token)
+	assert.Error(t, err)
+
+	// Tokens without a key ID are rejected too
+	unnamed := jwt.NewWithClaims(jwt.SigningMethodRS256, &Claims{Username: "mallory"})
+	token, err = unnamed.SignedString(ring.keys[0].signer)
+	require.NoError(t, err)
+	_, err = ParseToken(token)
+	assert.Error(t, err)
+}
+
+func TestKeyRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signing_keys.json")
+	ring, err := LoadKeyRing(path, AlgorithmEdDSA, 24*time.Hour)
+	require.NoError(t, err)
+	useKeys(t, ring)
+	first := ring.CurrentID()
+	token, err := GenerateToken("alice", RoleMember)
+	require.NoError(t, err)
+
+	// The keys are kept across restarts, readable by the server only
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	reloaded, err := LoadKeyRing(path, AlgorithmEdDSA, 24*time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, first, reloaded.CurrentID())
+
+	// A key is replaced when it is due, and keeps verifying its tokens
+	now := time.Now()
+	require.NoError(t, ring.Rotate(now.Add(time.Hour)))
+	assert.Equal(t, first, ring.CurrentID())
+	require.NoError(t, ring.Rotate(now.Add(24*time.Hour)))
+	assert.NotEqual(t, first, ring.CurrentID())
+	_, err = ParseToken(token)
+	assert.NoError(t, err)
+	assert.Len(t, ring.JWKS()["keys"], 2)
+
+	// Once its tokens have expired it is dropped
+	require.NoError(t, ring.Rotate(now.Add(24*time.Hour+config.AccessTokenTTL)))
+	assert.Len(t, ring.JWKS()["keys"], 1)
+	reloaded, err = LoadKeyRing(path, AlgorithmEdDSA, 24*time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, ring.CurrentID(), reloaded.CurrentID())
+	assert.Len(t, reloaded.keys, 1)
+
+	// Switching the algorithm replaces the key at once
+	switched, err := LoadKeyRing(path, AlgorithmRS256, 24*time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, AlgorithmRS256, switched.keys[0].Algorithm)
+	assert.Len(t, switched.keys, 2)
+}
+
+// publicKey decodes a JSON Web Key
+func publicKey(t *testing.T, jwk map[string]string) interface{} {
+	decode := func(name string) []byte {
+		data, err := base64.RawURLEncoding.DecodeString(jwk[name])
+		require.NoError(t, err)
+		return data
+	}
+	switch jwk["kty"] {
+	case "RSA":
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(decode("n")), E: int(new(big.Int).SetBytes(decode("e")).Int64())}
+	case "OKP":
+		return ed25519.PublicKey(decode("x"))
+	}
+	t.Fatalf("unexpected key type %s", jwk["kty"])
+	return nil
+}
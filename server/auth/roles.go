@@ -0,0 +1,76 @@
+package auth
+
+// Roles a user can have
+const (
+	// RoleAdmin can do everything, including managing other users
+	RoleAdmin = "admin"
+	// RoleMember uses the library: uploads, views, edits and shares photos
+	RoleMember = "member"
+	// RoleReadOnly views and downloads photos
+	RoleReadOnly = "read_only"
+	// RoleUploader only uploads, for devices such as a phone backing up
+	// its camera roll
+	RoleUploader = "uploader"
+)
+
+// Permission is an action a role allows
+type Permission string
+
+// Permissions checked by middleware.Require
+const (
+	// PermissionUpload allows uploading photos
+	PermissionUpload Permission = "photos:upload"
+	// PermissionRead allows listing, viewing and downloading photos
+	PermissionRead Permission = "photos:read"
+	// PermissionEdit allows changing photos, such as their capture dates
+	PermissionEdit Permission = "photos:edit"
+	// PermissionShare allows creating and deleting share links
+	PermissionShare Permission = "photos:share"
+	// PermissionManageAccount allows changing the account's preferences and
+	// subscription
+	PermissionManageAccount Permission = "account:manage"
+	// PermissionManageUsers allows listing users and changing their roles
+	PermissionManageUsers Permission = "users:manage"
+)
+
+// Roles lists the roles, most privileged first
+var Roles = []string{RoleAdmin, RoleMember, RoleReadOnly, RoleUploader}
+
+// rolePermissions are the permissions each role has
+var rolePermissions = map[string][]Permission{
+	RoleAdmin:    {PermissionUpload, PermissionRead, PermissionEdit, PermissionShare, PermissionManageAccount, PermissionManageUsers},
+	RoleMember:   {PermissionUpload, PermissionRead, PermissionEdit, PermissionShare, PermissionManageAccount},
+	RoleReadOnly: {PermissionRead},
+	RoleUploader: {PermissionUpload},
+}
+
+// ValidRole reports whether role is one of Roles
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// NormalizeRole maps the role stored before roles had permissions, "user",
+// and an empty role to RoleMember
+func NormalizeRole(role string) string {
+	if role == "" || role == "user" {
+		return RoleMember
+	}
+	return role
+}
+
+// HasPermission reports whether the role allows the action. Unknown roles
+// have no permissions.
+func HasPermission(role string, permission Permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Permissions returns the permissions of the role
+func Permissions(role string) []Permission {
+	return append([]Permission{}, rolePermissions[role]...)
+}
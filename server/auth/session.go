@@ -0,0 +1,469 @@
+package auth
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"image-upload-server/config"
+	"image-upload-server/tokenutil"
+)
+
+var (
+	// sessionsBucket maps a session ID to its JSON encoded Session
+	sessionsBucket = []byte("sessions")
+	// byUserBucket lists each user's sessions; keys are username + "\x00" +
+	// session ID
+	byUserBucket = []byte("by_user")
+	// refreshTokensBucket maps the SHA-256 hash of a refresh token to its
+	// JSON encoded refreshToken. The tokens themselves are never stored.
+	refreshTokensBucket = []byte("refresh_tokens")
+	// revokedBucket maps the ID (jti) of a revoked access token to the big
+	// endian Unix time it expires at, after which it can be forgotten
+	revokedBucket = []byte("revoked_tokens")
+)
+
+// refreshTokenBytes is the number of random bytes in a refresh token
+const refreshTokenBytes = 32
+
+var (
+	// ErrInvalidRefreshToken is returned for unknown, expired and revoked
+	// refresh tokens
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	// ErrRefreshTokenReused is returned for a refresh token that was already
+	// exchanged for a new one
+	ErrRefreshTokenReused = errors.New("refresh token was already used")
+)
+
+var (
+	// Sessions is the global session store
+	Sessions *SessionStore
+)
+
+// Session is a login on one device. Each refresh replaces its refresh token,
+// so the refresh tokens issued for a session form a family: presenting one
+// that was already replaced means it was copied, and the whole session is
+// revoked.
+type Session struct {
+	ID         string    `json:"id"`
+	Username   string    `json:"username"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	// ExpiresAt is when the current refresh token expires
+	ExpiresAt time.Time `json:"expires_at"`
+	// RevokedAt is set once the session was logged out
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	// AccessTokens are the unexpired access tokens issued in the session,
+	// which are revoked with it
+	AccessTokens []IssuedToken `json:"access_tokens,omitempty"`
+}
+
+// IssuedToken identifies an access token by its jti
+type IssuedToken struct {
+	ID        string    `json:"id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// refreshToken is the stored state of a refresh token
+type refreshToken struct {
+	SessionID string    `json:"session_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// UsedAt is set once the token was exchanged for a new one
+	UsedAt *time.Time `json:"used_at,omitempty"`
+}
+
+// TokenPair is an access token with the refresh token that renews it
+type TokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	// ExpiresIn is the lifetime of the access token in seconds
+	ExpiresIn int64  `json:"expires_in"`
+	SessionID string `json:"-"`
+}
+
+// SessionStore keeps sessions, hashed refresh tokens and the revoked access
+// tokens in an embedded bbolt database
+type SessionStore struct {
+	db *bolt.DB
+}
+
+// InitSessions opens the session store in the data directory and forgets
+// expired sessions and tokens
+func InitSessions(dataDir string) error {
+	dbPath := filepath.Join(dataDir, "sessions.db")
+	var err error
+	Sessions, err = OpenSessions(dbPath)
+	if err != nil {
+		return err
+	}
+	if err := Sessions.Prune(time.Now()); err != nil {
+		log.Printf("Error pruning sessions: %v", err)
+	}
+
+	log.Printf("Session store initialized at %s", dbPath)
+	return nil
+}
+
+// OpenSessions opens or creates the session database at path
+func OpenSessions(path string) (*SessionStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening session store: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{sessionsBucket, byUserBucket, refreshTokensBucket, revokedBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error initializing session store: %w", err)
+	}
+
+	return &SessionStore{db: db}, nil
+}
+
+// Close closes the underlying database
+func (s *SessionStore) Close() error {
+	return s.db.Close()
+}
+
+// Login starts a new session for the user and returns its first tokens,
+// which carry the user's role
+func (s *SessionStore) Login(username, role string) (*TokenPair, error) {
+	id, err := tokenutil.Random(16)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	session := &Session{ID: id, Username: username, CreatedAt: now}
+
+	var pair *TokenPair
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		pair, err = issue(tx, session, role, now)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(byUserBucket).Put(userKey(username, id), nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pair, nil
+}
+
+// Refresh exchanges a refresh token for a new access token and a new refresh
+// token. The old refresh token can't be used again; if it is, the session is
+// revoked and ErrRefreshTokenReused returned. The new access token carries
+// the role lookup returns for the user, so role changes apply from the next
+// refresh; if the user no longer exists the session is revoked.
+func (s *SessionStore) Refresh(token string, lookup func(username string) (role string, ok bool)) (*TokenPair, error) {
+	now := time.Now()
+	var pair *TokenPair
+	var reused *Session
+	removed := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		hash := tokenutil.Hash(token)
+		stored, err := getRefreshToken(tx, hash)
+		if err != nil {
+			return err
+		}
+		if stored == nil || !now.Before(stored.ExpiresAt) {
+			return ErrInvalidRefreshToken
+		}
+		session, err := getSession(tx, stored.SessionID)
+		if err != nil {
+			return err
+		}
+		if session == nil || session.RevokedAt != nil {
+			return ErrInvalidRefreshToken
+		}
+
+		if stored.UsedAt != nil {
+			// Commit the revocation, the error is returned below
+			reused = session
+			return revokeSession(tx, session, now)
+		}
+
+		role, ok := lookup(session.Username)
+		if !ok {
+			removed = true
+			return revokeSession(tx, session, now)
+		}
+
+		stored.UsedAt = &now
+		if err := putJSON(tx, refreshTokensBucket, hash, stored); err != nil {
+			return err
+		}
+		pair, err = issue(tx, session, role, now)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reused != nil {
+		log.Printf("Refresh token of session %s of user %s was reused, session revoked", reused.ID, reused.Username)
+		return nil, ErrRefreshTokenReused
+	}
+	if removed {
+		return nil, ErrInvalidRefreshToken
+	}
+	return pair, nil
+}
+
+// Revoke logs out one of the user's sessions, revoking its refresh token and
+// access tokens. It reports false if the user has no such session.
+func (s *SessionStore) Revoke(username, sessionID string) (bool, error) {
+	revoked := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		session, err := getSession(tx, sessionID)
+		if err != nil || session == nil || session.Username != username {
+			return err
+		}
+		revoked = true
+		return revokeSession(tx, session, time.Now())
+	})
+	return revoked, err
+}
+
+// RevokeAll logs out all of the user's sessions and returns how many were
+// still active
+func (s *SessionStore) RevokeAll(username string) (int, error) {
+	count := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		prefix := userKey(username, "")
+		cursor := tx.Bucket(byUserBucket).Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && strings.HasPrefix(string(key), string(prefix)); key, _ = cursor.Next() {
+			session, err := getSession(tx, string(key[len(prefix):]))
+			if err != nil {
+				return err
+			}
+			if session == nil || session.RevokedAt != nil {
+				continue
+			}
+			if err := revokeSession(tx, session, now); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// RevokeToken revokes a single access token until it expires
+func (s *SessionStore) RevokeToken(id string, expiresAt time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return revokeToken(tx, IssuedToken{ID: id, ExpiresAt: expiresAt})
+	})
+}
+
+// IsRevoked reports whether the access token with the given jti was revoked
+func (s *SessionStore) IsRevoked(id string) (bool, error) {
+	revoked := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		revoked = tx.Bucket(revokedBucket).Get([]byte(id)) != nil
+		return nil
+	})
+	return revoked, err
+}
+
+// List returns the user's active sessions, most recently used first
+func (s *SessionStore) List(username string) ([]Session, error) {
+	sessions := []Session{}
+	now := time.Now()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := userKey(username, "")
+		cursor := tx.Bucket(byUserBucket).Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && strings.HasPrefix(string(key), string(prefix)); key, _ = cursor.Next() {
+			session, err := getSession(tx, string(key[len(prefix):]))
+			if err != nil {
+				return err
+			}
+			if session != nil && session.RevokedAt == nil && now.Before(session.ExpiresAt) {
+				sessions = append(sessions, *session)
+			}
+		}
+		return nil
+	})
+	sort.SliceStable(sessions, func(i, j int) bool { return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt) })
+	return sessions, err
+}
+
+// Prune forgets expired and revoked sessions with their refresh tokens, and
+// revoked access tokens that have expired anyway
+func (s *SessionStore) Prune(now time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		sessions := tx.Bucket(sessionsBucket)
+		byUser := tx.Bucket(byUserBucket)
+		var stale [][]byte
+		err := sessions.ForEach(func(key, data []byte) error {
+			var session Session
+			if err := json.Unmarshal(data, &session); err != nil {
+				return err
+			}
+			if session.RevokedAt != nil || !now.Before(session.ExpiresAt) {
+				stale = append(stale, append([]byte(nil), key...))
+				if err := byUser.Delete(userKey(session.Username, session.ID)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := deleteKeys(sessions, stale); err != nil {
+			return err
+		}
+
+		stale = nil
+		refreshTokens := tx.Bucket(refreshTokensBucket)
+		err = refreshTokens.ForEach(func(key, data []byte) error {
+			var stored refreshToken
+			if err := json.Unmarshal(data, &stored); err != nil {
+				return err
+			}
+			if !now.Before(stored.ExpiresAt) || sessions.Get([]byte(stored.SessionID)) == nil {
+				stale = append(stale, append([]byte(nil), key...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := deleteKeys(refreshTokens, stale); err != nil {
+			return err
+		}
+
+		stale = nil
+		revoked := tx.Bucket(revokedBucket)
+		err = revoked.ForEach(func(key, value []byte) error {
+			if len(value) != 8 || int64(binary.BigEndian.Uint64(value)) < now.Unix() {
+				stale = append(stale, append([]byte(nil), key...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return deleteKeys(revoked, stale)
+	})
+}
+
+// issue creates an access token and a refresh token for the session and
+// stores them with the session
+func issue(tx *bolt.Tx, session *Session, role string, now time.Time) (*TokenPair, error) {
+	accessToken, claims, err := generateAccessToken(session.Username, role, session.ID, now)
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := tokenutil.Random(refreshTokenBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	session.LastUsedAt = now
+	session.ExpiresAt = now.Add(config.RefreshTokenTTL)
+	live := session.AccessTokens[:0]
+	for _, issued := range session.AccessTokens {
+		if now.Before(issued.ExpiresAt) {
+			live = append(live, issued)
+		}
+	}
+	session.AccessTokens = append(live, IssuedToken{ID: claims.ID, ExpiresAt: claims.ExpiresAt.Time})
+	if err := putJSON(tx, sessionsBucket, []byte(session.ID), session); err != nil {
+		return nil, err
+	}
+	stored := &refreshToken{SessionID: session.ID, ExpiresAt: session.ExpiresAt}
+	if err := putJSON(tx, refreshTokensBucket, tokenutil.Hash(refresh), stored); err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refresh,
+		ExpiresIn:    claims.ExpiresAt.Unix() - now.Unix(),
+		SessionID:    session.ID,
+	}, nil
+}
+
+// revokeSession marks the session revoked and adds its unexpired access
+// tokens to the revocation list
+func revokeSession(tx *bolt.Tx, session *Session, now time.Time) error {
+	for _, issued := range session.AccessTokens {
+		if now.Before(issued.ExpiresAt) {
+			if err := revokeToken(tx, issued); err != nil {
+				return err
+			}
+		}
+	}
+	session.AccessTokens = nil
+	session.RevokedAt = &now
+	return putJSON(tx, sessionsBucket, []byte(session.ID), session)
+}
+
+func revokeToken(tx *bolt.Tx, token IssuedToken) error {
+	expiry := make([]byte, 8)
+	binary.BigEndian.PutUint64(expiry, uint64(token.ExpiresAt.Unix()))
+	return tx.Bucket(revokedBucket).Put([]byte(token.ID), expiry)
+}
+
+func getSession(tx *bolt.Tx, id string) (*Session, error) {
+	data := tx.Bucket(sessionsBucket).Get([]byte(id))
+	if data == nil {
+		return nil, nil
+	}
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("error decoding session %s: %w", id, err)
+	}
+	return &session, nil
+}
+
+func getRefreshToken(tx *bolt.Tx, hash []byte) (*refreshToken, error) {
+	data := tx.Bucket(refreshTokensBucket).Get(hash)
+	if data == nil {
+		return nil, nil
+	}
+	var stored refreshToken
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("error decoding refresh token: %w", err)
+	}
+	return &stored, nil
+}
+
+func putJSON(tx *bolt.Tx, bucket, key []byte, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucket).Put(key, data)
+}
+
+func deleteKeys(bucket *bolt.Bucket, keys [][]byte) error {
+	for _, key := range keys {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func userKey(username, id string) []byte {
+	return []byte(username + "\x00" + id)
+}
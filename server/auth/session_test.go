@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+
+	"image-upload-server/tokenutil"
+)
+
+func openTestSessions(t *testing.T) *SessionStore {
+	store, err := OpenSessions(filepath.Join(t.TempDir(), "sessions.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// member is the role lookup of a user database where everybody is a member
+func member(username string) (string, bool) {
+	return RoleMember, true
+}
+
+func isRevoked(t *testing.T, store *SessionStore, accessToken string) bool {
+	claims, err := ParseToken(accessToken)
+	require.NoError(t, err)
+	revoked, err := store.IsRevoked(claims.ID)
+	require.NoError(t, err)
+	return revoked
+}
+
+func TestLoginIssuesRevocableTokens(t *testing.T) {
+	store := openTestSessions(t)
+
+	tokens, err := store.Login("alice", RoleMember)
+	require.NoError(t, err)
+	assert.NotEmpty(t, tokens.RefreshToken)
+	assert.InDelta(t, (15 * time.Minute).Seconds(), tokens.ExpiresIn, 1)
+
+	claims, err := ParseToken(tokens.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", claims.Username)
+	assert.Equal(t, tokens.SessionID, claims.SessionID)
+	assert.NotEmpty(t, claims.ID)
+
+	sessions, err := store.List("alice")
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, tokens.SessionID, sessions[0].ID)
+	require.Len(t, sessions[0].AccessTokens, 1)
+	assert.Equal(t, claims.ID, sessions[0].AccessTokens[0].ID)
+	assert.True(t, sessions[0].AccessTokens[0].ExpiresAt.Equal(claims.ExpiresAt.Time))
+
+	// Only the hash of the refresh token is stored
+	require.NoError(t, store.db.View(func(tx *bolt.Tx) error {
+		assert.Nil(t, tx.Bucket(refreshTokensBucket).Get([]byte(tokens.RefreshToken)))
+		assert.NotNil(t, tx.Bucket(refreshTokensBucket).Get(tokenutil.Hash(tokens.RefreshToken)))
+		return nil
+	}))
+}
+
+func TestRefreshRotatesTokens(t *testing.T) {
+	store := openTestSessions(t)
+	first, err := store.Login("alice", RoleMember)
+	require.NoError(t, err)
+
+	second, err := store.Refresh(first.RefreshToken, member)
+	require.NoError(t, err)
+	assert.Equal(t, first.SessionID, second.SessionID)
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+	assert.NotEqual(t, first.AccessToken, second.AccessToken)
+
+	third, err := store.Refresh(second.RefreshToken, member)
+	require.NoError(t, err)
+	assert.NotEqual(t, second.RefreshToken, third.RefreshToken)
+	assert.False(t, isRevoked(t, store, third.AccessToken))
+
+	_, err = store.Refresh("unknown", member)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+}
+
+func TestRefreshUsesCurrentRole(t *testing.T) {
+	store := openTestSessions(t)
+	first, err := store.Login("alice", RoleAdmin)
+	require.NoError(t, err)
+	claims, err := ParseToken(first.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, RoleAdmin, claims.Role)
+
+	second, err := store.Refresh(first.RefreshToken, func(username string) (string, bool) {
+		assert.Equal(t, "alice", username)
+		return RoleReadOnly, true
+	})
+	require.NoError(t, err)
+	claims, err = ParseToken(second.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, RoleReadOnly, claims.Role)
+
+	// The session of a removed user is revoked
+	_, err = store.Refresh(second.RefreshToken, func(string) (string, bool) { return "", false })
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+	assert.True(t, isRevoked(t, store, second.AccessToken))
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	store := openTestSessions(t)
+	first, err := store.Login("alice", RoleMember)
+	require.NoError(t, err)
+	second, err := store.Refresh(first.RefreshToken, member)
+	require.NoError(t, err)
+	other, err := store.Login("alice", RoleMember)
+	require.NoError(t, err)
+
+	// Even right after the refresh, as when a stolen token is replayed
+	// before the attacker could be noticed
+	_, err = store.Refresh(first.RefreshToken, member)
+	assert.ErrorIs(t, err, ErrRefreshTokenReused)
+
+	// Every token of the family is revoked, the other session is not
+	assert.True(t, isRevoked(t, store, first.AccessToken))
+	assert.True(t, isRevoked(t, store, second.AccessToken))
+	_, err = store.Refresh(second.RefreshToken, member)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+	assert.False(t, isRevoked(t, store, other.AccessToken))
+	_, err = store.Refresh(other.RefreshToken, member)
+	assert.NoError(t, err)
+}
+
+func TestRevokeSessions(t *testing.T) {
+	store := openTestSessions(t)
+	phone, err := store.Login("alice", RoleMember)
+	require.NoError(t, err)
+	laptop, err := store.Login("alice", RoleMember)
+	require.NoError(t, err)
+	bob, err := store.Login("bob", RoleMember)
+	require.NoError(t, err)
+
+	// Users can only revoke their own sessions
+	revoked, err := store.Revoke("bob", phone.SessionID)
+	require.NoError(t, err)
+	assert.False(t, revoked)
+	revoked, err = store.Revoke("alice", phone.SessionID)
+	require.NoError(t, err)
+	assert.True(t, revoked)
+	assert.True(t, isRevoked(t, store, phone.AccessToken))
+	_, err = store.Refresh(phone.RefreshToken, member)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	sessions, err := store.List("alice")
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, laptop.SessionID, sessions[0].ID)
+
+	count, err := store.RevokeAll("alice")
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.True(t, isRevoked(t, store, laptop.AccessToken))
+	assert.False(t, isRevoked(t, store, bob.AccessToken))
+
+	// Tokens issued without a session are revoked on their own
+	token, err := GenerateToken("carol", RoleMember)
+	require.NoError(t, err)
+	claims, err := ParseToken(token)
+	require.NoError(t, err)
+	require.NoError(t, store.RevokeToken(claims.ID, claims.ExpiresAt.Time))
+	assert.True(t, isRevoked(t, store, token))
+}
+
+func TestPrune(t *testing.T) {
+	store := openTestSessions(t)
+	revoked, err := store.Login("alice", RoleMember)
+	require.NoError(t, err)
+	active, err := store.Login("alice", RoleMember)
+	require.NoError(t, err)
+	_, err = store.Revoke("alice", revoked.SessionID)
+	require.NoError(t, err)
+
+	// Revoked sessions go at once, their access tokens stay revoked until
+	// they expire
+	require.NoError(t, store.Prune(time.Now()))
+	assert.True(t, isRevoked(t, store, revoked.AccessToken))
+	_, err = store.Refresh(revoked.RefreshToken, member)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+	count := func(bucket []byte) int {
+		n := 0
+		require.NoError(t, store.db.View(func(tx *bolt.Tx) error {
+			n = tx.Bucket(bucket).Stats().KeyN
+			return nil
+		}))
+		return n
+	}
+	assert.Equal(t, 1, count(sessionsBucket))
+	assert.Equal(t, 1, count(byUserBucket))
+	assert.Equal(t, 1, count(refreshTokensBucket))
+	assert.Equal(t, 1, count(revokedBucket))
+
+	// Everything is forgotten once expired
+	require.NoError(t, store.Prune(time.Now().Add(31*24*time.Hour)))
+	for _, bucket := range [][]byte{sessionsBucket, byUserBucket, refreshTokensBucket, revokedBucket} {
+		assert.Equal(t, 0, count(bucket), string(bucket))
+	}
+	_, err = store.Refresh(active.RefreshToken, member)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+}
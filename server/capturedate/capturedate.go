@@ -0,0 +1,165 @@
+package capturedate
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"image-upload-server/exif"
+	"image-upload-server/video"
+)
+
+// Confidence tells how far a resolved capture date can be trusted
+type Confidence string
+
+const (
+	// High is for dates recorded by the camera
+	High Confidence = "high"
+	// Medium is for dates written by software, such as file name timestamps
+	// and XMP or IPTC dates
+	Medium Confidence = "medium"
+	// Low is for dates that may well be when the file was copied or saved
+	// rather than captured, and for dates without a time of day
+	Low Confidence = "low"
+)
+
+// earliestDate is the earliest plausible capture date. Anything older is
+// usually a clock that was never set.
+var earliestDate = time.Date(1990, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// File is a file whose capture date is resolved
+type File struct {
+	// Path of the file, whose name is used if Name is empty
+	Path string
+	// Content of the file; if nil, the file at Path is read from disk
+	Content io.ReaderAt
+	// Name is the original file name sent by the client, if known
+	Name string
+	// LastModified is the modification time reported by the client, if known
+	LastModified time.Time
+	// Exif is the file's EXIF metadata, nil if it has none
+	Exif *exif.Metadata
+	// Video is the metadata of a video file, nil for other files
+	Video *video.Metadata
+
+	head     []byte
+	headRead bool
+}
+
+// Head returns the start of the file, where embedded metadata is found. It
+// is read once and shared by all resolvers.
+func (f *File) Head() []byte {
+	if !f.headRead {
+		f.headRead = true
+		if f.Content != nil {
+			f.head, _ = io.ReadAll(io.NewSectionReader(f.Content, 0, exif.MaxScanBytes))
+		} else if file, err := os.Open(f.Path); err == nil {
+			f.head, _ = io.ReadAll(io.LimitReader(file, exif.MaxScanBytes))
+			file.Close()
+		}
+	}
+	return f.head
+}
+
+// Result is a capture date found by a resolver
+type Result struct {
+	exif.CaptureTime
+	// Resolver is the name of the resolver that found the date
+	Resolver   string
+	Confidence Confidence
+}
+
+// Resolver finds the capture date of a file from one source of information
+type Resolver interface {
+	// Name identifies the resolver in results
+	Name() string
+	// Resolve returns the capture date, interpreting local times without
+	// zone information in defaultZone. It reports false if the resolver's
+	// source has no usable date.
+	Resolve(file *File, defaultZone *time.Location) (Result, bool)
+}
+
+// Chain tries resolvers in order
+type Chain []Resolver
+
+// DefaultChain is used for uploads: the EXIF or video creation date, then a
+// timestamp in the file name, then the client's modification time and
+// finally XMP or IPTC dates embedded by editing software
+var DefaultChain = Chain{EXIF{}, Video{}, Filename{}, LastModified{}, XMP{}, IPTC{}}
+
+// Resolve returns the first date found by any resolver of the chain
+func (c Chain) Resolve(file *File, defaultZone *time.Location) (Result, bool) {
+	for _, resolver := range c {
+		result, ok := resolver.Resolve(file, defaultZone)
+		if ok && Plausible(result.Time) {
+			result.Resolver = resolver.Name()
+			return result, true
+		}
+	}
+	return Result{}, false
+}
+
+// Plausible rejects dates from unset clocks and from the future
+func Plausible(t time.Time) bool {
+	return !t.Before(earliestDate) && t.Before(time.Now().Add(24*time.Hour))
+}
+
+// EXIF resolves the capture date from the EXIF DateTimeOriginal tag
+type EXIF struct{}
+
+func (EXIF) Name() string { return "exif" }
+
+func (EXIF) Resolve(file *File, defaultZone *time.Location) (Result, bool) {
+	if file.Exif == nil {
+		return Result{}, false
+	}
+	captureTime, err := file.Exif.ResolveCaptureTime(defaultZone)
+	if err != nil {
+		return Result{}, false
+	}
+	return Result{CaptureTime: captureTime, Confidence: High}, true
+}
+
+// Video resolves the capture date from the creation date in the metadata of
+// a video. The iPhone creation date, which carries the time zone, is
+// trusted more than the movie header, which editors reset on export.
+type Video struct{}
+
+func (Video) Name() string { return "video" }
+
+func (Video) Resolve(file *File, defaultZone *time.Location) (Result, bool) {
+	if file.Video == nil {
+		return Result{}, false
+	}
+	captureTime, err := file.Video.ResolveCaptureTime(defaultZone)
+	if err != nil {
+		return Result{}, false
+	}
+	confidence := Medium
+	if captureTime.Source == exif.ZoneFromOffset {
+		confidence = High
+	}
+	return Result{CaptureTime: captureTime, Confidence: confidence}, true
+}
+
+// LastModified uses the modification time the client reported for the file.
+// Browsers report when the file was last written, which for photos copied
+// between devices may be long after they were taken.
+type LastModified struct{}
+
+func (LastModified) Name() string { return "last_modified" }
+
+func (LastModified) Resolve(file *File, defaultZone *time.Location) (Result, bool) {
+	if file.LastModified.IsZero() {
+		return Result{}, false
+	}
+	return localTime(file.LastModified.In(defaultZone), defaultZone, Low), true
+}
+
+// localTime wraps a time in defaultZone into a result
+func localTime(t time.Time, defaultZone *time.Location, confidence Confidence) Result {
+	return Result{
+		CaptureTime: exif.CaptureTime{Time: t, Zone: defaultZone.String(), Source: exif.ZoneFromDefault},
+		Confidence:  confidence,
+	}
+}
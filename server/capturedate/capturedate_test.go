@@ -0,0 +1,127 @@
+package capturedate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"image-upload-server/exif"
+)
+
+func TestFilenameResolver(t *testing.T) {
+	warsaw, err := time.LoadLocation("Europe/Warsaw")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		want       time.Time
+		confidence Confidence
+	}{
+		{"IMG_20230415_123456.jpg", time.Date(2023, 4, 15, 12, 34, 56, 0, warsaw), Medium},
+		{"VID_20230415_123456_1.mp4", time.Date(2023, 4, 15, 12, 34, 56, 0, warsaw), Medium},
+		{"PXL_20230415_103456789.jpg", time.Date(2023, 4, 15, 10, 34, 56, 789_000_000, time.UTC), Medium},
+		{"Screenshot_2023-04-15-12-34-56.png", time.Date(2023, 4, 15, 12, 34, 56, 0, warsaw), Medium},
+		{"Screenshot_20230415-123456_Chrome.jpg", time.Date(2023, 4, 15, 12, 34, 56, 0, warsaw), Medium},
+		{"Screenshot 2023-04-15 at 9.34.56.png", time.Date(2023, 4, 15, 9, 34, 56, 0, warsaw), Medium},
+		{"signal-2023-04-15-123456.jpg", time.Date(2023, 4, 15, 12, 34, 56, 0, warsaw), Medium},
+		{"IMG-20230415-WA0001.jpg", time.Date(2023, 4, 15, 12, 0, 0, 0, warsaw), Low},
+		{"Screenshot_2023-04-15.png", time.Date(2023, 4, 15, 12, 0, 0, 0, warsaw), Low},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Filename{}.Resolve(&File{Path: "/uploads/x.jpg", Name: tt.name}, warsaw)
+			assert.True(t, ok)
+			assert.True(t, tt.want.Equal(got.Time), "got %v, want %v", got.Time, tt.want)
+			assert.Equal(t, warsaw, got.Time.Location())
+			assert.Equal(t, tt.confidence, got.Confidence)
+		})
+	}
+
+	for _, name := range []string{"photo.jpg", "1681568943783-12345678.jpg", "IMG_1234.JPG"} {
+		_, ok := Filename{}.Resolve(&File{Path: "/uploads/x.jpg", Name: name}, warsaw)
+		assert.False(t, ok, name)
+	}
+
+	// Without a client name the stored name is used
+	_, ok := Filename{}.Resolve(&File{Path: "/uploads/IMG_20230415_123456.jpg"}, warsaw)
+	assert.True(t, ok)
+}
+
+func TestEmbeddedResolvers(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) *File {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(path, data, 0644))
+		return &File{Path: path}
+	}
+
+	xmp := write("xmp.jpg", []byte(`junk<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:Description `+
+		`xmp:CreateDate="2021-01-01T00:00:00" photoshop:DateCreated="2020-07-04T18:30:00+02:00"/></x:xmpmeta>`))
+	got, ok := XMP{}.Resolve(xmp, time.UTC)
+	assert.True(t, ok)
+	assert.True(t, time.Date(2020, 7, 4, 16, 30, 0, 0, time.UTC).Equal(got.Time))
+	assert.Equal(t, "+02:00", got.Zone)
+	assert.Equal(t, exif.ZoneFromOffset, got.Source)
+
+	element := write("element.jpg", []byte(`<x:xmpmeta><exif:DateTimeOriginal>2019-05-06T07:08:09</exif:DateTimeOriginal></x:xmpmeta>`))
+	got, ok = XMP{}.Resolve(element, time.UTC)
+	assert.True(t, ok)
+	assert.True(t, time.Date(2019, 5, 6, 7, 8, 9, 0, time.UTC).Equal(got.Time))
+
+	iptc := []byte("8BIM\x04\x04")
+	iptc = append(iptc, 0x1C, 0x02, 55, 0x00, 0x08)
+	iptc = append(iptc, "20180203"...)
+	iptc = append(iptc, 0x1C, 0x02, 60, 0x00, 0x0B)
+	iptc = append(iptc, "101112-0500"...)
+	got, ok = IPTC{}.Resolve(write("iptc.jpg", iptc), time.UTC)
+	assert.True(t, ok)
+	assert.True(t, time.Date(2018, 2, 3, 15, 11, 12, 0, time.UTC).Equal(got.Time))
+	assert.Equal(t, Medium, got.Confidence)
+
+	// GIF images carry no EXIF data, only an XMP application extension
+	got, ok = XMP{}.Resolve(&File{Path: "../testdata/formats/animation.gif"}, time.UTC)
+	assert.True(t, ok)
+	assert.True(t, time.Date(2022, 12, 31, 22, 59, 0, 0, time.UTC).Equal(got.Time))
+
+	plain := write("plain.jpg", []byte("no metadata here"))
+	_, ok = XMP{}.Resolve(plain, time.UTC)
+	assert.False(t, ok)
+	_, ok = IPTC{}.Resolve(plain, time.UTC)
+	assert.False(t, ok)
+}
+
+func TestChainOrder(t *testing.T) {
+	lastModified := time.Date(2022, 9, 1, 8, 0, 0, 0, time.UTC)
+
+	// The file name wins over the client's modification time
+	file := &File{Path: "/missing/file.jpg", Name: "IMG_20230415_123456.jpg", LastModified: lastModified}
+	got, ok := DefaultChain.Resolve(file, time.UTC)
+	assert.True(t, ok)
+	assert.Equal(t, "filename", got.Resolver)
+
+	file = &File{Path: "/missing/file.jpg", Name: "holiday.jpg", LastModified: lastModified}
+	got, ok = DefaultChain.Resolve(file, time.UTC)
+	assert.True(t, ok)
+	assert.Equal(t, "last_modified", got.Resolver)
+	assert.Equal(t, Low, got.Confidence)
+	assert.True(t, lastModified.Equal(got.Time))
+
+	// EXIF comes first, and implausible dates are skipped
+	file.Exif = &exif.Metadata{DateTimeOriginal: "1970:01:01 00:00:00"}
+	got, ok = DefaultChain.Resolve(file, time.UTC)
+	assert.True(t, ok)
+	assert.Equal(t, "last_modified", got.Resolver)
+
+	file.Exif = &exif.Metadata{DateTimeOriginal: "2021:03:04 05:06:07"}
+	got, ok = DefaultChain.Resolve(file, time.UTC)
+	assert.True(t, ok)
+	assert.Equal(t, "exif", got.Resolver)
+	assert.Equal(t, High, got.Confidence)
+
+	_, ok = DefaultChain.Resolve(&File{Path: "/missing/file.jpg", Name: "holiday.jpg"}, time.UTC)
+	assert.False(t, ok)
+}
@@ -0,0 +1,152 @@
+package capturedate
+
+import (
+	"bytes"
+	"regexp"
+	"time"
+
+	"image-upload-server/exif"
+)
+
+// xmpDatePatterns match the XMP date properties in order of preference,
+// written either as attribute or as element
+var xmpDatePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`exif:DateTimeOriginal(?:="([^"]+)"|>([^<]+)<)`),
+	regexp.MustCompile(`photoshop:DateCreated(?:="([^"]+)"|>([^<]+)<)`),
+	regexp.MustCompile(`xmp:CreateDate(?:="([^"]+)"|>([^<]+)<)`),
+}
+
+// xmpLayouts are the ISO 8601 forms allowed for XMP dates, with and without
+// a time zone
+var xmpLayouts = []struct {
+	layout   string
+	hasZone  bool
+	dateOnly bool
+}{
+	{layout: "2006-01-02T15:04:05.999999999Z07:00", hasZone: true},
+	{layout: "2006-01-02T15:04Z07:00", hasZone: true},
+	{layout: "2006-01-02T15:04:05.999999999"},
+	{layout: "2006-01-02T15:04"},
+	{layout: "2006-01-02", dateOnly: true},
+}
+
+// XMP resolves the capture date from an XMP packet, which editing software
+// such as Lightroom or Photoshop embeds in exported files
+type XMP struct{}
+
+func (XMP) Name() string { return "xmp" }
+
+func (XMP) Resolve(file *File, defaultZone *time.Location) (Result, bool) {
+	head := file.Head()
+	start := bytes.Index(head, []byte("<x:xmpmeta"))
+	if start < 0 {
+		return Result{}, false
+	}
+	packet := head[start:]
+	if end := bytes.Index(packet, []byte("</x:xmpmeta>")); end >= 0 {
+		packet = packet[:end]
+	}
+
+	for _, pattern := range xmpDatePatterns {
+		match := pattern.FindSubmatch(packet)
+		if match == nil {
+			continue
+		}
+		value := string(match[1])
+		if value == "" {
+			value = string(bytes.TrimSpace(match[2]))
+		}
+		if result, ok := parseXMPDate(value, defaultZone); ok {
+			return result, true
+		}
+	}
+	return Result{}, false
+}
+
+func parseXMPDate(value string, defaultZone *time.Location) (Result, bool) {
+	for _, format := range xmpLayouts {
+		t, err := time.ParseInLocation(format.layout, value, defaultZone)
+		if err != nil {
+			continue
+		}
+		if format.hasZone {
+			zone := t.Format("-07:00")
+			return Result{
+				CaptureTime: exif.CaptureTime{Time: t, Zone: zone, Source: exif.ZoneFromOffset},
+				Confidence:  Medium,
+			}, true
+		}
+		if format.dateOnly {
+			return localTime(t.Add(12*time.Hour), defaultZone, Low), true
+		}
+		return localTime(t, defaultZone, Medium), true
+	}
+	return Result{}, false
+}
+
+// IPTC dataset markers: tag marker 0x1C, record 2 (application), dataset
+// 55 (DateCreated, CCYYMMDD) and 60 (TimeCreated, HHMMSS±HHMM)
+var (
+	iptcDateCreated = []byte{0x1C, 0x02, 55}
+	iptcTimeCreated = []byte{0x1C, 0x02, 60}
+)
+
+// IPTC resolves the capture date from the IPTC DateCreated and TimeCreated
+// datasets, as written by news and stock photo software
+type IPTC struct{}
+
+func (IPTC) Name() string { return "iptc" }
+
+func (IPTC) Resolve(file *File, defaultZone *time.Location) (Result, bool) {
+	head := file.Head()
+	date := iptcDataset(head, iptcDateCreated)
+	if len(date) != 8 {
+		return Result{}, false
+	}
+
+	clock := iptcDataset(head, iptcTimeCreated)
+	switch len(clock) {
+	case 11:
+		t, err := time.Parse("20060102150405-0700", date+clock)
+		if err != nil {
+			return Result{}, false
+		}
+		return Result{
+			CaptureTime: exif.CaptureTime{Time: t, Zone: t.Format("-07:00"), Source: exif.ZoneFromOffset},
+			Confidence:  Medium,
+		}, true
+	case 6:
+		t, err := time.ParseInLocation("20060102150405", date+clock, defaultZone)
+		if err != nil {
+			return Result{}, false
+		}
+		return localTime(t, defaultZone, Medium), true
+	default:
+		t, err := time.ParseInLocation("20060102", date, defaultZone)
+		if err != nil {
+			return Result{}, false
+		}
+		return localTime(t.Add(12*time.Hour), defaultZone, Low), true
+	}
+}
+
+// iptcDataset returns the value of the first IPTC dataset with the given
+// marker, or an empty string
+func iptcDataset(data, marker []byte) string {
+	for offset := 0; ; {
+		i := bytes.Index(data[offset:], marker)
+		if i < 0 {
+			return ""
+		}
+		start := offset + i + len(marker) + 2
+		if start > len(data) {
+			return ""
+		}
+		length := int(data[start-2])<<8 | int(data[start-1])
+		// Short datasets only; the high bit marks the extended form
+		if length < 0x8000 && start+length <= len(data) {
+			return string(data[start : start+length])
+		}
+		offset = start
+	}
+}
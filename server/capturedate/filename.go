@@ -0,0 +1,87 @@
+package capturedate
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// filenamePattern is a file naming scheme with an embedded timestamp. The
+// date and time submatches are concatenated and parsed with layout; a third
+// submatch holds milliseconds.
+type filenamePattern struct {
+	re     *regexp.Regexp
+	layout string
+	// utc is set for schemes that name files after the UTC time
+	utc bool
+	// dateOnly is set for schemes without a time of day
+	dateOnly bool
+}
+
+var filenamePatterns = []filenamePattern{
+	// Android camera apps: IMG_20230415_123456.jpg, VID_20230415_123456.mp4
+	{re: regexp.MustCompile(`^(?:IMG|VID)_(\d{8})_(\d{6})`), layout: "20060102150405"},
+	// Google Pixel: PXL_20230415_123456789.jpg, in UTC with milliseconds
+	{re: regexp.MustCompile(`^PXL_(\d{8})_(\d{6})(\d{3})`), layout: "20060102150405", utc: true},
+	// Android screenshots: Screenshot_2023-04-15-12-34-56.png, Screenshot_20230415-123456.png
+	{re: regexp.MustCompile(`^Screenshot_(\d{4}-\d{2}-\d{2})-(\d{2}-\d{2}-\d{2})`), layout: "2006-01-0215-04-05"},
+	{re: regexp.MustCompile(`^Screenshot_(\d{8})-(\d{6})`), layout: "20060102150405"},
+	// macOS screenshots: Screenshot 2023-04-15 at 12.34.56.png
+	{re: regexp.MustCompile(`^Screenshot (\d{4}-\d{2}-\d{2}) at (\d{1,2}\.\d{2}\.\d{2})`), layout: "2006-01-0215.04.05"},
+	// Signal: signal-2023-04-15-123456.jpg
+	{re: regexp.MustCompile(`^signal-(\d{4}-\d{2}-\d{2})-(\d{6})`), layout: "2006-01-02150405"},
+	// WhatsApp: IMG-20230415-WA0001.jpg, which carries only the day
+	{re: regexp.MustCompile(`^(?:IMG|VID)-(\d{8})-WA\d+`), layout: "20060102", dateOnly: true},
+	// Android screenshots without time: Screenshot_2023-04-15.png
+	{re: regexp.MustCompile(`^Screenshot_(\d{4}-\d{2}-\d{2})`), layout: "2006-01-02", dateOnly: true},
+}
+
+// Filename resolves the capture date from timestamps that cameras and apps
+// put into file names
+type Filename struct{}
+
+func (Filename) Name() string { return "filename" }
+
+func (Filename) Resolve(file *File, defaultZone *time.Location) (Result, bool) {
+	name := filepath.Base(file.Path)
+	if file.Name != "" {
+		// Some clients send the path the file was picked from
+		name = filepath.Base(file.Name)
+	}
+
+	for _, pattern := range filenamePatterns {
+		match := pattern.re.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+
+		value := match[1]
+		if len(match) > 2 {
+			value += match[2]
+		}
+
+		zone := defaultZone
+		if pattern.utc {
+			zone = time.UTC
+		}
+		t, err := time.ParseInLocation(pattern.layout, value, zone)
+		if err != nil {
+			continue
+		}
+		if len(match) > 3 {
+			millis, _ := strconv.Atoi(match[3])
+			t = t.Add(time.Duration(millis) * time.Millisecond)
+		}
+
+		confidence := Medium
+		if pattern.dateOnly {
+			// Noon keeps the day when the zone turns out to be off by a few hours
+			t = t.Add(12 * time.Hour)
+			confidence = Low
+		}
+		return localTime(t.In(defaultZone), defaultZone, confidence), true
+	}
+
+	return Result{}, false
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"image-upload-server/auth"
+	"image-upload-server/datefix"
+	"image-upload-server/filehandler"
+	"image-upload-server/layout"
+	"image-upload-server/user"
+)
+
+// runCommand executes an administrative command given on the command line
+// instead of starting the server
+func runCommand(args []string, uploadsDir string) error {
+	switch args[0] {
+	case "migrate-owner":
+		// Move the shared pre-namespace layout into one user's namespace
+		if len(args) != 2 {
+			return fmt.Errorf("usage: %s migrate-owner <username>", os.Args[0])
+		}
+		owner := args[1]
+		if _, exists := user.UserDB.GetUser(owner); !exists {
+			return fmt.Errorf("user %s does not exist", owner)
+		}
+
+		moved, err := filehandler.MigrateLegacyLayout(owner)
+		if err != nil {
+			return err
+		}
+		log.Printf("Moved %d files into the namespace of %s", moved, owner)
+		return nil
+
+	case "refile-dates":
+		// Move files whose month changed under the current capture date rules.
+		// The startup reconcile already refreshed their capture dates.
+		moved, err := filehandler.RefileByCaptureDate()
+		if err != nil {
+			return err
+		}
+		log.Printf("Moved %d files to the directory of their capture date", moved)
+		return nil
+
+	case "resolve-undated":
+		// Look for capture dates of the files in the na directories again
+		moved, err := filehandler.ResolveUndated()
+		if err != nil {
+			return err
+		}
+		log.Printf("Found capture dates for %d undated files", moved)
+		return nil
+
+	case "reorganize":
+		// Move the files into the paths of the current storage layout
+		flags := flag.NewFlagSet("reorganize", flag.ContinueOnError)
+		dryRun := flags.Bool("dry-run", false, "print the planned moves without moving anything")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 0 {
+			return fmt.Errorf("usage: %s reorganize [-dry-run]", os.Args[0])
+		}
+
+		log.Printf("Reorganizing into storage layout %s", layout.Current)
+		moves, err := filehandler.Reorganize(*dryRun)
+		if *dryRun {
+			for _, move := range moves {
+				fmt.Printf("%s -> %s\n", move.From, move.To)
+			}
+			if err == nil {
+				log.Printf("%d files would be moved", len(moves))
+			}
+			return err
+		}
+		log.Printf("Moved %d files", len(moves))
+		return err
+
+	case "correct-dates":
+		// Shift or set the capture dates of a user's photos, selected by hash
+		// or by capture date and camera
+		flags := flag.NewFlagSet("correct-dates", flag.ContinueOnError)
+		owner := flags.String("user", "", "owner of the photos")
+		shift := flags.String("shift", "", "duration to shift the capture dates by, e.g. -1h30m")
+		date := flags.String("date", "", "capture date to set, e.g. 2023-04-01T12:00:00")
+		offset := flags.String("offset", "", "UTC offset to set, e.g. +09:00")
+		from := flags.String("from", "", "select photos captured at or after this RFC 3339 time")
+		to := flags.String("to", "", "select photos captured before this RFC 3339 time")
+		camera := flags.String("camera", "", "select photos taken by this camera model")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *owner == "" {
+			return fmt.Errorf("usage: %s correct-dates -user <username> [-shift <duration>] [-date <date>] [-offset <offset>] [-from <time>] [-to <time>] [-camera <model>] [hash ...]", os.Args[0])
+		}
+		if _, exists := user.UserDB.GetUser(*owner); !exists {
+			return fmt.Errorf("user %s does not exist", *owner)
+		}
+
+		selection := datefix.Selection{Hashes: flags.Args(), Camera: *camera}
+		for _, bound := range []struct {
+			value  string
+			target **time.Time
+		}{{*from, &selection.CapturedFrom}, {*to, &selection.CapturedTo}} {
+			if bound.value == "" {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, bound.value)
+			if err != nil {
+				return fmt.Errorf("invalid time %q: %v", bound.value, err)
+			}
+			*bound.target = &t
+		}
+
+		change := datefix.Change{Shift: *shift, Date: *date, Offset: *offset}
+		correction, err := datefix.Apply(uploadsDir, *owner, "admin", selection, change)
+		if err != nil {
+			return err
+		}
+		for _, item := range correction.Items {
+			if item.Error != "" {
+				log.Printf("Not corrected %s %s: %s", item.Hash, item.Path, item.Error)
+			} else {
+				log.Printf("Corrected %s: %s -> %s", item.Path, item.Before.DateTimeOriginal, item.After.DateTimeOriginal)
+			}
+		}
+		log.Printf("Recorded date correction %d, undo it with undo-date-correction %d", correction.ID, correction.ID)
+		return nil
+
+	case "undo-date-correction":
+		// Write the original capture dates of a correction back
+		if len(args) != 2 {
+			return fmt.Errorf("usage: %s undo-date-correction <id>", os.Args[0])
+		}
+		id, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid date correction ID %q", args[1])
+		}
+		correction, found, err := datefix.DB.Get(id)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("date correction %d does not exist", id)
+		}
+
+		if err := datefix.Undo(uploadsDir, correction); err != nil {
+			return err
+		}
+		for _, item := range correction.Items {
+			if item.UndoError != "" {
+				log.Printf("Not restored %s: %s", item.NewPath, item.UndoError)
+			}
+		}
+		return nil
+
+	case "set-role":
+		// Give a user another role, e.g. make the first admin
+		if len(args) != 3 {
+			return fmt.Errorf("usage: %s set-role <username> <%s>", os.Args[0], strings.Join(auth.Roles, "|"))
+		}
+		if err := user.ChangeRole(args[1], args[2]); err != nil {
+			return err
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
@@ -1,8 +1,12 @@
-
 package config
 
 import (
+	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -12,13 +16,101 @@ const (
 	DataDirDefault    = "./data"
 	// Default server port
 	Port = "0.0.0.0:3001"
+	// Default maximum size of a single uploaded file (2GB)
+	MaxUploadSizeDefault = 2 << 30
+	// Default maximum size of a single uploaded video (10GB)
+	MaxVideoUploadSizeDefault = 10 << 30
+	// Default number of background workers generating derivatives
+	DerivativeWorkersDefault = 2
+	// Default maximum number of pixels of an uploaded image (150 megapixels)
+	MaxImagePixelsDefault = 150_000_000
+	// Default storage layout within a user's directory: YYYY/MM/<millis>-<hash8><ext>
+	StorageLayoutDefault = "{year}/{month}/{timestamp}-{hash:8}{ext}"
+	// Default storage layout of files without a capture date
+	StorageLayoutUndatedDefault = "na/{timestamp}-{hash:8}{ext}"
+	// Default storage backend, the uploads directory on the local filesystem
+	StorageBackendDefault = "local"
+	// Default JWT secret, only accepted in dev mode
+	JWTSecretDefault = "your-secret-key-change-in-production"
+	// Default algorithm tokens are signed with
+	JWTAlgorithmDefault = "HS256"
+	// Default interval at which generated signing keys are replaced
+	JWTKeyRotationDefault = 30 * 24 * time.Hour
+	// Default mailer, which writes messages to the outbox directory
+	MailerDefault = "outbox"
+	// Default SMTP port, for submission with STARTTLS
+	SMTPPortDefault = 587
+	// Default maximum number of messages sent to one address per hour
+	MailRateLimitDefault = 5
+	// Default lifetime of an access token
+	AccessTokenTTLDefault = 15 * time.Minute
+	// Default lifetime of a refresh token; each refresh starts a new one
+	RefreshTokenTTLDefault = 30 * 24 * time.Hour
 )
 
 var (
 	// JWT secret key for token signing
 	JWTSecret           string
+	// Former JWT secrets, which still verify tokens signed with them
+	JWTPreviousSecrets  []string
+	// Algorithm tokens are signed with: HS256 with JWTSecret, or RS256 or
+	// EdDSA with keys generated in the data directory and replaced every
+	// JWTKeyRotation
+	JWTAlgorithm        string
+	JWTKeyRotation      = JWTKeyRotationDefault
+	// Allow insecure settings such as the default JWT secret, for development
+	DevMode             bool
+	// How long access tokens are valid, and how long a session may stay
+	// unused before its refresh token expires
+	AccessTokenTTL      = AccessTokenTTLDefault
+	RefreshTokenTTL     = RefreshTokenTTLDefault
 	UploadsDirOverriden string
 	DataDirOverriden    string
+	// Maximum size of a single uploaded image or other non-video file in bytes
+	MaxUploadSize       int64
+	// Maximum size of a single uploaded video in bytes
+	MaxVideoUploadSize  int64
+	// Maximum width times height of an uploaded image. Decoding takes about
+	// four bytes per pixel, so this also bounds the memory of derivatives.
+	MaxImagePixels      int64 = MaxImagePixelsDefault
+	// Store content uploaded by several users only once, using hard links
+	ShareIdenticalFiles bool
+	// Number of background workers generating thumbnails and previews
+	DerivativeWorkers   int
+	// Time zone assumed for capture dates without offset or GPS position
+	DefaultTimeZone     = time.Local
+	// Templates of the paths files are stored under within a user's
+	// directory, for dated and undated files (see the layout package)
+	StorageLayout        string
+	StorageLayoutUndated string
+	// Where the library is stored: "local" keeps it in the uploads
+	// directory, "s3" in an S3-compatible object store such as MinIO. The
+	// uploads directory still holds incoming files with either backend.
+	StorageBackend       string
+	// Settings of the S3-compatible object store
+	S3Endpoint           string
+	S3Region             string
+	S3Bucket             string
+	S3Prefix             string
+	S3AccessKeyID        string
+	S3SecretAccessKey    string
+	S3VirtualHosted      bool
+	// Base URL of the web app, which links in emails point to
+	PublicURL           string
+	// How email is sent: "smtp", or "outbox" to write each message to a
+	// file in OutboxDir
+	Mailer              string
+	OutboxDir           string
+	MailFrom            string
+	// Maximum number of messages sent to one address per hour
+	MailRateLimit       int
+	// Settings of the SMTP server; SMTPImplicitTLS connects with TLS, as on
+	// port 465, instead of upgrading with STARTTLS
+	SMTPHost            string
+	SMTPPort            int
+	SMTPUsername        string
+	SMTPPassword        string
+	SMTPImplicitTLS     bool
 	// Heap Analytics settings
 	HeapAppID           string
 	HeapAPIKey          string
@@ -28,9 +120,41 @@ var (
 // Init initializes the configuration
 func Init() {
 	// Set JWT secret from environment or use default
-	JWTSecret = getEnvOrDefault("JWT_SECRET", "your-secret-key-change-in-production")
+	JWTSecret = getEnvOrDefault("JWT_SECRET", JWTSecretDefault)
+	JWTPreviousSecrets = getEnvListOrDefault("JWT_PREVIOUS_SECRETS", nil)
+	JWTAlgorithm = getEnvOrDefault("JWT_ALGORITHM", JWTAlgorithmDefault)
+	JWTKeyRotation = getEnvDurationOrDefault("JWT_KEY_ROTATION", JWTKeyRotationDefault)
+	DevMode = getEnvOrDefault("DEV_MODE", "false") == "true"
+	AccessTokenTTL = getEnvDurationOrDefault("ACCESS_TOKEN_TTL", AccessTokenTTLDefault)
+	RefreshTokenTTL = getEnvDurationOrDefault("REFRESH_TOKEN_TTL", RefreshTokenTTLDefault)
 	UploadsDirOverriden = getEnvOrDefault("UPLOADS_DIR", UploadsDirDefault)
 	DataDirOverriden = getEnvOrDefault("DATA_DIR", DataDirDefault)
+	MaxUploadSize = getEnvInt64OrDefault("MAX_UPLOAD_SIZE", MaxUploadSizeDefault)
+	MaxVideoUploadSize = getEnvInt64OrDefault("MAX_VIDEO_UPLOAD_SIZE", MaxVideoUploadSizeDefault)
+	MaxImagePixels = getEnvInt64OrDefault("MAX_IMAGE_PIXELS", MaxImagePixelsDefault)
+	ShareIdenticalFiles = getEnvOrDefault("SHARE_IDENTICAL_FILES", "false") == "true"
+	DerivativeWorkers = int(getEnvInt64OrDefault("DERIVATIVE_WORKERS", DerivativeWorkersDefault))
+	DefaultTimeZone = getEnvLocationOrDefault("DEFAULT_TIMEZONE", time.Local)
+	StorageLayout = getEnvOrDefault("STORAGE_LAYOUT", StorageLayoutDefault)
+	StorageLayoutUndated = getEnvOrDefault("STORAGE_LAYOUT_UNDATED", StorageLayoutUndatedDefault)
+	StorageBackend = getEnvOrDefault("STORAGE_BACKEND", StorageBackendDefault)
+	S3Endpoint = getEnvOrDefault("S3_ENDPOINT", "")
+	S3Region = getEnvOrDefault("S3_REGION", "us-east-1")
+	S3Bucket = getEnvOrDefault("S3_BUCKET", "")
+	S3Prefix = getEnvOrDefault("S3_PREFIX", "")
+	S3AccessKeyID = getEnvOrDefault("S3_ACCESS_KEY_ID", "")
+	S3SecretAccessKey = getEnvOrDefault("S3_SECRET_ACCESS_KEY", "")
+	S3VirtualHosted = getEnvOrDefault("S3_VIRTUAL_HOSTED", "false") == "true"
+	PublicURL = strings.TrimSuffix(getEnvOrDefault("PUBLIC_URL", "http://localhost:3001"), "/")
+	Mailer = getEnvOrDefault("MAILER", MailerDefault)
+	OutboxDir = getEnvOrDefault("OUTBOX_DIR", filepath.Join(DataDirOverriden, "outbox"))
+	MailFrom = getEnvOrDefault("MAIL_FROM", "Image Upload Server <noreply@localhost>")
+	MailRateLimit = int(getEnvInt64OrDefault("MAIL_RATE_LIMIT", MailRateLimitDefault))
+	SMTPHost = getEnvOrDefault("SMTP_HOST", "")
+	SMTPPort = int(getEnvInt64OrDefault("SMTP_PORT", SMTPPortDefault))
+	SMTPUsername = getEnvOrDefault("SMTP_USERNAME", "")
+	SMTPPassword = getEnvOrDefault("SMTP_PASSWORD", "")
+	SMTPImplicitTLS = getEnvOrDefault("SMTP_IMPLICIT_TLS", "false") == "true"
 	
 	// Heap configuration
 	HeapAppID = getEnvOrDefault("HEAP_APP_ID", "")
@@ -46,3 +170,63 @@ func getEnvOrDefault(key, defaultValue string) string {
 	}
 	return value
 }
+
+// getEnvListOrDefault gets a comma separated list from an environment
+// variable or returns default value
+func getEnvListOrDefault(key string, defaultValue []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getEnvInt64OrDefault gets an integer environment variable or returns default value
+func getEnvInt64OrDefault(key string, defaultValue int64) int64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || parsed <= 0 {
+		log.Printf("Invalid value %q for %s, using default %d", value, key, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+// getEnvDurationOrDefault gets a duration such as "15m" from an environment
+// variable or returns default value
+func getEnvDurationOrDefault(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		log.Printf("Invalid duration %q for %s, using default %s", value, key, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+// getEnvLocationOrDefault gets a time zone name such as "Europe/Warsaw" from
+// an environment variable or returns default value
+func getEnvLocationOrDefault(key string, defaultValue *time.Location) *time.Location {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	location, err := time.LoadLocation(value)
+	if err != nil {
+		log.Printf("Invalid time zone %q for %s, using default %s", value, key, defaultValue)
+		return defaultValue
+	}
+	return location
+}
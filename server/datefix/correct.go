@@ -0,0 +1,267 @@
+package datefix
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"image-upload-server/exifwrite"
+	"image-upload-server/filehandler"
+	"image-upload-server/index"
+	"image-upload-server/share"
+	"image-upload-server/sniff"
+	"image-upload-server/storage"
+)
+
+// MaxPhotos is the largest number of photos corrected at once
+const MaxPhotos = 1000
+
+// Codes classifying why a photo was not corrected
+const (
+	CodeNotFound            = "not_found"
+	CodeMetadataNotWritable = "metadata_not_writable"
+	CodeUndated             = "undated"
+	CodeDuplicate           = "duplicate"
+	CodeFailed              = "failed"
+)
+
+var (
+	// ErrInvalid is wrapped by the errors for invalid changes and selections
+	ErrInvalid = errors.New("invalid date correction")
+	// ErrUndone is returned when a correction is undone twice
+	ErrUndone = errors.New("date correction was already undone")
+)
+
+// mu serializes corrections, so two of them never rewrite the same file
+var mu sync.Mutex
+
+// Selection chooses the photos to correct: the ones with the given hashes,
+// or the photos captured in a period, optionally only by one camera
+type Selection struct {
+	Hashes []string `json:"hashes,omitempty"`
+	// CapturedFrom and CapturedTo bound the capture dates, inclusive and
+	// exclusive respectively
+	CapturedFrom *time.Time `json:"captured_from,omitempty"`
+	CapturedTo   *time.Time `json:"captured_to,omitempty"`
+	// Camera matches the make and model, or the model alone, ignoring case
+	Camera string `json:"camera,omitempty"`
+}
+
+// byFilter reports whether the selection filters by capture date or camera
+func (selection *Selection) byFilter() bool {
+	return selection.CapturedFrom != nil || selection.CapturedTo != nil || selection.Camera != ""
+}
+
+// matches reports whether a record is selected by the filter. Only images
+// are selected, as the dates of videos can't be rewritten.
+func (selection *Selection) matches(record *index.Record) bool {
+	if record.MediaType != index.MediaImage {
+		return false
+	}
+	if (selection.CapturedFrom != nil || selection.CapturedTo != nil) && record.CaptureDate.IsZero() {
+		return false
+	}
+	if selection.CapturedFrom != nil && record.CaptureDateUTC.Before(*selection.CapturedFrom) {
+		return false
+	}
+	if selection.CapturedTo != nil && !record.CaptureDateUTC.Before(*selection.CapturedTo) {
+		return false
+	}
+	if selection.Camera != "" {
+		if record.Exif == nil {
+			return false
+		}
+		model := strings.TrimSpace(record.Exif.Model)
+		makeModel := strings.TrimSpace(record.Exif.Make + " " + model)
+		if !strings.EqualFold(selection.Camera, model) && !strings.EqualFold(selection.Camera, makeModel) {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply corrects the capture dates of the selected photos of an owner and
+// records the correction. Photos that can't be corrected are recorded with
+// the reason, the others are rewritten, moved and re-indexed, and the
+// owner's share links follow them. Invalid changes and selections are
+// rejected with an error wrapping ErrInvalid.
+func Apply(uploadsDir, owner, by string, selection Selection, change Change) (*Correction, error) {
+	p, err := change.parse()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if len(selection.Hashes) > 0 && selection.byFilter() {
+		return nil, fmt.Errorf("%w: select photos either by hash or by capture date and camera", ErrInvalid)
+	}
+	if len(selection.Hashes) == 0 && !selection.byFilter() {
+		return nil, fmt.Errorf("%w: no photos selected", ErrInvalid)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	correction := &Correction{Owner: owner, By: by, Change: change, CreatedAt: time.Now().UTC(), Items: []Item{}}
+	var records []index.Record
+	if selection.byFilter() {
+		records, _, err = index.DB.List(index.ListQuery{Owner: owner, Filter: selection.matches})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, hash := range selection.Hashes {
+			record, found, err := index.DB.LookupOwned(owner, hash)
+			if err != nil {
+				return nil, err
+			}
+			if !found {
+				correction.Items = append(correction.Items, Item{Hash: hash, Error: "photo not found", Code: CodeNotFound})
+				continue
+			}
+			records = append(records, *record)
+		}
+	}
+	if len(records) > MaxPhotos {
+		return nil, fmt.Errorf("%w: %d photos selected, at most %d can be corrected at once", ErrInvalid, len(records), MaxPhotos)
+	}
+
+	for _, record := range records {
+		item := Item{Hash: record.Hash, Path: record.Path}
+		corrected, err := p.target(record.CaptureDate)
+		if err != nil {
+			item.fail(err)
+		} else {
+			correct(uploadsDir, record, &item, func(before Values) Values { return p.values(corrected, before) })
+		}
+		correction.Items = append(correction.Items, item)
+	}
+
+	if err := DB.Add(correction); err != nil {
+		return nil, err
+	}
+	log.Printf("Date correction %d by %s: corrected %d of %d photos of %s", correction.ID, by, correction.count(), len(correction.Items), owner)
+	return correction, nil
+}
+
+// Undo writes the original capture date tags back into the photos of a
+// correction. Photos changed or removed since then are left alone and
+// recorded with the reason. The correction is reloaded once the lock is
+// held, so two concurrent undos can't both rewrite the photos.
+func Undo(uploadsDir string, correction *Correction) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	current, found, err := DB.Get(correction.ID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("date correction %d not found", correction.ID)
+	}
+	*correction = *current
+	if correction.UndoneAt != nil {
+		return ErrUndone
+	}
+
+	for i := range correction.Items {
+		item := &correction.Items[i]
+		if !item.Corrected() {
+			continue
+		}
+		record, found, err := index.DB.LookupOwned(correction.Owner, item.NewHash)
+		if err != nil {
+			return err
+		}
+		if !found {
+			item.UndoError = "photo was changed or removed since the correction"
+			continue
+		}
+
+		undone := Item{}
+		correct(uploadsDir, *record, &undone, func(Values) Values { return item.Before })
+		item.UndoError = undone.Error
+	}
+
+	now := time.Now().UTC()
+	correction.UndoneAt = &now
+	if err := DB.Update(correction); err != nil {
+		return err
+	}
+	log.Printf("Date correction %d of %s undone", correction.ID, correction.Owner)
+	return nil
+}
+
+// count returns the number of photos the correction rewrote
+func (correction *Correction) count() int {
+	n := 0
+	for i := range correction.Items {
+		if correction.Items[i].Corrected() {
+			n++
+		}
+	}
+	return n
+}
+
+// correct rewrites the capture date tags of a file and replaces it, filling
+// in the item
+func correct(uploadsDir string, record index.Record, item *Item, values func(before Values) Values) {
+	data, err := readImage(storage.Key(record.Path))
+	if err != nil {
+		item.fail(err)
+		return
+	}
+	rewritten, before, after, err := rewrite(data, values)
+	if err != nil {
+		item.fail(err)
+		return
+	}
+	item.Before, item.After = before, after
+	if before == after {
+		item.NewHash, item.NewPath = record.Hash, record.Path
+		return
+	}
+
+	replaced, err := filehandler.ReplaceContent(uploadsDir, record, rewritten)
+	if err != nil {
+		item.fail(err)
+		return
+	}
+	item.NewHash, item.NewPath = replaced.Hash, replaced.Path
+	if replaced.Hash != record.Hash {
+		if err := share.DB.Rehash(record.Owner, record.Hash, replaced.Hash); err != nil {
+			log.Printf("Failed to update share links of %s: %v", replaced.Path, err)
+		}
+	}
+}
+
+// readImage reads a file whose EXIF data can be rewritten, so videos and
+// RAW files are rejected before they are read into memory
+func readImage(key string) ([]byte, error) {
+	file, err := storage.Open(storage.Files, key)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if kind, ok := sniff.Detect(file, file.Size); !ok || !exifwrite.Supports(kind) {
+		return nil, exifwrite.ErrUnsupported
+	}
+	return io.ReadAll(file)
+}
+
+// fail records why the photo was not corrected
+func (item *Item) fail(err error) {
+	item.Error = err.Error()
+	switch {
+	case errors.Is(err, exifwrite.ErrUnsupported):
+		item.Code = CodeMetadataNotWritable
+	case errors.Is(err, ErrUndated):
+		item.Code = CodeUndated
+	case errors.Is(err, index.ErrDuplicate):
+		item.Code = CodeDuplicate
+	default:
+		item.Code = CodeFailed
+	}
+}
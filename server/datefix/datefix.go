@@ -0,0 +1,233 @@
+// Package datefix corrects the capture dates of photos taken by cameras
+// whose clock was wrong or set to the wrong time zone. The corrected date is
+// written into the photo's EXIF DateTimeOriginal and OffsetTimeOriginal tags,
+// the file moves to the directory of its new month and its index entry is
+// replaced, as its content hash changes. Every correction is recorded with
+// the original values, so it can be undone.
+package datefix
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	exif "github.com/dsoprea/go-exif/v3"
+
+	"image-upload-server/capturedate"
+	"image-upload-server/config"
+	"image-upload-server/exifwrite"
+)
+
+// Tags of the Exif IFD holding the capture date
+const (
+	tagDateTimeOriginal   uint16 = 0x9003
+	tagOffsetTimeOriginal uint16 = 0x9011
+)
+
+// exifTimeLayout is the format of EXIF date and time tags
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+// Layouts accepted for the date and offset of a Change
+const (
+	dateLayout   = "2006-01-02T15:04:05"
+	offsetLayout = "-07:00"
+)
+
+// ErrUndated is returned when a photo without a capture date is shifted
+var ErrUndated = errors.New("photo has no capture date to shift")
+
+// Values are the capture date tags of a photo, as written in the file. An
+// empty value means the tag is absent.
+type Values struct {
+	DateTimeOriginal   string `json:"date_time_original,omitempty"`
+	OffsetTimeOriginal string `json:"offset_time_original,omitempty"`
+}
+
+// Change describes how capture dates are corrected. Shift moves them by a
+// duration such as "-1h30m", Date sets them to an absolute date in the
+// form 2006-01-02T15:04:05, optionally followed by a UTC offset, and Offset
+// sets the UTC offset, e.g. "+09:00", keeping the clock time. Shift and Date
+// are exclusive; either can be combined with Offset.
+type Change struct {
+	Shift  string `json:"shift,omitempty"`
+	Date   string `json:"date,omitempty"`
+	Offset string `json:"offset,omitempty"`
+}
+
+// plan is a parsed Change
+type plan struct {
+	shift time.Duration
+	// date is the wall clock of an absolute date, in UTC unless dateZoned
+	date      *time.Time
+	dateZoned bool
+	// offset is the explicit UTC offset, nil to keep the photo's own
+	offset     *time.Location
+	offsetText string
+}
+
+// parse validates the change
+func (change Change) parse() (*plan, error) {
+	if change.Shift == "" && change.Date == "" && change.Offset == "" {
+		return nil, errors.New("a shift, date or offset is required")
+	}
+	if change.Shift != "" && change.Date != "" {
+		return nil, errors.New("shift and date can't be combined")
+	}
+
+	p := &plan{}
+	if change.Shift != "" {
+		shift, err := time.ParseDuration(change.Shift)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shift %q: %v", change.Shift, err)
+		}
+		if shift%time.Second != 0 {
+			return nil, fmt.Errorf("shift %q must be whole seconds", change.Shift)
+		}
+		p.shift = shift
+	}
+	if change.Date != "" {
+		date, err := time.Parse(time.RFC3339, change.Date)
+		if err == nil {
+			p.dateZoned = true
+		} else if date, err = time.Parse(dateLayout, change.Date); err != nil {
+			return nil, fmt.Errorf("invalid date %q, expected 2006-01-02T15:04:05 with an optional offset", change.Date)
+		}
+		if date.Nanosecond() != 0 {
+			return nil, fmt.Errorf("date %q must be whole seconds", change.Date)
+		}
+		p.date = &date
+	}
+	if change.Offset != "" {
+		if p.dateZoned {
+			return nil, errors.New("offset can't be combined with a date that has one")
+		}
+		parsed, err := time.Parse(offsetLayout, change.Offset)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset %q, expected e.g. +09:00", change.Offset)
+		}
+		_, seconds := parsed.Zone()
+		p.offset = time.FixedZone(change.Offset, seconds)
+		p.offsetText = parsed.Format(offsetLayout)
+	}
+	if p.dateZoned {
+		p.offsetText = p.date.Format(offsetLayout)
+	}
+	return p, nil
+}
+
+// target returns the corrected capture date of a photo captured at current,
+// which is zero for undated photos. Dates are corrected on the wall clock
+// the photo was captured by, so shifting a photo doesn't change its zone
+// and setting an offset keeps its clock time.
+func (p *plan) target(current time.Time) (time.Time, error) {
+	var corrected time.Time
+	switch {
+	case p.date != nil && p.dateZoned:
+		corrected = *p.date
+	case p.date != nil:
+		location := config.DefaultTimeZone
+		if !current.IsZero() {
+			location = current.Location()
+		}
+		corrected = wallClock(*p.date, location)
+	case current.IsZero():
+		return time.Time{}, ErrUndated
+	default:
+		corrected = current.Add(p.shift)
+	}
+	if p.offset != nil {
+		corrected = wallClock(corrected, p.offset)
+	}
+
+	if !capturedate.Plausible(corrected) {
+		return time.Time{}, fmt.Errorf("corrected date %s is implausible", corrected.Format(time.RFC3339))
+	}
+	return corrected, nil
+}
+
+// values returns the tags for a corrected date. The offset tag is only
+// changed if the correction gives one.
+func (p *plan) values(corrected time.Time, before Values) Values {
+	after := Values{
+		DateTimeOriginal:   corrected.Format(exifTimeLayout),
+		OffsetTimeOriginal: before.OffsetTimeOriginal,
+	}
+	if p.offsetText != "" {
+		after.OffsetTimeOriginal = p.offsetText
+	}
+	return after
+}
+
+// wallClock returns the time with the same clock time in another location
+func wallClock(t time.Time, location *time.Location) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, location)
+}
+
+// rewrite replaces the capture date tags of an image with the values
+// returned by after, which is given the current ones. It returns the
+// rewritten image and the values before and after; the image is returned
+// unchanged if the values are.
+func rewrite(data []byte, after func(before Values) Values) ([]byte, Values, Values, error) {
+	var before, updated Values
+	edit := func(tiff []byte) ([]byte, bool, error) {
+		root, err := exifwrite.Builder(tiff)
+		if err != nil {
+			return nil, false, err
+		}
+		exifIFD, err := exif.GetOrCreateIbFromRootIb(root, "IFD/Exif")
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to find the Exif IFD: %v", err)
+		}
+
+		before = Values{
+			DateTimeOriginal:   asciiTag(exifIFD, tagDateTimeOriginal),
+			OffsetTimeOriginal: asciiTag(exifIFD, tagOffsetTimeOriginal),
+		}
+		updated = after(before)
+		if updated == before {
+			return nil, false, nil
+		}
+
+		if err := setASCIITag(exifIFD, tagDateTimeOriginal, "DateTimeOriginal", updated.DateTimeOriginal); err != nil {
+			return nil, false, err
+		}
+		if err := setASCIITag(exifIFD, tagOffsetTimeOriginal, "OffsetTimeOriginal", updated.OffsetTimeOriginal); err != nil {
+			return nil, false, err
+		}
+		encoded, err := exifwrite.Encode(root)
+		if err != nil {
+			return nil, false, err
+		}
+		return encoded, true, nil
+	}
+
+	rewritten, err := exifwrite.Rewrite(data, edit, exifwrite.Options{})
+	if err != nil {
+		return nil, before, updated, err
+	}
+	return rewritten, before, updated, nil
+}
+
+// asciiTag returns the value of an ASCII tag, or an empty string if the IFD
+// doesn't have it
+func asciiTag(ifd *exif.IfdBuilder, tagID uint16) string {
+	tag, err := ifd.FindTag(tagID)
+	if err != nil || !tag.Value().IsBytes() {
+		return ""
+	}
+	value, _, _ := bytes.Cut(tag.Value().Bytes(), []byte{0})
+	return string(value)
+}
+
+// setASCIITag sets an ASCII tag, or removes it for an empty value
+func setASCIITag(ifd *exif.IfdBuilder, tagID uint16, name, value string) error {
+	if value == "" {
+		_, err := ifd.DeleteAll(tagID)
+		return err
+	}
+	if err := ifd.SetStandardWithName(name, value); err != nil {
+		return fmt.Errorf("failed to set %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package datefix
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"image-upload-server/filehandler"
+	"image-upload-server/index"
+	"image-upload-server/share"
+	"image-upload-server/storage"
+)
+
+// setupCorrections opens the stores and indexes the given files, which are
+// copied into alice's uploads under the given relative paths. Their
+// modification time is implausible, so files without EXIF data are undated.
+func setupCorrections(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	uploadsDir := filepath.Join(dir, "uploads")
+
+	idx, err := index.Open(filepath.Join(dir, "index.db"))
+	require.NoError(t, err)
+	index.DB = idx
+	t.Cleanup(func() { idx.Close() })
+
+	shares, err := share.Open(filepath.Join(dir, "shares.db"))
+	require.NoError(t, err)
+	share.DB = shares
+	t.Cleanup(func() { shares.Close() })
+
+	store, err := Open(filepath.Join(dir, "date_corrections.db"))
+	require.NoError(t, err)
+	DB = store
+	t.Cleanup(func() { store.Close() })
+
+	previous := storage.Files
+	storage.Files = storage.NewLocal(uploadsDir)
+	t.Cleanup(func() { storage.Files = previous })
+
+	for target, source := range files {
+		data, err := os.ReadFile(source)
+		require.NoError(t, err)
+		path := filepath.Join(uploadsDir, "alice", filepath.FromSlash(target))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, data, 0644))
+		old := time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+		require.NoError(t, os.Chtimes(path, old, old))
+	}
+	require.NoError(t, filehandler.ReconcileIndex())
+	return uploadsDir
+}
+
+// plainPNG writes a PNG image without any metadata and returns its path
+func plainPNG(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "plain.png")
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	defer file.Close()
+	require.NoError(t, png.Encode(file, image.NewGray(image.Rect(0, 0, 8, 6))))
+	return path
+}
+
+func lookupPath(t *testing.T, path string) *index.Record {
+	record, found, err := index.DB.Get(path)
+	require.NoError(t, err)
+	require.True(t, found, path)
+	return record
+}
+
+func TestShiftMovesPhotoAndUndo(t *testing.T) {
+	uploadsDir := setupCorrections(t, map[string]string{"2023/06/photo.jpg": "../testdata/exif_gps.jpg"})
+	original := lookupPath(t, "/alice/2023/06/photo.jpg")
+	link := share.Share{Owner: "alice", Hash: original.Hash, CreatedAt: time.Now()}
+	require.NoError(t, share.DB.Create(&link))
+
+	// The camera clock ran 15 days ahead
+	correction, err := Apply(uploadsDir, "alice", "alice", Selection{Hashes: []string{original.Hash}}, Change{Shift: "-360h"})
+	require.NoError(t, err)
+	require.Len(t, correction.Items, 1)
+	item := correction.Items[0]
+	assert.Empty(t, item.Error)
+	assert.Equal(t, Values{DateTimeOriginal: "2023:06:15 18:42:07", OffsetTimeOriginal: "+02:00"}, item.Before)
+	assert.Equal(t, Values{DateTimeOriginal: "2023:05:31 18:42:07", OffsetTimeOriginal: "+02:00"}, item.After)
+	assert.Equal(t, "/alice/2023/05/photo.jpg", item.NewPath)
+	assert.NotEqual(t, original.Hash, item.NewHash)
+
+	moved := lookupPath(t, "/alice/2023/05/photo.jpg")
+	assert.Equal(t, item.NewHash, moved.Hash)
+	assert.Equal(t, time.Date(2023, 5, 31, 16, 42, 7, 123_000_000, time.UTC), moved.CaptureDateUTC)
+	assert.Equal(t, "+02:00", moved.CaptureTimeZone)
+	_, found, err := index.DB.LookupOwned("alice", original.Hash)
+	require.NoError(t, err)
+	assert.False(t, found)
+	_, err = os.Stat(filepath.Join(uploadsDir, "alice", "2023", "06"))
+	assert.True(t, os.IsNotExist(err))
+
+	// The share link follows the rewritten photo
+	shared, _, err := share.DB.Get(link.Token)
+	require.NoError(t, err)
+	assert.Equal(t, item.NewHash, shared.Hash)
+
+	stored, found, err := DB.Get(correction.ID)
+	require.NoError(t, err)
+	require.True(t, found)
+	// A second copy loaded before the undo is stale by the time it is used
+	stale, _, err := DB.Get(correction.ID)
+	require.NoError(t, err)
+	require.NoError(t, Undo(uploadsDir, stored))
+	assert.NotNil(t, stored.UndoneAt)
+	assert.Empty(t, stored.Items[0].UndoError)
+	assert.ErrorIs(t, Undo(uploadsDir, stored), ErrUndone)
+	assert.ErrorIs(t, Undo(uploadsDir, stale), ErrUndone)
+
+	restored := lookupPath(t, "/alice/2023/06/photo.jpg")
+	assert.Equal(t, original.CaptureDateUTC, restored.CaptureDateUTC)
+	shared, _, err = share.DB.Get(link.Token)
+	require.NoError(t, err)
+	assert.Equal(t, restored.Hash, shared.Hash)
+}
+
+func TestSetDateAddsExif(t *testing.T) {
+	uploadsDir := setupCorrections(t, map[string]string{
+		"na/plain.png":     plainPNG(t),
+		"na/animation.gif": "../testdata/formats/animation.gif",
+	})
+	plain := lookupPath(t, "/alice/na/plain.png")
+	gif := lookupPath(t, "/alice/na/animation.gif")
+
+	selection := Selection{Hashes: []string{plain.Hash, gif.Hash, "missing"}}
+	correction, err := Apply(uploadsDir, "alice", "admin", selection, Change{Date: "2021-03-04T05:06:07", Offset: "+09:00"})
+	require.NoError(t, err)
+	require.Len(t, correction.Items, 3)
+
+	codes := map[string]string{}
+	for _, item := range correction.Items {
+		codes[item.Hash] = item.Code
+	}
+	assert.Equal(t, map[string]string{plain.Hash: "", gif.Hash: CodeMetadataNotWritable, "missing": CodeNotFound}, codes)
+
+	corrected := lookupPath(t, "/alice/2021/03/plain.png")
+	assert.Equal(t, time.Date(2021, 3, 3, 20, 6, 7, 0, time.UTC), corrected.CaptureDateUTC)
+	assert.Equal(t, "+09:00", corrected.CaptureTimeZone)
+	lookupPath(t, "/alice/na/animation.gif")
+}
+
+func TestSelectByCamera(t *testing.T) {
+	uploadsDir := setupCorrections(t, map[string]string{
+		"2023/06/photo.jpg": "../testdata/exif_gps.jpg",
+		"na/plain.png":      plainPNG(t),
+	})
+	photo := lookupPath(t, "/alice/2023/06/photo.jpg")
+	require.NotNil(t, photo.Exif)
+
+	// Only the camera's photos are selected, and the clock time is kept
+	// when the offset changes
+	correction, err := Apply(uploadsDir, "alice", "alice", Selection{Camera: strings.ToUpper(photo.Exif.Model)}, Change{Offset: "-05:00"})
+	require.NoError(t, err)
+	require.Len(t, correction.Items, 1)
+	assert.Equal(t, Values{DateTimeOriginal: "2023:06:15 18:42:07", OffsetTimeOriginal: "-05:00"}, correction.Items[0].After)
+	assert.Equal(t, time.Date(2023, 6, 15, 23, 42, 7, 123_000_000, time.UTC), lookupPath(t, correction.Items[0].NewPath).CaptureDateUTC)
+}
+
+func TestApplyValidation(t *testing.T) {
+	uploadsDir := setupCorrections(t, map[string]string{"na/plain.png": plainPNG(t)})
+	plain := lookupPath(t, "/alice/na/plain.png")
+	hashes := Selection{Hashes: []string{plain.Hash}}
+
+	for _, tc := range []struct {
+		selection Selection
+		change    Change
+	}{
+		{hashes, Change{}},
+		{hashes, Change{Shift: "1h", Date: "2021-03-04T05:06:07"}},
+		{hashes, Change{Shift: "1.5s"}},
+		{hashes, Change{Date: "2021-03-04"}},
+		{hashes, Change{Date: "2021-03-04T05:06:07Z", Offset: "+01:00"}},
+		{hashes, Change{Offset: "9"}},
+		{Selection{}, Change{Shift: "1h"}},
+		{Selection{Hashes: hashes.Hashes, Camera: "X100V"}, Change{Shift: "1h"}},
+	} {
+		_, err := Apply(uploadsDir, "alice", "alice", tc.selection, tc.change)
+		assert.ErrorIs(t, err, ErrInvalid, "%+v", tc)
+	}
+
+	// Undated photos can be dated, but not shifted, and dates must be
+	// plausible
+	correction, err := Apply(uploadsDir, "alice", "alice", hashes, Change{Shift: "1h"})
+	require.NoError(t, err)
+	assert.Equal(t, CodeUndated, correction.Items[0].Code)
+	correction, err = Apply(uploadsDir, "alice", "alice", hashes, Change{Date: "1970-01-01T00:00:00"})
+	require.NoError(t, err)
+	assert.Equal(t, CodeFailed, correction.Items[0].Code)
+	lookupPath(t, "/alice/na/plain.png")
+}
+
+func TestCorrectionHandlers(t *testing.T) {
+	uploadsDir := setupCorrections(t, map[string]string{"2023/06/photo.jpg": "../testdata/exif_gps.jpg"})
+	photo := lookupPath(t, "/alice/2023/06/photo.jpg")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	authorized := r.Group("/", func(c *gin.Context) {
+		c.Set("username", c.GetHeader("X-User"))
+		c.Next()
+	})
+	authorized.POST("/date-corrections", HandleCreateCorrection(uploadsDir))
+	authorized.GET("/date-corrections", HandleListCorrections)
+	authorized.POST("/date-corrections/:id/undo", HandleUndoCorrection(uploadsDir))
+	request := func(method, target, username, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-User", username)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(http.MethodPost, "/date-corrections", "alice", `{"hashes": ["`+photo.Hash+`"], "shift": "nope"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(http.MethodPost, "/date-corrections", "alice", `{"hashes": ["`+photo.Hash+`"], "shift": "2h"}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created Correction
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, "2h", created.Change.Shift)
+	assert.Equal(t, "2023:06:15 20:42:07", created.Items[0].After.DateTimeOriginal)
+
+	w = request(http.MethodGet, "/date-corrections", "bob", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"corrections": []}`, w.Body.String())
+	w = request(http.MethodGet, "/date-corrections", "alice", "")
+	assert.Contains(t, w.Body.String(), created.Items[0].NewHash)
+
+	undo := fmt.Sprintf("/date-corrections/%d/undo", created.ID)
+	w = request(http.MethodPost, undo, "bob", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = request(http.MethodPost, undo, "alice", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = request(http.MethodPost, undo, "alice", "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
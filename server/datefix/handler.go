@@ -0,0 +1,97 @@
+package datefix
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HandleCreateCorrection corrects the capture dates of the authenticated
+// user's photos. The request combines a Selection and a Change; the
+// recorded correction is returned with the outcome for each photo.
+func HandleCreateCorrection(uploadsDir string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		username := c.GetString("username")
+		if username == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+
+		var request struct {
+			Selection
+			Change
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+			return
+		}
+
+		correction, err := Apply(uploadsDir, username, username, request.Selection, request.Change)
+		if errors.Is(err, ErrInvalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, correction)
+	}
+}
+
+// HandleListCorrections lists the authenticated user's date corrections,
+// newest first
+func HandleListCorrections(c *gin.Context) {
+	username := c.GetString("username")
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	corrections, err := DB.List(username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"corrections": corrections})
+}
+
+// HandleUndoCorrection undoes one of the authenticated user's date
+// corrections
+func HandleUndoCorrection(uploadsDir string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		username := c.GetString("username")
+		if username == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Date correction not found"})
+			return
+		}
+		correction, found, err := DB.Get(id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+			return
+		}
+		if !found || correction.Owner != username {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Date correction not found"})
+			return
+		}
+
+		err = Undo(uploadsDir, correction)
+		if errors.Is(err, ErrUndone) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, correction)
+	}
+}
@@ -0,0 +1,198 @@
+package datefix
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// correctionsBucket maps a big endian correction ID to its JSON encoded
+	// Correction
+	correctionsBucket = []byte("corrections")
+	// byOwnerBucket lists each owner's corrections; keys are owner + "\x00"
+	// + the big endian ID
+	byOwnerBucket = []byte("by_owner")
+)
+
+var (
+	// DB is the global correction audit log
+	DB *Store
+)
+
+// Correction records a change applied to a selection of an owner's photos
+type Correction struct {
+	ID    uint64 `json:"id"`
+	Owner string `json:"owner"`
+	// By is the user who made the correction, or "admin" for the command
+	// line
+	By        string    `json:"by"`
+	Change    Change    `json:"change"`
+	CreatedAt time.Time `json:"created_at"`
+	Items     []Item    `json:"items"`
+	// UndoneAt is set once the correction was undone
+	UndoneAt *time.Time `json:"undone_at,omitempty"`
+}
+
+// Item is the correction of a single photo
+type Item struct {
+	// Hash and Path identify the file before the correction, NewHash and
+	// NewPath after it. They are equal if it didn't have to be rewritten.
+	Hash    string `json:"hash"`
+	Path    string `json:"path"`
+	NewHash string `json:"new_hash,omitempty"`
+	NewPath string `json:"new_path,omitempty"`
+	// Before holds the original tags, which undoing writes back
+	Before Values `json:"before"`
+	After  Values `json:"after"`
+	// Error tells why the photo was not corrected, and Code classifies it
+	Error string `json:"error,omitempty"`
+	Code  string `json:"code,omitempty"`
+	// UndoError tells why undoing failed for the photo
+	UndoError string `json:"undo_error,omitempty"`
+}
+
+// Corrected reports whether the photo was rewritten
+func (item *Item) Corrected() bool {
+	return item.Error == "" && item.NewHash != item.Hash
+}
+
+// Store keeps the correction audit log in an embedded bbolt database
+type Store struct {
+	db *bolt.DB
+}
+
+// Init opens the correction audit log in the data directory
+func Init(dataDir string) error {
+	dbPath := filepath.Join(dataDir, "date_corrections.db")
+	var err error
+	DB, err = Open(dbPath)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Date correction log initialized at %s", dbPath)
+	return nil
+}
+
+// Open opens or creates the correction database at path
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening date correction log: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{correctionsBucket, byOwnerBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error initializing date correction log: %w", err)
+	}
+
+	return &Store{db: db}, nil
+}
+
+// Close closes the underlying database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Add stores a new correction, setting its ID
+func (s *Store) Add(correction *Correction) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(correctionsBucket)
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		correction.ID = id
+		if err := putCorrection(tx, correction); err != nil {
+			return err
+		}
+		return tx.Bucket(byOwnerBucket).Put(ownerKey(correction.Owner, id), nil)
+	})
+}
+
+// Update stores a changed correction
+func (s *Store) Update(correction *Correction) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putCorrection(tx, correction)
+	})
+}
+
+// Get returns the correction with the given ID
+func (s *Store) Get(id uint64) (*Correction, bool, error) {
+	var correction *Correction
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		correction, err = getCorrection(tx, idKey(id))
+		return err
+	})
+	return correction, correction != nil, err
+}
+
+// List returns the owner's corrections, newest first
+func (s *Store) List(owner string) ([]Correction, error) {
+	corrections := []Correction{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(owner + "\x00")
+		cursor := tx.Bucket(byOwnerBucket).Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && strings.HasPrefix(string(key), string(prefix)); key, _ = cursor.Next() {
+			correction, err := getCorrection(tx, key[len(prefix):])
+			if err != nil {
+				return err
+			}
+			if correction != nil {
+				corrections = append(corrections, *correction)
+			}
+		}
+		return nil
+	})
+	// IDs increase, so the keys are in the order the corrections were made
+	for i, j := 0, len(corrections)-1; i < j; i, j = i+1, j-1 {
+		corrections[i], corrections[j] = corrections[j], corrections[i]
+	}
+	return corrections, err
+}
+
+func putCorrection(tx *bolt.Tx, correction *Correction) error {
+	data, err := json.Marshal(correction)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(correctionsBucket).Put(idKey(correction.ID), data)
+}
+
+func getCorrection(tx *bolt.Tx, key []byte) (*Correction, error) {
+	data := tx.Bucket(correctionsBucket).Get(key)
+	if data == nil {
+		return nil, nil
+	}
+	var correction Correction
+	if err := json.Unmarshal(data, &correction); err != nil {
+		return nil, fmt.Errorf("error decoding date correction %x: %w", key, err)
+	}
+	return &correction, nil
+}
+
+func idKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+func ownerKey(owner string, id uint64) []byte {
+	return append([]byte(owner+"\x00"), idKey(id)...)
+}
@@ -0,0 +1,128 @@
+package derivatives
+
+import (
+	"image"
+	"math"
+	"strings"
+)
+
+const (
+	// Number of BlurHash components along each axis
+	blurHashComponentsX = 4
+	blurHashComponentsY = 3
+	// BlurHash is computed from a downscaled copy of this size, which is
+	// plenty for a handful of cosine components
+	blurHashSampleSize = 32
+)
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// encodeBlurHash computes the BlurHash (https://blurha.sh) of img
+func encodeBlurHash(img image.Image) string {
+	w, h := fitWithin(img.Bounds().Dx(), img.Bounds().Dy(), blurHashSampleSize)
+	sample := resizeRect(img, img.Bounds(), w, h)
+
+	factors := make([][3]float64, 0, blurHashComponentsX*blurHashComponentsY)
+	for j := 0; j < blurHashComponentsY; j++ {
+		for i := 0; i < blurHashComponentsX; i++ {
+			factors = append(factors, blurHashFactor(sample, i, j))
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encodeBase83((blurHashComponentsX-1)+(blurHashComponentsY-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+	maximumValue := 1.0
+	if len(ac) > 0 {
+		actualMaximum := 0.0
+		for _, factor := range ac {
+			for _, v := range factor {
+				actualMaximum = math.Max(actualMaximum, math.Abs(v))
+			}
+		}
+		quantisedMaximum := clampInt(int(math.Floor(actualMaximum*166-0.5)), 0, 82)
+		maximumValue = float64(quantisedMaximum+1) / 166
+		hash.WriteString(encodeBase83(quantisedMaximum, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+
+	hash.WriteString(encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+	for _, factor := range ac {
+		quantised := 0
+		for _, v := range factor {
+			quantised = quantised*19 + clampInt(int(math.Floor(signPow(v/maximumValue, 0.5)*9+9.5)), 0, 18)
+		}
+		hash.WriteString(encodeBase83(quantised, 2))
+	}
+
+	return hash.String()
+}
+
+// blurHashFactor returns the linear RGB weight of the (i, j) cosine component
+func blurHashFactor(img *image.RGBA, i, j int) [3]float64 {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	normalisation := 2.0
+	if i == 0 && j == 0 {
+		normalisation = 1
+	}
+
+	var factor [3]float64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			basis := normalisation *
+				math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) *
+				math.Cos(math.Pi*float64(j)*float64(y)/float64(h))
+			offset := img.PixOffset(x, y)
+			factor[0] += basis * sRGBToLinear(img.Pix[offset])
+			factor[1] += basis * sRGBToLinear(img.Pix[offset+1])
+			factor[2] += basis * sRGBToLinear(img.Pix[offset+2])
+		}
+	}
+
+	scale := 1 / float64(w*h)
+	for k := range factor {
+		factor[k] *= scale
+	}
+	return factor
+}
+
+func encodeBase83(value, length int) string {
+	result := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		result[i] = base83Chars[value%83]
+		value /= 83
+	}
+	return string(result)
+}
+
+func sRGBToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
+
+func clampInt(value, low, high int) int {
+	if value < low {
+		return low
+	}
+	if value > high {
+		return high
+	}
+	return value
+}
@@ -0,0 +1,308 @@
+package derivatives
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	// Register decoders for the supported source formats
+	_ "image/gif"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+
+	"image-upload-server/config"
+	"image-upload-server/exif"
+	"image-upload-server/raw"
+	"image-upload-server/storage"
+)
+
+// Kind names a derivative image generated from an original
+type Kind string
+
+const (
+	// Thumbnail is a small square crop from the middle of the image
+	Thumbnail Kind = "thumb"
+	// Preview is the whole image scaled down for viewing on screen
+	Preview Kind = "preview"
+)
+
+const (
+	// Edge length of thumbnails in pixels
+	thumbnailSize = 256
+	// Length of the longer edge of previews in pixels
+	previewSize = 1080
+	// JPEG quality of generated derivatives
+	jpegQuality = 82
+	// Number of uploads that can wait for a worker before new ones are
+	// left to be generated on first request
+	queueSize = 256
+	// File holding the BlurHash placeholder string
+	blurHashFile = "blurhash.txt"
+)
+
+var (
+	// ErrDisabled is returned when derivatives were not initialized
+	ErrDisabled = errors.New("derivatives are not initialized")
+	// ErrUnsupported is returned for originals that can't be decoded
+	ErrUnsupported = errors.New("unsupported image format")
+)
+
+var (
+	baseDir string
+	jobs    chan job
+	// slots limits how many images are decoded at once, by the workers and
+	// by requests for missing derivatives alike, to the number of workers.
+	// A decoded original can take hundreds of megabytes.
+	slots chan struct{}
+
+	// Per-hash locks so an image is only generated once at a time
+	locksMu sync.Mutex
+	locks   = make(map[string]*hashLock)
+)
+
+// hashLock is the lock of one image. refs counts the goroutines holding or
+// waiting for it, so it is only forgotten once none is left.
+type hashLock struct {
+	sync.Mutex
+	refs int
+}
+
+type job struct {
+	hash string
+	key  string
+}
+
+// Init stores derivatives in DATA_DIR/derivatives and starts the given
+// number of background workers
+func Init(dataDir string, workers int) error {
+	dir := filepath.Join(dataDir, "derivatives")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	baseDir = dir
+
+	if workers < 1 {
+		workers = 1
+	}
+	jobs = make(chan job, queueSize)
+	slots = make(chan struct{}, workers)
+	for i := 0; i < workers; i++ {
+		go worker(jobs)
+	}
+	return nil
+}
+
+func worker(queue <-chan job) {
+	for j := range queue {
+		if err := Ensure(j.hash, j.key); err != nil && !errors.Is(err, ErrUnsupported) {
+			log.Printf("Failed to generate derivatives for %s: %v", j.hash, err)
+		}
+	}
+}
+
+// Enqueue schedules derivative generation for an original stored under key.
+// It never blocks: when the queue is full the derivatives are generated
+// lazily on first request instead.
+func Enqueue(hash, key string) {
+	if jobs == nil {
+		return
+	}
+	select {
+	case jobs <- job{hash: hash, key: key}:
+	default:
+		log.Printf("Derivative queue is full, %s will be generated on first request", hash)
+	}
+}
+
+// Path returns where the derivative of the given kind is stored
+func Path(hash string, kind Kind) string {
+	return filepath.Join(hashDir(hash), string(kind)+".jpg")
+}
+
+// BlurHash returns the stored BlurHash of an image, or an empty string if
+// it was not generated yet
+func BlurHash(hash string) string {
+	if baseDir == "" {
+		return ""
+	}
+	data, err := os.ReadFile(filepath.Join(hashDir(hash), blurHashFile))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// Ensure generates the derivatives of the original stored under key unless
+// they all exist. It waits for a free slot of the worker pool first, so
+// requests for missing derivatives don't decode more images at once than
+// the workers.
+func Ensure(hash, key string) error {
+	if baseDir == "" {
+		return ErrDisabled
+	}
+	if complete(hash) {
+		return nil
+	}
+
+	unlock := lockHash(hash)
+	defer unlock()
+
+	// Another request may have finished generating while we waited
+	if complete(hash) {
+		return nil
+	}
+
+	slots <- struct{}{}
+	defer func() { <-slots }()
+	return generate(hash, key)
+}
+
+func hashDir(hash string) string {
+	prefix := hash
+	if len(prefix) > 2 {
+		prefix = prefix[:2]
+	}
+	return filepath.Join(baseDir, prefix, hash)
+}
+
+// lockHash locks the image and returns the function unlocking it
+func lockHash(hash string) func() {
+	locksMu.Lock()
+	lock, ok := locks[hash]
+	if !ok {
+		lock = &hashLock{}
+		locks[hash] = lock
+	}
+	lock.refs++
+	locksMu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		locksMu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(locks, hash)
+		}
+		locksMu.Unlock()
+	}
+}
+
+// complete reports whether all derivatives of an image exist
+func complete(hash string) bool {
+	for _, path := range []string{Path(hash, Thumbnail), Path(hash, Preview), filepath.Join(hashDir(hash), blurHashFile)} {
+		if _, err := os.Stat(path); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// generate decodes the original once and writes all derivatives
+func generate(hash, key string) error {
+	img, err := decode(key)
+	if err != nil {
+		return err
+	}
+
+	dir := hashDir(hash)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	bounds := img.Bounds()
+	thumbSize := thumbnailSize
+	square := centerSquare(bounds)
+	if square.Dx() < thumbSize {
+		thumbSize = square.Dx()
+	}
+	if err := writeJPEG(Path(hash, Thumbnail), resizeRect(img, square, thumbSize, thumbSize)); err != nil {
+		return err
+	}
+
+	w, h := fitWithin(bounds.Dx(), bounds.Dy(), previewSize)
+	if err := writeJPEG(Path(hash, Preview), resizeRect(img, bounds, w, h)); err != nil {
+		return err
+	}
+
+	return writeAtomic(filepath.Join(dir, blurHashFile), func(f *os.File) error {
+		_, err := f.WriteString(encodeBlurHash(img))
+		return err
+	})
+}
+
+// decode reads an original after checking that its size is within the
+// pixel budget, which protects the server's memory. RAW files are decoded
+// from their largest embedded JPEG preview. The image is returned as it is
+// displayed according to the original's EXIF orientation.
+func decode(key string) (image.Image, error) {
+	file, err := storage.Open(storage.Files, key)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// A RAW file's orientation applies to its previews too
+	orientation := 0
+	if metadata, err := exif.ExtractMetadataFromReaderAt(file, file.Size); err == nil && metadata != nil {
+		orientation = metadata.Orientation
+	}
+
+	var source io.ReadSeeker = file
+	if _, ok := raw.Detect(file, file.Size); ok {
+		preview, err := raw.LargestPreview(file, file.Size)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnsupported, err)
+		}
+		source = preview.Reader(file)
+	}
+
+	header, _, err := image.DecodeConfig(source)
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+	if header.Width <= 0 || header.Height <= 0 || int64(header.Width)*int64(header.Height) > config.MaxImagePixels {
+		return nil, fmt.Errorf("%w: %dx%d pixels", ErrUnsupported, header.Width, header.Height)
+	}
+
+	if _, err := source.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(source)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", key, err)
+	}
+	return orient(img, orientation), nil
+}
+
+func writeJPEG(path string, img image.Image) error {
+	return writeAtomic(path, func(f *os.File) error {
+		return jpeg.Encode(f, img, &jpeg.Options{Quality: jpegQuality})
+	})
+}
+
+// writeAtomic writes a file under a temporary name and renames it into
+// place, so readers never see a partially written derivative
+func writeAtomic(path string, write func(f *os.File) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
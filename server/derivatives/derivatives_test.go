@@ -0,0 +1,234 @@
+package derivatives
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"image-upload-server/exifwrite"
+	"image-upload-server/storage"
+)
+
+// useTestdata reads originals from the testdata directory
+func useTestdata(t *testing.T) {
+	previous := storage.Files
+	storage.Files = storage.NewLocal("../testdata")
+	t.Cleanup(func() { storage.Files = previous })
+}
+
+func TestEncodeBlurHashSolidColor(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for i := range img.Pix {
+		img.Pix[i] = 0xFF
+	}
+
+	hash := encodeBlurHash(img)
+	assert.Len(t, hash, 2+4+2*(blurHashComponentsX*blurHashComponentsY-1))
+	// 4x3 components, then the average color encoded as white
+	assert.Equal(t, "L", hash[:1])
+	assert.Equal(t, "TSUA", hash[2:6])
+}
+
+func TestResizeRectAveragesPixels(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 2; y++ {
+			if x%2 == 0 {
+				img.Set(x, y, color.RGBA{R: 200, A: 0xFF})
+			} else {
+				img.Set(x, y, color.RGBA{B: 100, A: 0xFF})
+			}
+		}
+	}
+
+	resized := resizeRect(img, img.Bounds(), 2, 1)
+	assert.Equal(t, color.RGBA{R: 100, B: 50, A: 0xFF}, resized.RGBAAt(0, 0))
+	assert.Equal(t, color.RGBA{R: 100, B: 50, A: 0xFF}, resized.RGBAAt(1, 0))
+}
+
+func TestEnsureGeneratesDerivatives(t *testing.T) {
+	assert.NoError(t, Init(t.TempDir(), 1))
+	useTestdata(t)
+
+	assert.NoError(t, Ensure("lenahash", "lena.jpeg"))
+
+	for kind, maxSize := range map[Kind]int{Thumbnail: thumbnailSize, Preview: previewSize} {
+		file, err := os.Open(Path("lenahash", kind))
+		assert.NoError(t, err)
+		config, err := jpeg.DecodeConfig(file)
+		file.Close()
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, config.Width, maxSize)
+		assert.LessOrEqual(t, config.Height, maxSize)
+		if kind == Thumbnail {
+			assert.Equal(t, config.Width, config.Height)
+		}
+	}
+	assert.Len(t, BlurHash("lenahash"), 2+4+2*(blurHashComponentsX*blurHashComponentsY-1))
+
+	// Files that aren't images have no derivatives
+	storage.Files = storage.NewLocal(t.TempDir())
+	assert.NoError(t, storage.Files.Put("notes.txt", strings.NewReader("not an image"), 12))
+	assert.ErrorIs(t, Ensure("noteshash", "notes.txt"), ErrUnsupported)
+	assert.Empty(t, BlurHash("noteshash"))
+}
+
+func TestEnsureGeneratesDerivativesFromRawPreview(t *testing.T) {
+	assert.NoError(t, Init(t.TempDir(), 1))
+	useTestdata(t)
+
+	// The derivatives are made from the NEF's embedded 480x320 JPEG
+	assert.NoError(t, Ensure("nefhash", "raw/nikon.nef"))
+	file, err := os.Open(Path("nefhash", Preview))
+	assert.NoError(t, err)
+	config, err := jpeg.DecodeConfig(file)
+	file.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, 480, config.Width)
+	assert.Equal(t, 320, config.Height)
+	assert.NotEmpty(t, BlurHash("nefhash"))
+}
+
+func TestEnsureGeneratesDerivativesFromWebP(t *testing.T) {
+	assert.NoError(t, Init(t.TempDir(), 1))
+	useTestdata(t)
+
+	assert.NoError(t, Ensure("webphash", "formats/photo.webp"))
+	_, err := os.Stat(Path("webphash", Thumbnail))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, BlurHash("webphash"))
+}
+
+// orientedJPEG returns a 40x20 JPEG whose left half is red and right half
+// blue, with the EXIF orientation
+func orientedJPEG(t *testing.T, orientation uint16) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 20; y++ {
+			if x < 20 {
+				img.Set(x, y, color.RGBA{R: 0xFF, A: 0xFF})
+			} else {
+				img.Set(x, y, color.RGBA{B: 0xFF, A: 0xFF})
+			}
+		}
+	}
+	var encoded bytes.Buffer
+	require.NoError(t, jpeg.Encode(&encoded, img, &jpeg.Options{Quality: 95}))
+	data, err := exifwrite.Rewrite(encoded.Bytes(), func(tiff []byte) ([]byte, bool, error) {
+		root, err := exifwrite.Builder(tiff)
+		if err != nil {
+			return nil, false, err
+		}
+		if err := root.SetStandardWithName("Orientation", []uint16{orientation}); err != nil {
+			return nil, false, err
+		}
+		encoded, err := exifwrite.Encode(root)
+		return encoded, err == nil, err
+	}, exifwrite.Options{})
+	require.NoError(t, err)
+	return data
+}
+
+func TestEnsureAppliesOrientation(t *testing.T) {
+	require.NoError(t, Init(t.TempDir(), 1))
+	previous := storage.Files
+	storage.Files = storage.NewLocal(t.TempDir())
+	t.Cleanup(func() { storage.Files = previous })
+
+	// Turned 90 degrees clockwise, the left half is displayed on top
+	data := orientedJPEG(t, 6)
+	require.NoError(t, storage.Files.Put("portrait.jpg", bytes.NewReader(data), int64(len(data))))
+	require.NoError(t, Ensure("portraithash", "portrait.jpg"))
+
+	file, err := os.Open(Path("portraithash", Preview))
+	require.NoError(t, err)
+	preview, err := jpeg.Decode(file)
+	file.Close()
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 20, 40), preview.Bounds())
+	r, _, b, _ := preview.At(10, 5).RGBA()
+	assert.Greater(t, r, b, "top is red")
+	r, _, b, _ = preview.At(10, 35).RGBA()
+	assert.Greater(t, b, r, "bottom is blue")
+}
+
+func TestOrient(t *testing.T) {
+	// A 3x2 image numbering its pixels
+	src := image.NewGray(image.Rect(0, 0, 3, 2))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i)
+	}
+	pixels := func(img image.Image) [][]uint8 {
+		pixel := pixelReader(img)
+		var rows [][]uint8
+		for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
+			var row []uint8
+			for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
+				v, _, _ := pixel(x, y)
+				row = append(row, v)
+			}
+			rows = append(rows, row)
+		}
+		return rows
+	}
+
+	tests := map[int][][]uint8{
+		1: {{0, 1, 2}, {3, 4, 5}},
+		2: {{2, 1, 0}, {5, 4, 3}},
+		3: {{5, 4, 3}, {2, 1, 0}},
+		4: {{3, 4, 5}, {0, 1, 2}},
+		5: {{0, 3}, {1, 4}, {2, 5}},
+		6: {{3, 0}, {4, 1}, {5, 2}},
+		7: {{5, 2}, {4, 1}, {3, 0}},
+		8: {{2, 5}, {1, 4}, {0, 3}},
+	}
+	for orientation, want := range tests {
+		assert.Equal(t, want, pixels(orient(src, orientation)), "orientation %d", orientation)
+	}
+}
+
+func TestLockHashIsSharedByWaiters(t *testing.T) {
+	unlock := lockHash("shared")
+
+	var wg sync.WaitGroup
+	acquired := make(chan func(), 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			acquired <- lockHash("shared")
+		}()
+	}
+	// Wait until both are waiting for the lock
+	require.Eventually(t, func() bool {
+		locksMu.Lock()
+		defer locksMu.Unlock()
+		return locks["shared"] != nil && locks["shared"].refs == 3
+	}, time.Second, time.Millisecond)
+
+	// Releasing the lock keeps it for the waiters, one at a time
+	unlock()
+	second := <-acquired
+	select {
+	case <-acquired:
+		t.Fatal("two goroutines hold the lock")
+	case <-time.After(20 * time.Millisecond):
+	}
+	second()
+	third := <-acquired
+	third()
+	wg.Wait()
+
+	locksMu.Lock()
+	defer locksMu.Unlock()
+	assert.NotContains(t, locks, "shared")
+}
@@ -0,0 +1,68 @@
+package derivatives
+
+import (
+	"image"
+	"image/color"
+)
+
+// orientedImage presents an image the way its EXIF orientation says it is
+// displayed, without copying the pixels. Originals can be large, so it is
+// cheaper to map each pixel read during resizing than to rotate a copy.
+type orientedImage struct {
+	src         image.Image
+	orientation int
+	// Size of the stored image
+	w, h int
+}
+
+// orient returns img as displayed with the EXIF orientation, 1-8. Other
+// values leave the image as it is stored.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	return &orientedImage{src: img, orientation: orientation, w: bounds.Dx(), h: bounds.Dy()}
+}
+
+func (o *orientedImage) ColorModel() color.Model {
+	return o.src.ColorModel()
+}
+
+// Bounds swaps width and height for the orientations that turn the image
+// by 90 degrees
+func (o *orientedImage) Bounds() image.Rectangle {
+	if o.orientation >= 5 {
+		return image.Rect(0, 0, o.h, o.w)
+	}
+	return image.Rect(0, 0, o.w, o.h)
+}
+
+func (o *orientedImage) At(x, y int) color.Color {
+	return o.src.At(o.source(x, y))
+}
+
+// source maps a point of the displayed image to the stored image
+func (o *orientedImage) source(x, y int) (int, int) {
+	var sx, sy int
+	switch o.orientation {
+	case 2: // mirrored horizontally
+		sx, sy = o.w-1-x, y
+	case 3: // turned 180 degrees
+		sx, sy = o.w-1-x, o.h-1-y
+	case 4: // mirrored vertically
+		sx, sy = x, o.h-1-y
+	case 5: // mirrored along the top-left to bottom-right diagonal
+		sx, sy = y, x
+	case 6: // displayed turned 90 degrees clockwise
+		sx, sy = y, o.h-1-x
+	case 7: // mirrored along the top-right to bottom-left diagonal
+		sx, sy = o.w-1-y, o.h-1-x
+	case 8: // displayed turned 90 degrees counterclockwise
+		sx, sy = o.w-1-y, x
+	default:
+		sx, sy = x, y
+	}
+	min := o.src.Bounds().Min
+	return min.X + sx, min.Y + sy
+}
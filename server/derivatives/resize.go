@@ -0,0 +1,102 @@
+package derivatives
+
+import (
+	"image"
+	"image/color"
+)
+
+// resizeRect scales the rect region of src to w x h pixels. Every source
+// pixel is added to the destination pixel it falls into and the sums are
+// averaged, which gives smooth results when shrinking. Images are never
+// enlarged by callers, so w and h are at most the size of rect.
+func resizeRect(src image.Image, rect image.Rectangle, w, h int) *image.RGBA {
+	srcW, srcH := rect.Dx(), rect.Dy()
+	sums := make([]uint32, w*h*3)
+	counts := make([]uint32, w*h)
+	pixel := pixelReader(src)
+
+	for sy := 0; sy < srcH; sy++ {
+		row := (sy * h / srcH) * w
+		for sx := 0; sx < srcW; sx++ {
+			r, g, b := pixel(rect.Min.X+sx, rect.Min.Y+sy)
+			i := row + sx*w/srcW
+			sums[i*3] += uint32(r)
+			sums[i*3+1] += uint32(g)
+			sums[i*3+2] += uint32(b)
+			counts[i]++
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i, count := range counts {
+		if count == 0 {
+			count = 1
+		}
+		dst.Pix[i*4] = uint8(sums[i*3] / count)
+		dst.Pix[i*4+1] = uint8(sums[i*3+1] / count)
+		dst.Pix[i*4+2] = uint8(sums[i*3+2] / count)
+		dst.Pix[i*4+3] = 0xFF
+	}
+	return dst
+}
+
+// fitWithin returns the size of a w x h image scaled down to fit in a
+// maxSize x maxSize box, keeping the aspect ratio
+func fitWithin(w, h, maxSize int) (int, int) {
+	if w <= maxSize && h <= maxSize {
+		return w, h
+	}
+	if w >= h {
+		return maxSize, atLeastOne(h * maxSize / w)
+	}
+	return atLeastOne(w * maxSize / h), maxSize
+}
+
+func atLeastOne(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// centerSquare returns the largest square in the middle of bounds
+func centerSquare(bounds image.Rectangle) image.Rectangle {
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	x := bounds.Min.X + (bounds.Dx()-side)/2
+	y := bounds.Min.Y + (bounds.Dy()-side)/2
+	return image.Rect(x, y, x+side, y+side)
+}
+
+// pixelReader returns a function reading 8-bit RGB values from img, with
+// fast paths for the image types produced by the standard decoders
+func pixelReader(img image.Image) func(x, y int) (uint8, uint8, uint8) {
+	switch src := img.(type) {
+	case *orientedImage:
+		pixel := pixelReader(src.src)
+		return func(x, y int) (uint8, uint8, uint8) {
+			return pixel(src.source(x, y))
+		}
+	case *image.YCbCr:
+		return func(x, y int) (uint8, uint8, uint8) {
+			return color.YCbCrToRGB(src.Y[src.YOffset(x, y)], src.Cb[src.COffset(x, y)], src.Cr[src.COffset(x, y)])
+		}
+	case *image.RGBA:
+		return func(x, y int) (uint8, uint8, uint8) {
+			i := src.PixOffset(x, y)
+			return src.Pix[i], src.Pix[i+1], src.Pix[i+2]
+		}
+	case *image.Gray:
+		return func(x, y int) (uint8, uint8, uint8) {
+			v := src.Pix[src.PixOffset(x, y)]
+			return v, v, v
+		}
+	default:
+		return func(x, y int) (uint8, uint8, uint8) {
+			r, g, b, _ := img.At(x, y).RGBA()
+			return uint8(r >> 8), uint8(g >> 8), uint8(b >> 8)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package exif
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"image-upload-server/isobmff"
+	"image-upload-server/raw"
+)
+
+// container is an image format that keeps its EXIF data in a structure of
+// its own rather than in a JPEG APP1 segment
+type container string
+
+const (
+	containerHEIF container = "heif"
+	containerRaw  container = "raw"
+	containerPNG  container = "png"
+	containerWebP container = "webp"
+	containerGIF  container = "gif"
+)
+
+// Magic numbers at the start of PNG and GIF files
+var (
+	pngSignature  = []byte("\x89PNG\r\n\x1a\n")
+	gifSignatures = [][]byte{[]byte("GIF87a"), []byte("GIF89a")}
+)
+
+// exifPrefix starts the payload of JPEG APP1 segments. Some writers keep it
+// in the EXIF chunks of PNG and WebP images as well.
+var exifPrefix = []byte("Exif\x00\x00")
+
+// maxChunks bounds the number of PNG or RIFF chunks read from a file
+const maxChunks = 10000
+
+// errNoExif is returned for images whose container has no EXIF data
+var errNoExif = errors.New("failed to decode EXIF data: no EXIF data in image")
+
+// detectContainer identifies the container format of an image by its magic
+// number. It reports false for JPEG, TIFF and other files, which are
+// scanned for EXIF data.
+func detectContainer(r io.ReaderAt, size int64) (container, bool) {
+	head := make([]byte, 12)
+	n, _ := r.ReadAt(head, 0)
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, pngSignature):
+		return containerPNG, true
+	case len(head) == 12 && string(head[0:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		return containerWebP, true
+	case bytes.HasPrefix(head, gifSignatures[0]) || bytes.HasPrefix(head, gifSignatures[1]):
+		return containerGIF, true
+	case isobmff.IsHEIF(r, size):
+		return containerHEIF, true
+	}
+	if _, ok := raw.Detect(r, size); ok {
+		return containerRaw, true
+	}
+	return "", false
+}
+
+// ExtractMetadataFromReaderAt extracts the descriptive EXIF metadata of an
+// image of the given size. The format is told by its magic number: HEIF,
+// PNG and WebP images and camera RAW files keep EXIF in a structure of
+// their own, which is located without scanning the file. PNG images
+// without an EXIF capture date get the one of their Creation Time text
+// chunk. GIF images carry no EXIF data. Other images are scanned like in
+// ExtractMetadataFromReader.
+func ExtractMetadataFromReaderAt(r io.ReaderAt, size int64) (*Metadata, error) {
+	kind, ok := detectContainer(r, size)
+	if !ok {
+		return ExtractMetadataFromReader(io.NewSectionReader(r, 0, size))
+	}
+
+	var tiffData []byte
+	var err error
+	switch kind {
+	case containerHEIF:
+		tiffData, err = heifExif(r, size)
+	case containerRaw:
+		tiffData, err = raw.Exif(r, size)
+		if err != nil {
+			err = fmt.Errorf("failed to read RAW metadata: %v", err)
+		}
+	case containerPNG:
+		return pngMetadata(r, size)
+	case containerWebP:
+		tiffData, err = webpExif(r, size)
+	case containerGIF:
+		return nil, errNoExif
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ExtractMetadataFromReader(bytes.NewReader(tiffData))
+}
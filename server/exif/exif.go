@@ -1,26 +1,23 @@
 package exif
 
-import (
-	"bytes"
-	"fmt"
-	"time"
+import "time"
 
-	"github.com/rwcarlsen/goexif/exif"
-)
+// MaxScanBytes bounds how much of a file is read while looking for EXIF data.
+// The APP1 segment holding EXIF is limited to 64KB and sits near the start of
+// the file, so files without EXIF are not read in full.
+const MaxScanBytes = 1 << 20
 
-// ExtractImageDate extracts the date from image EXIF metadata
-func ExtractImageDate(jpegData []byte) (time.Time, error) {
-	// Parse EXIF data
-	exifData, err := exif.Decode(bytes.NewReader(jpegData))
+// ExtractImageDate extracts the capture date from the metadata of an image
+// in any of the formats understood by ExtractMetadata, in the time zone it
+// was taken in when known and in the local time zone otherwise
+func ExtractImageDate(data []byte) (time.Time, error) {
+	metadata, err := ExtractMetadata(data)
 	if err != nil {
-		return time.Time{}, fmt.Errorf("failed to decode EXIF data: %v", err)
+		return time.Time{}, err
 	}
-
-	// Get the DateTimeOriginal tag
-	dateTime, err := exifData.DateTime()
+	captureTime, err := metadata.ResolveCaptureTime(time.Local)
 	if err != nil {
-		return time.Time{}, fmt.Errorf("DateTimeOriginal tag not found: %v", err)
+		return time.Time{}, err
 	}
-
-	return dateTime, nil
+	return captureTime.Time, nil
 }
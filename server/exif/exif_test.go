@@ -23,6 +23,26 @@ func TestExtractImageDate(t *testing.T) {
 			filePath: testutil.NoExifImagePath,
 			wantErr:  true,
 		},
+		{
+			name:     "Test HEIC with EXIF data",
+			filePath: "../testdata/heic/ios11.heic",
+			wantErr:  false,
+		},
+		{
+			name:     "Test PNG with Creation Time",
+			filePath: "../testdata/formats/screenshot.png",
+			wantErr:  false,
+		},
+		{
+			name:     "Test WebP with EXIF data",
+			filePath: "../testdata/formats/photo.webp",
+			wantErr:  false,
+		},
+		{
+			name:     "Test GIF without EXIF data",
+			filePath: "../testdata/formats/animation.gif",
+			wantErr:  true,
+		},
 		// Additional test cases will be added when we have sample images with EXIF data
 	}
 
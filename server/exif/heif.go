@@ -0,0 +1,22 @@
+package exif
+
+import (
+	"fmt"
+	"io"
+
+	"image-upload-server/isobmff"
+)
+
+// heifExif returns the TIFF structure of a HEIF image's Exif item, which
+// goexif decodes like the payload of a JPEG APP1 segment
+func heifExif(r io.ReaderAt, size int64) ([]byte, error) {
+	heif, err := isobmff.ParseHEIF(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse HEIF image: %v", err)
+	}
+	tiffData, err := heif.Exif()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode EXIF data: %v", err)
+	}
+	return tiffData, nil
+}
@@ -0,0 +1,62 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// appleMakerNoteHeader starts the MakerNote of iPhone photos. It is followed
+// by a two byte version and the byte order, then an IFD whose offsets are
+// relative to the start of the MakerNote.
+var appleMakerNoteHeader = []byte("Apple iOS\x00")
+
+// appleContentIdentifierTag holds the UUID that links the photo and the
+// video of a Live Photo
+const appleContentIdentifierTag = 0x0011
+
+// appleContentIdentifier returns the Live Photo content identifier from the
+// Apple MakerNote, or an empty string
+func appleContentIdentifier(x *exif.Exif) string {
+	tag, err := x.Get(exif.MakerNote)
+	if err != nil {
+		return ""
+	}
+	data := tag.Val
+	if len(data) < 16 || !bytes.HasPrefix(data, appleMakerNoteHeader) {
+		return ""
+	}
+
+	var order binary.ByteOrder = binary.BigEndian
+	if string(data[12:14]) == "II" {
+		order = binary.LittleEndian
+	}
+
+	count := int(order.Uint16(data[14:16]))
+	for i := 0; i < count; i++ {
+		entry := 16 + i*12
+		if entry+12 > len(data) {
+			break
+		}
+		// Only ASCII values of the content identifier tag are of interest
+		if order.Uint16(data[entry:]) != appleContentIdentifierTag || order.Uint16(data[entry+2:]) != 2 {
+			continue
+		}
+
+		size := int64(order.Uint32(data[entry+4:]))
+		var value []byte
+		if size <= 4 {
+			value = data[entry+8 : entry+8+int(size)]
+		} else {
+			offset := int64(order.Uint32(data[entry+8:]))
+			if offset+size > int64(len(data)) {
+				return ""
+			}
+			value = data[offset : offset+size]
+		}
+		return strings.TrimSpace(strings.TrimRight(string(value), "\x00"))
+	}
+	return ""
+}
@@ -0,0 +1,224 @@
+package exif
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strings"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// EXIF 2.31 offset tags, which goexif doesn't know about
+const (
+	OffsetTime          exif.FieldName = "OffsetTime"
+	OffsetTimeOriginal  exif.FieldName = "OffsetTimeOriginal"
+	OffsetTimeDigitized exif.FieldName = "OffsetTimeDigitized"
+)
+
+// exifTimeLayout is the format of EXIF date and time values
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+func init() {
+	exif.RegisterParsers(offsetTimeParser{})
+}
+
+// offsetTimeParser loads the time offset tags from the EXIF sub-IFD
+type offsetTimeParser struct{}
+
+func (offsetTimeParser) Parse(x *exif.Exif) error {
+	tag, err := x.Get(exif.ExifIFDPointer)
+	if err != nil || tag.Count == 0 {
+		return nil
+	}
+	offset, err := tag.Int64(0)
+	if err != nil {
+		return nil
+	}
+
+	r := bytes.NewReader(x.Raw)
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return nil
+	}
+	dir, _, err := tiff.DecodeDir(r, x.Tiff.Order)
+	if err != nil {
+		return nil
+	}
+	x.LoadTags(dir, map[uint16]exif.FieldName{
+		0x9010: OffsetTime,
+		0x9011: OffsetTimeOriginal,
+		0x9012: OffsetTimeDigitized,
+	}, false)
+	return nil
+}
+
+// Metadata is the descriptive EXIF information of an image. Fields missing
+// from the image are left empty.
+type Metadata struct {
+	Make  string `json:"make,omitempty"`
+	Model string `json:"model,omitempty"`
+	Lens  string `json:"lens,omitempty"`
+	// Focal length in millimeters
+	FocalLength float64 `json:"focal_length,omitempty"`
+	// Aperture as f-number
+	Aperture float64 `json:"aperture,omitempty"`
+	// Exposure time in seconds, and formatted as a shutter speed like "1/250"
+	ExposureTime float64 `json:"exposure_time,omitempty"`
+	ShutterSpeed string  `json:"shutter_speed,omitempty"`
+	ISO          int     `json:"iso,omitempty"`
+	// EXIF orientation, 1 to 8
+	Orientation int `json:"orientation,omitempty"`
+	// Pixel dimensions as recorded by the camera
+	Width  int  `json:"width,omitempty"`
+	Height int  `json:"height,omitempty"`
+	GPS    *GPS `json:"gps,omitempty"`
+	// Capture time as written by the camera, without time zone
+	DateTimeOriginal string `json:"date_time_original,omitempty"`
+	// Offset from UTC of the capture time, like "+02:00"
+	OffsetTimeOriginal string `json:"offset_time_original,omitempty"`
+	// Fraction of a second of the capture time, like "123"
+	SubSecTimeOriginal string `json:"subsec_time_original,omitempty"`
+	// ContentIdentifier links the photo of an iPhone Live Photo to its
+	// video, from the Apple MakerNote
+	ContentIdentifier string `json:"content_identifier,omitempty"`
+}
+
+// GPS is the location an image was taken at
+type GPS struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	// Altitude in meters above sea level, nil if not recorded
+	Altitude *float64 `json:"altitude,omitempty"`
+}
+
+// ExtractMetadata extracts the descriptive EXIF metadata of an image
+func ExtractMetadata(data []byte) (*Metadata, error) {
+	return ExtractMetadataFromReaderAt(bytes.NewReader(data), int64(len(data)))
+}
+
+// ExtractMetadataFromReader extracts the descriptive EXIF metadata of an
+// image read from r. At most MaxScanBytes are consumed from the reader.
+func ExtractMetadataFromReader(r io.Reader) (*Metadata, error) {
+	x, err := exif.Decode(io.LimitReader(r, MaxScanBytes))
+	// A broken GPS or interoperability sub-IFD still leaves usable data
+	if x == nil || (err != nil && exif.IsCriticalError(err)) {
+		return nil, fmt.Errorf("failed to decode EXIF data: %v", err)
+	}
+
+	metadata := &Metadata{
+		Make:               stringTag(x, exif.Make),
+		Model:              stringTag(x, exif.Model),
+		Lens:               stringTag(x, exif.LensModel),
+		FocalLength:        ratTag(x, exif.FocalLength),
+		Aperture:           ratTag(x, exif.FNumber),
+		ISO:                intTag(x, exif.ISOSpeedRatings),
+		Orientation:        intTag(x, exif.Orientation),
+		Width:              intTag(x, exif.PixelXDimension),
+		Height:             intTag(x, exif.PixelYDimension),
+		DateTimeOriginal:   stringTag(x, exif.DateTimeOriginal),
+		OffsetTimeOriginal: stringTag(x, OffsetTimeOriginal),
+		SubSecTimeOriginal: stringTag(x, exif.SubSecTimeOriginal),
+		ContentIdentifier:  appleContentIdentifier(x),
+	}
+	if metadata.DateTimeOriginal == "" {
+		metadata.DateTimeOriginal = stringTag(x, exif.DateTime)
+	}
+
+	if rat, ok := ratValue(x, exif.ExposureTime); ok && rat.Sign() > 0 {
+		metadata.ExposureTime, _ = rat.Float64()
+		metadata.ShutterSpeed = formatShutterSpeed(rat)
+	}
+
+	if lat, long, ok := position(x); ok {
+		metadata.GPS = &GPS{Latitude: lat, Longitude: long}
+		if rat, ok := ratValue(x, exif.GPSAltitude); ok {
+			altitude, _ := rat.Float64()
+			// Reference 1 means below sea level
+			if intTag(x, exif.GPSAltitudeRef) == 1 {
+				altitude = -altitude
+			}
+			metadata.GPS.Altitude = &altitude
+		}
+	}
+
+	return metadata, nil
+}
+
+// position reads the GPS coordinates, ignoring malformed or out of range
+// values
+func position(x *exif.Exif) (float64, float64, bool) {
+	for _, name := range []exif.FieldName{exif.GPSLatitude, exif.GPSLongitude} {
+		if tag, err := x.Get(name); err != nil || tag.Count == 0 {
+			return 0, 0, false
+		}
+	}
+	lat, long, err := x.LatLong()
+	if err != nil || math.IsNaN(lat) || math.IsNaN(long) || math.Abs(lat) > 90 || math.Abs(long) > 180 {
+		return 0, 0, false
+	}
+	return lat, long, true
+}
+
+// formatShutterSpeed formats an exposure time the way cameras show it:
+// "1/250" for fractions of a second and "2.5" for longer exposures
+func formatShutterSpeed(rat *big.Rat) string {
+	if rat.Cmp(big.NewRat(1, 1)) < 0 {
+		denominator := new(big.Rat).Inv(rat)
+		if denominator.IsInt() {
+			return "1/" + denominator.Num().String()
+		}
+		value, _ := denominator.Float64()
+		return fmt.Sprintf("1/%.0f", value)
+	}
+	value, _ := rat.Float64()
+	return strings.TrimSuffix(strings.TrimRight(fmt.Sprintf("%.1f", value), "0"), ".")
+}
+
+func stringTag(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil || tag.Format() != tiff.StringVal {
+		return ""
+	}
+	value, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(value, "\x00"))
+}
+
+func intTag(x *exif.Exif, name exif.FieldName) int {
+	tag, err := x.Get(name)
+	if err != nil || tag.Format() != tiff.IntVal || tag.Count == 0 {
+		return 0
+	}
+	value, err := tag.Int(0)
+	if err != nil {
+		return 0
+	}
+	return value
+}
+
+func ratTag(x *exif.Exif, name exif.FieldName) float64 {
+	rat, ok := ratValue(x, name)
+	if !ok {
+		return 0
+	}
+	value, _ := rat.Float64()
+	return value
+}
+
+// ratValue reads a rational tag, rejecting zero denominators
+func ratValue(x *exif.Exif, name exif.FieldName) (*big.Rat, bool) {
+	tag, err := x.Get(name)
+	if err != nil || tag.Format() != tiff.RatVal || tag.Count == 0 {
+		return nil, false
+	}
+	num, den, err := tag.Rat2(0)
+	if err != nil || den == 0 {
+		return nil, false
+	}
+	return big.NewRat(num, den), true
+}
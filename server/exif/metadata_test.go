@@ -0,0 +1,225 @@
+package exif
+
+import (
+	"math/big"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestExtractMetadata(t *testing.T) {
+	altitude := 100.5
+	iPhoneAltitude := 41.0
+
+	tests := []struct {
+		name     string
+		filePath string
+		want     *Metadata
+		wantErr  bool
+	}{
+		{
+			// The APP1 segment holds a bare date instead of a TIFF structure
+			name:     "Malformed EXIF segment",
+			filePath: "../testdata/with_exif.jpg",
+			wantErr:  true,
+		},
+		{
+			name:     "JPEG without EXIF",
+			filePath: "../testdata/lena.jpeg",
+			wantErr:  true,
+		},
+		{
+			name:     "Camera image with GPS",
+			filePath: "../testdata/exif_gps.jpg",
+			want: &Metadata{
+				Make:               "Canon",
+				Model:              "Canon EOS R6",
+				Lens:               "RF24-105mm F4 L IS USM",
+				FocalLength:        50,
+				Aperture:           2.8,
+				ExposureTime:       0.004,
+				ShutterSpeed:       "1/250",
+				ISO:                400,
+				Orientation:        6,
+				Width:              64,
+				Height:             48,
+				GPS:                &GPS{Latitude: 52 + 13.0/60 + 30.45/3600, Longitude: 21 + 0.0/60 + 30.0/3600, Altitude: &altitude},
+				DateTimeOriginal:   "2023:06:15 18:42:07",
+				OffsetTimeOriginal: "+02:00",
+				SubSecTimeOriginal: "123",
+			},
+		},
+		{
+			name:     "iOS 14 HEIC without location",
+			filePath: "../testdata/heic/ios14.heic",
+			want: &Metadata{
+				Make:               "Apple",
+				Model:              "iPhone 12 Pro",
+				Lens:               "iPhone 12 Pro back triple camera 4.2mm f/1.6",
+				FocalLength:        3.99,
+				Aperture:           1.8,
+				ExposureTime:       1.0 / 120,
+				ShutterSpeed:       "1/120",
+				ISO:                25,
+				Orientation:        6,
+				Width:              4032,
+				Height:             3024,
+				DateTimeOriginal:   "2020:11:02 09:15:00",
+				OffsetTimeOriginal: "-08:00",
+				SubSecTimeOriginal: "874",
+			},
+		},
+		{
+			name:     "iOS 17 HEIC with GPS",
+			filePath: "../testdata/heic/ios17.heic",
+			want: &Metadata{
+				Make:               "Apple",
+				Model:              "iPhone 15 Pro",
+				Lens:               "iPhone 15 Pro back triple camera 6.765mm f/1.78",
+				FocalLength:        3.99,
+				Aperture:           1.8,
+				ExposureTime:       1.0 / 120,
+				ShutterSpeed:       "1/120",
+				ISO:                25,
+				Orientation:        6,
+				Width:              5712,
+				Height:             4284,
+				GPS:                &GPS{Latitude: 35 + 39.0/60 + 31.08/3600, Longitude: 139 + 42.0/60 + 10.2/3600, Altitude: &iPhoneAltitude},
+				DateTimeOriginal:   "2023:10:07 19:48:12",
+				OffsetTimeOriginal: "+09:00",
+				SubSecTimeOriginal: "051",
+			},
+		},
+		{
+			name:     "Live Photo HEIC with content identifier",
+			filePath: "../testdata/stack/IMG_4211.HEIC",
+			want: &Metadata{
+				Make:               "Apple",
+				Model:              "iPhone 15 Pro",
+				Aperture:           1.78,
+				ExposureTime:       1.0 / 60,
+				ShutterSpeed:       "1/60",
+				ISO:                80,
+				Orientation:        1,
+				Width:              5712,
+				Height:             4284,
+				DateTimeOriginal:   "2024:05:18 17:20:31",
+				OffsetTimeOriginal: "+02:00",
+				SubSecTimeOriginal: "402",
+				ContentIdentifier:  "5A7F3E2C-9B41-4D8E-A6C2-3F1E0B9D7C44",
+			},
+		},
+		{
+			name:     "Canon CR3 RAW with GPS",
+			filePath: "../testdata/raw/canon.cr3",
+			want: &Metadata{
+				Make:               "Canon",
+				Model:              "Canon EOS R5",
+				Lens:               "RF70-200mm F2.8 L IS USM",
+				FocalLength:        70,
+				Aperture:           2.8,
+				ExposureTime:       1.0 / 320,
+				ShutterSpeed:       "1/320",
+				ISO:                400,
+				Orientation:        1,
+				GPS:                &GPS{Latitude: degrees(45, 49, 57), Longitude: degrees(6, 51, 54)},
+				DateTimeOriginal:   "2024:02:10 09:41:27",
+				OffsetTimeOriginal: "+01:00",
+			},
+		},
+		{
+			name:     "DNG from a phone",
+			filePath: "../testdata/raw/pixel.dng",
+			want: &Metadata{
+				Make:               "Google",
+				Model:              "Pixel 7 Pro",
+				FocalLength:        6.81,
+				Aperture:           1.85,
+				ExposureTime:       0.001,
+				ShutterSpeed:       "1/1000",
+				ISO:                54,
+				Orientation:        1,
+				DateTimeOriginal:   "2023:08:19 14:22:05",
+				OffsetTimeOriginal: "-07:00",
+				SubSecTimeOriginal: "318",
+			},
+		},
+		{
+			name:     "PNG screenshot with Creation Time",
+			filePath: "../testdata/formats/screenshot.png",
+			want: &Metadata{
+				DateTimeOriginal:   "2023:04:15 12:34:56",
+				OffsetTimeOriginal: "+02:00",
+			},
+		},
+		{
+			name:     "PNG with eXIf chunk",
+			filePath: "../testdata/formats/exif.png",
+			want: &Metadata{
+				Make:               "Apple",
+				Model:              "iPhone 14 Pro",
+				ISO:                50,
+				Orientation:        1,
+				Width:              8,
+				Height:             6,
+				DateTimeOriginal:   "2023:06:01 08:15:30",
+				OffsetTimeOriginal: "+09:00",
+			},
+		},
+		{
+			name:     "WebP with EXIF chunk",
+			filePath: "../testdata/formats/photo.webp",
+			want: &Metadata{
+				Make:               "Google",
+				Model:              "Pixel 8",
+				ISO:                64,
+				Orientation:        1,
+				DateTimeOriginal:   "2024:03:09 18:30:00",
+				OffsetTimeOriginal: "+01:00",
+			},
+		},
+		{
+			name:     "GIF",
+			filePath: "../testdata/formats/animation.gif",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := os.ReadFile(tt.filePath)
+			if err != nil {
+				t.Fatalf("Failed to read test file: %v", err)
+			}
+
+			got, err := ExtractMetadata(data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExtractMetadata() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ExtractMetadata() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// degrees converts degrees, minutes and seconds like goexif does, with
+// float64 rounding after every step
+func degrees(d, m, s float64) float64 {
+	return d + m/60 + s/3600
+}
+
+func TestFormatShutterSpeed(t *testing.T) {
+	tests := map[string]string{
+		"1/250":  "1/250",
+		"10/600": "1/60",
+		"10/3":   "3.3",
+		"2/1":    "2",
+	}
+	for input, want := range tests {
+		rat, _ := new(big.Rat).SetString(input)
+		if got := formatShutterSpeed(rat); got != want {
+			t.Errorf("formatShutterSpeed(%s) = %q, want %q", input, got, want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package exif
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"strings"
+	"time"
+)
+
+// pngCreationTime is the keyword of the PNG text chunk holding the time the
+// original image was created
+const pngCreationTime = "Creation Time"
+
+// maxTextSize bounds the size of PNG text chunks, compressed or not
+const maxTextSize = 64 << 10
+
+// pngTimeLayouts are the forms of Creation Time written by screenshot tools
+// and editors: the RFC 1123 form suggested by the PNG specification,
+// ISO 8601 and the EXIF form
+var pngTimeLayouts = []struct {
+	layout  string
+	hasZone bool
+}{
+	{layout: time.RFC1123Z, hasZone: true},
+	{layout: time.RFC1123, hasZone: true},
+	{layout: time.RFC3339, hasZone: true},
+	{layout: "2006-01-02T15:04:05"},
+	{layout: "2006-01-02 15:04:05"},
+	{layout: exifTimeLayout},
+}
+
+// pngMetadata reads the metadata of a PNG image from its eXIf chunk. The
+// capture date is taken from the Creation Time text chunk if the EXIF data
+// has none.
+func pngMetadata(r io.ReaderAt, size int64) (*Metadata, error) {
+	var tiffData []byte
+	var created string
+
+	header := make([]byte, 8)
+	offset := int64(len(pngSignature))
+chunks:
+	for i := 0; i < maxChunks && offset+12 <= size; i++ {
+		if _, err := r.ReadAt(header, offset); err != nil {
+			break
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		chunkType := string(header[4:8])
+		if offset+12+length > size {
+			break
+		}
+
+		switch chunkType {
+		case "eXIf":
+			if tiffData == nil && length <= MaxScanBytes {
+				tiffData = make([]byte, length)
+				if _, err := r.ReadAt(tiffData, offset+8); err != nil {
+					return nil, err
+				}
+				tiffData = bytes.TrimPrefix(tiffData, exifPrefix)
+			}
+		case "tEXt", "zTXt", "iTXt":
+			if created == "" && length <= maxTextSize {
+				data := make([]byte, length)
+				if _, err := r.ReadAt(data, offset+8); err != nil {
+					return nil, err
+				}
+				if keyword, text, ok := pngText(chunkType, data); ok && keyword == pngCreationTime {
+					created = strings.TrimSpace(text)
+				}
+			}
+		case "IEND":
+			break chunks
+		}
+		// Length, type, data and CRC
+		offset += 12 + length
+	}
+
+	var metadata *Metadata
+	if tiffData != nil {
+		var err error
+		metadata, err = ExtractMetadataFromReader(bytes.NewReader(tiffData))
+		if err != nil && created == "" {
+			return nil, err
+		}
+	}
+	if metadata == nil {
+		metadata = &Metadata{}
+	}
+	if metadata.DateTimeOriginal == "" {
+		if t, hasZone, ok := parsePNGTime(created); ok {
+			metadata.DateTimeOriginal = t.Format(exifTimeLayout)
+			if hasZone {
+				metadata.OffsetTimeOriginal = t.Format("-07:00")
+			}
+		}
+	}
+	if *metadata == (Metadata{}) {
+		return nil, errNoExif
+	}
+	return metadata, nil
+}
+
+// pngText returns the keyword and text of a tEXt, zTXt or iTXt chunk
+func pngText(chunkType string, data []byte) (string, string, bool) {
+	keyword, rest, ok := bytes.Cut(data, []byte{0})
+	if !ok {
+		return "", "", false
+	}
+
+	compressed := false
+	switch chunkType {
+	case "zTXt":
+		// Compression method, 0 for zlib
+		if len(rest) < 1 {
+			return "", "", false
+		}
+		rest, compressed = rest[1:], true
+	case "iTXt":
+		// Compression flag and method, then the language tag and the
+		// translated keyword
+		if len(rest) < 2 {
+			return "", "", false
+		}
+		compressed = rest[0] == 1
+		fields := bytes.SplitN(rest[2:], []byte{0}, 3)
+		if len(fields) != 3 {
+			return "", "", false
+		}
+		rest = fields[2]
+	}
+
+	if compressed {
+		zr, err := zlib.NewReader(bytes.NewReader(rest))
+		if err != nil {
+			return "", "", false
+		}
+		defer zr.Close()
+		if rest, err = io.ReadAll(io.LimitReader(zr, maxTextSize)); err != nil {
+			return "", "", false
+		}
+	}
+	return string(keyword), string(rest), true
+}
+
+// parsePNGTime parses a Creation Time value, reporting whether it carried
+// its time zone
+func parsePNGTime(value string) (time.Time, bool, bool) {
+	if value == "" {
+		return time.Time{}, false, false
+	}
+	for _, layout := range pngTimeLayouts {
+		if t, err := time.Parse(layout.layout, value); err == nil {
+			return t, layout.hasZone, true
+		}
+	}
+	return time.Time{}, false, false
+}
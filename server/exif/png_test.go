@@ -0,0 +1,63 @@
+package exif
+
+import (
+	"bytes"
+	"compress/zlib"
+	"testing"
+	"time"
+)
+
+func TestPNGText(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write([]byte("2021-08-01T10:00:00"))
+	zw.Close()
+
+	tests := []struct {
+		name      string
+		chunkType string
+		data      []byte
+		want      string
+	}{
+		{"tEXt", "tEXt", []byte("Creation Time\x002021-08-01T10:00:00"), "2021-08-01T10:00:00"},
+		{"zTXt", "zTXt", append([]byte("Creation Time\x00\x00"), compressed.Bytes()...), "2021-08-01T10:00:00"},
+		{"iTXt", "iTXt", []byte("Creation Time\x00\x00\x00en\x00Erstellungszeit\x002021-08-01T10:00:00"), "2021-08-01T10:00:00"},
+		{"compressed iTXt", "iTXt", append([]byte("Creation Time\x00\x01\x00\x00\x00"), compressed.Bytes()...), "2021-08-01T10:00:00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyword, text, ok := pngText(tt.chunkType, tt.data)
+			if !ok || keyword != pngCreationTime || text != tt.want {
+				t.Errorf("pngText() = %q, %q, %v, want %q, %q", keyword, text, ok, pngCreationTime, tt.want)
+			}
+		})
+	}
+
+	if _, _, ok := pngText("tEXt", []byte("no separator")); ok {
+		t.Errorf("pngText() accepted a chunk without keyword separator")
+	}
+}
+
+func TestParsePNGTime(t *testing.T) {
+	tests := []struct {
+		value    string
+		want     string
+		wantZone bool
+		wantOK   bool
+	}{
+		{"Sat, 15 Apr 2023 12:34:56 +0200", "2023-04-15T12:34:56+02:00", true, true},
+		{"2023-04-15T12:34:56-07:00", "2023-04-15T12:34:56-07:00", true, true},
+		{"2023-04-15T12:34:56", "2023-04-15T12:34:56Z", false, true},
+		{"2023:04:15 12:34:56", "2023-04-15T12:34:56Z", false, true},
+		{"yesterday", "", false, false},
+		{"", "", false, false},
+	}
+
+	for _, tt := range tests {
+		got, hasZone, ok := parsePNGTime(tt.value)
+		if ok != tt.wantOK || hasZone != tt.wantZone || (ok && got.Format(time.RFC3339) != tt.want) {
+			t.Errorf("parsePNGTime(%q) = %v, %v, %v, want %s, %v, %v", tt.value, got, hasZone, ok, tt.want, tt.wantZone, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package exif
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	// Zone names found from GPS positions must resolve without a system
+	// zoneinfo database, e.g. in minimal containers
+	_ "time/tzdata"
+
+	"github.com/bradfitz/latlong"
+)
+
+// Sources of the time zone of a resolved capture time
+const (
+	// ZoneFromOffset means the camera recorded OffsetTimeOriginal
+	ZoneFromOffset = "offset"
+	// ZoneFromGPS means the zone was looked up from the GPS position
+	ZoneFromGPS = "gps"
+	// ZoneFromDefault means the server's default time zone was assumed
+	ZoneFromDefault = "default"
+)
+
+// CaptureTime is a capture date resolved to the time zone it was taken in
+type CaptureTime struct {
+	// Time is the capture instant, in the resolved time zone
+	Time time.Time
+	// Zone names the time zone, e.g. "Europe/Warsaw" or "+02:00"
+	Zone string
+	// Source tells how the zone was found, one of the ZoneFrom constants
+	Source string
+}
+
+// ResolveCaptureTime interprets DateTimeOriginal in the time zone the image
+// was taken in. The zone is taken from OffsetTimeOriginal if present, then
+// looked up from the GPS position, and defaultZone is assumed otherwise.
+func (m *Metadata) ResolveCaptureTime(defaultZone *time.Location) (CaptureTime, error) {
+	if m.DateTimeOriginal == "" {
+		return CaptureTime{}, fmt.Errorf("DateTimeOriginal tag not found")
+	}
+
+	zone, name, source := defaultZone, defaultZone.String(), ZoneFromDefault
+	if location, ok := parseOffset(m.OffsetTimeOriginal); ok {
+		zone, name, source = location, m.OffsetTimeOriginal, ZoneFromOffset
+	} else if location, zoneName, ok := LookupZone(m.GPS); ok {
+		zone, name, source = location, zoneName, ZoneFromGPS
+	}
+
+	t, err := time.ParseInLocation(exifTimeLayout, m.DateTimeOriginal, zone)
+	if err != nil {
+		return CaptureTime{}, err
+	}
+	t = t.Add(subSeconds(m.SubSecTimeOriginal))
+
+	return CaptureTime{Time: t, Zone: name, Source: source}, nil
+}
+
+// parseOffset parses an EXIF offset like "+02:00" into a fixed zone
+func parseOffset(offset string) (*time.Location, bool) {
+	offset = strings.TrimSpace(offset)
+	if offset == "" {
+		return nil, false
+	}
+	t, err := time.Parse("-07:00", offset)
+	if err != nil {
+		return nil, false
+	}
+	_, seconds := t.Zone()
+	return time.FixedZone(offset, seconds), true
+}
+
+// LookupZone looks up the time zone at a GPS position in the embedded zone
+// boundary dataset
+func LookupZone(gps *GPS) (*time.Location, string, bool) {
+	if gps == nil {
+		return nil, "", false
+	}
+	name := latlong.LookupZoneName(gps.Latitude, gps.Longitude)
+	if name == "" {
+		return nil, "", false
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, "", false
+	}
+	return location, name, true
+}
+
+// subSeconds converts an EXIF SubSecTime value, the digits after the decimal
+// point, into a duration
+func subSeconds(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	var duration time.Duration
+	scale := time.Second
+	for _, digit := range value {
+		if digit < '0' || digit > '9' || scale == time.Nanosecond {
+			break
+		}
+		scale /= 10
+		duration += time.Duration(digit-'0') * scale
+	}
+	return duration
+}
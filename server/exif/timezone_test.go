@@ -0,0 +1,69 @@
+package exif
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResolveCaptureTime(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("Failed to load time zone: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		metadata   Metadata
+		wantUTC    time.Time
+		wantZone   string
+		wantSource string
+	}{
+		{
+			name:       "Offset tag wins over GPS",
+			metadata:   Metadata{DateTimeOriginal: "2023:06:15 18:42:07", OffsetTimeOriginal: "+09:00", SubSecTimeOriginal: "25", GPS: &GPS{Latitude: 52.2297, Longitude: 21.0122}},
+			wantUTC:    time.Date(2023, 6, 15, 9, 42, 7, 250_000_000, time.UTC),
+			wantZone:   "+09:00",
+			wantSource: ZoneFromOffset,
+		},
+		{
+			name:       "Zone looked up from GPS position",
+			metadata:   Metadata{DateTimeOriginal: "2023:01:01 00:30:00", GPS: &GPS{Latitude: 52.2297, Longitude: 21.0122}},
+			wantUTC:    time.Date(2022, 12, 31, 23, 30, 0, 0, time.UTC),
+			wantZone:   "Europe/Warsaw",
+			wantSource: ZoneFromGPS,
+		},
+		{
+			name:       "Default zone without offset or position",
+			metadata:   Metadata{DateTimeOriginal: "2023:07:01 12:00:00", OffsetTimeOriginal: "   :  "},
+			wantUTC:    time.Date(2023, 7, 1, 16, 0, 0, 0, time.UTC),
+			wantZone:   "America/New_York",
+			wantSource: ZoneFromDefault,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.metadata.ResolveCaptureTime(newYork)
+			if err != nil {
+				t.Fatalf("ResolveCaptureTime() error = %v", err)
+			}
+			if !got.Time.Equal(tt.wantUTC) {
+				t.Errorf("ResolveCaptureTime() time = %v, want %v", got.Time.UTC(), tt.wantUTC)
+			}
+			if got.Zone != tt.wantZone || got.Source != tt.wantSource {
+				t.Errorf("ResolveCaptureTime() zone = %q from %q, want %q from %q", got.Zone, got.Source, tt.wantZone, tt.wantSource)
+			}
+		})
+	}
+
+	// The local wall clock time is kept, so photos are filed under the day
+	// they were taken on
+	got, _ := tests[1].metadata.ResolveCaptureTime(newYork)
+	if got.Time.Year() != 2023 || got.Time.Day() != 1 {
+		t.Errorf("ResolveCaptureTime() lost the local date: %v", got.Time)
+	}
+
+	if _, err := (&Metadata{}).ResolveCaptureTime(newYork); err == nil {
+		t.Error("ResolveCaptureTime() should fail without DateTimeOriginal")
+	}
+}
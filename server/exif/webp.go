@@ -0,0 +1,43 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// webpExif returns the TIFF structure in the EXIF chunk of a WebP image's
+// RIFF container
+func webpExif(r io.ReaderAt, size int64) ([]byte, error) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	// The RIFF size counts from the WEBP form type on
+	end := 8 + int64(binary.LittleEndian.Uint32(header[4:8]))
+	if end > size {
+		end = size
+	}
+
+	offset := int64(12)
+	for i := 0; i < maxChunks && offset+8 <= end; i++ {
+		if _, err := r.ReadAt(header, offset); err != nil {
+			return nil, err
+		}
+		length := int64(binary.LittleEndian.Uint32(header[4:8]))
+		if string(header[:4]) == "EXIF" {
+			if length > MaxScanBytes || offset+8+length > end {
+				return nil, fmt.Errorf("failed to decode EXIF data: invalid EXIF chunk of %d bytes", length)
+			}
+			tiffData := make([]byte, length)
+			if _, err := r.ReadAt(tiffData, offset+8); err != nil {
+				return nil, err
+			}
+			return bytes.TrimPrefix(tiffData, exifPrefix), nil
+		}
+		// Chunks are padded to an even size
+		offset += 8 + length + length&1
+	}
+	return nil, errNoExif
+}
@@ -0,0 +1,106 @@
+// Package exifwrite rewrites the EXIF data embedded in images. Only the
+// metadata is touched: the compressed image data is copied byte for byte,
+// never re-encoded. The TIFF structure holding the EXIF data is edited with
+// go-exif; this package finds it in the container formats and puts the
+// result back.
+package exifwrite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	exif "github.com/dsoprea/go-exif/v3"
+	exifcommon "github.com/dsoprea/go-exif/v3/common"
+
+	"image-upload-server/sniff"
+)
+
+// Edit rewrites a TIFF structure holding EXIF data and reports whether it
+// changed anything. Images without EXIF data pass nil; returning data for
+// them adds EXIF data to the image.
+type Edit func(tiff []byte) ([]byte, bool, error)
+
+// Options control what else is removed when an image is rewritten
+type Options struct {
+	// DropPackets removes the XMP and IPTC packets, which can repeat the
+	// EXIF data. XMP items of HEIF images are blanked instead.
+	DropPackets bool
+}
+
+// ErrUnsupported is returned for files whose EXIF data can't be rewritten
+var ErrUnsupported = errors.New("EXIF data can't be rewritten in this file format")
+
+// exifPrefix starts the EXIF data in JPEG segments and, optionally, in the
+// EXIF chunks of PNG and WebP images
+var exifPrefix = []byte("Exif\x00\x00")
+
+// Supports reports whether Rewrite can handle files of the given type
+func Supports(kind sniff.Type) bool {
+	switch kind {
+	case sniff.JPEG, sniff.PNG, sniff.WebP:
+		return true
+	}
+	return kind.Kind == sniff.HEIF
+}
+
+// Rewrite returns a copy of a JPEG, PNG, WebP or HEIF image with its EXIF
+// data replaced by the result of edit. Other files are rejected with
+// ErrUnsupported. In HEIF images the Exif item is rewritten in place, so
+// the result of edit must not be larger than the original, and EXIF data
+// can't be added to images without it.
+func Rewrite(data []byte, edit Edit, options Options) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, jpegMagic):
+		return rewriteJPEG(data, edit, options)
+	case bytes.HasPrefix(data, pngMagic):
+		return rewritePNG(data, edit, options)
+	case len(data) >= 12 && bytes.Equal(data[0:4], riffMagic) && bytes.Equal(data[8:12], webpMagic):
+		return rewriteWebP(data, edit, options)
+	case isHEIF(data):
+		return rewriteHEIF(data, edit, options)
+	}
+	return nil, ErrUnsupported
+}
+
+// Builder loads a TIFF structure into an IFD builder for editing. For nil
+// it returns an empty IFD0, ready to have tags added.
+func Builder(tiff []byte) (*exif.IfdBuilder, error) {
+	mapping, err := exifcommon.NewIfdMappingWithStandard()
+	if err != nil {
+		return nil, err
+	}
+	tagIndex := exif.NewTagIndex()
+	if tiff == nil {
+		return exif.NewIfdBuilder(mapping, tagIndex, exifcommon.IfdStandardIfdIdentity, exifcommon.EncodeDefaultByteOrder), nil
+	}
+
+	_, index, err := exif.Collect(mapping, tagIndex, tiff)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read EXIF data: %v", err)
+	}
+	return exif.NewIfdBuilderFromExistingChain(index.RootIfd), nil
+}
+
+// Encode writes an edited IFD chain back into a TIFF structure
+func Encode(root *exif.IfdBuilder) ([]byte, error) {
+	encoded, err := exif.NewIfdByteEncoder().EncodeToExif(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write EXIF data: %v", err)
+	}
+	return encoded, nil
+}
+
+// editPayload applies edit to the payload of a PNG or WebP EXIF chunk,
+// keeping the optional "Exif\0\0" prefix
+func editPayload(payload []byte, edit Edit) ([]byte, bool, error) {
+	var prefix []byte
+	if bytes.HasPrefix(payload, exifPrefix) {
+		prefix = exifPrefix
+	}
+	edited, changed, err := edit(payload[len(prefix):])
+	if err != nil || !changed {
+		return nil, false, err
+	}
+	return append(append([]byte(nil), prefix...), edited...), true, nil
+}
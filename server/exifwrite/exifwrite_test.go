@@ -0,0 +1,123 @@
+package exifwrite
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"testing"
+
+	exif "github.com/dsoprea/go-exif/v3"
+	jpegstructure "github.com/dsoprea/go-jpeg-image-structure/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// addSoftware is an edit setting the Software tag of IFD0
+func addSoftware(tiff []byte) ([]byte, bool, error) {
+	root, err := Builder(tiff)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := root.SetStandardWithName("Software", "exifwrite"); err != nil {
+		return nil, false, err
+	}
+	encoded, err := Encode(root)
+	return encoded, err == nil, err
+}
+
+// software returns the Software tag of the EXIF data found in a file
+func software(t *testing.T, data []byte) string {
+	t.Helper()
+	rawExif, err := exif.SearchAndExtractExif(data)
+	require.NoError(t, err)
+	entries, _, err := exif.GetFlatExifData(rawExif, nil)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		if entry.TagName == "Software" {
+			return entry.Formatted
+		}
+	}
+	return ""
+}
+
+func TestRewriteAddsExif(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 8, 6))
+	encoded := map[string]*bytes.Buffer{"jpeg": {}, "png": {}}
+	require.NoError(t, jpeg.Encode(encoded["jpeg"], img, nil))
+	require.NoError(t, png.Encode(encoded["png"], img))
+
+	for name, data := range encoded {
+		rewritten, err := Rewrite(data.Bytes(), addSoftware, Options{})
+		require.NoError(t, err, name)
+		assert.Equal(t, "exifwrite", software(t, rewritten), name)
+
+		// The added data is rewritten in place the next time
+		rewritten, err = Rewrite(rewritten, addSoftware, Options{})
+		require.NoError(t, err, name)
+		assert.Equal(t, "exifwrite", software(t, rewritten), name)
+
+		decoded, _, err := image.Decode(bytes.NewReader(rewritten))
+		require.NoError(t, err, name)
+		assert.Equal(t, img.Bounds(), decoded.Bounds(), name)
+	}
+}
+
+func TestRewriteRejectsUnsupportedFiles(t *testing.T) {
+	data, err := os.ReadFile("../testdata/formats/animation.gif")
+	require.NoError(t, err)
+	_, err = Rewrite(data, addSoftware, Options{})
+	assert.ErrorIs(t, err, ErrUnsupported)
+}
+
+// setSoftware returns an edit setting the Software tag of IFD0 to value
+func setSoftware(value string) Edit {
+	return func(tiff []byte) ([]byte, bool, error) {
+		root, err := Builder(tiff)
+		if err != nil {
+			return nil, false, err
+		}
+		if err := root.SetStandardWithName("Software", value); err != nil {
+			return nil, false, err
+		}
+		encoded, err := Encode(root)
+		return encoded, err == nil, err
+	}
+}
+
+func TestRewriteDropsDuplicateExifSegments(t *testing.T) {
+	var encoded bytes.Buffer
+	require.NoError(t, jpeg.Encode(&encoded, image.NewGray(image.Rect(0, 0, 8, 6)), nil))
+	first, err := Rewrite(encoded.Bytes(), setSoftware("first"), Options{})
+	require.NoError(t, err)
+	second, err := Rewrite(encoded.Bytes(), setSoftware("owner serial 1234"), Options{})
+	require.NoError(t, err)
+
+	// Append the EXIF segment of the second file after that of the first
+	parsed, err := jpegstructure.NewJpegMediaParser().ParseBytes(first)
+	require.NoError(t, err)
+	segments := parsed.(*jpegstructure.SegmentList).Segments()
+	extra, err := jpegstructure.NewJpegMediaParser().ParseBytes(second)
+	require.NoError(t, err)
+	var duplicated []*jpegstructure.Segment
+	for _, segment := range segments {
+		duplicated = append(duplicated, segment)
+		if segment.MarkerId == jpegstructure.MARKER_APP1 && bytes.HasPrefix(segment.Data, exifPrefix) {
+			for _, other := range extra.(*jpegstructure.SegmentList).Segments() {
+				if other.MarkerId == jpegstructure.MARKER_APP1 && bytes.HasPrefix(other.Data, exifPrefix) {
+					duplicated = append(duplicated, other)
+				}
+			}
+		}
+	}
+	var data bytes.Buffer
+	require.NoError(t, jpegstructure.NewSegmentList(duplicated).Write(&data))
+	require.Equal(t, 2, bytes.Count(data.Bytes(), exifPrefix))
+
+	rewritten, err := Rewrite(data.Bytes(), setSoftware("stripped"), Options{DropPackets: true})
+	require.NoError(t, err)
+	assert.Equal(t, 1, bytes.Count(rewritten, exifPrefix))
+	assert.Equal(t, "stripped", software(t, rewritten))
+	assert.NotContains(t, string(rewritten), "owner serial 1234")
+}
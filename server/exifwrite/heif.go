@@ -0,0 +1,91 @@
+package exifwrite
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"image-upload-server/isobmff"
+)
+
+func isHEIF(data []byte) bool {
+	return isobmff.IsHEIF(bytes.NewReader(data), int64(len(data)))
+}
+
+// rewriteHEIF rewrites the Exif item of a HEIF image in place: the item
+// keeps its size, so no offsets in the file change, and the rebuilt TIFF
+// structure is padded with zeros. XMP items are blanked with spaces, which
+// XMP allows as padding.
+func rewriteHEIF(data []byte, edit Edit, options Options) ([]byte, error) {
+	heif, err := isobmff.ParseHEIF(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	out := append([]byte(nil), data...)
+
+	if heif.HasExif() {
+		ranges, ok := heif.ExifRanges()
+		if !ok {
+			return nil, ErrUnsupported
+		}
+		item, ok := gather(out, ranges)
+		// The item starts with the offset of the TIFF header
+		if !ok || len(item) < 4 || uint64(binary.BigEndian.Uint32(item))+4 >= uint64(len(item)) {
+			return nil, ErrUnsupported
+		}
+		tiffData := item[4+binary.BigEndian.Uint32(item):]
+		edited, changed, err := edit(tiffData)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			if len(edited) > len(tiffData) {
+				return nil, ErrUnsupported
+			}
+			n := copy(tiffData, edited)
+			for i := n; i < len(tiffData); i++ {
+				tiffData[i] = 0
+			}
+			scatter(out, ranges, item)
+		}
+	} else if _, changed, err := edit(nil); err != nil || changed {
+		// Adding an item would move the data of the other items
+		if err == nil {
+			err = ErrUnsupported
+		}
+		return nil, err
+	}
+
+	if options.DropPackets {
+		ranges, ok := heif.XMPRanges()
+		if !ok {
+			return nil, ErrUnsupported
+		}
+		for _, rng := range ranges {
+			if rng.Offset+rng.Length > int64(len(out)) {
+				return nil, ErrUnsupported
+			}
+			copy(out[rng.Offset:rng.Offset+rng.Length], bytes.Repeat([]byte{' '}, int(rng.Length)))
+		}
+	}
+	return out, nil
+}
+
+// gather copies the extents of an item into one buffer
+func gather(data []byte, ranges []isobmff.Range) ([]byte, bool) {
+	var item []byte
+	for _, rng := range ranges {
+		if rng.Offset+rng.Length > int64(len(data)) {
+			return nil, false
+		}
+		item = append(item, data[rng.Offset:rng.Offset+rng.Length]...)
+	}
+	return item, true
+}
+
+// scatter writes an item gathered from the ranges back into them
+func scatter(data []byte, ranges []isobmff.Range, item []byte) {
+	for _, rng := range ranges {
+		copy(data[rng.Offset:rng.Offset+rng.Length], item[:rng.Length])
+		item = item[rng.Length:]
+	}
+}
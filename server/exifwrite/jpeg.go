@@ -0,0 +1,105 @@
+package exifwrite
+
+import (
+	"bytes"
+	"fmt"
+
+	jpegstructure "github.com/dsoprea/go-jpeg-image-structure/v2"
+)
+
+// Magic numbers and segment prefixes of JPEG images
+var (
+	jpegMagic = []byte{0xFF, 0xD8, 0xFF}
+	// xmpPrefixes start the APP1 segments holding the XMP packet and its
+	// extension for packets larger than a segment
+	xmpPrefixes = [][]byte{
+		[]byte("http://ns.adobe.com/xap/1.0/\x00"),
+		[]byte("http://ns.adobe.com/xmp/extension/\x00"),
+	}
+	// photoshopPrefix starts the APP13 segment holding IPTC data
+	photoshopPrefix = []byte("Photoshop 3.0\x00")
+)
+
+// maxSegmentData is the largest payload of a JPEG segment, whose 16-bit
+// length includes itself
+const maxSegmentData = 0xFFFF - 2
+
+// rewriteJPEG rewrites the EXIF segment of a JPEG image, adding one after
+// the JFIF segment if there is none, drops any further EXIF segments, and
+// drops the XMP and IPTC segments if asked to. All other segments,
+// including the scan data, are written back unchanged.
+func rewriteJPEG(data []byte, edit Edit, options Options) ([]byte, error) {
+	parsed, err := jpegstructure.NewJpegMediaParser().ParseBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JPEG structure: %v", err)
+	}
+	segments := parsed.(*jpegstructure.SegmentList).Segments()
+
+	kept := make([]*jpegstructure.Segment, 0, len(segments)+1)
+	// Where a new EXIF segment goes: after SOI and a JFIF APP0 segment
+	insertAt := 0
+	hasExif := false
+	for _, segment := range segments {
+		switch {
+		case segment.MarkerId == jpegstructure.MARKER_APP1 && bytes.HasPrefix(segment.Data, exifPrefix):
+			if hasExif {
+				// Only the first EXIF segment is read by anyone, so another
+				// one is dropped rather than left unedited, which would keep
+				// the metadata an edit removes
+				continue
+			}
+			hasExif = true
+			edited, changed, err := edit(segment.Data[len(exifPrefix):])
+			if err != nil {
+				return nil, err
+			}
+			if changed {
+				if len(exifPrefix)+len(edited) > maxSegmentData {
+					return nil, ErrUnsupported
+				}
+				segment.Data = append(append([]byte(nil), exifPrefix...), edited...)
+			}
+		case options.DropPackets && segment.MarkerId == jpegstructure.MARKER_APP1 && hasAnyPrefix(segment.Data, xmpPrefixes):
+			continue
+		case options.DropPackets && segment.MarkerId == jpegstructure.MARKER_APP13 && bytes.HasPrefix(segment.Data, photoshopPrefix):
+			continue
+		}
+		kept = append(kept, segment)
+		if segment.MarkerId == jpegstructure.MARKER_SOI || (segment.MarkerId == jpegstructure.MARKER_APP0 && insertAt == len(kept)-1) {
+			insertAt = len(kept)
+		}
+	}
+
+	if !hasExif {
+		added, changed, err := edit(nil)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			if len(exifPrefix)+len(added) > maxSegmentData {
+				return nil, ErrUnsupported
+			}
+			segment := &jpegstructure.Segment{
+				MarkerId: jpegstructure.MARKER_APP1,
+				Data:     append(append([]byte(nil), exifPrefix...), added...),
+			}
+			kept = append(kept[:insertAt], append([]*jpegstructure.Segment{segment}, kept[insertAt:]...)...)
+		}
+	}
+
+	out := new(bytes.Buffer)
+	out.Grow(len(data))
+	if err := jpegstructure.NewSegmentList(kept).Write(out); err != nil {
+		return nil, fmt.Errorf("failed to write JPEG structure: %v", err)
+	}
+	return out.Bytes(), nil
+}
+
+func hasAnyPrefix(data []byte, prefixes [][]byte) bool {
+	for _, prefix := range prefixes {
+		if bytes.HasPrefix(data, prefix) {
+			return true
+		}
+	}
+	return false
+}
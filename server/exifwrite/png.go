@@ -0,0 +1,99 @@
+package exifwrite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"strings"
+)
+
+// pngMagic is the signature at the start of PNG images
+var pngMagic = []byte("\x89PNG\r\n\x1a\n")
+
+// Keywords of PNG text chunks that carry metadata packets. ImageMagick
+// stores EXIF, XMP and IPTC data as hex encoded raw profiles, which can't
+// be rewritten and would contradict the rewritten EXIF data, so they are
+// always dropped.
+const (
+	pngXMPKeyword    = "XML:com.adobe.xmp"
+	pngProfilePrefix = "Raw profile type "
+)
+
+// pngMaxChunkLength is the largest chunk length the PNG specification allows
+const pngMaxChunkLength = 1<<31 - 1
+
+var errTruncatedPNG = errors.New("truncated PNG chunk")
+
+// rewritePNG rewrites the eXIf chunk of a PNG image, adding one before the
+// image data if there is none, and drops its raw profile and, if asked to,
+// XMP text chunks. The image data chunks are copied unchanged.
+func rewritePNG(data []byte, edit Edit, options Options) ([]byte, error) {
+	out := new(bytes.Buffer)
+	out.Grow(len(data))
+	out.Write(pngMagic)
+	hasExif := false
+	for offset := len(pngMagic); offset < len(data); {
+		if offset+12 > len(data) {
+			return nil, errTruncatedPNG
+		}
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		end := offset + 12 + length
+		if length > pngMaxChunkLength || end > len(data) {
+			return nil, errTruncatedPNG
+		}
+		chunkType := string(data[offset+4 : offset+8])
+		payload := data[offset+8 : offset+8+length]
+		chunk := data[offset:end]
+		offset = end
+
+		switch chunkType {
+		case "eXIf":
+			hasExif = true
+			edited, changed, err := editPayload(payload, edit)
+			if err != nil {
+				return nil, err
+			}
+			if changed {
+				writePNGChunk(out, chunkType, edited)
+				continue
+			}
+		case "IDAT":
+			// The eXIf chunk must come before the image data
+			if !hasExif {
+				hasExif = true
+				added, changed, err := edit(nil)
+				if err != nil {
+					return nil, err
+				}
+				if changed {
+					writePNGChunk(out, "eXIf", added)
+				}
+			}
+		case "tEXt", "zTXt", "iTXt":
+			keyword, _, _ := bytes.Cut(payload, []byte{0})
+			if strings.HasPrefix(string(keyword), pngProfilePrefix) {
+				continue
+			}
+			if options.DropPackets && string(keyword) == pngXMPKeyword {
+				continue
+			}
+		}
+		out.Write(chunk)
+		if chunkType == "IEND" {
+			break
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// writePNGChunk appends a chunk with its length and CRC
+func writePNGChunk(out *bytes.Buffer, chunkType string, payload []byte) {
+	binary.Write(out, binary.BigEndian, uint32(len(payload)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunkType))
+	crc.Write(payload)
+	out.WriteString(chunkType)
+	out.Write(payload)
+	binary.Write(out, binary.BigEndian, crc.Sum32())
+}
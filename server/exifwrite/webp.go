@@ -0,0 +1,122 @@
+package exifwrite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Magic numbers of WebP images' RIFF container
+var (
+	riffMagic = []byte("RIFF")
+	webpMagic = []byte("WEBP")
+)
+
+// Bits of the VP8X chunk's flags announcing metadata chunks
+const (
+	vp8xXMPFlag  = 0x04
+	vp8xExifFlag = 0x08
+)
+
+var errTruncatedWebP = errors.New("truncated WebP chunk")
+
+// rewriteWebP rewrites the EXIF chunk of a WebP image and drops its XMP
+// chunk if asked to. An EXIF chunk is added to extended WebP images
+// without one; simple images, which have no VP8X chunk, can't hold EXIF
+// data. The bitstream chunks are copied unchanged.
+func rewriteWebP(data []byte, edit Edit, options Options) ([]byte, error) {
+	// The RIFF size counts from the WEBP form type on
+	end := 8 + int(binary.LittleEndian.Uint32(data[4:8]))
+	if end > len(data) {
+		return nil, errTruncatedWebP
+	}
+
+	out := new(bytes.Buffer)
+	out.Grow(len(data))
+	out.Write(data[:12])
+	flagsAt := -1
+	hasExif := false
+	// addExif adds an EXIF chunk at the current position if the image has
+	// none, which is before the XMP chunk or at the end
+	addExif := func() error {
+		if hasExif {
+			return nil
+		}
+		hasExif = true
+		added, changed, err := edit(nil)
+		if err != nil || !changed {
+			return err
+		}
+		if flagsAt < 0 {
+			return ErrUnsupported
+		}
+		writeRIFFChunk(out, "EXIF", added)
+		out.Bytes()[flagsAt] |= vp8xExifFlag
+		return nil
+	}
+
+	for offset := 12; offset < end; {
+		if offset+8 > end {
+			return nil, errTruncatedWebP
+		}
+		length := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		// Chunks are padded to an even size
+		next := offset + 8 + length + length&1
+		if offset+8+length > end {
+			return nil, errTruncatedWebP
+		}
+		if next > end {
+			next = end
+		}
+		fourCC := string(data[offset : offset+4])
+		payload := data[offset+8 : offset+8+length]
+		chunk := data[offset:next]
+		offset = next
+
+		switch fourCC {
+		case "VP8X":
+			if length < 1 {
+				return nil, errTruncatedWebP
+			}
+			flagsAt = out.Len() + 8
+		case "EXIF":
+			hasExif = true
+			edited, changed, err := editPayload(payload, edit)
+			if err != nil {
+				return nil, err
+			}
+			if changed {
+				writeRIFFChunk(out, fourCC, edited)
+				continue
+			}
+		case "XMP ":
+			if err := addExif(); err != nil {
+				return nil, err
+			}
+			if options.DropPackets {
+				continue
+			}
+		}
+		out.Write(chunk)
+	}
+	if err := addExif(); err != nil {
+		return nil, err
+	}
+
+	result := out.Bytes()
+	if options.DropPackets && flagsAt >= 0 {
+		result[flagsAt] &^= vp8xXMPFlag
+	}
+	binary.LittleEndian.PutUint32(result[4:8], uint32(len(result)-8))
+	return result, nil
+}
+
+// writeRIFFChunk appends a chunk with its size and padding
+func writeRIFFChunk(out *bytes.Buffer, fourCC string, payload []byte) {
+	out.WriteString(fourCC)
+	binary.Write(out, binary.LittleEndian, uint32(len(payload)))
+	out.Write(payload)
+	if len(payload)%2 == 1 {
+		out.WriteByte(0)
+	}
+}
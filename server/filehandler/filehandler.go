@@ -1,123 +1,440 @@
-
 package filehandler
 
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"image-upload-server/config"
+	"image-upload-server/derivatives"
 	"image-upload-server/exif"
+	"image-upload-server/index"
+	"image-upload-server/layout"
+	"image-upload-server/sniff"
+	"image-upload-server/storage"
+	"image-upload-server/video"
 )
 
-// Global map to store file hashes for duplicate detection
+// tempDirName is the directory inside the uploads directory where incoming
+// files are written before they are stored. With the local storage backend
+// it lives on the same filesystem as the final location, so storing a file
+// is an atomic rename.
+const tempDirName = ".tmp"
+
+// multipartOverhead is the allowance for multipart headers and boundaries on
+// top of the maximum file size when limiting the request body.
+const multipartOverhead = 1 << 20
+
+// maxPathCandidates is the number of names tried when the path a file is
+// stored under is taken
+const maxPathCandidates = 1000
+
+// reconcileBatchSize is the number of index updates written per transaction
+// while reconciling the index with the stored files
+const reconcileBatchSize = 256
+
 var (
-	uploadedHashes = make(map[string]string)
-	hashMutex      sync.Mutex
+	errFileTooLarge = errors.New("file too large")
+	errInvalidOwner = errors.New("username can't be used as a storage directory")
 )
 
+// stagedFile is an upload that has been fully written to a temporary file
+type stagedFile struct {
+	path string
+	hash string
+	size int64
+	// kind is the media type detected by validateStaged
+	kind sniff.Type
+}
+
+// uploadResult describes a file that was stored in the library
+type uploadResult struct {
+	relativePath string
+	date         time.Time
+	timeZone     string
+	resolver     string
+	confidence   string
+	mediaType    string
+	exif         *exif.Metadata
+	video        *video.Metadata
+}
+
+// duplicateError is returned when the uploaded content is already stored
+type duplicateError struct {
+	existingPath string
+}
+
+func (e *duplicateError) Error() string {
+	return fmt.Sprintf("image already uploaded as %s", e.existingPath)
+}
+
 // HandleUpload handles the file upload request
 func HandleUpload(uploadsDir string) func(c *gin.Context) {
 	return func(c *gin.Context) {
-		// Get file from form data
-		file, header, err := c.Request.FormFile("image")
+		// The size limit depends on whether the file is a video, which is
+		// only known from its part of the body
+		maxSize := maxUploadLimit()
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxSize+multipartOverhead)
+
+		// Stream the multipart body instead of letting it be buffered in memory
+		reader, err := c.Request.MultipartReader()
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "No image file provided"})
 			return
 		}
-		defer file.Close()
 
-		// Check file size
-		if header.Size > 10*1024*1024 { // 10MB limit
-			c.JSON(http.StatusBadRequest, gin.H{"error": "File too large (max 10MB)"})
+		var staged *stagedFile
+		var originalName string
+		var lastModified time.Time
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				discardStaged(staged)
+				respondStageError(c, err, maxSize)
+				return
+			}
+
+			if part.FormName() == "lastModified" {
+				value, _ := io.ReadAll(io.LimitReader(part, 64))
+				lastModified = parseClientTime(string(value))
+				part.Close()
+				continue
+			}
+
+			if !uploadFields[part.FormName()] || staged != nil {
+				part.Close()
+				continue
+			}
+
+			originalName = part.FileName()
+			maxSize = uploadLimit(declaresVideo(part.FormName(), part.Header.Get("Content-Type"), originalName))
+			staged, err = stageUpload(uploadsDir, part, maxSize)
+			part.Close()
+			if err != nil {
+				respondStageError(c, err, maxSize)
+				return
+			}
+		}
+
+		if staged == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No image file provided"})
+			return
+		}
+		if err := validateStaged(staged); err != nil {
+			discardStaged(staged)
+			respondFinalizeError(c, err)
 			return
 		}
 
-		// Read file content
-		buffer, err := io.ReadAll(file)
+		// Get username from context (set by authMiddleware)
+		username := c.GetString("username")
+
+		result, err := finalizeUpload(uploadsDir, staged, originalName, lastModified, username)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+			discardStaged(staged)
+			respondFinalizeError(c, err)
 			return
 		}
 
-		// Calculate file hash
-		hash := CalculateHash(buffer)
+		message := "Image uploaded successfully"
+		if result.mediaType == index.MediaVideo {
+			message = "Video uploaded successfully"
+		}
 
-		// Check for duplicates
-		hashMutex.Lock()
-		existingPath, exists := uploadedHashes[hash]
-		hashMutex.Unlock()
+		// Return success response
+		c.JSON(http.StatusCreated, gin.H{
+			"success":         true,
+			"message":         message,
+			"path":            result.relativePath,
+			"media_type":      result.mediaType,
+			"date":            result.date,
+			"time_zone":       result.timeZone,
+			"date_resolver":   result.resolver,
+			"date_confidence": result.confidence,
+			"uploader":        username,
+			"exif":            result.exif,
+			"video":           result.video,
+		})
+	}
+}
 
-		if exists {
-			c.JSON(http.StatusConflict, gin.H{
-				"error":   "Image already uploaded",
-				"message": "This exact image has already been uploaded previously.",
-				"path":    existingPath,
-			})
-			return
-		}
+// respondStageError writes the response for a failure while receiving the file
+func respondStageError(c *gin.Context, err error, maxSize int64) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.Is(err, errFileTooLarge) || errors.As(err, &maxBytesErr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("File too large (max %dMB)", maxSize/(1024*1024)), "code": codeFileTooLarge})
+		return
+	}
 
-		var dateDir string
+	c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read upload", "message": err.Error()})
+}
 
-		// Extract image date from metadata
-		imageDate, err := exif.ExtractImageDate(buffer)
-		if err != nil {
-			log.Printf("Failed to extract date from image: %v", err)
-			//imageDate = time.Now()
-			dateDir = filepath.Join(uploadsDir, "na")
-		} else {
-			log.Printf("Successfully extracted image date: %v", imageDate)
-			// Create date-based directory structure: YYYY/MM/DD
-			year := fmt.Sprintf("%d", imageDate.Year())
-			month := fmt.Sprintf("%02d", imageDate.Month())
-			dateDir = filepath.Join(uploadsDir, year, month)
-		}
-
-		// Create directory if it doesn't exist
-		if err := os.MkdirAll(dateDir, 0755); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
-			return
+// respondFinalizeError writes the response for a failure while storing the file
+func respondFinalizeError(c *gin.Context, err error) {
+	var dupErr *duplicateError
+	if errors.As(err, &dupErr) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "Image already uploaded",
+			"message": "This exact image has already been uploaded previously.",
+			"path":    dupErr.existingPath,
+		})
+		return
+	}
+
+	if errors.Is(err, errFileTooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("File too large (max %dMB)", config.MaxUploadSize/(1024*1024)), "code": codeFileTooLarge})
+		return
+	}
+
+	var validationErr *validationError
+	if errors.As(err, &validationErr) {
+		c.JSON(validationErr.status, gin.H{"error": validationErr.message, "code": validationErr.code})
+		return
+	}
+
+	if errors.Is(err, errInvalidOwner) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Uploads are not allowed for this user"})
+		return
+	}
+
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+}
+
+// stageUpload streams r into a temporary file under the uploads directory,
+// computing the SHA-256 of the content on the fly. Files larger than maxSize
+// are rejected with errFileTooLarge.
+func stageUpload(uploadsDir string, r io.Reader, maxSize int64) (*stagedFile, error) {
+	tmpDir := filepath.Join(uploadsDir, tempDirName)
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(tmpDir, "upload-*")
+	if err != nil {
+		return nil, err
+	}
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), io.LimitReader(r, maxSize+1))
+	if err == nil && size > maxSize {
+		err = errFileTooLarge
+	}
+	if err == nil {
+		// Make sure the content is on disk before it is renamed into place
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	return &stagedFile{
+		path: tmp.Name(),
+		hash: hex.EncodeToString(hasher.Sum(nil)),
+		size: size,
+	}, nil
+}
+
+// discardStaged removes the temporary file of an upload that was not stored
+func discardStaged(staged *stagedFile) {
+	if staged == nil {
+		return
+	}
+	if err := os.Remove(staged.path); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove temporary file %s: %v", staged.path, err)
+	}
+}
+
+// finalizeUpload checks a staged file for duplicates among the owner's files,
+// sorts it into the owner's date-based directory structure and stores it.
+// The duplicate check and the index entry for the new file are a single
+// index transaction, so concurrent uploads of the same content can't both
+// succeed.
+func finalizeUpload(uploadsDir string, staged *stagedFile, originalName string, lastModified time.Time, owner string) (*uploadResult, error) {
+	if err := checkOwner(owner); err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(staged.path)
+	if err != nil {
+		return nil, err
+	}
+
+	record := index.Record{
+		Hash:       staged.hash,
+		Owner:      owner,
+		Size:       info.Size(),
+		ModTime:    info.ModTime(),
+		Uploader:   owner,
+		UploadedAt: time.Now(),
+		// Used to resolve the capture date of files without EXIF
+		OriginalName:  originalName,
+		ClientModTime: lastModified,
+	}
+
+	// Extract image date and other details from metadata
+	if err := describeStaged(staged.path, &record); err != nil {
+		log.Printf("Failed to extract date from %s: %v", record.MediaType, err)
+	} else {
+		log.Printf("Successfully extracted %s date: %v (time zone from %s)", record.MediaType, record.CaptureDate, record.CaptureTimeZoneSource)
+	}
+
+	// Fill in the storage layout, by default <user>/YYYY/MM in the time zone
+	// the image was taken in. The extension follows the detected content,
+	// not the name the client sent.
+	key, existing, err := claimPath(owner, &record, layout.Current.Path(&record, staged.kind.Extension))
+	if errors.Is(err, index.ErrDuplicate) {
+		return nil, &duplicateError{existingPath: existing.Path}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := storeFile(staged, key, &record); err != nil {
+		if removeErr := index.DB.Remove(record.Path); removeErr != nil {
+			log.Printf("Failed to release index entry for %s: %v", record.Path, removeErr)
 		}
+		return nil, err
+	}
 
-		// Generate unique filename
-		ext := strings.ToLower(filepath.Ext(header.Filename))
-		timestamp := time.Now().UnixNano() / int64(time.Millisecond)
-		filename := fmt.Sprintf("%d-%s%s", timestamp, hash[:8], ext)
-		filePath := filepath.Join(dateDir, filename)
+	// Thumbnails and previews of images are generated in the background
+	if record.MediaType == index.MediaImage {
+		derivatives.Enqueue(record.Hash, key)
+	}
 
-		// Save file to disk
-		if err := os.WriteFile(filePath, buffer, 0644); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
-			return
+	return &uploadResult{
+		relativePath: record.Path,
+		date:         record.CaptureDate,
+		timeZone:     record.CaptureTimeZone,
+		resolver:     record.CaptureDateResolver,
+		confidence:   record.CaptureDateConfidence,
+		mediaType:    record.MediaType,
+		exif:         record.Exif,
+		video:        record.Video,
+	}, nil
+}
+
+// claimPath reserves the index entry for a new file at layoutPath within
+// the owner's namespace, checking the owner's files for duplicates. If the
+// path is taken, "-2", "-3" and so on are appended to the name until a free
+// one is found. It returns the storage key and sets the index path in
+// record; for duplicates the owner's existing record is returned with
+// index.ErrDuplicate.
+func claimPath(owner string, record *index.Record, layoutPath string) (string, *index.Record, error) {
+	for n := 1; n <= maxPathCandidates; n++ {
+		key := path.Join(owner, layout.WithSuffix(layoutPath, n))
+		// Files missing from the index still occupy their path
+		if exists, err := storage.Exists(storage.Files, key); err != nil {
+			return "", nil, err
+		} else if exists {
+			continue
+		}
+		record.Path = "/" + key
+		existing, err := index.DB.Claim(*record)
+		if errors.Is(err, index.ErrPathTaken) {
+			continue
 		}
+		return key, existing, err
+	}
+	return "", nil, fmt.Errorf("no free path for %s after %d attempts", layoutPath, maxPathCandidates)
+}
 
-		// Store hash to prevent duplicates
-		relativePath := strings.Replace(filePath, uploadsDir, "", 1)
-		hashMutex.Lock()
-		uploadedHashes[hash] = relativePath
-		hashMutex.Unlock()
+// storeFile moves a staged file into storage under key. When identical files
+// are shared between users, another user already stored the same content
+// and the backend can link files, the file is linked to the existing copy
+// instead and the staged file is dropped.
+func storeFile(staged *stagedFile, key string, record *index.Record) error {
+	linker, canLink := storage.Files.(storage.Linker)
+	if config.ShareIdenticalFiles && canLink {
+		shared, found, err := index.DB.Lookup(staged.hash)
+		if err == nil && found && shared.Path != record.Path {
+			if err := linker.Link(storage.Key(shared.Path), key); err == nil {
+				discardStaged(staged)
+				updateModTime(key, record)
+				return nil
+			}
+			log.Printf("Failed to share identical file, storing a copy: %v", err)
+		}
+	}
 
-		// Get username from context (set by authMiddleware)
-		username, _ := c.Get("username")
+	if err := storage.PutFile(storage.Files, key, staged.path); err != nil {
+		return err
+	}
+	updateModTime(key, record)
+	return nil
+}
 
-		// Return success response
-		c.JSON(http.StatusCreated, gin.H{
-			"success":  true,
-			"message":  "Image uploaded successfully",
-			"path":     relativePath,
-			"date":     imageDate,
-			"uploader": username,
-		})
+// updateModTime records the modification time of a stored file in its index
+// entry, when it differs from the one of the staged file: links carry the
+// time of the shared copy and object stores set the time of the upload
+func updateModTime(key string, record *index.Record) {
+	info, err := storage.Files.Stat(key)
+	if err != nil || info.ModTime.Equal(record.ModTime) {
+		return
+	}
+	record.ModTime = info.ModTime
+	if err := index.DB.Put(*record); err != nil {
+		log.Printf("Failed to update index entry for %s: %v", record.Path, err)
+	}
+}
+
+// checkOwner checks that a user's name can be used as the directory
+// holding their uploads
+func checkOwner(owner string) error {
+	if !isSafePathSegment(owner) || isLegacyTopLevel(owner) {
+		return errInvalidOwner
+	}
+	return nil
+}
+
+// ownerFromPath returns the owner of a file from its relative path, or an
+// empty string for files still in the legacy shared layout
+func ownerFromPath(relativePath string) string {
+	first := strings.SplitN(strings.TrimPrefix(relativePath, "/"), "/", 2)[0]
+	if isLegacyTopLevel(first) {
+		return ""
+	}
+	return first
+}
+
+// isSafePathSegment reports whether name can be used as a single directory
+// name without escaping its parent
+func isSafePathSegment(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`)
+}
+
+// isLegacyTopLevel reports whether a top-level directory belongs to the
+// shared layout used before uploads were kept per user (YYYY or na)
+func isLegacyTopLevel(name string) bool {
+	if name == "na" {
+		return true
+	}
+	if len(name) != 4 {
+		return false
+	}
+	for _, r := range name {
+		if r < '0' || r > '9' {
+			return false
+		}
 	}
+	return true
 }
 
 // CalculateHash calculates SHA256 hash of file content (exported for testing)
@@ -127,41 +444,211 @@ func CalculateHash(data []byte) string {
 	return hex.EncodeToString(hasher.Sum(nil))
 }
 
-// LoadExistingHashes loads existing file hashes to prevent duplicate uploads
-func LoadExistingHashes(uploadsDir string) {
-	// Walk through all files in the uploads directory
-	err := filepath.Walk(uploadsDir, func(path string, info os.FileInfo, err error) error {
+// CalculateFileHash calculates SHA256 hash of a file without loading it into memory
+func CalculateFileHash(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return calculateHash(file)
+}
+
+// calculateStoredHash calculates SHA256 hash of a file in storage
+func calculateStoredHash(key string) (string, error) {
+	body, err := storage.Files.Get(key, 0, -1)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	return calculateHash(body)
+}
+
+func calculateHash(r io.Reader) (string, error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// CleanupTempFiles removes partially written uploads left behind by a crash
+func CleanupTempFiles(uploadsDir string) {
+	tmpDir := filepath.Join(uploadsDir, tempDirName)
+	if err := os.RemoveAll(tmpDir); err != nil {
+		log.Printf("Error removing temporary upload files: %v", err)
+	}
+}
+
+// ReconcileIndex brings the upload index in line with the stored files.
+// Only files that are new or whose size or modification time changed are
+// hashed again; index entries for files that disappeared are removed.
+func ReconcileIndex() error {
+	seen := make(map[string]bool)
+	var pending []index.Record
+	hashed := 0
+
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		err := index.DB.PutAll(pending)
+		pending = pending[:0]
+		return err
+	}
+
+	// Go through all stored files, which leaves out internal directories
+	// such as the temp directory
+	err := storage.Files.List("", func(info storage.Info) error {
+		relativePath := "/" + info.Key
+		seen[relativePath] = true
+
+		existing, found, err := index.DB.Get(relativePath)
 		if err != nil {
 			return err
 		}
+		if found && existing.Size == info.Size && existing.ModTime.Equal(info.ModTime) {
+			if existing.MetadataVersion >= metadataVersion {
+				return nil
+			}
 
-		// Skip directories
-		if info.IsDir() {
+			// Refresh metadata extracted by an older version without rehashing
+			describeStored(info.Key, existing)
+			pending = append(pending, *existing)
+			if len(pending) >= reconcileBatchSize {
+				return flush()
+			}
 			return nil
 		}
 
-		// Read file content
-		data, err := os.ReadFile(path)
+		// Calculate hash
+		hash, err := calculateStoredHash(info.Key)
 		if err != nil {
-			log.Printf("Error reading file %s: %v", path, err)
+			log.Printf("Error reading file %s: %v", info.Key, err)
 			return nil
 		}
+		hashed++
 
-		// Calculate hash
-		hash := CalculateHash(data)
-		relativePath := strings.Replace(path, uploadsDir, "", 1)
+		record := index.Record{
+			Hash:       hash,
+			Path:       relativePath,
+			Owner:      ownerFromPath(relativePath),
+			Size:       info.Size,
+			ModTime:    info.ModTime,
+			UploadedAt: info.ModTime,
+		}
+		if !found && record.Owner != "" {
+			// A file moved without updating the index, e.g. by an
+			// interrupted reorganize, keeps the details of its old entry
+			existing, found, err = movedRecord(record.Owner, hash)
+			if err != nil {
+				return err
+			}
+		}
+		if found {
+			record.Uploader = existing.Uploader
+			record.UploadedAt = existing.UploadedAt
+			record.OriginalName = existing.OriginalName
+			record.ClientModTime = existing.ClientModTime
+		}
+		describeStored(info.Key, &record)
 
-		// Store hash
-		hashMutex.Lock()
-		uploadedHashes[hash] = relativePath
-		hashMutex.Unlock()
+		pending = append(pending, record)
+		if len(pending) >= reconcileBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return fmt.Errorf("error reconciling upload index: %w", err)
+	}
 
+	// Forget files that no longer exist
+	var missing []string
+	err = index.DB.ForEach(func(record *index.Record) error {
+		if !seen[record.Path] {
+			missing = append(missing, record.Path)
+		}
 		return nil
 	})
+	if err == nil {
+		err = index.DB.RemoveAll(missing)
+	}
+	if err != nil {
+		return fmt.Errorf("error reconciling upload index: %w", err)
+	}
 
+	log.Printf("Upload index reconciled: %d files indexed, %d rehashed, %d removed", index.DB.Count(), hashed, len(missing))
+	return nil
+}
+
+// movedRecord returns the owner's index entry for the content if its file no
+// longer exists
+func movedRecord(owner, hash string) (*index.Record, bool, error) {
+	existing, found, err := index.DB.LookupOwned(owner, hash)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	if exists, err := storage.Exists(storage.Files, storage.Key(existing.Path)); err != nil || exists {
+		return nil, false, err
+	}
+	return existing, true, nil
+}
+
+// MigrateLegacyLayout moves files from the shared YYYY/MM and na layout into
+// the namespace of owner and assigns them to that user in the index. Files
+// whose target path already exists are skipped.
+func MigrateLegacyLayout(owner string) (int, error) {
+	if err := checkOwner(owner); err != nil {
+		return 0, err
+	}
+
+	// Collect first, so the listing doesn't see the moves
+	var legacy []string
+	err := storage.Files.List("", func(info storage.Info) error {
+		if isLegacyTopLevel(strings.SplitN(info.Key, "/", 2)[0]) {
+			legacy = append(legacy, info.Key)
+		}
+		return nil
+	})
 	if err != nil {
-		log.Printf("Error loading existing hashes: %v", err)
+		return 0, err
+	}
+
+	moved := 0
+	for _, key := range legacy {
+		newKey := path.Join(owner, key)
+		if exists, err := storage.Exists(storage.Files, newKey); err != nil {
+			return moved, err
+		} else if exists {
+			log.Printf("Skipping %s: %s already exists", key, newKey)
+			continue
+		}
+
+		if err := storage.Files.Move(key, newKey); err != nil {
+			return moved, fmt.Errorf("error migrating %s: %w", key, err)
+		}
+		moved++
+
+		record, found, err := index.DB.Get("/" + key)
+		if err != nil {
+			return moved, err
+		}
+		if !found {
+			// Files missing from the index are picked up by the next reconcile
+			continue
+		}
+		record.Path = "/" + newKey
+		record.Owner = owner
+		if err := index.DB.Replace("/"+key, *record); err != nil {
+			return moved, err
+		}
 	}
 
-	log.Printf("Loaded %d existing file hashes", len(uploadedHashes))
+	return moved, nil
 }
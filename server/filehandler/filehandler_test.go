@@ -0,0 +1,777 @@
+package filehandler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"image-upload-server/capturedate"
+	"image-upload-server/config"
+	"image-upload-server/exif"
+	"image-upload-server/index"
+	"image-upload-server/sniff"
+	"image-upload-server/storage"
+	"image-upload-server/video"
+)
+
+// setupUploadRouter creates a router serving HandleUpload for the given
+// directory as the given user
+func setupUploadRouter(uploadsDir, username string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/upload", func(c *gin.Context) {
+		c.Set("username", username)
+		c.Next()
+	}, HandleUpload(uploadsDir))
+	return r
+}
+
+// newUploadRequest builds a multipart upload request with the given file content
+func newUploadRequest(t *testing.T, data []byte, fileName string) *http.Request {
+	return newUploadRequestWithField(t, "image", data, fileName)
+}
+
+// newUploadRequestWithField builds a multipart upload request sending the
+// file in the given form field
+func newUploadRequestWithField(t *testing.T, field string, data []byte, fileName string) *http.Request {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile(field, fileName)
+	assert.NoError(t, err)
+	_, err = part.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+// setupTestIndex points the global upload index at a fresh database
+func setupTestIndex(t *testing.T) {
+	db, err := index.Open(filepath.Join(t.TempDir(), "index.db"))
+	assert.NoError(t, err)
+	index.DB = db
+	t.Cleanup(func() { db.Close() })
+}
+
+// setupTestStorage stores the library in a temporary uploads directory,
+// which is returned
+func setupTestStorage(t *testing.T) string {
+	uploadsDir := t.TempDir()
+	previous := storage.Files
+	storage.Files = storage.NewLocal(uploadsDir)
+	t.Cleanup(func() { storage.Files = previous })
+	return uploadsDir
+}
+
+func TestHandleUploadStreamsToDisk(t *testing.T) {
+	setupTestIndex(t)
+	config.MaxUploadSize = config.MaxUploadSizeDefault
+	uploadsDir := setupTestStorage(t)
+	router := setupUploadRouter(uploadsDir, "tester")
+
+	data, err := os.ReadFile("../testdata/lena.jpeg")
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newUploadRequest(t, data, "Lena.JPEG"))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var response map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	relativePath, _ := response["path"].(string)
+	// The extension is taken from the content, not the file name
+	assert.Equal(t, ".jpg", filepath.Ext(relativePath))
+	assert.True(t, strings.HasPrefix(relativePath, "/tester/na/"), relativePath)
+
+	stored, err := os.ReadFile(filepath.Join(uploadsDir, relativePath))
+	assert.NoError(t, err)
+	assert.Equal(t, data, stored)
+
+	// No temporary files should be left behind
+	entries, err := os.ReadDir(filepath.Join(uploadsDir, tempDirName))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Uploading the same content again is reported as a duplicate
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newUploadRequest(t, data, "copy.jpg"))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	entries, err = os.ReadDir(filepath.Join(uploadsDir, tempDirName))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestHandleUploadRejectsLargeFiles(t *testing.T) {
+	setupTestIndex(t)
+	config.MaxUploadSize = 1024
+	defer func() { config.MaxUploadSize = config.MaxUploadSizeDefault }()
+
+	uploadsDir := setupTestStorage(t)
+	router := setupUploadRouter(uploadsDir, "tester")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newUploadRequest(t, bytes.Repeat([]byte{0xAB}, 4096), "big.jpg"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	entries, err := os.ReadDir(filepath.Join(uploadsDir, tempDirName))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+// pngHeader returns the start of a PNG image that declares the given
+// dimensions in its IHDR chunk, without any image data
+func pngHeader(width, height uint32) []byte {
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], width)
+	binary.BigEndian.PutUint32(ihdr[4:], height)
+	ihdr[8] = 8 // bit depth
+	ihdr[9] = 6 // RGBA
+
+	data := []byte("\x89PNG\r\n\x1a\n")
+	data = binary.BigEndian.AppendUint32(data, uint32(len(ihdr)))
+	chunk := append([]byte("IHDR"), ihdr...)
+	data = append(data, chunk...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(chunk))
+}
+
+func TestHandleUploadValidatesContent(t *testing.T) {
+	setupTestIndex(t)
+	config.MaxUploadSize = config.MaxUploadSizeDefault
+	uploadsDir := setupTestStorage(t)
+	router := setupUploadRouter(uploadsDir, "tester")
+
+	tests := []struct {
+		name     string
+		data     []byte
+		fileName string
+		status   int
+		code     string
+	}{
+		{"HTML named like an image", []byte("<!DOCTYPE html><html><script>alert(1)</script></html>"), "x.jpg", http.StatusUnsupportedMediaType, codeUnsupportedType},
+		{"Decompression bomb", pngHeader(60000, 60000), "bomb.png", http.StatusUnprocessableEntity, codeTooManyPixels},
+		{"Truncated JPEG", []byte("\xFF\xD8\xFF\xE0\x00\x10JFIF"), "broken.jpg", http.StatusUnprocessableEntity, codeInvalidImage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, newUploadRequest(t, tt.data, tt.fileName))
+			assert.Equal(t, tt.status, w.Code)
+
+			var response map[string]interface{}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, tt.code, response["code"])
+			assert.NotEmpty(t, response["error"])
+
+			_, found, err := index.DB.LookupOwned("tester", CalculateHash(tt.data))
+			assert.NoError(t, err)
+			assert.False(t, found)
+		})
+	}
+
+	// A PNG sent under a JPEG name is stored as what it is
+	data, err := os.ReadFile("../testdata/formats/screenshot.png")
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newUploadRequest(t, data, "screenshot.jpg"))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var response map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, ".png", filepath.Ext(response["path"].(string)))
+
+	// The pixel budget can be lowered
+	config.MaxImagePixels = 100
+	defer func() { config.MaxImagePixels = config.MaxImagePixelsDefault }()
+	data, err = os.ReadFile("../testdata/lena.jpeg")
+	assert.NoError(t, err)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newUploadRequest(t, data, "lena.jpg"))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	entries, err := os.ReadDir(filepath.Join(uploadsDir, tempDirName))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestCalculateFileHashMatchesCalculateHash(t *testing.T) {
+	data := []byte("streamed hashing")
+	path := filepath.Join(t.TempDir(), "file.bin")
+	assert.NoError(t, os.WriteFile(path, data, 0644))
+
+	hash, err := CalculateFileHash(path)
+	assert.NoError(t, err)
+	assert.Equal(t, CalculateHash(data), hash)
+}
+
+func TestReconcileIndexOnlyRehashesChangedFiles(t *testing.T) {
+	setupTestIndex(t)
+	uploadsDir := setupTestStorage(t)
+
+	keptPath := filepath.Join(uploadsDir, "2023", "04", "kept.jpg")
+	changedPath := filepath.Join(uploadsDir, "na", "changed.jpg")
+	removedPath := filepath.Join(uploadsDir, "na", "removed.jpg")
+	for _, path := range []string{keptPath, changedPath, removedPath} {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, os.WriteFile(path, []byte(path), 0644))
+	}
+	// Internal directories are not indexed
+	assert.NoError(t, os.MkdirAll(filepath.Join(uploadsDir, tempDirName), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(uploadsDir, tempDirName, "upload-1"), []byte("partial"), 0644))
+
+	assert.NoError(t, ReconcileIndex())
+	assert.Equal(t, 3, index.DB.Count())
+
+	// Mark the unchanged file so a rehash would be noticed
+	kept, found, err := index.DB.Get("/2023/04/kept.jpg")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	kept.Uploader = "tester"
+	kept.Hash = "not-rehashed"
+	assert.NoError(t, index.DB.Put(*kept))
+
+	assert.NoError(t, os.WriteFile(changedPath, []byte("new content"), 0644))
+	assert.NoError(t, os.Remove(removedPath))
+
+	assert.NoError(t, ReconcileIndex())
+	assert.Equal(t, 2, index.DB.Count())
+
+	kept, _, err = index.DB.Get("/2023/04/kept.jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, "not-rehashed", kept.Hash)
+
+	changed, found, err := index.DB.Get("/na/changed.jpg")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, CalculateHash([]byte("new content")), changed.Hash)
+
+	_, found, err = index.DB.Get("/na/removed.jpg")
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestReconcileIndexKeepsLookupsOfRemainingCopies(t *testing.T) {
+	setupTestIndex(t)
+	uploadsDir := setupTestStorage(t)
+
+	for _, name := range []string{"first.jpg", "second.jpg"} {
+		path := filepath.Join(uploadsDir, "alice", "na", name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, os.WriteFile(path, []byte("same content"), 0644))
+	}
+	assert.NoError(t, ReconcileIndex())
+
+	hash := CalculateHash([]byte("same content"))
+	record, found, err := index.DB.LookupOwned("alice", hash)
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	// Removing the copy the lookups point at leaves the other one findable
+	assert.NoError(t, os.Remove(filepath.Join(uploadsDir, filepath.FromSlash(record.Path))))
+	assert.NoError(t, ReconcileIndex())
+	assert.Equal(t, 1, index.DB.Count())
+	remaining, found, err := index.DB.LookupOwned("alice", hash)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.NotEqual(t, record.Path, remaining.Path)
+	remaining, found, err = index.DB.Lookup(hash)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.NotEqual(t, record.Path, remaining.Path)
+}
+
+func TestHandleUploadDeduplicatesPerUser(t *testing.T) {
+	setupTestIndex(t)
+	config.ShareIdenticalFiles = true
+	defer func() { config.ShareIdenticalFiles = false }()
+	uploadsDir := setupTestStorage(t)
+
+	data, err := os.ReadFile("../testdata/lena.jpeg")
+	assert.NoError(t, err)
+
+	upload := func(username string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		setupUploadRouter(uploadsDir, username).ServeHTTP(w, newUploadRequest(t, data, "lena.jpg"))
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+
+	code, alice := upload("alice")
+	assert.Equal(t, http.StatusCreated, code)
+
+	// Another user can store the same content without learning about alice
+	code, bob := upload("bob")
+	assert.Equal(t, http.StatusCreated, code)
+	bobPath, _ := bob["path"].(string)
+	assert.True(t, strings.HasPrefix(bobPath, "/bob/"), bobPath)
+	assert.NotContains(t, fmt.Sprint(bob), "alice")
+
+	// With sharing enabled both paths point at the same data on disk
+	aliceInfo, err := os.Stat(filepath.Join(uploadsDir, alice["path"].(string)))
+	assert.NoError(t, err)
+	bobInfo, err := os.Stat(filepath.Join(uploadsDir, bobPath))
+	assert.NoError(t, err)
+	assert.True(t, os.SameFile(aliceInfo, bobInfo))
+
+	// The same user uploading again gets their own path back
+	code, duplicate := upload("bob")
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Equal(t, bobPath, duplicate["path"])
+
+	// Usernames that can't be used as a directory are rejected
+	code, _ = upload("..")
+	assert.Equal(t, http.StatusForbidden, code)
+}
+
+func TestMigrateLegacyLayout(t *testing.T) {
+	setupTestIndex(t)
+	uploadsDir := setupTestStorage(t)
+
+	legacyPath := filepath.Join(uploadsDir, "2021", "07", "photo.jpg")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(legacyPath), 0755))
+	assert.NoError(t, os.WriteFile(legacyPath, []byte("legacy"), 0644))
+	assert.NoError(t, ReconcileIndex())
+
+	record, found, err := index.DB.Get("/2021/07/photo.jpg")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "", record.Owner)
+
+	moved, err := MigrateLegacyLayout("alice")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, moved)
+
+	_, err = os.Stat(filepath.Join(uploadsDir, "alice", "2021", "07", "photo.jpg"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(uploadsDir, "2021"))
+	assert.True(t, os.IsNotExist(err))
+
+	record, found, err = index.DB.LookupOwned("alice", CalculateHash([]byte("legacy")))
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "/alice/2021/07/photo.jpg", record.Path)
+}
+
+func TestHandleUploadStoresExifMetadata(t *testing.T) {
+	setupTestIndex(t)
+	config.MaxUploadSize = config.MaxUploadSizeDefault
+	uploadsDir := setupTestStorage(t)
+	router := setupUploadRouter(uploadsDir, "tester")
+
+	data, err := os.ReadFile("../testdata/exif_gps.jpg")
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newUploadRequest(t, data, "IMG_0001.JPG"))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var response struct {
+		Path string         `json:"path"`
+		Exif *exif.Metadata `json:"exif"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.True(t, strings.HasPrefix(response.Path, "/tester/2023/06/"), response.Path)
+	if assert.NotNil(t, response.Exif) {
+		assert.Equal(t, "Canon EOS R6", response.Exif.Model)
+		assert.Equal(t, "+02:00", response.Exif.OffsetTimeOriginal)
+		assert.NotNil(t, response.Exif.GPS)
+	}
+
+	record, found, err := index.DB.Get(response.Path)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, response.Exif, record.Exif)
+}
+
+func TestHandleUploadReadsHEICMetadata(t *testing.T) {
+	setupTestIndex(t)
+	config.MaxUploadSize = config.MaxUploadSizeDefault
+	uploadsDir := setupTestStorage(t)
+	router := setupUploadRouter(uploadsDir, "tester")
+
+	// Taken in Paris with iOS 11, which didn't record the time offset
+	data, err := os.ReadFile("../testdata/heic/ios11.heic")
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newUploadRequest(t, data, "IMG_0042.HEIC"))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var response struct {
+		Path string `json:"path"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.True(t, strings.HasPrefix(response.Path, "/tester/2018/03/"), response.Path)
+	assert.True(t, strings.HasSuffix(response.Path, ".heic"), response.Path)
+
+	record, found, err := index.DB.Get(response.Path)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 4032, record.Width)
+	assert.Equal(t, 3024, record.Height)
+	assert.Equal(t, "Europe/Paris", record.CaptureTimeZone)
+	assert.Equal(t, time.Date(2018, 3, 24, 13, 5, 33, 512_000_000, time.UTC), record.CaptureDateUTC)
+	if assert.NotNil(t, record.Exif) {
+		assert.Equal(t, "iPhone X", record.Exif.Model)
+	}
+}
+
+func TestHandleUploadReadsRawMetadata(t *testing.T) {
+	setupTestIndex(t)
+	config.MaxUploadSize = config.MaxUploadSizeDefault
+	uploadsDir := setupTestStorage(t)
+	router := setupUploadRouter(uploadsDir, "tester")
+
+	data, err := os.ReadFile("../testdata/raw/nikon.nef")
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newUploadRequest(t, data, "DSC_2231.NEF"))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var response struct {
+		Path string `json:"path"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.True(t, strings.HasPrefix(response.Path, "/tester/2021/07/"), response.Path)
+	assert.Equal(t, ".nef", filepath.Ext(response.Path))
+
+	record, found, err := index.DB.Get(response.Path)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, index.MediaImage, record.MediaType)
+	// The size of the embedded full-size preview
+	assert.Equal(t, 480, record.Width)
+	assert.Equal(t, 320, record.Height)
+	assert.Equal(t, "+02:00", record.CaptureTimeZone)
+	if assert.NotNil(t, record.Exif) {
+		assert.Equal(t, "NIKON Z 6_2", record.Exif.Model)
+		assert.Equal(t, "NIKKOR Z 24-70mm f/4 S", record.Exif.Lens)
+		assert.NotNil(t, record.Exif.GPS)
+	}
+}
+
+func TestHandleUploadReadsPNGAndWebPMetadata(t *testing.T) {
+	setupTestIndex(t)
+	config.MaxUploadSize = config.MaxUploadSizeDefault
+	uploadsDir := setupTestStorage(t)
+	router := setupUploadRouter(uploadsDir, "tester")
+
+	tests := []struct {
+		file          string
+		dir           string
+		zone          string
+		width, height int
+	}{
+		// Screenshots used to end up in na
+		{"screenshot.png", "/tester/2023/04/", "+02:00", 8, 6},
+		{"photo.webp", "/tester/2024/03/", "+01:00", 150, 100},
+	}
+
+	for _, tt := range tests {
+		data, err := os.ReadFile(filepath.Join("../testdata/formats", tt.file))
+		assert.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newUploadRequest(t, data, tt.file))
+		assert.Equal(t, http.StatusCreated, w.Code)
+
+		var response struct {
+			Path string `json:"path"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.True(t, strings.HasPrefix(response.Path, tt.dir), response.Path)
+
+		record, found, err := index.DB.Get(response.Path)
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, tt.zone, record.CaptureTimeZone, tt.file)
+		assert.Equal(t, "exif", record.CaptureDateResolver, tt.file)
+		assert.Equal(t, tt.width, record.Width, tt.file)
+		assert.Equal(t, tt.height, record.Height, tt.file)
+	}
+}
+
+func TestHandleUploadStoresVideoMetadata(t *testing.T) {
+	setupTestIndex(t)
+	config.MaxUploadSize = config.MaxUploadSizeDefault
+	config.MaxVideoUploadSize = config.MaxVideoUploadSizeDefault
+	uploadsDir := setupTestStorage(t)
+	router := setupUploadRouter(uploadsDir, "tester")
+
+	data, err := os.ReadFile("../testdata/video/iphone.mov")
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newUploadRequestWithField(t, "video", data, "IMG_0100.MOV"))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var response struct {
+		Path      string          `json:"path"`
+		MediaType string          `json:"media_type"`
+		TimeZone  string          `json:"time_zone"`
+		Video     *video.Metadata `json:"video"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.True(t, strings.HasPrefix(response.Path, "/tester/2023/10/"), response.Path)
+	assert.Equal(t, ".mov", filepath.Ext(response.Path))
+	assert.Equal(t, index.MediaVideo, response.MediaType)
+	assert.Equal(t, "+09:00", response.TimeZone)
+
+	record, found, err := index.DB.Get(response.Path)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, index.MediaVideo, record.MediaType)
+	assert.Equal(t, 1920, record.Width)
+	assert.Equal(t, 1080, record.Height)
+	assert.Equal(t, "video", record.CaptureDateResolver)
+	assert.Nil(t, record.Exif)
+	if assert.NotNil(t, record.Video) {
+		assert.Equal(t, 12.5, record.Video.Duration)
+		assert.Equal(t, "hvc1", record.Video.Codec)
+	}
+	assert.Equal(t, response.Video, record.Video)
+}
+
+func TestHandleUploadAppliesVideoSizeLimit(t *testing.T) {
+	setupTestIndex(t)
+	config.MaxUploadSize = 1024
+	config.MaxVideoUploadSize = 8192
+	defer func() {
+		config.MaxUploadSize = config.MaxUploadSizeDefault
+		config.MaxVideoUploadSize = config.MaxVideoUploadSizeDefault
+	}()
+	uploadsDir := setupTestStorage(t)
+	router := setupUploadRouter(uploadsDir, "tester")
+
+	// A video above the image limit is accepted
+	data, err := os.ReadFile("../testdata/video/android.mp4")
+	assert.NoError(t, err)
+	data = append(data, make([]byte, 4096)...)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newUploadRequestWithField(t, "file", data, "VID_20220820_160355.mp4"))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	// Other content can't use the video limit by claiming to be a video
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newUploadRequestWithField(t, "video", bytes.Repeat([]byte{0xAB}, 4096), "fake.mp4"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+
+	// Nor can a video exceed its own limit
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newUploadRequestWithField(t, "video", append(data, make([]byte, 8192)...), "long.mp4"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	entries, err := os.ReadDir(filepath.Join(uploadsDir, tempDirName))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestRefileByCaptureDate(t *testing.T) {
+	setupTestIndex(t)
+	uploadsDir := setupTestStorage(t)
+
+	// A photo taken in June that was filed under the wrong month
+	data, err := os.ReadFile("../testdata/exif_gps.jpg")
+	assert.NoError(t, err)
+	oldPath := filepath.Join(uploadsDir, "alice", "2023", "05", "photo.jpg")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(oldPath), 0755))
+	assert.NoError(t, os.WriteFile(oldPath, data, 0644))
+	assert.NoError(t, ReconcileIndex())
+
+	moved, err := RefileByCaptureDate()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, moved)
+
+	record, found, err := index.DB.LookupOwned("alice", CalculateHash(data))
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "/alice/2023/06/photo.jpg", record.Path)
+	assert.Equal(t, "+02:00", record.CaptureTimeZone)
+	assert.Equal(t, time.Date(2023, 6, 15, 16, 42, 7, 123_000_000, time.UTC), record.CaptureDateUTC)
+
+	_, err = os.Stat(filepath.Join(uploadsDir, "alice", "2023", "06", "photo.jpg"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(uploadsDir, "alice", "2023", "05"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Nothing left to do on a second run
+	moved, err = RefileByCaptureDate()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, moved)
+}
+
+func TestHandleUploadResolvesDateWithoutExif(t *testing.T) {
+	setupTestIndex(t)
+	config.MaxUploadSize = config.MaxUploadSizeDefault
+	uploadsDir := setupTestStorage(t)
+	router := setupUploadRouter(uploadsDir, "tester")
+
+	data, err := os.ReadFile("../testdata/lena.jpeg")
+	assert.NoError(t, err)
+
+	upload := func(fileName, lastModified string) map[string]interface{} {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("image", fileName)
+		assert.NoError(t, err)
+		part.Write(data)
+		writer.WriteField("lastModified", lastModified)
+		assert.NoError(t, writer.Close())
+
+		req := httptest.NewRequest(http.MethodPost, "/upload", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusCreated, w.Code)
+
+		var response map[string]interface{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	// The client's modification time is used when nothing better is known
+	response := upload("lena.jpg", "1618488000000")
+	assert.Equal(t, "last_modified", response["date_resolver"])
+	assert.Equal(t, "low", response["date_confidence"])
+	assert.True(t, strings.HasPrefix(response["path"].(string), "/tester/2021/04/"), response["path"])
+
+	// A timestamp in the file name is preferred
+	assert.NoError(t, index.DB.Remove(response["path"].(string)))
+	response = upload("IMG_20230415_123456.jpg", "1618488000000")
+	assert.Equal(t, "filename", response["date_resolver"])
+	assert.Equal(t, "medium", response["date_confidence"])
+	assert.True(t, strings.HasPrefix(response["path"].(string), "/tester/2023/04/"), response["path"])
+}
+
+func TestResolveUndated(t *testing.T) {
+	setupTestIndex(t)
+	uploadsDir := setupTestStorage(t)
+
+	undatedPath := filepath.Join(uploadsDir, "alice", "na", "photo.jpg")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(undatedPath), 0755))
+	assert.NoError(t, os.WriteFile(undatedPath, []byte("no metadata"), 0644))
+	assert.NoError(t, ReconcileIndex())
+
+	// Learn the name the file was uploaded under, as recorded for new uploads
+	record, found, err := index.DB.Get("/alice/na/photo.jpg")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.True(t, record.CaptureDate.IsZero())
+	record.OriginalName = "IMG-20220301-WA0007.jpg"
+	assert.NoError(t, index.DB.Put(*record))
+
+	moved, err := ResolveUndated()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, moved)
+
+	record, found, err = index.DB.Get("/alice/2022/03/photo.jpg")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "filename", record.CaptureDateResolver)
+	_, err = os.Stat(filepath.Join(uploadsDir, "alice", "2022", "03", "photo.jpg"))
+	assert.NoError(t, err)
+}
+
+func TestHandleUploadStacksPairs(t *testing.T) {
+	setupTestIndex(t)
+	config.MaxUploadSize = config.MaxUploadSizeDefault
+	config.MaxVideoUploadSize = config.MaxVideoUploadSizeDefault
+	uploadsDir := setupTestStorage(t)
+	router := setupUploadRouter(uploadsDir, "tester")
+
+	upload := func(field, name string) *index.Record {
+		data, err := os.ReadFile(filepath.Join("../testdata/stack", name))
+		assert.NoError(t, err)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newUploadRequestWithField(t, field, data, name))
+		assert.Equal(t, http.StatusCreated, w.Code)
+
+		var response struct {
+			Path string `json:"path"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		record, found, err := index.DB.Get(response.Path)
+		assert.NoError(t, err)
+		assert.True(t, found)
+		return record
+	}
+
+	// The video of a Live Photo usually arrives first
+	liveVideo := upload("video", "IMG_4211.MOV")
+	assert.Equal(t, "live:5A7F3E2C-9B41-4D8E-A6C2-3F1E0B9D7C44", liveVideo.PairKey)
+	assert.Equal(t, index.RoleLiveVideo, liveVideo.PairRole)
+	assert.False(t, liveVideo.Stacked)
+
+	livePhoto := upload("image", "IMG_4211.HEIC")
+	assert.Equal(t, liveVideo.PairKey, livePhoto.PairKey)
+	assert.Equal(t, index.RolePrimary, livePhoto.PairRole)
+	assert.True(t, livePhoto.Stacked)
+
+	members, err := index.DB.Stack("tester", livePhoto.PairKey)
+	assert.NoError(t, err)
+	assert.Len(t, members, 2)
+	for _, member := range members {
+		assert.True(t, member.Stacked, member.Path)
+	}
+
+	raw := upload("image", "IMG_0815.CR2")
+	assert.Equal(t, "raw:img_0815:20220903T110745", raw.PairKey)
+	assert.Equal(t, index.RoleRaw, raw.PairRole)
+	jpeg := upload("image", "IMG_0815.JPG")
+	assert.Equal(t, raw.PairKey, jpeg.PairKey)
+	assert.Equal(t, index.RolePrimary, jpeg.PairRole)
+
+	members, err = index.DB.Stack("tester", raw.PairKey)
+	assert.NoError(t, err)
+	assert.Len(t, members, 2)
+	for _, member := range members {
+		assert.True(t, member.Stacked, member.Path)
+	}
+
+	// A second JPEG with the same name and capture time makes the pair
+	// ambiguous, so nothing is stacked
+	other := *jpeg
+	other.Path = "/tester/2022/09/IMG_0815_1.JPG"
+	other.Hash = strings.Repeat("0", len(jpeg.Hash))
+	assert.NoError(t, index.DB.Put(other))
+	members, err = index.DB.Stack("tester", raw.PairKey)
+	assert.NoError(t, err)
+	assert.Len(t, members, 3)
+	for _, member := range members {
+		assert.False(t, member.Stacked, member.Path)
+	}
+}
+
+func TestSetPairKeyGivesRawRoleByContent(t *testing.T) {
+	record := &index.Record{
+		MediaType:           index.MediaImage,
+		OriginalName:        "IMG_0815.CR2",
+		CaptureDate:         time.Date(2022, 9, 3, 11, 7, 45, 0, time.UTC),
+		CaptureDateResolver: (capturedate.EXIF{}).Name(),
+	}
+
+	setPairKey(record, sniff.CR2)
+	assert.Equal(t, "raw:img_0815:20220903T110745", record.PairKey)
+	assert.Equal(t, index.RoleRaw, record.PairRole)
+
+	// A JPEG named like a RAW file is a rendered image
+	setPairKey(record, sniff.JPEG)
+	assert.Equal(t, "raw:img_0815:20220903T110745", record.PairKey)
+	assert.Equal(t, index.RolePrimary, record.PairRole)
+}
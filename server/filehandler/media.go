@@ -0,0 +1,47 @@
+package filehandler
+
+import (
+	"mime"
+	"path/filepath"
+	"strings"
+
+	"image-upload-server/config"
+)
+
+// uploadFields are the multipart form fields accepted as the uploaded file.
+// "image" is kept for existing clients.
+var uploadFields = map[string]bool{"image": true, "video": true, "file": true}
+
+// videoExtensions are the file extensions of the video formats recorded by
+// phones and cameras
+var videoExtensions = map[string]bool{".mp4": true, ".mov": true, ".m4v": true, ".3gp": true}
+
+// declaresVideo reports whether the client announced an upload as a video,
+// through the form field, the content type or the file name. The claim only
+// selects the size limit; it is checked against the content once received.
+func declaresVideo(fieldName, contentType, fileName string) bool {
+	if fieldName == "video" {
+		return true
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && strings.HasPrefix(mediaType, "video/") {
+		return true
+	}
+	return videoExtensions[strings.ToLower(filepath.Ext(fileName))]
+}
+
+// uploadLimit returns the maximum size of an upload
+func uploadLimit(isVideo bool) int64 {
+	if isVideo {
+		return config.MaxVideoUploadSize
+	}
+	return config.MaxUploadSize
+}
+
+// maxUploadLimit returns the larger of the image and video limits, which
+// bounds uploads whose type is not known yet
+func maxUploadLimit() int64 {
+	if config.MaxVideoUploadSize > config.MaxUploadSize {
+		return config.MaxVideoUploadSize
+	}
+	return config.MaxUploadSize
+}
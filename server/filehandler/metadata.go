@@ -0,0 +1,175 @@
+package filehandler
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	// Register decoders for reading image dimensions
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+
+	"image-upload-server/capturedate"
+	"image-upload-server/config"
+	"image-upload-server/exif"
+	"image-upload-server/index"
+	"image-upload-server/isobmff"
+	"image-upload-server/layout"
+	"image-upload-server/raw"
+	"image-upload-server/sniff"
+	"image-upload-server/storage"
+	"image-upload-server/video"
+)
+
+// metadataVersion is stored with every index record described by
+// describeFile. Bump it when describeFile learns to extract more, so that the
+// next reconcile refreshes existing records.
+const metadataVersion = 10
+
+// describeFile fills in the descriptive fields of an index record from the
+// file's content and the client details recorded in it. name is the path of
+// the file, whose base name may hold a timestamp. An error is returned when
+// no capture date was found; other details are filled in on a best-effort
+// basis.
+func describeFile(content io.ReaderAt, size int64, name string, record *index.Record) error {
+	record.MetadataVersion = metadataVersion
+
+	file := &capturedate.File{
+		Path:         name,
+		Content:      content,
+		Name:         record.OriginalName,
+		LastModified: record.ClientModTime,
+	}
+	var metadataErr error
+	if video.IsVideo(content, size) {
+		record.MediaType = index.MediaVideo
+		record.Exif = nil
+		record.Video, metadataErr = video.ExtractMetadataFromReaderAt(content, size)
+		if record.Video != nil {
+			record.Width = record.Video.Width
+			record.Height = record.Video.Height
+		}
+		file.Video = record.Video
+	} else {
+		record.MediaType = index.MediaImage
+		record.Video = nil
+		if width, height, err := extractDimensions(content, size); err == nil {
+			record.Width = width
+			record.Height = height
+		}
+		record.Exif, metadataErr = exif.ExtractMetadataFromReaderAt(content, size)
+		file.Exif = record.Exif
+	}
+
+	result, found := capturedate.DefaultChain.Resolve(file, config.DefaultTimeZone)
+	setCaptureDate(record, result)
+	kind, _ := sniff.Detect(content, size)
+	setPairKey(record, kind)
+	if !found {
+		if metadataErr != nil {
+			return fmt.Errorf("no capture date found: %v", metadataErr)
+		}
+		return fmt.Errorf("no capture date found")
+	}
+	return nil
+}
+
+// describeStored describes a file of the library
+func describeStored(key string, record *index.Record) error {
+	object, err := storage.Open(storage.Files, key)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+	return describeFile(object, object.Size, key, record)
+}
+
+// describeStaged describes an upload that was written to a temporary file
+func describeStaged(path string, record *index.Record) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return describeFile(file, info.Size(), path, record)
+}
+
+// setCaptureDate stores a resolved capture date in a record, or clears it
+// for a zero result
+func setCaptureDate(record *index.Record, result capturedate.Result) {
+	record.CaptureDate = result.Time
+	record.CaptureDateUTC = time.Time{}
+	if !result.Time.IsZero() {
+		record.CaptureDateUTC = result.Time.UTC()
+	}
+	record.CaptureTimeZone = result.Zone
+	record.CaptureTimeZoneSource = result.Source
+	record.CaptureDateResolver = result.Resolver
+	record.CaptureDateConfidence = string(result.Confidence)
+}
+
+// layoutDir returns the directory a file belongs in within its owner's
+// namespace under the storage layout, using slashes: by default YYYY/MM of
+// the local capture date, or na if undated
+func layoutDir(record *index.Record) string {
+	return path.Dir(layout.Current.Path(record, path.Ext(record.Path)))
+}
+
+// extractDimensions reads the pixel dimensions from the image header
+// without decoding the image. HEIF images, which the standard library
+// can't decode, report them in the ispe property of the primary item, and
+// RAW files are given the size of their largest embedded preview.
+func extractDimensions(file io.ReaderAt, size int64) (int, int, error) {
+	if isobmff.IsHEIF(file, size) {
+		heif, err := isobmff.ParseHEIF(file, size)
+		if err != nil {
+			return 0, 0, err
+		}
+		if heif.Width == 0 || heif.Height == 0 {
+			return 0, 0, fmt.Errorf("HEIF image has no size property")
+		}
+		return heif.Width, heif.Height, nil
+	}
+	if _, ok := raw.Detect(file, size); ok {
+		preview, err := raw.LargestPreview(file, size)
+		if err != nil {
+			return 0, 0, err
+		}
+		return preview.Width, preview.Height, nil
+	}
+
+	config, _, err := image.DecodeConfig(io.NewSectionReader(file, 0, size))
+	if err != nil {
+		return 0, 0, err
+	}
+	return config.Width, config.Height, nil
+}
+
+// parseClientTime parses a modification time sent by a client, either as
+// milliseconds since the epoch like JavaScript's File.lastModified or in
+// RFC 3339 format. It returns the zero time for empty or invalid values.
+func parseClientTime(value string) time.Time {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}
+	}
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil && millis > 0 {
+		return time.UnixMilli(millis)
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t
+	}
+	return time.Time{}
+}
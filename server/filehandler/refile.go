@@ -0,0 +1,102 @@
+package filehandler
+
+import (
+	"fmt"
+	"path"
+
+	"image-upload-server/index"
+	"image-upload-server/storage"
+)
+
+// RefileByCaptureDate moves files whose directory doesn't match the storage
+// layout for their indexed capture time, e.g. the YYYY/MM directory after
+// the time zone rules changed, and returns how many were moved. Files keep
+// their name. Undated files and files of the shared legacy layout are left
+// alone.
+func RefileByCaptureDate() (int, error) {
+	// Collect first: the index can't be written while it is being iterated
+	var misfiled []index.Record
+	err := index.DB.ForEach(func(record *index.Record) error {
+		if record.Owner == "" || record.CaptureDate.IsZero() {
+			return nil
+		}
+		if path.Dir(record.Path) != path.Join("/", record.Owner, layoutDir(record)) {
+			misfiled = append(misfiled, *record)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, record := range misfiled {
+		if err := moveRecord(record, refiledKey(&record)); err != nil {
+			return moved, fmt.Errorf("error refiling %s: %w", record.Path, err)
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// refiledKey returns the storage key of a file moved into the directory the
+// storage layout gives it, under the same name
+func refiledKey(record *index.Record) string {
+	return path.Join(record.Owner, layoutDir(record), path.Base(record.Path))
+}
+
+// moveRecord moves an indexed file to another key and updates its index
+// entry
+func moveRecord(record index.Record, newKey string) error {
+	oldKey := storage.Key(record.Path)
+	if exists, err := storage.Exists(storage.Files, newKey); err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("%s already exists", newKey)
+	}
+
+	if err := storage.Files.Move(oldKey, newKey); err != nil {
+		return err
+	}
+
+	oldRelative := record.Path
+	record.Path = "/" + newKey
+	// Object stores give the moved file a new modification time
+	if info, err := storage.Files.Stat(newKey); err == nil {
+		record.ModTime = info.ModTime
+	}
+	return index.DB.Replace(oldRelative, record)
+}
+
+// ResolveUndated runs the capture date resolvers again for the owners'
+// undated files and moves those that now have a date into the directory the
+// storage layout gives them. It returns how many files were moved.
+func ResolveUndated() (int, error) {
+	var undated []index.Record
+	err := index.DB.ForEach(func(record *index.Record) error {
+		if record.Owner != "" && record.CaptureDate.IsZero() {
+			undated = append(undated, *record)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, record := range undated {
+		if err := describeStored(storage.Key(record.Path), &record); err != nil {
+			// Still undated; keep the refreshed details
+			if err := index.DB.Put(record); err != nil {
+				return moved, err
+			}
+			continue
+		}
+
+		if err := moveRecord(record, refiledKey(&record)); err != nil {
+			return moved, fmt.Errorf("error refiling %s: %w", record.Path, err)
+		}
+		moved++
+	}
+	return moved, nil
+}
@@ -0,0 +1,108 @@
+package filehandler
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"image-upload-server/index"
+	"image-upload-server/layout"
+	"image-upload-server/storage"
+)
+
+// Move is a file that Reorganize moves, or would move in a dry run, as
+// index paths
+type Move struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Reorganize moves every user's indexed files to the paths the current
+// storage layout gives them and returns the moves, in the order they are
+// made. Paths that are taken get "-2", "-3" and so on appended to the name,
+// and a file whose path only differs from its layout path by such a suffix
+// stays where it is. With dryRun the moves are only planned.
+//
+// Each file's index entry is replaced right after it is moved, and files
+// already in place are skipped, so an interrupted run is resumed by running
+// it again. Files of the shared legacy layout are left alone.
+func Reorganize(dryRun bool) ([]Move, error) {
+	moves, records, err := planReorganize()
+	if err != nil || dryRun {
+		return moves, err
+	}
+
+	for i, move := range moves {
+		if err := moveRecord(records[i], storage.Key(move.To)); err != nil {
+			return moves[:i], fmt.Errorf("error moving %s: %w", move.From, err)
+		}
+	}
+	return moves, nil
+}
+
+// planReorganize returns the moves Reorganize makes and the records of the
+// files moved
+func planReorganize() ([]Move, []index.Record, error) {
+	// Paths of indexed files aren't free until the file moved away, which
+	// keeps the plan from depending on the order of the moves
+	taken := make(map[string]bool)
+	var records []index.Record
+	err := index.DB.ForEach(func(record *index.Record) error {
+		taken[record.Path] = true
+		if record.Owner != "" {
+			records = append(records, *record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var moves []Move
+	var moved []index.Record
+	for _, record := range records {
+		target := path.Join("/", record.Owner, layout.Current.Path(&record, path.Ext(record.Path)))
+		if isLayoutCandidate(record.Path, target) {
+			continue
+		}
+
+		to := ""
+		for n := 1; n <= maxPathCandidates && to == ""; n++ {
+			candidate := layout.WithSuffix(target, n)
+			if taken[candidate] {
+				continue
+			}
+			// Files missing from the index still occupy their path
+			if exists, err := storage.Exists(storage.Files, storage.Key(candidate)); err != nil {
+				return nil, nil, err
+			} else if exists {
+				continue
+			}
+			to = candidate
+		}
+		if to == "" {
+			return nil, nil, fmt.Errorf("no free path for %s after %d attempts", target, maxPathCandidates)
+		}
+
+		taken[to] = true
+		moves = append(moves, Move{From: record.Path, To: to})
+		moved = append(moved, record)
+	}
+	return moves, moved, nil
+}
+
+// isLayoutCandidate reports whether p is target, or target with a "-n"
+// suffix as given by layout.WithSuffix
+func isLayoutCandidate(p, target string) bool {
+	if p == target {
+		return true
+	}
+	ext := path.Ext(target)
+	prefix := strings.TrimSuffix(target, ext) + "-"
+	if !strings.HasPrefix(p, prefix) || !strings.HasSuffix(p, ext) {
+		return false
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(p, prefix), ext))
+	return err == nil && n >= 2 && layout.WithSuffix(target, n) == p
+}
@@ -0,0 +1,138 @@
+package filehandler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"image-upload-server/index"
+	"image-upload-server/layout"
+)
+
+// useLayout switches the storage layout for the duration of a test
+func useLayout(t *testing.T, dated, undated string) {
+	previous := layout.Current
+	require.NoError(t, layout.Init(dated, undated))
+	t.Cleanup(func() { layout.Current = previous })
+}
+
+func TestHandleUploadAvoidsPathCollisions(t *testing.T) {
+	setupTestIndex(t)
+	useLayout(t, "{year}/{original_name}{ext}", "undated/{original_name}{ext}")
+	uploadsDir := setupTestStorage(t)
+	router := setupUploadRouter(uploadsDir, "alice")
+
+	data, err := os.ReadFile("../testdata/exif_gps.jpg")
+	require.NoError(t, err)
+	var paths []string
+	for _, content := range [][]byte{data, append(append([]byte{}, data...), 0)} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newUploadRequest(t, content, "IMG_0001.JPG"))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		paths = append(paths, response["path"].(string))
+	}
+	assert.Equal(t, []string{"/alice/2023/IMG_0001.jpg", "/alice/2023/IMG_0001-2.jpg"}, paths)
+}
+
+func TestReorganize(t *testing.T) {
+	setupTestIndex(t)
+	uploadsDir := setupTestStorage(t)
+
+	// Two photos from the same month and an undated file in the default layout
+	data, err := os.ReadFile("../testdata/exif_gps.jpg")
+	require.NoError(t, err)
+	files := map[string][]byte{
+		"2023/06/1681568943783-aaaaaaaa.jpg": data,
+		"2023/06/1681568943784-bbbbbbbb.jpg": append(append([]byte{}, data...), 0),
+		"na/1681568943785-cccccccc.png":      mustReadFile(t, "../testdata/formats/screenshot.png"),
+	}
+	for name, content := range files {
+		path := filepath.Join(uploadsDir, "alice", filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, content, 0644))
+	}
+	require.NoError(t, ReconcileIndex())
+	screenshot, found, err := index.DB.Get("/alice/na/1681568943785-cccccccc.png")
+	require.NoError(t, err)
+	require.True(t, found)
+	screenshot.CaptureDate = time.Time{}
+	screenshot.OriginalName = "Screenshot.png"
+	require.NoError(t, index.DB.Put(*screenshot))
+
+	useLayout(t, "{year}/{month}/{day}/{original_name}{ext}", "undated/{original_name}{ext}")
+
+	// A dry run plans the moves without making them
+	planned, err := Reorganize(true)
+	require.NoError(t, err)
+	assert.Equal(t, []Move{
+		{From: "/alice/2023/06/1681568943783-aaaaaaaa.jpg", To: "/alice/2023/06/15/unnamed.jpg"},
+		{From: "/alice/2023/06/1681568943784-bbbbbbbb.jpg", To: "/alice/2023/06/15/unnamed-2.jpg"},
+		{From: "/alice/na/1681568943785-cccccccc.png", To: "/alice/undated/Screenshot.png"},
+	}, planned)
+	_, err = os.Stat(filepath.Join(uploadsDir, "alice", "2023", "06", "15"))
+	assert.True(t, os.IsNotExist(err))
+
+	moves, err := Reorganize(false)
+	require.NoError(t, err)
+	assert.Equal(t, planned, moves)
+	for _, move := range moves {
+		record, found, err := index.DB.Get(move.To)
+		require.NoError(t, err)
+		assert.True(t, found, move.To)
+		assert.Equal(t, "alice", record.Owner)
+		_, err = os.Stat(filepath.Join(uploadsDir, filepath.FromSlash(move.To)))
+		assert.NoError(t, err)
+	}
+	_, err = os.Stat(filepath.Join(uploadsDir, "alice", "na"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Everything is in place, so running again moves nothing
+	moves, err = Reorganize(false)
+	require.NoError(t, err)
+	assert.Empty(t, moves)
+}
+
+func TestReconcileKeepsDetailsOfMovedFiles(t *testing.T) {
+	setupTestIndex(t)
+	uploadsDir := setupTestStorage(t)
+
+	oldPath := filepath.Join(uploadsDir, "alice", "na", "photo.png")
+	require.NoError(t, os.MkdirAll(filepath.Dir(oldPath), 0755))
+	require.NoError(t, os.WriteFile(oldPath, mustReadFile(t, "../testdata/formats/screenshot.png"), 0644))
+	require.NoError(t, ReconcileIndex())
+	record, _, err := index.DB.Get("/alice/na/photo.png")
+	require.NoError(t, err)
+	record.OriginalName = "Screenshot.png"
+	record.Uploader = "alice"
+	require.NoError(t, index.DB.Put(*record))
+
+	// The file was moved, but its index entry was not updated
+	newPath := filepath.Join(uploadsDir, "alice", "undated", "Screenshot.png")
+	require.NoError(t, os.MkdirAll(filepath.Dir(newPath), 0755))
+	require.NoError(t, os.Rename(oldPath, newPath))
+	require.NoError(t, ReconcileIndex())
+
+	moved, found, err := index.DB.Get("/alice/undated/Screenshot.png")
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, "Screenshot.png", moved.OriginalName)
+	assert.Equal(t, "alice", moved.Uploader)
+	_, found, err = index.DB.Get("/alice/na/photo.png")
+	require.NoError(t, err)
+	assert.False(t, found)
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return data
+}
@@ -0,0 +1,84 @@
+package filehandler
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+
+	"image-upload-server/derivatives"
+	"image-upload-server/index"
+	"image-upload-server/storage"
+)
+
+// ReplaceContent stores new content for an indexed file, e.g. after its
+// metadata was rewritten, and returns its new index record. The file is
+// described again and moved into the directory the storage layout gives its
+// capture date under the same name, and its index entry is replaced, as the
+// content hash changes. Other files hard linked to the old content keep it.
+// If the owner already has the new content, index.ErrDuplicate is returned.
+func ReplaceContent(uploadsDir string, record index.Record, data []byte) (*index.Record, error) {
+	oldKey := storage.Key(record.Path)
+	oldRelative := record.Path
+
+	staged, err := stageUpload(uploadsDir, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	defer discardStaged(staged)
+	if staged.hash == record.Hash {
+		return &record, nil
+	}
+
+	_, found, err := index.DB.LookupOwned(record.Owner, staged.hash)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return nil, fmt.Errorf("%s: %w", record.Path, index.ErrDuplicate)
+	}
+
+	info, err := os.Stat(staged.path)
+	if err != nil {
+		return nil, err
+	}
+	record.Hash = staged.hash
+	record.Size = info.Size()
+	record.ModTime = info.ModTime()
+	if err := describeStaged(staged.path, &record); err != nil {
+		log.Printf("Failed to extract date from rewritten %s: %v", record.Path, err)
+	}
+
+	newKey := refiledKey(&record)
+	if newKey != oldKey {
+		if exists, err := storage.Exists(storage.Files, newKey); err != nil {
+			return nil, err
+		} else if exists {
+			return nil, fmt.Errorf("%s already exists", newKey)
+		}
+	}
+
+	// Storing over the old key swaps the content atomically; a file moving
+	// to another directory is written there before the old one is removed,
+	// so a crash leaves at least one copy
+	if err := storage.PutFile(storage.Files, newKey, staged.path); err != nil {
+		return nil, err
+	}
+	record.Path = "/" + newKey
+	if info, err := storage.Files.Stat(newKey); err == nil {
+		record.ModTime = info.ModTime
+	}
+	if err := index.DB.Replace(oldRelative, record); err != nil {
+		return nil, err
+	}
+	if newKey != oldKey {
+		if err := storage.Files.Delete(oldKey); err != nil {
+			log.Printf("Failed to remove %s after moving it: %v", oldKey, err)
+		}
+	}
+
+	if record.MediaType == index.MediaImage {
+		derivatives.Enqueue(record.Hash, newKey)
+	}
+	return &record, nil
+}
@@ -0,0 +1,40 @@
+package filehandler
+
+import (
+	"path/filepath"
+	"strings"
+
+	"image-upload-server/capturedate"
+	"image-upload-server/index"
+	"image-upload-server/sniff"
+)
+
+// setPairKey identifies the logical asset a file belongs to, so that the
+// index stacks it with the owner's other files of that asset:
+//   - the photo and video of an iPhone Live Photo share the content
+//     identifier from the Apple MakerNote and the QuickTime metadata
+//   - a RAW file and the in-camera JPEG share the original base name and
+//     the capture time recorded by the camera
+//
+// kind is the sniffed type of the file; only RAW content gets the RAW role,
+// whatever the file was called.
+func setPairKey(record *index.Record, kind sniff.Type) {
+	record.PairKey, record.PairRole = "", ""
+
+	switch {
+	case record.Exif != nil && record.Exif.ContentIdentifier != "":
+		record.PairKey = "live:" + strings.ToUpper(record.Exif.ContentIdentifier)
+		record.PairRole = index.RolePrimary
+	case record.Video != nil && record.Video.ContentIdentifier != "":
+		record.PairKey = "live:" + strings.ToUpper(record.Video.ContentIdentifier)
+		record.PairRole = index.RoleLiveVideo
+	case record.MediaType == index.MediaImage && record.OriginalName != "" && record.CaptureDateResolver == (capturedate.EXIF{}).Name():
+		name := filepath.Base(record.OriginalName)
+		ext := filepath.Ext(name)
+		record.PairKey = "raw:" + strings.ToLower(strings.TrimSuffix(name, ext)) + ":" + record.CaptureDate.Format("20060102T150405")
+		record.PairRole = index.RolePrimary
+		if kind.Kind == sniff.Raw {
+			record.PairRole = index.RoleRaw
+		}
+	}
+}
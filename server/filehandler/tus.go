@@ -0,0 +1,522 @@
+package filehandler
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"image-upload-server/config"
+	"image-upload-server/sniff"
+)
+
+// Resumable uploads implementing the tus 1.0 protocol (https://tus.io) with
+// the creation and termination extensions. Partial uploads are kept in a
+// staging directory inside the uploads directory and go through the same
+// pipeline as HandleUpload once the last byte has been received.
+
+const (
+	// TusVersion is the tus protocol version spoken by the server
+	TusVersion = "1.0.0"
+	// TusBasePath is the route under which tus uploads are created
+	TusBasePath = "/upload/tus"
+
+	stagingDirName = ".staging"
+	// Staged uploads that were not touched for this long are removed on startup
+	tusUploadTTL = 7 * 24 * time.Hour
+)
+
+// tusUpload is the persisted state of a resumable upload
+type tusUpload struct {
+	ID        string            `json:"id"`
+	Owner     string            `json:"owner"`
+	Length    int64             `json:"length"`
+	Offset    int64             `json:"offset"`
+	Metadata  map[string]string `json:"metadata"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// Per-upload locks so concurrent PATCH requests can't interleave writes
+var (
+	tusLocks   = make(map[string]*tusLock)
+	tusLocksMu sync.Mutex
+)
+
+// tusLock is the lock of one upload. refs counts the requests holding or
+// waiting for it, so it is only forgotten once none is left.
+type tusLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockTusUpload locks an upload that exists and belongs to the caller, so
+// requests for made up IDs never add to the locks
+func lockTusUpload(id string) func() {
+	tusLocksMu.Lock()
+	lock, exists := tusLocks[id]
+	if !exists {
+		lock = &tusLock{}
+		tusLocks[id] = lock
+	}
+	lock.refs++
+	tusLocksMu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		tusLocksMu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(tusLocks, id)
+		}
+		tusLocksMu.Unlock()
+	}
+}
+
+func stagingDir(uploadsDir string) string {
+	return filepath.Join(uploadsDir, stagingDirName)
+}
+
+func tusInfoPath(uploadsDir, id string) string {
+	return filepath.Join(stagingDir(uploadsDir), id+".json")
+}
+
+func tusDataPath(uploadsDir, id string) string {
+	return filepath.Join(stagingDir(uploadsDir), id+".bin")
+}
+
+// HandleTusOptions answers tus discovery requests
+func HandleTusOptions(c *gin.Context) {
+	c.Header("Tus-Resumable", TusVersion)
+	c.Header("Tus-Version", TusVersion)
+	c.Header("Tus-Extension", "creation,termination")
+	c.Header("Tus-Max-Size", strconv.FormatInt(maxUploadLimit(), 10))
+	c.Status(http.StatusNoContent)
+}
+
+// HandleTusCreate creates a new resumable upload (creation extension)
+func HandleTusCreate(uploadsDir string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if !checkTusResumable(c) {
+			return
+		}
+
+		length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+		if err != nil || length < 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Length header"})
+			return
+		}
+
+		metadata, err := parseTusMetadata(c.GetHeader("Upload-Metadata"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Metadata header"})
+			return
+		}
+
+		// Only uploads that turn out to be videos may use all of it, see
+		// tusChunkLimit
+		maxSize := maxUploadLimit()
+		if length > maxSize {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("File too large (max %dMB)", maxSize/(1024*1024))})
+			return
+		}
+
+		id, err := newTusID()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+			return
+		}
+
+		upload := &tusUpload{
+			ID:        id,
+			Owner:     c.GetString("username"),
+			Length:    length,
+			Metadata:  metadata,
+			CreatedAt: time.Now(),
+		}
+
+		if err := os.MkdirAll(stagingDir(uploadsDir), 0755); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+			return
+		}
+		data, err := os.OpenFile(tusDataPath(uploadsDir, id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+			return
+		}
+		data.Close()
+
+		if err := saveTusUpload(uploadsDir, upload); err != nil {
+			os.Remove(tusDataPath(uploadsDir, id))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+			return
+		}
+
+		c.Header("Tus-Resumable", TusVersion)
+		c.Header("Location", TusBasePath+"/"+id)
+		c.Header("Upload-Offset", "0")
+		c.Status(http.StatusCreated)
+	}
+}
+
+// HandleTusHead reports the current offset of a resumable upload
+func HandleTusHead(uploadsDir string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if !checkTusResumable(c) {
+			return
+		}
+
+		upload, ok := loadOwnedTusUpload(c, uploadsDir)
+		if !ok {
+			return
+		}
+
+		c.Header("Tus-Resumable", TusVersion)
+		c.Header("Cache-Control", "no-store")
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		if len(upload.Metadata) > 0 {
+			c.Header("Upload-Metadata", formatTusMetadata(upload.Metadata))
+		}
+		c.Status(http.StatusOK)
+	}
+}
+
+// HandleTusPatch appends a chunk to a resumable upload. When the upload is
+// complete the file is deduplicated, sorted by date and moved into place
+// exactly like a regular upload.
+func HandleTusPatch(uploadsDir string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if !checkTusResumable(c) {
+			return
+		}
+
+		if c.ContentType() != "application/offset+octet-stream" {
+			c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be application/offset+octet-stream"})
+			return
+		}
+
+		upload, unlock, ok := lockOwnedTusUpload(c, uploadsDir)
+		if !ok {
+			return
+		}
+		defer unlock()
+
+		offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Offset header"})
+			return
+		}
+		if offset != upload.Offset {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Upload-Offset does not match current offset"})
+			return
+		}
+
+		limit, err := tusChunkLimit(uploadsDir, upload)
+		if err != nil {
+			removeTusUpload(uploadsDir, upload.ID)
+			respondFinalizeError(c, err)
+			return
+		}
+
+		written, copyErr := appendTusChunk(tusDataPath(uploadsDir, upload.ID), c.Request.Body, limit)
+		upload.Offset += written
+
+		// Keep whatever was received even if the connection dropped midway
+		if err := saveTusUpload(uploadsDir, upload); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+			return
+		}
+		if copyErr != nil {
+			log.Printf("Resumable upload %s interrupted at offset %d: %v", upload.ID, upload.Offset, copyErr)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read upload", "message": copyErr.Error()})
+			return
+		}
+
+		c.Header("Tus-Resumable", TusVersion)
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+
+		if upload.Offset < upload.Length {
+			c.Status(http.StatusNoContent)
+			return
+		}
+
+		result, err := completeTusUpload(uploadsDir, upload)
+		if err != nil {
+			respondFinalizeError(c, err)
+			return
+		}
+
+		c.Header("Upload-Path", result.relativePath)
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// HandleTusDelete cancels a resumable upload (termination extension)
+func HandleTusDelete(uploadsDir string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if !checkTusResumable(c) {
+			return
+		}
+
+		upload, unlock, ok := lockOwnedTusUpload(c, uploadsDir)
+		if !ok {
+			return
+		}
+		defer unlock()
+
+		removeTusUpload(uploadsDir, upload.ID)
+
+		c.Header("Tus-Resumable", TusVersion)
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// completeTusUpload hashes a fully received upload and finalizes it
+func completeTusUpload(uploadsDir string, upload *tusUpload) (*uploadResult, error) {
+	dataPath := tusDataPath(uploadsDir, upload.ID)
+
+	staged := &stagedFile{path: dataPath, size: upload.Length}
+	if err := validateStaged(staged); err != nil {
+		removeTusUpload(uploadsDir, upload.ID)
+		return nil, err
+	}
+
+	hash, err := CalculateFileHash(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	staged.hash = hash
+
+	result, err := finalizeUpload(uploadsDir, staged, tusFilename(upload.Metadata), parseClientTime(upload.Metadata["lastModified"]), upload.Owner)
+
+	// The data file has either been moved into place or is no longer needed
+	removeTusUpload(uploadsDir, upload.ID)
+
+	return result, err
+}
+
+// appendTusChunk appends at most limit bytes from r to the staged data file
+// and returns the number of bytes that made it to disk.
+func appendTusChunk(path string, r io.Reader, limit int64) (int64, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	written, err := io.Copy(file, io.LimitReader(r, limit))
+	if syncErr := file.Sync(); err == nil {
+		err = syncErr
+	}
+	return written, err
+}
+
+// checkTusResumable verifies the client speaks a supported protocol version
+func checkTusResumable(c *gin.Context) bool {
+	if c.GetHeader("Tus-Resumable") != TusVersion {
+		c.Header("Tus-Version", TusVersion)
+		c.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{"error": "Unsupported tus version"})
+		return false
+	}
+	return true
+}
+
+// loadOwnedTusUpload loads the upload named in the URL, answering 404 if it
+// does not exist or belongs to another user.
+func loadOwnedTusUpload(c *gin.Context, uploadsDir string) (*tusUpload, bool) {
+	id := c.Param("id")
+	upload, err := loadTusUpload(uploadsDir, id)
+	if err != nil || upload.Owner != c.GetString("username") {
+		c.Header("Tus-Resumable", TusVersion)
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return nil, false
+	}
+	return upload, true
+}
+
+// lockOwnedTusUpload loads the upload named in the URL like
+// loadOwnedTusUpload and locks it. The upload is loaded again once the lock
+// is held, as another request may have changed or removed it meanwhile.
+func lockOwnedTusUpload(c *gin.Context, uploadsDir string) (*tusUpload, func(), bool) {
+	upload, ok := loadOwnedTusUpload(c, uploadsDir)
+	if !ok {
+		return nil, nil, false
+	}
+	unlock := lockTusUpload(upload.ID)
+	upload, ok = loadOwnedTusUpload(c, uploadsDir)
+	if !ok {
+		unlock()
+		return nil, nil, false
+	}
+	return upload, unlock, true
+}
+
+// tusChunkLimit returns the number of bytes the upload may receive next.
+// Whatever the client declared, uploads are held to the image limit until
+// the data received so far shows they are videos; errFileTooLarge means
+// the upload reached the image limit without doing so.
+func tusChunkLimit(uploadsDir string, upload *tusUpload) (int64, error) {
+	remaining := upload.Length - upload.Offset
+	if upload.Length <= config.MaxUploadSize {
+		return remaining, nil
+	}
+
+	file, err := os.Open(tusDataPath(uploadsDir, upload.ID))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if kind, ok := sniff.Detect(file, upload.Offset); ok && kind.Kind == sniff.Video {
+		return remaining, nil
+	}
+
+	if upload.Offset >= config.MaxUploadSize {
+		return 0, errFileTooLarge
+	}
+	return config.MaxUploadSize - upload.Offset, nil
+}
+
+func loadTusUpload(uploadsDir, id string) (*tusUpload, error) {
+	if !isValidTusID(id) {
+		return nil, os.ErrNotExist
+	}
+
+	data, err := os.ReadFile(tusInfoPath(uploadsDir, id))
+	if err != nil {
+		return nil, err
+	}
+
+	upload := &tusUpload{}
+	if err := json.Unmarshal(data, upload); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// saveTusUpload writes the upload state atomically
+func saveTusUpload(uploadsDir string, upload *tusUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+
+	infoPath := tusInfoPath(uploadsDir, upload.ID)
+	tmpPath := infoPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, infoPath)
+}
+
+// removeTusUpload deletes the staged files of an upload. The caller holds
+// the upload's lock, which forgets itself once released.
+func removeTusUpload(uploadsDir, id string) {
+	for _, path := range []string{tusDataPath(uploadsDir, id), tusInfoPath(uploadsDir, id)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove staged upload file %s: %v", path, err)
+		}
+	}
+}
+
+// CleanupStaleTusUploads removes resumable uploads that were abandoned
+func CleanupStaleTusUploads(uploadsDir string) {
+	entries, err := os.ReadDir(stagingDir(uploadsDir))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading staging directory: %v", err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		if id == entry.Name() {
+			continue
+		}
+		removeStaleTusUpload(uploadsDir, id)
+	}
+}
+
+// removeStaleTusUpload removes an upload unless it was touched within the
+// TTL. It holds the upload's lock, so a PATCH in progress is never cut off.
+func removeStaleTusUpload(uploadsDir, id string) {
+	unlock := lockTusUpload(id)
+	defer unlock()
+
+	info, err := os.Stat(tusDataPath(uploadsDir, id))
+	if err == nil && time.Since(info.ModTime()) < tusUploadTTL {
+		return
+	}
+	log.Printf("Removing stale resumable upload %s", id)
+	removeTusUpload(uploadsDir, id)
+}
+
+func newTusID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func isValidTusID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// parseTusMetadata decodes an Upload-Metadata header ("key base64value,...")
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		switch len(fields) {
+		case 1:
+			metadata[fields[0]] = ""
+		case 2:
+			value, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, err
+			}
+			metadata[fields[0]] = string(value)
+		default:
+			return nil, fmt.Errorf("invalid metadata pair %q", pair)
+		}
+	}
+	return metadata, nil
+}
+
+func formatTusMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for key, value := range metadata {
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(value)))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// tusFilename returns the original file name sent by the client, if any
+func tusFilename(metadata map[string]string) string {
+	if name := metadata["filename"]; name != "" {
+		return name
+	}
+	return metadata["name"]
+}
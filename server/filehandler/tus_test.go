@@ -0,0 +1,266 @@
+package filehandler
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"image-upload-server/config"
+)
+
+// setupTusRouter creates a router serving the tus handlers as the given user
+func setupTusRouter(uploadsDir, username string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("username", username)
+		c.Next()
+	})
+	r.POST(TusBasePath, HandleTusCreate(uploadsDir))
+	r.HEAD(TusBasePath+"/:id", HandleTusHead(uploadsDir))
+	r.PATCH(TusBasePath+"/:id", HandleTusPatch(uploadsDir))
+	r.DELETE(TusBasePath+"/:id", HandleTusDelete(uploadsDir))
+	return r
+}
+
+func tusRequest(method, url string, body []byte, headers map[string]string) *http.Request {
+	req := httptest.NewRequest(method, url, bytes.NewReader(body))
+	req.Header.Set("Tus-Resumable", TusVersion)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	return req
+}
+
+func patchChunk(router *gin.Engine, location string, offset int, chunk []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, tusRequest(http.MethodPatch, location, chunk, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.Itoa(offset),
+	}))
+	return w
+}
+
+func TestTusUploadInChunks(t *testing.T) {
+	setupTestIndex(t)
+	config.MaxUploadSize = config.MaxUploadSizeDefault
+	uploadsDir := setupTestStorage(t)
+	router := setupTusRouter(uploadsDir, "tester")
+
+	data, err := os.ReadFile("../testdata/lena.jpeg")
+	assert.NoError(t, err)
+
+	// Create the upload
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, tusRequest(http.MethodPost, TusBasePath, nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(len(data)),
+		"Upload-Metadata": "filename bGVuYS5qcGVn",
+	}))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	location := w.Header().Get("Location")
+	assert.NotEmpty(t, location)
+
+	// Send the first half
+	half := len(data) / 2
+	w = patchChunk(router, location, 0, data[:half])
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, strconv.Itoa(half), w.Header().Get("Upload-Offset"))
+
+	// A chunk at the wrong offset is rejected
+	w = patchChunk(router, location, 0, data[:half])
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// Another user can't see the upload
+	w = httptest.NewRecorder()
+	setupTusRouter(uploadsDir, "intruder").ServeHTTP(w, tusRequest(http.MethodHead, location, nil, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// HEAD reports where to resume
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, tusRequest(http.MethodHead, location, nil, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, strconv.Itoa(half), w.Header().Get("Upload-Offset"))
+	assert.Equal(t, strconv.Itoa(len(data)), w.Header().Get("Upload-Length"))
+
+	// Send the rest, which completes the upload
+	w = patchChunk(router, location, half, data[half:])
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	relativePath := w.Header().Get("Upload-Path")
+	assert.Equal(t, ".jpg", filepath.Ext(relativePath))
+	assert.Equal(t, "/tester/na", filepath.Dir(relativePath))
+
+	stored, err := os.ReadFile(filepath.Join(uploadsDir, relativePath))
+	assert.NoError(t, err)
+	assert.Equal(t, data, stored)
+
+	// The staging area is cleaned up
+	entries, err := os.ReadDir(stagingDir(uploadsDir))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestTusRejectsUnsupportedContent(t *testing.T) {
+	setupTestIndex(t)
+	config.MaxUploadSize = config.MaxUploadSizeDefault
+	uploadsDir := setupTestStorage(t)
+	router := setupTusRouter(uploadsDir, "tester")
+
+	data := []byte("<html><body>not a photo</body></html>")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, tusRequest(http.MethodPost, TusBasePath, nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(len(data)),
+		"Upload-Metadata": "filename cGhvdG8uanBn",
+	}))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	location := w.Header().Get("Location")
+
+	w = patchChunk(router, location, 0, data)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	assert.Contains(t, w.Body.String(), codeUnsupportedType)
+
+	// The rejected upload is gone
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, tusRequest(http.MethodHead, location, nil, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestTusAppliesVideoSizeLimit(t *testing.T) {
+	setupTestIndex(t)
+	config.MaxUploadSize = 1024
+	config.MaxVideoUploadSize = 8192
+	defer func() {
+		config.MaxUploadSize = config.MaxUploadSizeDefault
+		config.MaxVideoUploadSize = config.MaxVideoUploadSizeDefault
+	}()
+	uploadsDir := setupTestStorage(t)
+	router := setupTusRouter(uploadsDir, "tester")
+
+	create := func(length int, metadata string) string {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, tusRequest(http.MethodPost, TusBasePath, nil, map[string]string{
+			"Upload-Length":   strconv.Itoa(length),
+			"Upload-Metadata": metadata,
+		}))
+		assert.Equal(t, http.StatusCreated, w.Code)
+		return w.Header().Get("Location")
+	}
+
+	// Claiming to be a video only gets other content as far as the image limit
+	fake := bytes.Repeat([]byte{0xAB}, 4096)
+	location := create(len(fake), "filename ZmFrZS5tcDQ=,filetype dmlkZW8vbXA0")
+	w := patchChunk(router, location, 0, fake)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "1024", w.Header().Get("Upload-Offset"))
+	w = patchChunk(router, location, 1024, fake[1024:])
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, tusRequest(http.MethodHead, location, nil, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// A video goes on once its content shows it is one
+	data, err := os.ReadFile("../testdata/video/android.mp4")
+	assert.NoError(t, err)
+	data = append(data, make([]byte, 4096)...)
+	location = create(len(data), "filename VklEXzIwMjIwODIwXzE2MDM1NS5tcDQ=")
+	w = patchChunk(router, location, 0, data)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "1024", w.Header().Get("Upload-Offset"))
+	w = patchChunk(router, location, 1024, data[1024:])
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, ".mp4", filepath.Ext(w.Header().Get("Upload-Path")))
+
+	// Nor can anything exceed the video limit
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, tusRequest(http.MethodPost, TusBasePath, nil, map[string]string{"Upload-Length": "8193"}))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
+
+func TestTusLocksOnlyOwnedUploads(t *testing.T) {
+	uploadsDir := setupTestStorage(t)
+	router := setupTusRouter(uploadsDir, "tester")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, tusRequest(http.MethodPost, TusBasePath, nil, map[string]string{"Upload-Length": "10"}))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	location := w.Header().Get("Location")
+
+	// Made up IDs and other users' uploads are turned away before locking
+	w = patchChunk(router, TusBasePath+"/0123456789abcdef0123456789abcdef", 0, []byte("x"))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	setupTusRouter(uploadsDir, "intruder").ServeHTTP(w, tusRequest(http.MethodDelete, location, nil, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = patchChunk(router, location, 0, []byte("12345"))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	// Locks are forgotten once released
+	tusLocksMu.Lock()
+	assert.Empty(t, tusLocks)
+	tusLocksMu.Unlock()
+}
+
+func TestTusTermination(t *testing.T) {
+	uploadsDir := setupTestStorage(t)
+	router := setupTusRouter(uploadsDir, "tester")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, tusRequest(http.MethodPost, TusBasePath, nil, map[string]string{"Upload-Length": "10"}))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	location := w.Header().Get("Location")
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, tusRequest(http.MethodDelete, location, nil, nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, tusRequest(http.MethodHead, location, nil, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestCleanupStaleTusUploads(t *testing.T) {
+	uploadsDir := setupTestStorage(t)
+	router := setupTusRouter(uploadsDir, "tester")
+
+	create := func() string {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, tusRequest(http.MethodPost, TusBasePath, nil, map[string]string{"Upload-Length": "10"}))
+		assert.Equal(t, http.StatusCreated, w.Code)
+		return w.Header().Get("Location")
+	}
+	stale, fresh := create(), create()
+	abandoned := time.Now().Add(-tusUploadTTL - time.Hour)
+	assert.NoError(t, os.Chtimes(tusDataPath(uploadsDir, filepath.Base(stale)), abandoned, abandoned))
+
+	CleanupStaleTusUploads(uploadsDir)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, tusRequest(http.MethodHead, stale, nil, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, tusRequest(http.MethodHead, fresh, nil, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	tusLocksMu.Lock()
+	assert.Empty(t, tusLocks)
+	tusLocksMu.Unlock()
+}
+
+func TestTusRejectsUnsupportedVersion(t *testing.T) {
+	router := setupTusRouter(t.TempDir(), "tester")
+
+	req := httptest.NewRequest(http.MethodPost, TusBasePath, nil)
+	req.Header.Set("Tus-Resumable", "0.2.2")
+	req.Header.Set("Upload-Length", "10")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+}
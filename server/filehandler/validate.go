@@ -0,0 +1,82 @@
+package filehandler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"image-upload-server/config"
+	"image-upload-server/raw"
+	"image-upload-server/sniff"
+)
+
+// Error codes returned with rejected uploads, so clients can tell the
+// reasons apart without parsing messages
+const (
+	codeFileTooLarge    = "file_too_large"
+	codeUnsupportedType = "unsupported_media_type"
+	codeInvalidImage    = "invalid_image"
+	codeTooManyPixels   = "image_dimensions_too_large"
+)
+
+// validationError rejects an upload whose content isn't acceptable
+type validationError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *validationError) Error() string {
+	return e.message
+}
+
+// validateStaged checks the content of a staged file before it is stored:
+// its format must be on the allowlist of the sniff package, files other
+// than videos must fit in the limit for images and images must declare
+// dimensions within the pixel budget. Only headers are read, nothing is
+// decoded. The detected type is recorded in staged.
+func validateStaged(staged *stagedFile) error {
+	file, err := os.Open(staged.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	kind, ok := sniff.Detect(file, staged.size)
+	if !ok {
+		return &validationError{
+			status:  http.StatusUnsupportedMediaType,
+			code:    codeUnsupportedType,
+			message: "File type not supported. Upload JPEG, PNG, GIF, WebP, HEIF, camera RAW, MP4 or QuickTime files.",
+		}
+	}
+	if kind.Kind != sniff.Video && staged.size > config.MaxUploadSize {
+		return errFileTooLarge
+	}
+	staged.kind = kind
+	if kind.Kind == sniff.Video {
+		return nil
+	}
+
+	width, height, err := extractDimensions(file, staged.size)
+	if kind.Kind == sniff.Raw && errors.Is(err, raw.ErrNoPreview) {
+		// The sensor data is never decoded, so there is nothing to check
+		return nil
+	}
+	if err != nil || width <= 0 || height <= 0 {
+		return &validationError{
+			status:  http.StatusUnprocessableEntity,
+			code:    codeInvalidImage,
+			message: fmt.Sprintf("File is not a valid %s image", kind.MIME),
+		}
+	}
+	if int64(width)*int64(height) > config.MaxImagePixels {
+		return &validationError{
+			status:  http.StatusUnprocessableEntity,
+			code:    codeTooManyPixels,
+			message: fmt.Sprintf("Image dimensions %dx%d exceed the limit of %d megapixels", width, height, config.MaxImagePixels/1_000_000),
+		}
+	}
+	return nil
+}
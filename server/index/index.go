@@ -0,0 +1,640 @@
+package index
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"image-upload-server/exif"
+	"image-upload-server/video"
+)
+
+var (
+	// filesBucket maps a relative file path to its JSON encoded Record
+	filesBucket = []byte("files")
+	// hashesBucket maps a content hash to the relative path of a file holding
+	// it, regardless of owner
+	hashesBucket = []byte("hashes")
+	// ownedBucket maps owner + "\x00" + content hash to the relative path of
+	// the owner's file holding it
+	ownedBucket = []byte("owned")
+	// byOwnerBucket orders each owner's files by capture date; keys are
+	// owner + "\x00" + capture date + "\x00" + relative path
+	byOwnerBucket = []byte("by_owner")
+	// pairsBucket groups the files of one logical asset; keys are owner +
+	// "\x00" + pair key + "\x00" + relative path
+	pairsBucket = []byte("pairs")
+	// metaBucket holds bookkeeping values such as the schema version
+	metaBucket = []byte("meta")
+)
+
+// schemaVersion is bumped whenever the lookup buckets change shape; they are
+// rebuilt from the files bucket when an older version is opened
+const schemaVersion = "4"
+
+// Media types of indexed files
+const (
+	MediaImage = "image"
+	MediaVideo = "video"
+)
+
+// Roles of a file within a logical asset made of several files
+const (
+	// RolePrimary is the file shown in the library, e.g. the photo of a
+	// Live Photo or the JPEG of a RAW+JPEG pair
+	RolePrimary = "primary"
+	// RoleLiveVideo is the video of a Live Photo
+	RoleLiveVideo = "live_video"
+	// RoleRaw is the RAW file of a RAW+JPEG pair
+	RoleRaw = "raw"
+)
+
+var (
+	// ErrDuplicate is returned by Claim when the content is already indexed
+	ErrDuplicate = errors.New("content already indexed")
+	// ErrPathTaken is returned by Claim when another file has the path
+	ErrPathTaken = errors.New("path already indexed")
+)
+
+var (
+	// DB is the global upload index
+	DB *Index
+)
+
+// Record describes a single file stored in the uploads directory
+type Record struct {
+	Hash     string    `json:"hash"`
+	Path     string    `json:"path"`
+	Owner    string    `json:"owner"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Uploader string    `json:"uploader,omitempty"`
+	// CaptureDate is in the time zone the file was captured in, so its year
+	// and month are the ones the file is filed under
+	CaptureDate    time.Time `json:"capture_date"`
+	CaptureDateUTC time.Time `json:"capture_date_utc"`
+	// CaptureTimeZone names the zone of CaptureDate and CaptureTimeZoneSource
+	// tells how it was found (see exif.ZoneFromOffset and friends)
+	CaptureTimeZone       string `json:"capture_time_zone,omitempty"`
+	CaptureTimeZoneSource string `json:"capture_time_zone_source,omitempty"`
+	// CaptureDateResolver names the capturedate resolver that found the
+	// capture date and CaptureDateConfidence how far it can be trusted
+	CaptureDateResolver   string `json:"capture_date_resolver,omitempty"`
+	CaptureDateConfidence string `json:"capture_date_confidence,omitempty"`
+	// OriginalName and ClientModTime are the file name and modification time
+	// reported by the client, kept to resolve the capture date again later
+	OriginalName  string    `json:"original_name,omitempty"`
+	ClientModTime time.Time `json:"client_mod_time,omitempty"`
+	UploadedAt    time.Time `json:"uploaded_at"`
+	Width         int       `json:"width,omitempty"`
+	Height        int       `json:"height,omitempty"`
+	// MediaType is MediaImage or MediaVideo
+	MediaType string `json:"media_type,omitempty"`
+	// Exif holds the camera metadata, nil for files without EXIF data
+	Exif *exif.Metadata `json:"exif,omitempty"`
+	// Video holds the duration, codec and other metadata of videos
+	Video *video.Metadata `json:"video,omitempty"`
+	// PairKey identifies the logical asset the file belongs to together with
+	// the owner's other files with the same key, e.g. by the content
+	// identifier of a Live Photo. PairRole is the file's role in it.
+	PairKey  string `json:"pair_key,omitempty"`
+	PairRole string `json:"pair_role,omitempty"`
+	// Stacked is maintained by the index: it is set while the owner has
+	// exactly one other file with the same PairKey and exactly one of the
+	// two is RolePrimary
+	Stacked bool `json:"stacked,omitempty"`
+	// MetadataVersion records which version of the metadata extraction filled
+	// in the descriptive fields, so older records can be refreshed
+	MetadataVersion int `json:"metadata_version,omitempty"`
+}
+
+// ListQuery selects a page of an owner's files, ordered by capture date with
+// undated files first
+type ListQuery struct {
+	Owner string
+	// Cursor is the value returned as next cursor by the previous page
+	Cursor     string
+	Limit      int
+	Descending bool
+	// Filter, if set, decides which records are included
+	Filter func(record *Record) bool
+}
+
+// Index is a persistent content-hash index of the uploads directory, stored
+// in an embedded bbolt database
+type Index struct {
+	db *bolt.DB
+}
+
+// InitIndex opens the upload index in the data directory
+func InitIndex(dataDir string) error {
+	dbPath := filepath.Join(dataDir, "index.db")
+	var err error
+	DB, err = Open(dbPath)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Upload index initialized at %s", dbPath)
+	return nil
+}
+
+// Open opens or creates the index database at path. The index holds the
+// paths and metadata, GPS positions included, of every user's files, so only
+// the server may read the file.
+func Open(path string) (*Index, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening upload index: %w", err)
+	}
+	// Indexes created before were readable by everyone
+	if err := os.Chmod(path, 0600); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error opening upload index: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{filesBucket, hashesBucket, ownedBucket, byOwnerBucket, pairsBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		meta := tx.Bucket(metaBucket)
+		if string(meta.Get([]byte("version"))) == schemaVersion {
+			return nil
+		}
+		if err := rebuildLookups(tx); err != nil {
+			return err
+		}
+		return meta.Put([]byte("version"), []byte(schemaVersion))
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error initializing upload index: %w", err)
+	}
+
+	return &Index{db: db}, nil
+}
+
+// Close closes the underlying database
+func (idx *Index) Close() error {
+	return idx.db.Close()
+}
+
+// Lookup returns a record holding the given content hash, owned by anyone
+func (idx *Index) Lookup(hash string) (*Record, bool, error) {
+	var record *Record
+	err := idx.db.View(func(tx *bolt.Tx) error {
+		path := tx.Bucket(hashesBucket).Get([]byte(hash))
+		if path == nil {
+			return nil
+		}
+		var err error
+		record, err = getRecord(tx, path)
+		return err
+	})
+	return record, record != nil, err
+}
+
+// LookupOwned returns the owner's record holding the given content hash
+func (idx *Index) LookupOwned(owner, hash string) (*Record, bool, error) {
+	var record *Record
+	err := idx.db.View(func(tx *bolt.Tx) error {
+		path := tx.Bucket(ownedBucket).Get(ownedKey(owner, hash))
+		if path == nil {
+			return nil
+		}
+		var err error
+		record, err = getRecord(tx, path)
+		return err
+	})
+	return record, record != nil, err
+}
+
+// Get returns the record for a relative path
+func (idx *Index) Get(path string) (*Record, bool, error) {
+	var record *Record
+	err := idx.db.View(func(tx *bolt.Tx) error {
+		var err error
+		record, err = getRecord(tx, []byte(path))
+		return err
+	})
+	return record, record != nil, err
+}
+
+// Stack returns the owner's files sharing a pair key, in path order
+func (idx *Index) Stack(owner, pairKey string) ([]Record, error) {
+	var records []Record
+	err := idx.db.View(func(tx *bolt.Tx) error {
+		var err error
+		records, err = stackMembers(tx, owner, pairKey)
+		return err
+	})
+	return records, err
+}
+
+// Claim atomically checks that the owner of record does not have its content
+// hash indexed yet and inserts the record. If the owner already has the
+// content, their existing record is returned together with ErrDuplicate; if
+// another file has the path, ErrPathTaken is returned. Because bbolt
+// serializes writers, two concurrent claims for the same content or path
+// can't both succeed.
+func (idx *Index) Claim(record Record) (*Record, error) {
+	var existing *Record
+	err := idx.db.Update(func(tx *bolt.Tx) error {
+		if path := tx.Bucket(ownedBucket).Get(ownedKey(record.Owner, record.Hash)); path != nil {
+			var err error
+			existing, err = getRecord(tx, path)
+			if err != nil {
+				return err
+			}
+			if existing != nil {
+				return ErrDuplicate
+			}
+		}
+		if tx.Bucket(filesBucket).Get([]byte(record.Path)) != nil {
+			return ErrPathTaken
+		}
+		return putRecord(tx, &record)
+	})
+	return existing, err
+}
+
+// Put inserts or replaces the record for its path
+func (idx *Index) Put(record Record) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		return putRecord(tx, &record)
+	})
+}
+
+// PutAll inserts or replaces several records in a single transaction
+func (idx *Index) PutAll(records []Record) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		for i := range records {
+			if err := putRecord(tx, &records[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Replace removes the record for oldPath and stores record in its place, for
+// files that were moved or rewritten
+func (idx *Index) Replace(oldPath string, record Record) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		if err := deleteRecord(tx, []byte(oldPath), nil); err != nil {
+			return err
+		}
+		return putRecord(tx, &record)
+	})
+}
+
+// Remove deletes the record for a relative path
+func (idx *Index) Remove(path string) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		return deleteRecord(tx, []byte(path), nil)
+	})
+}
+
+// RemoveAll deletes the records for several relative paths in a single
+// transaction and makes sure every remaining content hash still points to
+// one of its files.
+func (idx *Index) RemoveAll(paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		orphaned := map[string]bool{}
+		for _, path := range paths {
+			if err := deleteRecord(tx, []byte(path), orphaned); err != nil {
+				return err
+			}
+		}
+
+		// Another copy of a removed file may still be present
+		return repairHashes(tx, orphaned)
+	})
+}
+
+// Count returns the number of indexed files
+func (idx *Index) Count() int {
+	count := 0
+	idx.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(filesBucket).Stats().KeyN
+		return nil
+	})
+	return count
+}
+
+// List returns a page of the owner's records matching the query and the
+// cursor for the next page, which is empty on the last page. The cursor is
+// only returned once another matching record was seen, so a client never
+// fetches an empty page.
+func (idx *Index) List(query ListQuery) ([]Record, string, error) {
+	var records []Record
+	next := ""
+	prefix := []byte(query.Owner + "\x00")
+
+	err := idx.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(byOwnerBucket).Cursor()
+
+		// Position on the first key of the page
+		var k []byte
+		switch {
+		case query.Cursor != "":
+			start := append(append([]byte{}, prefix...), query.Cursor...)
+			k, _ = cursor.Seek(start)
+			switch {
+			case k != nil && string(k) == string(start):
+				k = step(cursor, query.Descending)
+			case query.Descending && k == nil:
+				k, _ = cursor.Last()
+			case query.Descending:
+				k, _ = cursor.Prev()
+			}
+		case query.Descending:
+			// Seek past the last key with the prefix
+			end := append(append([]byte{}, prefix[:len(prefix)-1]...), 0x01)
+			if k, _ = cursor.Seek(end); k == nil {
+				k, _ = cursor.Last()
+			} else {
+				k, _ = cursor.Prev()
+			}
+		default:
+			k, _ = cursor.Seek(prefix)
+		}
+
+		for ; k != nil && strings.HasPrefix(string(k), string(prefix)); k = step(cursor, query.Descending) {
+			path := k[strings.LastIndexByte(string(k), 0)+1:]
+			record, err := getRecord(tx, path)
+			if err != nil {
+				return err
+			}
+			if record == nil || (query.Filter != nil && !query.Filter(record)) {
+				continue
+			}
+
+			if query.Limit > 0 && len(records) == query.Limit {
+				next = string(records[len(records)-1].listKey())
+				next = strings.TrimPrefix(next, string(prefix))
+				return nil
+			}
+			records = append(records, *record)
+		}
+		return nil
+	})
+	return records, next, err
+}
+
+func step(cursor *bolt.Cursor, descending bool) []byte {
+	var k []byte
+	if descending {
+		k, _ = cursor.Prev()
+	} else {
+		k, _ = cursor.Next()
+	}
+	return k
+}
+
+// listKey returns the key of the record in the by-owner bucket
+func (record *Record) listKey() []byte {
+	date := "" // sorts before any date
+	if !record.CaptureDate.IsZero() {
+		date = record.CaptureDate.UTC().Format("20060102T150405.000000000Z")
+	}
+	return []byte(record.Owner + "\x00" + date + "\x00" + record.Path)
+}
+
+// ForEach calls fn for every indexed record in path order
+func (idx *Index) ForEach(fn func(record *Record) error) error {
+	return idx.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).ForEach(func(k, v []byte) error {
+			record := &Record{}
+			if err := json.Unmarshal(v, record); err != nil {
+				return fmt.Errorf("error decoding index record %s: %w", k, err)
+			}
+			return fn(record)
+		})
+	})
+}
+
+func ownedKey(owner, hash string) []byte {
+	return []byte(owner + "\x00" + hash)
+}
+
+// repairLookups points every content hash without a lookup entry at one of
+// the files holding it
+func repairLookups(tx *bolt.Tx) error {
+	return tx.Bucket(filesBucket).ForEach(func(k, v []byte) error {
+		record := &Record{}
+		if err := json.Unmarshal(v, record); err != nil {
+			return fmt.Errorf("error decoding index record %s: %w", k, err)
+		}
+		return putLookups(tx, record)
+	})
+}
+
+// repairHashes points the lookup entries of the given content hashes, which
+// lost the file they pointed at, at another file holding the content. Only
+// the records with those hashes are written.
+func repairHashes(tx *bolt.Tx, hashes map[string]bool) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	return tx.Bucket(filesBucket).ForEach(func(k, v []byte) error {
+		record := &Record{}
+		if err := json.Unmarshal(v, record); err != nil {
+			return fmt.Errorf("error decoding index record %s: %w", k, err)
+		}
+		if !hashes[record.Hash] {
+			return nil
+		}
+		return putLookups(tx, record)
+	})
+}
+
+// rebuildLookups recreates the lookup buckets from the files bucket
+func rebuildLookups(tx *bolt.Tx) error {
+	for _, name := range [][]byte{hashesBucket, ownedBucket, byOwnerBucket, pairsBucket} {
+		if err := tx.DeleteBucket(name); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket(name); err != nil {
+			return err
+		}
+	}
+	return repairLookups(tx)
+}
+
+func getRecord(tx *bolt.Tx, path []byte) (*Record, error) {
+	data := tx.Bucket(filesBucket).Get(path)
+	if data == nil {
+		return nil, nil
+	}
+
+	record := &Record{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, fmt.Errorf("error decoding index record %s: %w", path, err)
+	}
+	return record, nil
+}
+
+func putRecord(tx *bolt.Tx, record *Record) error {
+	// Drop the hash entry of a previous version of the file
+	if err := deleteRecord(tx, []byte(record.Path), nil); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("error encoding index record: %w", err)
+	}
+	if err := tx.Bucket(filesBucket).Put([]byte(record.Path), data); err != nil {
+		return err
+	}
+	if err := putLookups(tx, record); err != nil {
+		return err
+	}
+	return restack(tx, record.Owner, record.PairKey)
+}
+
+// putLookups adds the lookup entries for record. Hash entries are only added
+// if no other file already holds them.
+func putLookups(tx *bolt.Tx, record *Record) error {
+	if err := tx.Bucket(byOwnerBucket).Put(record.listKey(), nil); err != nil {
+		return err
+	}
+	if record.PairKey != "" {
+		if err := tx.Bucket(pairsBucket).Put(record.pairKey(), nil); err != nil {
+			return err
+		}
+	}
+
+	hashes := tx.Bucket(hashesBucket)
+	if hashes.Get([]byte(record.Hash)) == nil {
+		if err := hashes.Put([]byte(record.Hash), []byte(record.Path)); err != nil {
+			return err
+		}
+	}
+
+	owned := tx.Bucket(ownedBucket)
+	key := ownedKey(record.Owner, record.Hash)
+	if owned.Get(key) == nil {
+		return owned.Put(key, []byte(record.Path))
+	}
+	return nil
+}
+
+// deleteRecord removes the record for path and its lookup entries. The
+// content hash is added to orphaned, unless it is nil, when a hash entry
+// pointing at the file was removed.
+func deleteRecord(tx *bolt.Tx, path []byte, orphaned map[string]bool) error {
+	existing, err := getRecord(tx, path)
+	if err != nil || existing == nil {
+		return err
+	}
+
+	hashes := tx.Bucket(hashesBucket)
+	if string(hashes.Get([]byte(existing.Hash))) == string(path) {
+		if err := hashes.Delete([]byte(existing.Hash)); err != nil {
+			return err
+		}
+		if orphaned != nil {
+			orphaned[existing.Hash] = true
+		}
+	}
+
+	owned := tx.Bucket(ownedBucket)
+	key := ownedKey(existing.Owner, existing.Hash)
+	if string(owned.Get(key)) == string(path) {
+		if err := owned.Delete(key); err != nil {
+			return err
+		}
+		if orphaned != nil {
+			orphaned[existing.Hash] = true
+		}
+	}
+
+	if err := tx.Bucket(byOwnerBucket).Delete(existing.listKey()); err != nil {
+		return err
+	}
+	if existing.PairKey != "" {
+		if err := tx.Bucket(pairsBucket).Delete(existing.pairKey()); err != nil {
+			return err
+		}
+	}
+	if err := tx.Bucket(filesBucket).Delete(path); err != nil {
+		return err
+	}
+	return restack(tx, existing.Owner, existing.PairKey)
+}
+
+// pairKey returns the key of the record in the pairs bucket
+func (record *Record) pairKey() []byte {
+	return []byte(record.Owner + "\x00" + record.PairKey + "\x00" + record.Path)
+}
+
+// stackMembers returns the owner's records sharing a pair key
+func stackMembers(tx *bolt.Tx, owner, pairKey string) ([]Record, error) {
+	var records []Record
+	prefix := []byte(owner + "\x00" + pairKey + "\x00")
+	cursor := tx.Bucket(pairsBucket).Cursor()
+	for k, _ := cursor.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, _ = cursor.Next() {
+		record, err := getRecord(tx, k[len(prefix):])
+		if err != nil {
+			return nil, err
+		}
+		if record != nil {
+			records = append(records, *record)
+		}
+	}
+	return records, nil
+}
+
+// restack updates the Stacked flag of the owner's files sharing a pair key
+// after one of them was added or removed
+func restack(tx *bolt.Tx, owner, pairKey string) error {
+	if pairKey == "" {
+		return nil
+	}
+	members, err := stackMembers(tx, owner, pairKey)
+	if err != nil {
+		return err
+	}
+
+	// A stack is a rendered file and its companion, the video of a Live
+	// Photo or the RAW file of a JPEG. Files that merely share a name and
+	// capture time, such as two JPEGs, stay apart.
+	primaries := 0
+	for i := range members {
+		if members[i].PairRole == RolePrimary {
+			primaries++
+		}
+	}
+	stacked := len(members) == 2 && primaries == 1
+
+	for i := range members {
+		if members[i].Stacked == stacked {
+			continue
+		}
+		// The flag isn't part of any lookup key, so only the record changes
+		members[i].Stacked = stacked
+		data, err := json.Marshal(&members[i])
+		if err != nil {
+			return fmt.Errorf("error encoding index record: %w", err)
+		}
+		if err := tx.Bucket(filesBucket).Put([]byte(members[i].Path), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,415 @@
+package isobmff
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// heifBrands are the ftyp brands of HEIF still images, including HEIC
+// (HEVC coded) as written by iPhones and AVIF
+var heifBrands = map[string]bool{
+	"heic": true, "heix": true, "heim": true, "heis": true,
+	"mif1": true, "msf1": true, "avif": true,
+}
+
+// ErrNoExif is returned for HEIF files without an Exif item
+var ErrNoExif = errors.New("no Exif item found")
+
+// HEIF describes the primary image of a HEIF file
+type HEIF struct {
+	// Width and Height of the primary image from its ispe property. As in
+	// JPEG, they are the coded size before any rotation is applied.
+	Width  int
+	Height int
+
+	r         io.ReaderAt
+	exifItems []itemLocation
+	xmpItems  []itemLocation
+}
+
+// Range is a contiguous range of bytes in a file
+type Range struct {
+	Offset int64
+	Length int64
+}
+
+// xmpContentType is the content type of mime items holding XMP packets
+const xmpContentType = "application/rdf+xml"
+
+// itemInfo is the type of an item from its infe box and, for mime items,
+// its content type
+type itemInfo struct {
+	itemType    string
+	contentType string
+}
+
+// itemLocation is where an item's data is stored, as listed in iloc
+type itemLocation struct {
+	constructionMethod uint16
+	baseOffset         uint64
+	extents            []extent
+}
+
+type extent struct {
+	offset uint64
+	length uint64
+}
+
+// IsHEIF reports whether the file has the brand of a HEIF image
+func IsHEIF(r io.ReaderAt, size int64) bool {
+	brands, err := Brands(r, size)
+	if err != nil {
+		return false
+	}
+	for _, brand := range brands {
+		if heifBrands[brand] {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseHEIF reads the meta box of a HEIF file: the item types from iinf,
+// their locations from iloc and the primary item's size from the ispe
+// property in iprp
+func ParseHEIF(r io.ReaderAt, size int64) (*HEIF, error) {
+	if !IsHEIF(r, size) {
+		return nil, fmt.Errorf("%w: not a HEIF image", ErrNotISOBMFF)
+	}
+
+	boxes, err := ReadBoxes(r, 0, size)
+	meta, ok := Find(boxes, "meta")
+	if !ok {
+		if err == nil {
+			err = errors.New("meta box not found")
+		}
+		return nil, err
+	}
+	children, err := Children(r, meta, 4)
+	if err != nil {
+		return nil, fmt.Errorf("error reading meta box: %w", err)
+	}
+
+	primary := uint32(0)
+	if box, ok := Find(children, "pitm"); ok {
+		data, err := Payload(r, box)
+		if err != nil {
+			return nil, err
+		}
+		br := &reader{data: data}
+		if version, _ := br.fullBox(); version == 0 {
+			primary = uint32(br.u16())
+		} else {
+			primary = br.u32()
+		}
+		if br.err != nil {
+			return nil, fmt.Errorf("error reading pitm box: %w", br.err)
+		}
+	}
+
+	itemTypes, err := readItemTypes(r, children)
+	if err != nil {
+		return nil, err
+	}
+	locations, err := readItemLocations(r, children)
+	if err != nil {
+		return nil, err
+	}
+
+	heif := &HEIF{r: r}
+	for id, info := range itemTypes {
+		location, ok := locations[id]
+		if !ok {
+			continue
+		}
+		switch {
+		case info.itemType == "Exif":
+			heif.exifItems = append(heif.exifItems, location)
+		case info.itemType == "mime" && info.contentType == xmpContentType:
+			heif.xmpItems = append(heif.xmpItems, location)
+		}
+	}
+
+	if width, height, ok := readImageSize(r, children, primary); ok {
+		heif.Width = width
+		heif.Height = height
+	}
+	return heif, nil
+}
+
+// Exif returns the TIFF structure of the Exif item, ready for an EXIF
+// decoder. The item starts with the offset of the TIFF header, which is
+// usually preceded by "Exif\0\0".
+func (h *HEIF) Exif() ([]byte, error) {
+	for _, item := range h.exifItems {
+		// Construction method 0 addresses the file; the others address
+		// data within the meta box and are not used for Exif in practice
+		if item.constructionMethod != 0 {
+			continue
+		}
+
+		var data []byte
+		for _, e := range item.extents {
+			if e.length > maxBoxSize || uint64(len(data))+e.length > maxBoxSize {
+				return nil, fmt.Errorf("Exif item too large")
+			}
+			chunk := make([]byte, e.length)
+			if _, err := h.r.ReadAt(chunk, int64(item.baseOffset+e.offset)); err != nil {
+				return nil, fmt.Errorf("error reading Exif item: %w", err)
+			}
+			data = append(data, chunk...)
+		}
+
+		br := &reader{data: data}
+		headerOffset := br.u32()
+		if br.err != nil || uint64(headerOffset) > uint64(len(data)-4) {
+			continue
+		}
+		return data[4+headerOffset:], nil
+	}
+	return nil, ErrNoExif
+}
+
+// HasExif reports whether the image has an Exif item
+func (h *HEIF) HasExif() bool {
+	return len(h.exifItems) > 0
+}
+
+// ExifRanges returns where in the file the extents of the Exif item are
+// stored, in order, for rewriting it in place. It reports false if there
+// is none or if it is stored in the meta box.
+func (h *HEIF) ExifRanges() ([]Range, bool) {
+	if len(h.exifItems) == 0 {
+		return nil, false
+	}
+	return fileRanges(h.exifItems[0])
+}
+
+// XMPRanges returns where in the file the extents of the XMP items are
+// stored. It reports false if any of them is stored in the meta box.
+func (h *HEIF) XMPRanges() ([]Range, bool) {
+	var ranges []Range
+	for _, item := range h.xmpItems {
+		itemRanges, ok := fileRanges(item)
+		if !ok {
+			return nil, false
+		}
+		ranges = append(ranges, itemRanges...)
+	}
+	return ranges, true
+}
+
+// fileRanges returns the ranges of the extents of an item stored in the file
+func fileRanges(item itemLocation) ([]Range, bool) {
+	if item.constructionMethod != 0 || len(item.extents) == 0 {
+		return nil, false
+	}
+	var ranges []Range
+	var total uint64
+	for _, e := range item.extents {
+		start := item.baseOffset + e.offset
+		total += e.length
+		if e.length == 0 || total > maxBoxSize || start < item.baseOffset || start > math.MaxInt64-e.length {
+			return nil, false
+		}
+		ranges = append(ranges, Range{Offset: int64(start), Length: int64(e.length)})
+	}
+	return ranges, true
+}
+
+// readItemTypes maps item IDs to their type from the infe boxes in iinf
+func readItemTypes(r io.ReaderAt, meta []Box) (map[uint32]itemInfo, error) {
+	types := make(map[uint32]itemInfo)
+	iinf, ok := Find(meta, "iinf")
+	if !ok {
+		return types, nil
+	}
+
+	data, err := Payload(r, iinf)
+	if err != nil {
+		return nil, err
+	}
+	br := &reader{data: data}
+	skip := int64(4 + 2)
+	if version, _ := br.fullBox(); version > 0 {
+		skip = 4 + 4
+	}
+	entries, err := Children(r, iinf, skip)
+	if err != nil {
+		return nil, fmt.Errorf("error reading iinf box: %w", err)
+	}
+
+	for _, entry := range entries {
+		if entry.Type != "infe" {
+			continue
+		}
+		data, err := Payload(r, entry)
+		if err != nil {
+			return nil, err
+		}
+		br := &reader{data: data}
+		version, _ := br.fullBox()
+		// Versions 0 and 1 predate item types and don't describe Exif items
+		if version < 2 {
+			continue
+		}
+		var id uint32
+		if version == 2 {
+			id = uint32(br.u16())
+		} else {
+			id = br.u32()
+		}
+		br.u16() // item_protection_index
+		info := itemInfo{itemType: string(br.bytes(4))}
+		if info.itemType == "mime" {
+			br.cstring() // item_name
+			info.contentType = br.cstring()
+		}
+		if br.err == nil {
+			types[id] = info
+		}
+	}
+	return types, nil
+}
+
+// readItemLocations parses the iloc box
+func readItemLocations(r io.ReaderAt, meta []Box) (map[uint32]itemLocation, error) {
+	locations := make(map[uint32]itemLocation)
+	iloc, ok := Find(meta, "iloc")
+	if !ok {
+		return locations, nil
+	}
+
+	data, err := Payload(r, iloc)
+	if err != nil {
+		return nil, err
+	}
+	br := &reader{data: data}
+	version, _ := br.fullBox()
+	if version > 2 {
+		return nil, fmt.Errorf("unsupported iloc version %d", version)
+	}
+	sizes := br.u16()
+	offsetSize := int(sizes >> 12)
+	lengthSize := int(sizes >> 8 & 0xF)
+	baseOffsetSize := int(sizes >> 4 & 0xF)
+	indexSize := 0
+	if version > 0 {
+		indexSize = int(sizes & 0xF)
+	}
+
+	var count uint32
+	if version < 2 {
+		count = uint32(br.u16())
+	} else {
+		count = br.u32()
+	}
+
+	for i := uint32(0); i < count && br.err == nil; i++ {
+		var id uint32
+		if version < 2 {
+			id = uint32(br.u16())
+		} else {
+			id = br.u32()
+		}
+
+		var location itemLocation
+		if version > 0 {
+			location.constructionMethod = br.u16() & 0xF
+		}
+		br.u16() // data_reference_index
+		location.baseOffset = br.uint(baseOffsetSize)
+
+		extents := br.u16()
+		for j := uint16(0); j < extents && br.err == nil; j++ {
+			br.uint(indexSize) // extent_index
+			location.extents = append(location.extents, extent{
+				offset: br.uint(offsetSize),
+				length: br.uint(lengthSize),
+			})
+		}
+		locations[id] = location
+	}
+	if br.err != nil {
+		return nil, fmt.Errorf("error reading iloc box: %w", br.err)
+	}
+	return locations, nil
+}
+
+// readImageSize finds the ispe property associated with an item in iprp
+func readImageSize(r io.ReaderAt, meta []Box, item uint32) (int, int, bool) {
+	iprp, ok := Find(meta, "iprp")
+	if !ok {
+		return 0, 0, false
+	}
+	children, err := Children(r, iprp, 0)
+	if err != nil {
+		return 0, 0, false
+	}
+	ipco, ok := Find(children, "ipco")
+	if !ok {
+		return 0, 0, false
+	}
+	properties, err := Children(r, ipco, 0)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	for _, index := range propertyIndexes(r, children, item) {
+		if index < 1 || index > len(properties) || properties[index-1].Type != "ispe" {
+			continue
+		}
+		data, err := Payload(r, properties[index-1])
+		if err != nil {
+			return 0, 0, false
+		}
+		br := &reader{data: data}
+		br.fullBox()
+		width, height := br.u32(), br.u32()
+		if br.err == nil {
+			return int(width), int(height), true
+		}
+	}
+	return 0, 0, false
+}
+
+// propertyIndexes returns the 1-based ipco indexes of the properties the
+// ipma boxes associate with an item
+func propertyIndexes(r io.ReaderAt, iprp []Box, item uint32) []int {
+	var indexes []int
+	for _, box := range iprp {
+		if box.Type != "ipma" {
+			continue
+		}
+		data, err := Payload(r, box)
+		if err != nil {
+			continue
+		}
+		br := &reader{data: data}
+		version, flags := br.fullBox()
+		count := br.u32()
+		for i := uint32(0); i < count && br.err == nil; i++ {
+			var id uint32
+			if version < 1 {
+				id = uint32(br.u16())
+			} else {
+				id = br.u32()
+			}
+			associations := int(br.u8())
+			for j := 0; j < associations && br.err == nil; j++ {
+				var index int
+				if flags&1 != 0 {
+					index = int(br.u16() & 0x7FFF)
+				} else {
+					index = int(br.u8() & 0x7F)
+				}
+				if id == item {
+					indexes = append(indexes, index)
+				}
+			}
+		}
+	}
+	return indexes
+}
@@ -0,0 +1,75 @@
+package isobmff
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The fixtures in testdata/heic are reduced HEIC files: the box layout of
+// the iOS version they are named after with placeholder tile data, so they
+// carry metadata but no decodable image
+func TestParseHEIF(t *testing.T) {
+	tests := []struct {
+		file   string
+		width  int
+		height int
+	}{
+		// iloc version 0 with 4-byte offsets, 8-bit property indexes
+		{file: "ios11.heic", width: 4032, height: 3024},
+		// iloc version 1 with a base offset
+		{file: "ios14.heic", width: 4032, height: 3024},
+		// 32-bit item IDs, 8-byte offsets, 16-bit property indexes and an
+		// Exif item in two extents
+		{file: "ios17.heic", width: 5712, height: 4284},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := os.ReadFile("../testdata/heic/" + tt.file)
+			require.NoError(t, err)
+			r := bytes.NewReader(data)
+
+			assert.True(t, IsHEIF(r, int64(len(data))))
+			heif, err := ParseHEIF(r, int64(len(data)))
+			require.NoError(t, err)
+			assert.Equal(t, tt.width, heif.Width)
+			assert.Equal(t, tt.height, heif.Height)
+
+			tiff, err := heif.Exif()
+			require.NoError(t, err)
+			assert.Equal(t, []byte("MM\x00\x2a"), tiff[:4])
+
+			// The ranges hold the same item, as stored in the file
+			ranges, ok := heif.ExifRanges()
+			require.True(t, ok)
+			var item []byte
+			for _, rng := range ranges {
+				item = append(item, data[rng.Offset:rng.Offset+rng.Length]...)
+			}
+			assert.True(t, bytes.HasSuffix(item, tiff))
+		})
+	}
+}
+
+func TestParseHEIFRejectsOtherFiles(t *testing.T) {
+	data, err := os.ReadFile("../testdata/lena.jpeg")
+	require.NoError(t, err)
+
+	assert.False(t, IsHEIF(bytes.NewReader(data), int64(len(data))))
+	_, err = ParseHEIF(bytes.NewReader(data), int64(len(data)))
+	assert.ErrorIs(t, err, ErrNotISOBMFF)
+}
+
+func TestParseHEIFTruncated(t *testing.T) {
+	data, err := os.ReadFile("../testdata/heic/ios14.heic")
+	require.NoError(t, err)
+
+	// Cut off within the meta box
+	data = data[:200]
+	_, err = ParseHEIF(bytes.NewReader(data), int64(len(data)))
+	assert.Error(t, err)
+}
@@ -0,0 +1,179 @@
+// Package isobmff reads the box structure of ISO base media files (ISO/IEC
+// 14496-12), the container format of HEIF images and MP4/QuickTime videos.
+// Only the metadata boxes are read; media data is never loaded.
+package isobmff
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxBoxSize bounds the size of boxes that are read into memory. Metadata
+// boxes are small; anything larger is media data or a corrupt file.
+const maxBoxSize = 16 << 20
+
+var (
+	// ErrNotISOBMFF is returned for files that don't start with an ftyp box
+	ErrNotISOBMFF = errors.New("not an ISO base media file")
+	// errTruncated is returned when a box extends beyond its parent
+	errTruncated = errors.New("truncated box")
+)
+
+// Box is a box header located in a file
+type Box struct {
+	// Type is the four character code, e.g. "ftyp" or "moov"
+	Type string
+	// Offset of the box payload in the file and its size in bytes
+	Offset int64
+	Size   int64
+}
+
+// ReadBoxes lists the boxes stored in r between offset start and end
+func ReadBoxes(r io.ReaderAt, start, end int64) ([]Box, error) {
+	var boxes []Box
+	header := make([]byte, 16)
+	for offset := start; offset+8 <= end; {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			return boxes, err
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		boxType := string(header[4:8])
+		headerSize := int64(8)
+
+		switch size {
+		case 0:
+			// The box extends to the end of the file
+			size = end - offset
+		case 1:
+			// A 64-bit size follows the type
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				return boxes, err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+		if size < headerSize || offset+size > end {
+			return boxes, fmt.Errorf("%w: %s at %d", errTruncated, boxType, offset)
+		}
+
+		boxes = append(boxes, Box{Type: boxType, Offset: offset + headerSize, Size: size - headerSize})
+		offset += size
+	}
+	return boxes, nil
+}
+
+// Children lists the boxes nested in box, skipping skip header bytes, e.g.
+// 4 for the version and flags of a full box
+func Children(r io.ReaderAt, box Box, skip int64) ([]Box, error) {
+	if skip > box.Size {
+		return nil, errTruncated
+	}
+	return ReadBoxes(r, box.Offset+skip, box.Offset+box.Size)
+}
+
+// Find returns the first box of the given type
+func Find(boxes []Box, boxType string) (Box, bool) {
+	for _, box := range boxes {
+		if box.Type == boxType {
+			return box, true
+		}
+	}
+	return Box{}, false
+}
+
+// Payload reads the payload of a box into memory
+func Payload(r io.ReaderAt, box Box) ([]byte, error) {
+	if box.Size > maxBoxSize {
+		return nil, fmt.Errorf("%s box too large: %d bytes", box.Type, box.Size)
+	}
+	data := make([]byte, box.Size)
+	if _, err := r.ReadAt(data, box.Offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Brands returns the major and compatible brands of the file's ftyp box
+func Brands(r io.ReaderAt, size int64) ([]string, error) {
+	// Only the first box matters; a truncated file may still identify itself
+	boxes, _ := ReadBoxes(r, 0, size)
+	if len(boxes) == 0 || boxes[0].Type != "ftyp" {
+		return nil, ErrNotISOBMFF
+	}
+
+	data, err := Payload(r, boxes[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 8 {
+		return nil, fmt.Errorf("%w: short ftyp box", ErrNotISOBMFF)
+	}
+	// Major brand, minor version, then compatible brands
+	brands := []string{string(data[:4])}
+	for i := 8; i+4 <= len(data); i += 4 {
+		brands = append(brands, string(data[i:i+4]))
+	}
+	return brands, nil
+}
+
+// reader decodes big-endian fields from a box payload. Reads past the end
+// yield zero and set err.
+type reader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil || r.pos+n > len(r.data) {
+		if r.err == nil {
+			r.err = errTruncated
+		}
+		return make([]byte, n)
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *reader) u8() uint8   { return r.bytes(1)[0] }
+func (r *reader) u16() uint16 { return binary.BigEndian.Uint16(r.bytes(2)) }
+func (r *reader) u32() uint32 { return binary.BigEndian.Uint32(r.bytes(4)) }
+func (r *reader) u64() uint64 { return binary.BigEndian.Uint64(r.bytes(8)) }
+
+// uint reads an unsigned integer of 0, 4 or 8 bytes, as used by iloc
+func (r *reader) uint(size int) uint64 {
+	switch size {
+	case 0:
+		return 0
+	case 4:
+		return uint64(r.u32())
+	case 8:
+		return r.u64()
+	default:
+		r.err = fmt.Errorf("unsupported field size %d", size)
+		return 0
+	}
+}
+
+// fullBox reads the version and flags of a full box
+func (r *reader) fullBox() (version uint8, flags uint32) {
+	v := r.u32()
+	return uint8(v >> 24), v & 0xFFFFFF
+}
+
+// cstring reads a null terminated string
+func (r *reader) cstring() string {
+	for i := r.pos; i < len(r.data); i++ {
+		if r.data[i] == 0 {
+			s := string(r.data[r.pos:i])
+			r.pos = i + 1
+			return s
+		}
+	}
+	s := string(r.data[r.pos:])
+	r.pos = len(r.data)
+	return s
+}
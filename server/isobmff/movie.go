@@ -0,0 +1,370 @@
+package isobmff
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// movieBrands are the ftyp brands of MP4, QuickTime and 3GPP videos
+var movieBrands = map[string]bool{
+	"isom": true, "iso2": true, "iso4": true, "iso5": true, "iso6": true,
+	"mp41": true, "mp42": true, "avc1": true, "qt  ": true, "M4V ": true,
+	"M4VP": true, "3gp4": true, "3gp5": true, "3gp6": true, "3g2a": true,
+	"MSNV": true, "XAVC": true,
+}
+
+// stillBrands are the major brands of still image formats that list movie
+// brands as compatible, such as Canon CR3 RAW files
+var stillBrands = map[string]bool{"crx ": true}
+
+// macEpochOffset is the number of seconds between the QuickTime epoch,
+// 1904-01-01 UTC, and the Unix epoch
+const macEpochOffset = 2082844800
+
+// maxMovieTime bounds creation times in seconds since 1904; larger values
+// (after 2100) are garbage
+const maxMovieTime = 6_247_152_000
+
+// Movie is the metadata of an MP4 or QuickTime video
+type Movie struct {
+	// CreationTime is the creation time of the movie header, or of the
+	// first track if the movie header doesn't have one. It is in UTC by
+	// specification, though some cameras store their local time.
+	CreationTime time.Time
+	Duration     time.Duration
+	// Width and Height of the first video track before Rotation, in
+	// degrees clockwise, is applied
+	Width    int
+	Height   int
+	Rotation int
+	// Codec is the sample entry type of the first video track, e.g. "avc1"
+	// for H.264 or "hvc1" for HEVC
+	Codec string
+	// Metadata holds the UTF-8 values of the QuickTime metadata keys, e.g.
+	// com.apple.quicktime.creationdate, and the text atoms of the user data
+	// box under their type, e.g. "©xyz"
+	Metadata map[string]string
+}
+
+// IsMovie reports whether the file is an MP4 or QuickTime video. QuickTime
+// files written before ftyp was introduced are recognized by their first box.
+func IsMovie(r io.ReaderAt, size int64) bool {
+	brands, err := Brands(r, size)
+	if errors.Is(err, ErrNotISOBMFF) {
+		boxes, _ := ReadBoxes(r, 0, size)
+		if len(boxes) == 0 {
+			return false
+		}
+		switch boxes[0].Type {
+		case "moov", "mdat", "wide":
+			return true
+		}
+		return false
+	}
+	if err != nil || IsHEIF(r, size) || stillBrands[brands[0]] {
+		return false
+	}
+	for _, brand := range brands {
+		if movieBrands[brand] {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseMovie reads the movie box of a video: the movie and track headers,
+// the sample description of the first video track and the metadata boxes
+func ParseMovie(r io.ReaderAt, size int64) (*Movie, error) {
+	boxes, err := ReadBoxes(r, 0, size)
+	moov, ok := Find(boxes, "moov")
+	if !ok {
+		if err == nil {
+			err = errors.New("moov box not found")
+		}
+		return nil, err
+	}
+	children, err := Children(r, moov, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error reading moov box: %w", err)
+	}
+
+	movie := &Movie{Metadata: make(map[string]string)}
+	if mvhd, ok := Find(children, "mvhd"); ok {
+		if err := movie.readMovieHeader(r, mvhd); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, box := range children {
+		switch box.Type {
+		case "trak":
+			movie.readTrack(r, box)
+		case "meta":
+			readMetadataKeys(r, box, movie.Metadata)
+		case "udta":
+			readUserData(r, box, movie.Metadata)
+		}
+	}
+	return movie, nil
+}
+
+// readMovieHeader parses the mvhd box
+func (m *Movie) readMovieHeader(r io.ReaderAt, box Box) error {
+	data, err := Payload(r, box)
+	if err != nil {
+		return err
+	}
+	br := &reader{data: data}
+	var created, duration uint64
+	var timescale uint32
+	if version, _ := br.fullBox(); version == 1 {
+		created = br.u64()
+		br.u64() // modification_time
+		timescale = br.u32()
+		duration = br.u64()
+	} else {
+		created = uint64(br.u32())
+		br.u32() // modification_time
+		timescale = br.u32()
+		duration = uint64(br.u32())
+	}
+	if br.err != nil {
+		return fmt.Errorf("error reading mvhd box: %w", br.err)
+	}
+
+	m.CreationTime = movieTime(created)
+	// All ones means the duration is unknown
+	if timescale > 0 && duration != 0xFFFFFFFF && duration != 0xFFFFFFFFFFFFFFFF {
+		whole := duration / uint64(timescale)
+		fraction := duration % uint64(timescale)
+		m.Duration = time.Duration(whole)*time.Second + time.Duration(fraction)*time.Second/time.Duration(timescale)
+	}
+	return nil
+}
+
+// readTrack takes the size and codec from the first video track and the
+// creation time from the first track that has one
+func (m *Movie) readTrack(r io.ReaderAt, trak Box) {
+	children, err := Children(r, trak, 0)
+	if err != nil {
+		return
+	}
+	tkhd, ok := Find(children, "tkhd")
+	if !ok {
+		return
+	}
+	data, err := Payload(r, tkhd)
+	if err != nil {
+		return
+	}
+	br := &reader{data: data}
+	var created uint64
+	if version, _ := br.fullBox(); version == 1 {
+		created = br.u64()
+		br.bytes(8 + 4 + 4 + 8) // modification_time, track_ID, reserved, duration
+	} else {
+		created = uint64(br.u32())
+		br.bytes(4 + 4 + 4 + 4)
+	}
+	br.bytes(8 + 2 + 2 + 2 + 2) // reserved, layer, alternate_group, volume, reserved
+	var matrix [9]int32
+	for i := range matrix {
+		matrix[i] = int32(br.u32())
+	}
+	width, height := br.u32()>>16, br.u32()>>16
+	if br.err != nil {
+		return
+	}
+
+	if m.CreationTime.IsZero() {
+		m.CreationTime = movieTime(created)
+	}
+	if m.Codec != "" {
+		return
+	}
+	codec, ok := videoCodec(r, children)
+	if !ok {
+		return
+	}
+	m.Codec = codec
+	m.Width = int(width)
+	m.Height = int(height)
+	m.Rotation = matrixRotation(matrix)
+}
+
+// videoCodec returns the sample entry type of a video track, reporting
+// false for tracks of other media
+func videoCodec(r io.ReaderAt, trak []Box) (string, bool) {
+	mdia, ok := Find(trak, "mdia")
+	if !ok {
+		return "", false
+	}
+	children, err := Children(r, mdia, 0)
+	if err != nil {
+		return "", false
+	}
+
+	hdlr, ok := Find(children, "hdlr")
+	if !ok {
+		return "", false
+	}
+	data, err := Payload(r, hdlr)
+	if err != nil {
+		return "", false
+	}
+	br := &reader{data: data}
+	br.fullBox()
+	br.u32() // pre_defined
+	if string(br.bytes(4)) != "vide" || br.err != nil {
+		return "", false
+	}
+
+	// mdia/minf/stbl/stsd, whose entries follow the version, flags and count
+	box := mdia
+	for _, boxType := range []string{"minf", "stbl", "stsd"} {
+		children, err := Children(r, box, 0)
+		if err != nil {
+			return "", true
+		}
+		if box, ok = Find(children, boxType); !ok {
+			return "", true
+		}
+	}
+	entries, _ := Children(r, box, 8)
+	if len(entries) == 0 {
+		return "", true
+	}
+	return entries[0].Type, true
+}
+
+// matrixRotation returns the clockwise rotation in degrees of a track
+// transformation matrix {a, b, u, c, d, v, x, y, w}
+func matrixRotation(matrix [9]int32) int {
+	a, b := matrix[0], matrix[1]
+	switch {
+	case a == 0 && b > 0:
+		return 90
+	case a == 0 && b < 0:
+		return 270
+	case a < 0:
+		return 180
+	default:
+		return 0
+	}
+}
+
+// movieTime converts seconds since 1904 into a time, zero if unset
+func movieTime(seconds uint64) time.Time {
+	if seconds == 0 || seconds > maxMovieTime {
+		return time.Time{}
+	}
+	return time.Unix(int64(seconds)-macEpochOffset, 0).UTC()
+}
+
+// readMetadataKeys reads the keys and ilst boxes of a QuickTime meta box,
+// which is where iPhones store the creation date with its time zone and
+// the location
+func readMetadataKeys(r io.ReaderAt, meta Box, into map[string]string) {
+	// The QuickTime meta box is a plain box, the MP4 one a full box
+	head := make([]byte, 8)
+	if _, err := r.ReadAt(head, meta.Offset); err != nil {
+		return
+	}
+	skip := int64(4)
+	if string(head[4:8]) == "hdlr" {
+		skip = 0
+	}
+	children, err := Children(r, meta, skip)
+	if err != nil {
+		return
+	}
+
+	keysBox, ok := Find(children, "keys")
+	if !ok {
+		return
+	}
+	data, err := Payload(r, keysBox)
+	if err != nil {
+		return
+	}
+	br := &reader{data: data}
+	br.fullBox()
+	count := br.u32()
+	var keys []string
+	for i := uint32(0); i < count && br.err == nil; i++ {
+		size := br.u32()
+		if size < 8 {
+			return
+		}
+		br.bytes(4) // key_namespace, "mdta"
+		keys = append(keys, string(br.bytes(int(size-8))))
+	}
+
+	ilst, ok := Find(children, "ilst")
+	if !ok {
+		return
+	}
+	items, _ := Children(r, ilst, 0)
+	for _, item := range items {
+		// Items are typed with the 1-based index of their key
+		index := binary.BigEndian.Uint32([]byte(item.Type))
+		if index < 1 || int(index) > len(keys) {
+			continue
+		}
+		if value, ok := readDataValue(r, item); ok {
+			into[keys[index-1]] = value
+		}
+	}
+}
+
+// readDataValue returns the UTF-8 value of the data box in a metadata item
+func readDataValue(r io.ReaderAt, item Box) (string, bool) {
+	children, err := Children(r, item, 0)
+	if err != nil {
+		return "", false
+	}
+	box, ok := Find(children, "data")
+	if !ok {
+		return "", false
+	}
+	data, err := Payload(r, box)
+	if err != nil {
+		return "", false
+	}
+	br := &reader{data: data}
+	// Well-known type 1 is UTF-8 text
+	dataType := br.u32() & 0xFFFFFF
+	br.u32() // locale
+	if br.err != nil || dataType != 1 {
+		return "", false
+	}
+	return string(data[br.pos:]), true
+}
+
+// readUserData reads the QuickTime text atoms of a udta box, whose types
+// start with ©. Android phones store the location in "©xyz".
+func readUserData(r io.ReaderAt, udta Box, into map[string]string) {
+	children, err := Children(r, udta, 0)
+	if err != nil {
+		return
+	}
+	for _, box := range children {
+		if box.Type[0] != 0xA9 {
+			continue
+		}
+		data, err := Payload(r, box)
+		if err != nil {
+			continue
+		}
+		br := &reader{data: data}
+		size := br.u16()
+		br.u16() // language
+		text := br.bytes(int(size))
+		if br.err == nil {
+			into["©"+box.Type[1:]] = string(text)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package isobmff
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The fixtures in testdata/video carry the boxes written by an iPhone and an
+// Android phone with placeholder media data
+func TestParseMovie(t *testing.T) {
+	tests := []struct {
+		file     string
+		created  time.Time
+		duration time.Duration
+		width    int
+		height   int
+		rotation int
+		codec    string
+		metadata map[string]string
+	}{
+		{
+			file:     "iphone.mov",
+			created:  time.Date(2023, 10, 7, 10, 48, 12, 0, time.UTC),
+			duration: 12500 * time.Millisecond,
+			width:    1920,
+			height:   1080,
+			rotation: 90,
+			codec:    "hvc1",
+			metadata: map[string]string{
+				"com.apple.quicktime.creationdate":     "2023-10-07T19:48:12+0900",
+				"com.apple.quicktime.location.ISO6709": "+35.6586+139.7454+041.000/",
+				"com.apple.quicktime.make":             "Apple",
+				"com.apple.quicktime.model":            "iPhone 15 Pro",
+			},
+		},
+		{
+			// Version 1 movie header with 64-bit times
+			file:     "android.mp4",
+			created:  time.Date(2022, 8, 20, 14, 3, 55, 0, time.UTC),
+			duration: 4321 * time.Millisecond,
+			width:    1920,
+			height:   1080,
+			codec:    "avc1",
+			metadata: map[string]string{"©xyz": "+52.2297+021.0122/"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := os.ReadFile("../testdata/video/" + tt.file)
+			require.NoError(t, err)
+			r := bytes.NewReader(data)
+
+			assert.True(t, IsMovie(r, int64(len(data))))
+			assert.False(t, IsHEIF(r, int64(len(data))))
+
+			movie, err := ParseMovie(r, int64(len(data)))
+			require.NoError(t, err)
+			assert.Equal(t, tt.created, movie.CreationTime)
+			assert.Equal(t, tt.duration, movie.Duration)
+			assert.Equal(t, tt.width, movie.Width)
+			assert.Equal(t, tt.height, movie.Height)
+			assert.Equal(t, tt.rotation, movie.Rotation)
+			assert.Equal(t, tt.codec, movie.Codec)
+			assert.Equal(t, tt.metadata, movie.Metadata)
+		})
+	}
+}
+
+func TestIsMovieRejectsImages(t *testing.T) {
+	for _, path := range []string{"../testdata/heic/ios14.heic", "../testdata/lena.jpeg", "../testdata/raw/canon.cr3"} {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.False(t, IsMovie(bytes.NewReader(data), int64(len(data))), path)
+	}
+}
@@ -0,0 +1,292 @@
+// Package layout turns the storage layout setting into file paths. A
+// layout is a template such as "{year}/{month}/{original_name}{ext}" that
+// is filled in from a file's index record; the result is relative to the
+// owner's directory in the uploads directory. Undated files have a template
+// of their own, as they have no date to fill in.
+package layout
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"image-upload-server/config"
+	"image-upload-server/index"
+)
+
+// Tokens that can be used in templates
+const (
+	TokenYear         = "year"
+	TokenMonth        = "month"
+	TokenDay          = "day"
+	TokenCameraModel  = "camera_model"
+	TokenUser         = "user"
+	TokenHash         = "hash"
+	TokenOriginalName = "original_name"
+	TokenTimestamp    = "timestamp"
+	TokenExt          = "ext"
+)
+
+// dateTokens can't be used in the template of undated files
+var dateTokens = map[string]bool{TokenYear: true, TokenMonth: true, TokenDay: true}
+
+// knownTokens lists the valid token names
+var knownTokens = map[string]bool{
+	TokenYear: true, TokenMonth: true, TokenDay: true, TokenCameraModel: true, TokenUser: true,
+	TokenHash: true, TokenOriginalName: true, TokenTimestamp: true, TokenExt: true,
+}
+
+// Placeholders for values a file doesn't have
+const (
+	unknownCamera = "unknown"
+	unnamed       = "unnamed"
+)
+
+// maxValueLength limits the length of a filled in token, in bytes
+const maxValueLength = 100
+
+var (
+	// Current is the layout new and reorganized files are stored in
+	Current = Must(New(config.StorageLayoutDefault, config.StorageLayoutUndatedDefault))
+)
+
+// Layout is a pair of parsed templates, for dated and undated files
+type Layout struct {
+	dated   template
+	undated template
+}
+
+// template is a parsed template: literal text alternating with tokens
+type template struct {
+	source string
+	parts  []part
+}
+
+// part is literal text, or a token if name is set
+type part struct {
+	literal string
+	name    string
+	// length is the number of characters of a {hash:N} token, 0 for all
+	length int
+}
+
+// Init sets the current layout from the storage layout settings
+func Init(dated, undated string) error {
+	layout, err := New(dated, undated)
+	if err != nil {
+		return err
+	}
+	Current = layout
+	return nil
+}
+
+// New parses and validates the templates for dated and undated files
+func New(dated, undated string) (*Layout, error) {
+	datedTemplate, err := parse(dated)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage layout %q: %w", dated, err)
+	}
+	undatedTemplate, err := parse(undated)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage layout for undated files %q: %w", undated, err)
+	}
+	for _, p := range undatedTemplate.parts {
+		if dateTokens[p.name] {
+			return nil, fmt.Errorf("invalid storage layout for undated files %q: {%s} can't be used for undated files", undated, p.name)
+		}
+	}
+	return &Layout{dated: *datedTemplate, undated: *undatedTemplate}, nil
+}
+
+// Must returns the layout or panics if it is invalid, for the defaults
+func Must(layout *Layout, err error) *Layout {
+	if err != nil {
+		panic(err)
+	}
+	return layout
+}
+
+// String describes the layout as its two templates
+func (l *Layout) String() string {
+	return l.dated.source + " (undated: " + l.undated.source + ")"
+}
+
+// Path returns the path of a file within its owner's directory, using
+// slashes. ext is the file's extension including the dot.
+func (l *Layout) Path(record *index.Record, ext string) string {
+	if record.CaptureDate.IsZero() {
+		return l.undated.render(record, ext)
+	}
+	return l.dated.render(record, ext)
+}
+
+// WithSuffix returns the name to try when the path of a file is taken: the
+// n-th candidate, counting from 1, has "-n" appended before the extension
+func WithSuffix(name string, n int) string {
+	if n <= 1 {
+		return name
+	}
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "-" + strconv.Itoa(n) + ext
+}
+
+// parse splits a template into literals and tokens and checks that it
+// yields relative paths ending in the file's extension
+func parse(source string) (*template, error) {
+	t := &template{source: source}
+	for rest := source; rest != ""; {
+		open := strings.IndexByte(rest, '{')
+		if closing := strings.IndexByte(rest, '}'); closing >= 0 && (open < 0 || closing < open) {
+			return nil, fmt.Errorf("unexpected '}'")
+		}
+		if open < 0 {
+			t.parts = append(t.parts, part{literal: rest})
+			break
+		}
+		if open > 0 {
+			t.parts = append(t.parts, part{literal: rest[:open]})
+		}
+		closing := strings.IndexByte(rest[open:], '}')
+		if closing < 0 {
+			return nil, fmt.Errorf("unclosed '{'")
+		}
+		token, err := parseToken(rest[open+1 : open+closing])
+		if err != nil {
+			return nil, err
+		}
+		t.parts = append(t.parts, token)
+		rest = rest[open+closing+1:]
+	}
+
+	if len(t.parts) == 0 {
+		return nil, fmt.Errorf("template is empty")
+	}
+	if last := t.parts[len(t.parts)-1]; last.name != TokenExt {
+		return nil, fmt.Errorf("template must end with {ext}")
+	}
+	for i, p := range t.parts {
+		if p.name == TokenExt && i != len(t.parts)-1 {
+			return nil, fmt.Errorf("{ext} can only be used at the end")
+		}
+		if strings.ContainsAny(p.literal, "\\\x00") {
+			return nil, fmt.Errorf("template can't contain backslashes or NUL characters")
+		}
+	}
+
+	// Check the directories with sample values, which can't contain
+	// slashes or start with a dot
+	segments := strings.Split(t.render(&index.Record{}, ".jpg"), "/")
+	if segments[len(segments)-1] == ".jpg" {
+		return nil, fmt.Errorf("file name can't be just {ext}")
+	}
+	for _, segment := range segments {
+		switch {
+		case segment == "":
+			return nil, fmt.Errorf("template can't contain empty path segments or start with '/'")
+		case strings.HasPrefix(segment, "."):
+			return nil, fmt.Errorf("path segments can't start with '.'")
+		}
+	}
+	return t, nil
+}
+
+// parseToken parses the text between braces
+func parseToken(text string) (part, error) {
+	name, argument, hasArgument := strings.Cut(text, ":")
+	if !knownTokens[name] {
+		return part{}, fmt.Errorf("unknown token {%s}", text)
+	}
+	token := part{name: name}
+	if !hasArgument {
+		return token, nil
+	}
+	if name != TokenHash {
+		return part{}, fmt.Errorf("{%s} takes no length", name)
+	}
+	length, err := strconv.Atoi(argument)
+	if err != nil || length < 4 || length > 64 {
+		return part{}, fmt.Errorf("hash length in {%s} must be between 4 and 64", text)
+	}
+	token.length = length
+	return token, nil
+}
+
+// render fills in the template for a record
+func (t *template) render(record *index.Record, ext string) string {
+	var b strings.Builder
+	for _, p := range t.parts {
+		if p.name == "" {
+			b.WriteString(p.literal)
+			continue
+		}
+		b.WriteString(value(p, record, ext))
+	}
+	return b.String()
+}
+
+// value returns the text a token stands for. Everything taken from the file
+// or the client is made safe as a single path segment.
+func value(p part, record *index.Record, ext string) string {
+	date := record.CaptureDate
+	switch p.name {
+	case TokenYear:
+		return fmt.Sprintf("%04d", date.Year())
+	case TokenMonth:
+		return fmt.Sprintf("%02d", date.Month())
+	case TokenDay:
+		return fmt.Sprintf("%02d", date.Day())
+	case TokenCameraModel:
+		model := ""
+		if record.Exif != nil {
+			model = record.Exif.Model
+		}
+		return sanitize(model, unknownCamera)
+	case TokenUser:
+		return sanitize(record.Owner, unnamed)
+	case TokenHash:
+		if p.length > 0 && p.length < len(record.Hash) {
+			return record.Hash[:p.length]
+		}
+		return sanitize(record.Hash, unnamed)
+	case TokenOriginalName:
+		name := path.Base(strings.ReplaceAll(record.OriginalName, "\\", "/"))
+		name = strings.TrimSuffix(name, path.Ext(name))
+		return sanitize(name, unnamed)
+	case TokenTimestamp:
+		return strconv.FormatInt(record.UploadedAt.UnixMilli(), 10)
+	case TokenExt:
+		return strings.ToLower(ext)
+	}
+	return ""
+}
+
+// sanitize makes a value usable as part of a path segment: separators and
+// control characters are replaced, leading dots and surrounding spaces are
+// removed and the length is limited. Empty values become fallback.
+func sanitize(value, fallback string) string {
+	value = strings.Map(func(r rune) rune {
+		if r == utf8.RuneError {
+			return '_'
+		}
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, value)
+	value = strings.TrimLeft(strings.TrimSpace(value), ".")
+	if len(value) > maxValueLength {
+		value = value[:maxValueLength]
+		// Don't cut a multi-byte character in half
+		for !utf8.ValidString(value) {
+			value = value[:len(value)-1]
+		}
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,84 @@
+package layout
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"image-upload-server/config"
+	"image-upload-server/exif"
+	"image-upload-server/index"
+)
+
+func TestPath(t *testing.T) {
+	record := &index.Record{
+		Hash:         "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+		Owner:        "alice",
+		CaptureDate:  time.Date(2023, 4, 5, 12, 34, 56, 0, time.FixedZone("+02:00", 2*60*60)),
+		OriginalName: `C:\Photos\IMG_0001.HEIC`,
+		UploadedAt:   time.UnixMilli(1681568943783),
+		Exif:         &exif.Metadata{Model: " Canon EOS R6/II "},
+	}
+	undated := *record
+	undated.CaptureDate = time.Time{}
+	undated.OriginalName = ""
+	undated.Exif = nil
+
+	tests := []struct {
+		dated, undated string
+		want           string
+		wantUndated    string
+	}{
+		{config.StorageLayoutDefault, config.StorageLayoutUndatedDefault, "2023/04/1681568943783-9f86d081.jpg", "na/1681568943783-9f86d081.jpg"},
+		{"{year}/{month}/{day}/{original_name}{ext}", "undated/{original_name}{ext}", "2023/04/05/IMG_0001.jpg", "undated/unnamed.jpg"},
+		{"{camera_model}/{user}-{hash}{ext}", "{camera_model}/{hash:12}{ext}", "Canon EOS R6_II/alice-" + record.Hash + ".jpg", "unknown/9f86d081884c.jpg"},
+	}
+	for _, tc := range tests {
+		layout, err := New(tc.dated, tc.undated)
+		require.NoError(t, err, tc.dated)
+		assert.Equal(t, tc.want, layout.Path(record, ".JPG"), tc.dated)
+		assert.Equal(t, tc.wantUndated, layout.Path(&undated, ".JPG"), tc.undated)
+	}
+}
+
+func TestNewRejectsInvalidTemplates(t *testing.T) {
+	for _, dated := range []string{
+		"",
+		"{year}/{month}/{name}{ext}",
+		"{year}/{month}/{hash}",
+		"{year}/{month}/{hash}{ext}.bak{ext}",
+		"/{year}/{hash}{ext}",
+		"{year}//{hash}{ext}",
+		"{year}/../{hash}{ext}",
+		"{year}/.hidden/{hash}{ext}",
+		"{year}/{ext}",
+		"{year}/{hash:2}{ext}",
+		"{year:4}/{hash}{ext}",
+		"{year}/{hash{ext}",
+		"{year}}/{hash}{ext}",
+		`{year}\{hash}{ext}`,
+	} {
+		_, err := New(dated, config.StorageLayoutUndatedDefault)
+		assert.Error(t, err, dated)
+	}
+
+	// Undated files have no date to fill in
+	_, err := New(config.StorageLayoutDefault, "na/{year}/{hash}{ext}")
+	assert.Error(t, err)
+}
+
+func TestSanitize(t *testing.T) {
+	assert.Equal(t, "_etc_passwd", sanitize("/etc/passwd", unnamed))
+	assert.Equal(t, "hidden", sanitize("..hidden", unnamed))
+	assert.Equal(t, unnamed, sanitize(" .. ", unnamed))
+	assert.Equal(t, "a_b", sanitize("a\nb", unnamed))
+	assert.Len(t, sanitize(strings.Repeat("é", 100), unnamed), maxValueLength)
+}
+
+func TestWithSuffix(t *testing.T) {
+	assert.Equal(t, "2023/04/IMG_0001.jpg", WithSuffix("2023/04/IMG_0001.jpg", 1))
+	assert.Equal(t, "2023/04/IMG_0001-3.jpg", WithSuffix("2023/04/IMG_0001.jpg", 3))
+}
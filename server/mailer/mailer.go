@@ -0,0 +1,203 @@
+// Package mailer sends email. The server writes plain text messages, which a
+// Mailer either delivers to an SMTP server or, by default, writes to an
+// outbox directory for development and tests. Sends are rate limited per
+// recipient, so public endpoints can't be used to flood an inbox.
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"image-upload-server/config"
+)
+
+// ErrRateLimited is returned when too many messages were sent to a recipient
+var ErrRateLimited = errors.New("too many messages sent to this address, try again later")
+
+// rateLimitWindow is the period MAIL_RATE_LIMIT applies to
+const rateLimitWindow = time.Hour
+
+var (
+	// Default is the global mailer
+	Default Mailer
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends messages
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// Init creates the global mailer from the configuration
+func Init() error {
+	var backend Mailer
+	switch config.Mailer {
+	case "smtp":
+		if config.SMTPHost == "" {
+			return errors.New("SMTP_HOST must be set when MAILER is smtp")
+		}
+		backend = &SMTP{
+			Host:        config.SMTPHost,
+			Port:        config.SMTPPort,
+			Username:    config.SMTPUsername,
+			Password:    config.SMTPPassword,
+			From:        config.MailFrom,
+			ImplicitTLS: config.SMTPImplicitTLS,
+		}
+		log.Printf("Mailer sends through %s:%d", config.SMTPHost, config.SMTPPort)
+	case "outbox":
+		outbox, err := NewOutbox(config.OutboxDir, config.MailFrom)
+		if err != nil {
+			return err
+		}
+		backend = outbox
+		log.Printf("Mailer writes messages to %s", config.OutboxDir)
+	default:
+		return fmt.Errorf("unknown mailer %s, expected smtp or outbox", config.Mailer)
+	}
+
+	Default = RateLimited(backend, config.MailRateLimit, rateLimitWindow)
+	return nil
+}
+
+// Send sends the message with the global mailer
+func Send(msg Message) error {
+	if Default == nil {
+		return errors.New("mailer is not initialized")
+	}
+	return Default.Send(msg)
+}
+
+// ValidateAddress checks that address is a bare email address, such as
+// alice@example.com, and returns it without surrounding whitespace
+func ValidateAddress(address string) (string, error) {
+	address = strings.TrimSpace(address)
+	parsed, err := mail.ParseAddress(address)
+	if err != nil || parsed.Address != address {
+		return "", fmt.Errorf("invalid email address %q", address)
+	}
+	return address, nil
+}
+
+// rateLimited wraps a Mailer, allowing at most max messages to a recipient
+// per window
+type rateLimited struct {
+	next   Mailer
+	max    int
+	window time.Duration
+	now    func() time.Time
+
+	mu   sync.Mutex
+	sent map[string][]time.Time
+}
+
+// RateLimited returns a Mailer that sends through next at most max messages
+// to each recipient per window and returns ErrRateLimited for the rest.
+// A max of 0 or less disables the limit.
+func RateLimited(next Mailer, max int, window time.Duration) Mailer {
+	if max <= 0 {
+		return next
+	}
+	return &rateLimited{next: next, max: max, window: window, now: time.Now, sent: map[string][]time.Time{}}
+}
+
+func (r *rateLimited) Send(msg Message) error {
+	if !r.allow(strings.ToLower(msg.To)) {
+		return ErrRateLimited
+	}
+	return r.next.Send(msg)
+}
+
+// allow records a send to the recipient if it is within the limit
+func (r *rateLimited) allow(recipient string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	// Forget sends that left the window, for all recipients, so the map
+	// doesn't grow with every address ever used
+	for key, times := range r.sent {
+		recent := times[:0]
+		for _, t := range times {
+			if now.Sub(t) < r.window {
+				recent = append(recent, t)
+			}
+		}
+		if len(recent) == 0 {
+			delete(r.sent, key)
+		} else {
+			r.sent[key] = recent
+		}
+	}
+
+	if len(r.sent[recipient]) >= r.max {
+		return false
+	}
+	r.sent[recipient] = append(r.sent[recipient], now)
+	return true
+}
+
+// format renders the message as an RFC 5322 message from the sender
+func (m Message) format(from string, now time.Time) ([]byte, error) {
+	if _, err := ValidateAddress(m.To); err != nil {
+		return nil, err
+	}
+	if strings.ContainsAny(m.Subject, "\r\n") {
+		return nil, errors.New("subject must be a single line")
+	}
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender %q: %w", from, err)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	domain := sender.Address[strings.LastIndex(sender.Address, "@")+1:]
+
+	var buf bytes.Buffer
+	header := func(name, value string) { fmt.Fprintf(&buf, "%s: %s\r\n", name, value) }
+	header("From", sender.String())
+	header("To", m.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", now.Format(time.RFC1123Z))
+	header("Message-ID", "<"+hex.EncodeToString(id)+"@"+domain+">")
+	header("MIME-Version", "1.0")
+	header("Content-Type", `text/plain; charset="utf-8"`)
+	header("Content-Transfer-Encoding", "quoted-printable")
+	buf.WriteString("\r\n")
+
+	body := quotedprintable.NewWriter(&buf)
+	if _, err := body.Write([]byte(strings.ReplaceAll(m.Body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// envelopeSender returns the bare address of the sender
+func envelopeSender(from string) (string, error) {
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return "", fmt.Errorf("invalid sender %q: %w", from, err)
+	}
+	return sender.Address, nil
+}
@@ -0,0 +1,194 @@
+package mailer
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// smtpSink is a minimal SMTP server that records the messages it receives
+type smtpSink struct {
+	listener net.Listener
+	mu       sync.Mutex
+	received []receivedMessage
+}
+
+type receivedMessage struct {
+	From string
+	To   []string
+	Data string
+}
+
+func startSMTPSink(t *testing.T) *smtpSink {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	sink := &smtpSink{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go sink.serve(conn)
+		}
+	}()
+	return sink
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+	reply("220 sink ESMTP")
+
+	var msg receivedMessage
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			reply("250-sink")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			reply("235 Authenticated")
+		case "MAIL":
+			msg = receivedMessage{From: strings.Trim(line[len("MAIL FROM:"):], "<>")}
+			reply("250 OK")
+		case "RCPT":
+			msg.To = append(msg.To, strings.Trim(line[len("RCPT TO:"):], "<>"))
+			reply("250 OK")
+		case "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			msg.Data = data.String()
+			s.mu.Lock()
+			s.received = append(s.received, msg)
+			s.mu.Unlock()
+			reply("250 Queued")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func (s *smtpSink) messages() []receivedMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]receivedMessage(nil), s.received...)
+}
+
+func TestSMTP(t *testing.T) {
+	sink := startSMTPSink(t)
+	host, port, err := net.SplitHostPort(sink.listener.Addr().String())
+	require.NoError(t, err)
+	portNumber, err := net.LookupPort("tcp", port)
+	require.NoError(t, err)
+
+	mailer := &SMTP{Host: host, Port: portNumber, Username: "server", Password: "secret", From: "Photos <noreply@example.com>"}
+	require.NoError(t, mailer.Send(Message{To: "alice@example.com", Subject: "Verify your email", Body: "Hello Alice,\nopen this link."}))
+
+	messages := sink.messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "noreply@example.com", messages[0].From)
+	assert.Equal(t, []string{"alice@example.com"}, messages[0].To)
+
+	parsed, err := mail.ReadMessage(strings.NewReader(messages[0].Data))
+	require.NoError(t, err)
+	assert.Equal(t, "Verify your email", parsed.Header.Get("Subject"))
+	assert.Equal(t, "alice@example.com", parsed.Header.Get("To"))
+	assert.Contains(t, parsed.Header.Get("From"), "noreply@example.com")
+	assert.NotEmpty(t, parsed.Header.Get("Message-ID"))
+	body, err := io.ReadAll(parsed.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "open this link.")
+}
+
+func TestOutbox(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	outbox, err := NewOutbox(dir, "noreply@example.com")
+	require.NoError(t, err)
+
+	require.NoError(t, outbox.Send(Message{To: "alice@example.com", Subject: "Passwort zurücksetzen", Body: "Grüße"}))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.True(t, strings.HasSuffix(entries[0].Name(), ".eml"))
+
+	data, err := os.ReadFile(filepath.Join(dir, entries[0].Name()))
+	require.NoError(t, err)
+	parsed, err := mail.ReadMessage(strings.NewReader(string(data)))
+	require.NoError(t, err)
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	require.NoError(t, err)
+	assert.Equal(t, "Passwort zurücksetzen", subject)
+
+	// Header injection through the recipient or subject is refused
+	assert.Error(t, outbox.Send(Message{To: "alice@example.com\r\nBcc: eve@example.com", Subject: "Hi"}))
+	assert.Error(t, outbox.Send(Message{To: "alice@example.com", Subject: "Hi\r\nBcc: eve@example.com"}))
+}
+
+type recordingMailer struct {
+	sent []Message
+}
+
+func (r *recordingMailer) Send(msg Message) error {
+	r.sent = append(r.sent, msg)
+	return nil
+}
+
+func TestRateLimited(t *testing.T) {
+	next := &recordingMailer{}
+	mailer := RateLimited(next, 2, time.Hour).(*rateLimited)
+	now := time.Now()
+	mailer.now = func() time.Time { return now }
+
+	assert.NoError(t, mailer.Send(Message{To: "alice@example.com"}))
+	assert.NoError(t, mailer.Send(Message{To: "Alice@Example.com"}))
+	assert.ErrorIs(t, mailer.Send(Message{To: "alice@example.com"}), ErrRateLimited)
+	assert.NoError(t, mailer.Send(Message{To: "bob@example.com"}))
+	assert.Len(t, next.sent, 3)
+
+	now = now.Add(time.Hour)
+	assert.NoError(t, mailer.Send(Message{To: "alice@example.com"}))
+	assert.NotContains(t, mailer.sent, "bob@example.com")
+}
+
+func TestValidateAddress(t *testing.T) {
+	address, err := ValidateAddress(" alice@example.com ")
+	require.NoError(t, err)
+	assert.Equal(t, "alice@example.com", address)
+
+	for _, invalid := range []string{"", "alice", "Alice <alice@example.com>", "alice@example.com, bob@example.com"} {
+		_, err := ValidateAddress(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
@@ -0,0 +1,64 @@
+package mailer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Outbox writes each message to a .eml file in a directory instead of
+// sending it. Files are named by the time they were written, so they sort
+// in order.
+type Outbox struct {
+	Dir  string
+	From string
+}
+
+// NewOutbox creates the outbox directory if needed
+func NewOutbox(dir, from string) (*Outbox, error) {
+	if _, err := envelopeSender(from); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating outbox: %w", err)
+	}
+	return &Outbox{Dir: dir, From: from}, nil
+}
+
+// Send writes the message to the outbox
+func (o *Outbox) Send(msg Message) error {
+	now := time.Now()
+	data, err := msg.format(o.From, now)
+	if err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := now.UTC().Format("20060102T150405.000000000") + "-" + hex.EncodeToString(suffix) + ".eml"
+
+	// Write to a temporary file first, so a reader of the outbox never sees
+	// a partial message
+	tmp, err := os.CreateTemp(o.Dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error writing to outbox: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing to outbox: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing to outbox: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(o.Dir, name)); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing to outbox: %w", err)
+	}
+	return nil
+}
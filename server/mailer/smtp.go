@@ -0,0 +1,104 @@
+package mailer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+// smtpTimeout bounds a whole delivery, from connecting to QUIT
+const smtpTimeout = 30 * time.Second
+
+// SMTP delivers messages to an SMTP server. Unless ImplicitTLS is set, the
+// connection is upgraded with STARTTLS when the server offers it.
+// Credentials are only sent over TLS or to localhost.
+type SMTP struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	// ImplicitTLS connects with TLS from the start, as on port 465
+	ImplicitTLS bool
+	// TLSConfig overrides the TLS configuration, which otherwise verifies
+	// the server's certificate for Host
+	TLSConfig *tls.Config
+}
+
+// Send delivers the message
+func (s *SMTP) Send(msg Message) error {
+	data, err := msg.format(s.From, time.Now())
+	if err != nil {
+		return err
+	}
+	from, err := envelopeSender(s.From)
+	if err != nil {
+		return err
+	}
+
+	if err := s.deliver(from, msg.To, data); err != nil {
+		return fmt.Errorf("error sending email through %s: %w", s.Host, err)
+	}
+	return nil
+}
+
+func (s *SMTP) deliver(from, to string, data []byte) error {
+	tlsConfig := s.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: s.Host}
+	}
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+
+	var conn net.Conn
+	var err error
+	if s.ImplicitTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	client, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if !s.ImplicitTLS {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		}
+	}
+	if s.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
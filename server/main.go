@@ -8,15 +8,24 @@ import (
 	"io"
 	"log"
 	"os"
-	"path/filepath"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 
+	"image-upload-server/apikey"
+	"image-upload-server/auth"
 	"image-upload-server/config"
+	"image-upload-server/datefix"
+	"image-upload-server/derivatives"
 	"image-upload-server/filehandler"
+	"image-upload-server/index"
+	"image-upload-server/layout"
+	"image-upload-server/mailer"
 	"image-upload-server/middleware"
+	"image-upload-server/photos"
+	"image-upload-server/share"
+	"image-upload-server/storage"
 	"image-upload-server/subscription"
 	"image-upload-server/user"
 )
@@ -25,12 +34,23 @@ func main() {
 	// Initialize configuration
 	config.Init()
 
+	// Validate the storage layout before anything is stored
+	if err := layout.Init(config.StorageLayout, config.StorageLayoutUndated); err != nil {
+		log.Fatalf("Failed to configure storage layout: %v", err)
+	}
+
 	// Ensure uploads directory exists
 	uploadsDir := config.UploadsDirOverriden
 	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
 		log.Fatalf("Failed to create uploads directory: %v", err)
 	}
 
+	// Select where the library is stored. The uploads directory holds
+	// incoming files with every backend.
+	if err := storage.Init(uploadsDir); err != nil {
+		log.Fatalf("Failed to configure storage backend: %v", err)
+	}
+
 	// Ensure data directory exists for user database
 	dataDir := config.DataDirOverriden
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
@@ -42,8 +62,66 @@ func main() {
 		log.Fatalf("Failed to initialize user database: %v", err)
 	}
 
-	// Load existing file hashes
-	filehandler.LoadExistingHashes(uploadsDir)
+	// Initialize the session store holding refresh tokens and revoked
+	// access tokens
+	if err := auth.InitSessions(dataDir); err != nil {
+		log.Fatalf("Failed to initialize session store: %v", err)
+	}
+
+	// Initialize the store of tokens sent by email, and the mailer sending
+	// them
+	if err := user.InitTokens(dataDir); err != nil {
+		log.Fatalf("Failed to initialize email token store: %v", err)
+	}
+	if err := mailer.Init(); err != nil {
+		log.Fatalf("Failed to initialize mailer: %v", err)
+	}
+
+	// Initialize the API key store
+	if err := apikey.Init(dataDir); err != nil {
+		log.Fatalf("Failed to initialize API key store: %v", err)
+	}
+
+	// Initialize the upload index
+	if err := index.InitIndex(dataDir); err != nil {
+		log.Fatalf("Failed to initialize upload index: %v", err)
+	}
+
+	// Initialize the share link store
+	if err := share.Init(dataDir); err != nil {
+		log.Fatalf("Failed to initialize share store: %v", err)
+	}
+
+	// Initialize the audit log of capture date corrections
+	if err := datefix.Init(dataDir); err != nil {
+		log.Fatalf("Failed to initialize date correction log: %v", err)
+	}
+
+	// Start generating thumbnails and previews in the background
+	if err := derivatives.Init(dataDir, config.DerivativeWorkers); err != nil {
+		log.Fatalf("Failed to initialize derivatives: %v", err)
+	}
+
+	// Remove partially written uploads and bring the index up to date
+	filehandler.CleanupTempFiles(uploadsDir)
+	filehandler.CleanupStaleTusUploads(uploadsDir)
+	if err := filehandler.ReconcileIndex(); err != nil {
+		log.Printf("Failed to reconcile upload index: %v", err)
+	}
+
+	// Run an administrative command instead of the server if one was given
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:], uploadsDir); err != nil {
+			log.Fatalf("Command %s failed: %v", os.Args[1], err)
+		}
+		return
+	}
+
+	// Load the keys tokens are signed with. The server doesn't start with
+	// the default secret outside dev mode.
+	if err := auth.InitKeys(dataDir); err != nil {
+		log.Fatalf("Failed to initialize signing keys: %v", err)
+	}
 
 	// Setup Gin router
 	router := gin.Default()
@@ -51,9 +129,9 @@ func main() {
 	// Configure CORS
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"POST", "GET", "OPTIONS", "PUT"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "x-heap-user-id"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowMethods:     []string{"POST", "GET", "OPTIONS", "PUT", "PATCH", "HEAD", "DELETE"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "x-heap-user-id", "Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata", "Range", "If-Range", "If-None-Match", "If-Modified-Since"},
+		ExposeHeaders:    []string{"Content-Length", "Content-Range", "Content-Disposition", "Accept-Ranges", "ETag", "Last-Modified", "Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size", "Upload-Offset", "Upload-Length", "Upload-Metadata", "Upload-Path"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
@@ -61,23 +139,98 @@ func main() {
 	// Public routes
 	router.POST("/login", user.HandleLogin)
 	router.POST("/register", user.HandleRegister)
+	router.POST("/token/refresh", user.HandleRefreshToken)
+	router.POST("/email/verify", user.HandleVerifyEmail)
+	router.POST("/email/change/confirm", user.HandleConfirmEmailChange)
+	router.POST("/password/forgot", user.HandleForgotPassword)
+	router.POST("/password/reset", user.HandleResetPassword)
+	router.GET("/.well-known/jwks.json", auth.HandleJWKS)
+	router.OPTIONS(filehandler.TusBasePath, filehandler.HandleTusOptions)
+
+	// Shared photos, accessible to anyone with the link
+	router.GET(share.PathPrefix+":token", share.HandleSharedOriginal)
+	router.HEAD(share.PathPrefix+":token", share.HandleSharedOriginal)
+	router.GET(share.PathPrefix+":token/thumbnail", share.HandleSharedThumbnail)
+	router.GET(share.PathPrefix+":token/preview", share.HandleSharedPreview)
 
-	// Protected routes
+	// Protected routes, each group requiring a permission of the user's role.
+	// API keys are only accepted on routes with Require, within their scopes.
 	authorized := router.Group("/")
 	authorized.Use(middleware.AuthMiddleware())
 	{
-		authorized.POST("/upload", filehandler.HandleUpload(uploadsDir))
-		authorized.POST("/subscribe", subscription.HandleSubscriptionCheckout)
-		
+		uploads := authorized.Group("/", middleware.Require(auth.PermissionUpload))
+		uploads.POST("/upload", filehandler.HandleUpload(uploadsDir))
+
+		// Resumable upload routes (tus protocol)
+		uploads.POST(filehandler.TusBasePath, filehandler.HandleTusCreate(uploadsDir))
+		uploads.HEAD(filehandler.TusBasePath+"/:id", filehandler.HandleTusHead(uploadsDir))
+		uploads.PATCH(filehandler.TusBasePath+"/:id", filehandler.HandleTusPatch(uploadsDir))
+		uploads.DELETE(filehandler.TusBasePath+"/:id", filehandler.HandleTusDelete(uploadsDir))
+
+		// Photo library routes
+		authorized.GET("/photos", middleware.RequireFiltered(auth.PermissionRead), photos.HandleListPhotos)
+		library := authorized.Group("/", middleware.Require(auth.PermissionRead))
+		library.GET("/photos/:hash", photos.HandleGetPhoto)
+		library.GET("/photos/:hash/original", photos.HandleDownloadPhoto)
+		library.HEAD("/photos/:hash/original", photos.HandleDownloadPhoto)
+		library.GET("/photos/:hash/thumbnail", photos.HandleThumbnail)
+		library.GET("/photos/:hash/preview", photos.HandlePreview)
+		library.GET("/date-corrections", datefix.HandleListCorrections)
+
+		// Share link routes
+		sharing := authorized.Group("/", middleware.Require(auth.PermissionShare))
+		sharing.POST("/photos/:hash/shares", share.HandleCreateShare)
+		sharing.GET("/shares", share.HandleListShares)
+		sharing.DELETE("/shares/:token", share.HandleDeleteShare)
+
+		// Capture date corrections
+		editing := authorized.Group("/", middleware.Require(auth.PermissionEdit))
+		editing.POST("/date-corrections", datefix.HandleCreateCorrection(uploadsDir))
+		editing.POST("/date-corrections/:id/undo", datefix.HandleUndoCorrection(uploadsDir))
+
+		// Preference and subscription routes
+		account := authorized.Group("/", middleware.Require(auth.PermissionManageAccount))
+		account.GET("/preferences", user.HandleGetPreferences)
+		account.PUT("/preferences", user.HandleUpdatePreferences)
+		account.POST("/subscribe", subscription.HandleSubscriptionCheckout)
+		account.POST("/email/change", user.HandleChangeEmail)
+
+		// API key routes. No key scope allows managing the account, so
+		// only logged in users manage keys.
+		account.POST("/api-keys", apikey.HandleCreateKey)
+		account.GET("/api-keys", apikey.HandleListKeys)
+		account.DELETE("/api-keys/:id", apikey.HandleRevokeKey)
+
+		// Routes open to every role. API keys can't use them, as they have
+		// no Require.
+
 		// Notification routes
 		authorized.GET("/notifications", user.HandleGetNotifications)
 		authorized.PUT("/notifications/read", user.HandleMarkNotificationsRead)
 		authorized.POST("/activity", user.HandleUpdateActivity)
+		authorized.POST("/email/verify/resend", user.HandleResendVerification)
+
+		// Session routes
+		authorized.POST("/logout", user.HandleLogout)
+		authorized.POST("/logout/all", user.HandleLogoutAll)
+		authorized.GET("/sessions", user.HandleListSessions)
+		authorized.DELETE("/sessions/:id", user.HandleRevokeSession)
+
+		// Admin routes
+		admin := authorized.Group("/admin", middleware.Require(auth.PermissionManageUsers))
+		admin.GET("/users", user.HandleListUsers)
+		admin.PUT("/users/:username/role", user.HandleSetRole)
 	}
 
 	// Start the inactivity checker in a background goroutine
 	go startInactivityChecker()
 
+	// Forget expired sessions and tokens in the background
+	go startSessionPruner()
+
+	// Replace signing keys when they are due
+	go startKeyRotation()
+
 	// Start the server
 	log.Printf("Server running on port%s", config.Port)
 	if err := router.Run(config.Port); err != nil {
@@ -95,28 +248,52 @@ func startInactivityChecker() {
 	}
 }
 
+// startSessionPruner periodically removes expired sessions, refresh tokens,
+// revocations and email tokens
+func startSessionPruner() {
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if err := auth.Sessions.Prune(now); err != nil {
+			log.Printf("Error pruning sessions: %v", err)
+		}
+		if err := user.Tokens.Prune(now); err != nil {
+			log.Printf("Error pruning email tokens: %v", err)
+		}
+	}
+}
+
+// startKeyRotation periodically replaces generated signing keys that are
+// older than JWT_KEY_ROTATION
+func startKeyRotation() {
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if err := auth.Keys.Rotate(now); err != nil {
+			log.Printf("Error rotating signing keys: %v", err)
+		}
+	}
+}
+
 type duplicate struct {
 	hash  string
 	paths []string
 }
 
-func findDuplicateImages(rootDir string) []duplicate {
+func findDuplicateImages(backend storage.Backend) []duplicate {
 	hashes := make(map[string][]string)
-	err := filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
+	err := backend.List("", func(info storage.Info) error {
+		hash, err := hashFile(backend, info.Key)
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() {
-			hash, err := hashFile(path)
-			if err != nil {
-				return err
-			}
-			hashes[hash] = append(hashes[hash], path)
-		}
+		hashes[hash] = append(hashes[hash], info.Key)
 		return nil
 	})
 	if err != nil {
-		fmt.Printf("Error walking the path %q: %v\n", rootDir, err)
+		fmt.Printf("Error listing stored files: %v\n", err)
 		return nil
 	}
 
@@ -129,8 +306,8 @@ func findDuplicateImages(rootDir string) []duplicate {
 	return duplicates
 }
 
-func hashFile(filePath string) (string, error) {
-	file, err := os.Open(filePath)
+func hashFile(backend storage.Backend, key string) (string, error) {
+	file, err := backend.Get(key, 0, -1)
 	if err != nil {
 		return "", err
 	}
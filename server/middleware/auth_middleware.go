@@ -1,12 +1,16 @@
 package middleware
 
 import (
+	"errors"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"image-upload-server/apikey"
 	"image-upload-server/auth"
+	"image-upload-server/user"
 )
 
 // AuthMiddleware returns a middleware for authenticating JWT tokens
@@ -29,6 +33,12 @@ func AuthMiddleware() gin.HandlerFunc {
 		// Get the token
 		tokenString := headerParts[1]
 
+		// API keys are accepted in place of a JWT
+		if strings.HasPrefix(tokenString, apikey.Prefix) {
+			authenticateAPIKey(c, tokenString)
+			return
+		}
+
 		// Parse and validate the token
 		claims, err := auth.ParseToken(tokenString)
 		if err != nil {
@@ -36,9 +46,28 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		// Reject logged out tokens. Tokens without an ID predate revocation
+		// and can't be logged out, so they are not accepted either.
+		if claims.ID == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+			return
+		}
+		if auth.Sessions != nil {
+			revoked, err := auth.Sessions.IsRevoked(claims.ID)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check token"})
+				return
+			}
+			if revoked {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Token has been revoked"})
+				return
+			}
+		}
+
 		// Add claims to the context for other handlers to use
 		c.Set("username", claims.Username)
 		c.Set("role", claims.Role)
+		c.Set("session_id", claims.SessionID)
 
 		// Set heap identity headers for client-side tracking
 		//c.Header("X-Heap-Identity", claims.Username)
@@ -47,3 +76,72 @@ func AuthMiddleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// authenticateAPIKey authenticates a request made with an API key. Keys
+// are rejected by default: the request only gets the identity of the key's
+// owner from Require, which checks the key's scopes and photos, so routes
+// without Require see an unauthenticated request.
+func authenticateAPIKey(c *gin.Context, secret string) {
+	key, err := apikey.DB.Authenticate(secret, c.ClientIP(), time.Now())
+	if errors.Is(err, apikey.ErrInvalidKey) || errors.Is(err, apikey.ErrExpired) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check API key"})
+		return
+	}
+
+	c.Set(apikey.ContextKey, key)
+	c.Next()
+}
+
+// Require returns a middleware that only lets requests through whose role
+// has the permission. Requests made with an API key must also have it in
+// the key's scopes and, for keys limited to photos, be about one of them,
+// identified by the route's :hash parameter. It must run after
+// AuthMiddleware.
+func Require(permission auth.Permission) gin.HandlerFunc {
+	return requirePermission(permission, false)
+}
+
+// RequireFiltered is Require for routes that list photos and only include
+// those a key is limited to, which keys limited to photos may use too
+func RequireFiltered(permission auth.Permission) gin.HandlerFunc {
+	return requirePermission(permission, true)
+}
+
+func requirePermission(permission auth.Permission, filtered bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		allowed := true
+		if key := apikey.FromContext(c); key != nil {
+			if !authorizeAPIKey(c, key) {
+				return
+			}
+			allowed = key.Allows(permission) && (filtered || key.AllowsPhoto(c.Param("hash")))
+		}
+		allowed = allowed && auth.HasPermission(c.GetString("role"), permission)
+		if !allowed {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error":      "Insufficient permissions",
+				"permission": permission,
+			})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// authorizeAPIKey gives a request made with an API key the identity of the
+// key's owner, with their current role
+func authorizeAPIKey(c *gin.Context, key *apikey.Key) bool {
+	owner, exists := user.UserDB.GetUser(key.Owner)
+	if !exists {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": apikey.ErrInvalidKey.Error()})
+		return false
+	}
+	c.Set("username", owner.Username)
+	c.Set("role", owner.Role)
+	return true
+}
@@ -0,0 +1,192 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"image-upload-server/apikey"
+	"image-upload-server/auth"
+	"image-upload-server/user"
+)
+
+func TestAuthMiddlewareRejectsRevokedTokens(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store, err := auth.OpenSessions(filepath.Join(t.TempDir(), "sessions.db"))
+	require.NoError(t, err)
+	previous := auth.Sessions
+	auth.Sessions = store
+	t.Cleanup(func() {
+		auth.Sessions = previous
+		store.Close()
+	})
+
+	router := gin.New()
+	router.GET("/whoami", AuthMiddleware(), func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString("username")+" "+c.GetString("session_id"))
+	})
+	request := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	tokens, err := store.Login("alice", auth.RoleMember)
+	require.NoError(t, err)
+	w := request(tokens.AccessToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "alice "+tokens.SessionID, w.Body.String())
+
+	_, err = store.Revoke("alice", tokens.SessionID)
+	require.NoError(t, err)
+	w = request(tokens.AccessToken)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "revoked")
+
+	assert.Equal(t, http.StatusUnauthorized, request("not-a-token").Code)
+}
+
+func TestRequire(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	previous := auth.Keys
+	auth.Keys = auth.NewHMACKeyRing("test-secret")
+	t.Cleanup(func() { auth.Keys = previous })
+
+	router := gin.New()
+	authorized := router.Group("/", AuthMiddleware())
+	authorized.POST("/upload", Require(auth.PermissionUpload), func(c *gin.Context) { c.Status(http.StatusCreated) })
+	authorized.GET("/photos", Require(auth.PermissionRead), func(c *gin.Context) { c.Status(http.StatusOK) })
+	admin := authorized.Group("/admin", Require(auth.PermissionManageUsers))
+	admin.GET("/users", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		role   string
+		method string
+		path   string
+		status int
+	}{
+		{auth.RoleAdmin, http.MethodGet, "/admin/users", http.StatusOK},
+		{auth.RoleAdmin, http.MethodPost, "/upload", http.StatusCreated},
+		{auth.RoleMember, http.MethodGet, "/admin/users", http.StatusForbidden},
+		{auth.RoleMember, http.MethodGet, "/photos", http.StatusOK},
+		{auth.RoleReadOnly, http.MethodGet, "/photos", http.StatusOK},
+		{auth.RoleReadOnly, http.MethodPost, "/upload", http.StatusForbidden},
+		{auth.RoleUploader, http.MethodPost, "/upload", http.StatusCreated},
+		{auth.RoleUploader, http.MethodGet, "/photos", http.StatusForbidden},
+		{"default", http.MethodGet, "/photos", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		token, err := auth.GenerateToken("alice", tt.role)
+		require.NoError(t, err)
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, tt.status, w.Code, "%s %s %s", tt.role, tt.method, tt.path)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	keys, err := apikey.Open(filepath.Join(dir, "api_keys.db"))
+	require.NoError(t, err)
+	users, err := user.NewUserDatabase(filepath.Join(dir, "users.json"))
+	require.NoError(t, err)
+	require.NoError(t, users.AddUser("alice", "secret", "alice@example.com"))
+	previousKeys, previousUsers := apikey.DB, user.UserDB
+	apikey.DB, user.UserDB = keys, users
+	t.Cleanup(func() {
+		apikey.DB, user.UserDB = previousKeys, previousUsers
+		keys.Close()
+	})
+
+	router := gin.New()
+	authorized := router.Group("/", AuthMiddleware())
+	authorized.POST("/upload", Require(auth.PermissionUpload), func(c *gin.Context) {
+		c.String(http.StatusCreated, c.GetString("username"))
+	})
+	authorized.GET("/photos", Require(auth.PermissionRead), func(c *gin.Context) { c.Status(http.StatusOK) })
+	authorized.GET("/preferences", Require(auth.PermissionManageAccount), func(c *gin.Context) { c.Status(http.StatusOK) })
+	authorized.GET("/sessions", func(c *gin.Context) {
+		if c.GetString("username") == "" {
+			c.Status(http.StatusUnauthorized)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+	request := func(method, path, secret string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+secret)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	secret, err := keys.Create(&apikey.Key{Owner: "alice", Name: "camera", Scopes: []auth.Permission{auth.PermissionUpload}})
+	require.NoError(t, err)
+	w := request(http.MethodPost, "/upload", secret)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "alice", w.Body.String())
+
+	// The key is limited to its scopes, which never include the account
+	assert.Equal(t, http.StatusForbidden, request(http.MethodGet, "/photos", secret).Code)
+	assert.Equal(t, http.StatusForbidden, request(http.MethodGet, "/preferences", secret).Code)
+
+	// Routes without Require don't accept keys at all
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/sessions", secret).Code)
+
+	// And to its owner's current role
+	require.NoError(t, users.SetRole("alice", auth.RoleReadOnly))
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/upload", secret).Code)
+
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/photos", apikey.Prefix+"unknown").Code)
+}
+
+func TestAPIKeysLimitedToPhotos(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	keys, err := apikey.Open(filepath.Join(dir, "api_keys.db"))
+	require.NoError(t, err)
+	users, err := user.NewUserDatabase(filepath.Join(dir, "users.json"))
+	require.NoError(t, err)
+	require.NoError(t, users.AddUser("alice", "secret", "alice@example.com"))
+	previousKeys, previousUsers := apikey.DB, user.UserDB
+	apikey.DB, user.UserDB = keys, users
+	t.Cleanup(func() {
+		apikey.DB, user.UserDB = previousKeys, previousUsers
+		keys.Close()
+	})
+
+	router := gin.New()
+	authorized := router.Group("/", AuthMiddleware())
+	authorized.GET("/photos", RequireFiltered(auth.PermissionRead), func(c *gin.Context) { c.Status(http.StatusOK) })
+	authorized.GET("/photos/:hash", Require(auth.PermissionRead), func(c *gin.Context) { c.Status(http.StatusOK) })
+	authorized.GET("/date-corrections", Require(auth.PermissionRead), func(c *gin.Context) { c.Status(http.StatusOK) })
+	request := func(path, secret string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+secret)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	limited, err := keys.Create(&apikey.Key{Owner: "alice", Name: "album", Scopes: []auth.Permission{auth.PermissionRead}, Photos: []string{"aaaa", "bbbb"}})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, request("/photos/aaaa", limited))
+	assert.Equal(t, http.StatusForbidden, request("/photos/cccc", limited))
+	assert.Equal(t, http.StatusOK, request("/photos", limited))
+	assert.Equal(t, http.StatusForbidden, request("/date-corrections", limited))
+
+	unlimited, err := keys.Create(&apikey.Key{Owner: "alice", Name: "library", Scopes: []auth.Permission{auth.PermissionRead}})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, request("/photos/cccc", unlimited))
+	assert.Equal(t, http.StatusOK, request("/date-corrections", unlimited))
+}
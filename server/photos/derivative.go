@@ -0,0 +1,69 @@
+package photos
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+
+	"image-upload-server/derivatives"
+	"image-upload-server/index"
+	"image-upload-server/storage"
+)
+
+// HandleThumbnail serves the square thumbnail of one of the authenticated
+// user's photos
+func HandleThumbnail(c *gin.Context) {
+	serveDerivative(c, derivatives.Thumbnail)
+}
+
+// HandlePreview serves the screen-sized preview of one of the authenticated
+// user's photos
+func HandlePreview(c *gin.Context) {
+	serveDerivative(c, derivatives.Preview)
+}
+
+// serveDerivative serves a derivative image of one of the authenticated
+// user's photos
+func serveDerivative(c *gin.Context, kind derivatives.Kind) {
+	record, ok := lookupOwnedPhoto(c)
+	if !ok {
+		return
+	}
+	ServeDerivative(c, record, kind)
+}
+
+// ServeDerivative serves a derivative image of a record, generating it
+// first if it is missing. Derivatives are re-encoded without metadata and
+// addressed by content hash; they never change, so clients may cache them
+// indefinitely.
+func ServeDerivative(c *gin.Context, record *index.Record, kind derivatives.Kind) {
+	if err := derivatives.Ensure(record.Hash, storage.Key(record.Path)); err != nil {
+		if errors.Is(err, derivatives.ErrUnsupported) || errors.Is(err, fs.ErrNotExist) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No " + string(kind) + " available for this file"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+		return
+	}
+
+	file, err := os.Open(derivatives.Path(record.Hash, kind))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "image/jpeg")
+	c.Header("ETag", `"`+record.Hash+"-"+string(kind)+`"`)
+	c.Header("Cache-Control", "private, max-age=31536000, immutable")
+	http.ServeContent(c.Writer, c.Request, "", info.ModTime(), file)
+}
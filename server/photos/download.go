@@ -0,0 +1,113 @@
+package photos
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"image-upload-server/index"
+	"image-upload-server/privacy"
+	"image-upload-server/sniff"
+	"image-upload-server/storage"
+)
+
+// CodeMetadataNotRemovable is returned when metadata should be removed from
+// a file whose format can't be rewritten
+const CodeMetadataNotRemovable = "metadata_not_removable"
+
+// HandleDownloadPhoto serves the original file of one of the authenticated
+// user's photos. Range requests, If-Range, If-None-Match and
+// If-Modified-Since are honored; the strong ETag is the SHA-256 content hash.
+// The strip query parameter, a comma separated list of metadata groups or
+// "all", removes personal metadata from the file first.
+func HandleDownloadPhoto(c *gin.Context) {
+	groups, err := privacy.ParseGroups(strings.Split(c.Query("strip"), ","))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	record, ok := lookupOwnedPhoto(c)
+	if !ok {
+		return
+	}
+	ServeOriginal(c, record, groups)
+}
+
+// ServeOriginal serves the original file of a record, without the metadata
+// of the given groups if there are any. Files from which metadata can't be
+// removed are answered with 422.
+func ServeOriginal(c *gin.Context, record *index.Record, groups []privacy.Group) {
+	file, err := storage.Open(storage.Files, storage.Key(record.Path))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Photo not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+		return
+	}
+	defer file.Close()
+
+	var content io.ReadSeeker = file
+	etag := record.Hash
+	var contentType string
+	if len(groups) > 0 {
+		stripped, kind, err := stripOriginal(file, groups)
+		if errors.Is(err, privacy.ErrUnsupported) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Metadata can't be removed from this file format", "code": CodeMetadataNotRemovable})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+			return
+		}
+		content = bytes.NewReader(stripped)
+		etag += "-" + privacy.Key(groups)
+		contentType = kind.MIME
+	} else {
+		contentType = detectContentType(file)
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("ETag", `"`+etag+`"`)
+	c.Header("Cache-Control", "private, no-cache")
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(record.Path)}))
+
+	// ServeContent handles ranges and conditional requests. With an
+	// empty name it never guesses the type from the file extension.
+	http.ServeContent(c.Writer, c.Request, "", file.ModTime, content)
+}
+
+// stripOriginal reads a file and removes the metadata of the groups. The
+// format is checked before the file is read, so videos and other large
+// files that can't be rewritten are never loaded into memory.
+func stripOriginal(file *storage.Object, groups []privacy.Group) ([]byte, sniff.Type, error) {
+	kind, ok := sniff.Detect(file, file.Size)
+	if !ok || !privacy.Supports(kind) {
+		return nil, kind, privacy.ErrUnsupported
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, kind, err
+	}
+	stripped, err := privacy.Strip(data, groups)
+	return stripped, kind, err
+}
+
+// detectContentType identifies the file the way uploads are identified, so
+// HEIF, RAW and QuickTime files get their own media type. Files that aren't
+// in an accepted format are served as plain bytes.
+func detectContentType(file *storage.Object) string {
+	if kind, ok := sniff.Detect(file, file.Size); ok {
+		return kind.MIME
+	}
+	return "application/octet-stream"
+}
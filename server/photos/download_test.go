@@ -0,0 +1,165 @@
+package photos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"image-upload-server/index"
+)
+
+// setupDownload stores lena.jpeg for alice under a misleading extension and
+// returns a router serving downloads as the given user
+func setupDownload(t *testing.T, username string) (*gin.Engine, []byte, time.Time) {
+	setupTestLibrary(t)
+	uploadsDir := useStorage(t)
+
+	data, err := os.ReadFile("../testdata/lena.jpeg")
+	assert.NoError(t, err)
+	filePath := filepath.Join(uploadsDir, "alice", "na", "lena.png")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+	assert.NoError(t, os.WriteFile(filePath, data, 0644))
+	modTime := time.Date(2023, 4, 15, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, os.Chtimes(filePath, modTime, modTime))
+
+	assert.NoError(t, index.DB.Put(index.Record{
+		Hash:  "lenahash",
+		Path:  "/alice/na/lena.png",
+		Owner: "alice",
+		Size:  int64(len(data)),
+	}))
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/photos/:hash/original", func(c *gin.Context) {
+		c.Set("username", username)
+		c.Next()
+	}, HandleDownloadPhoto)
+	return r, data, modTime
+}
+
+func download(r *gin.Engine, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/photos/lenahash/original", nil)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestDownloadPhotoDetectsMediaTypes(t *testing.T) {
+	setupTestLibrary(t)
+	uploadsDir := useStorage(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/photos/:hash/original", func(c *gin.Context) {
+		c.Set("username", "alice")
+		c.Next()
+	}, HandleDownloadPhoto)
+
+	for source, contentType := range map[string]string{
+		"../testdata/stack/IMG_4211.HEIC": "image/heic",
+		"../testdata/stack/IMG_0815.CR2":  "image/x-canon-cr2",
+		"../testdata/stack/IMG_4211.MOV":  "video/quicktime",
+	} {
+		data, err := os.ReadFile(source)
+		assert.NoError(t, err)
+		name := filepath.Base(source)
+		assert.NoError(t, os.MkdirAll(filepath.Join(uploadsDir, "alice", "na"), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(uploadsDir, "alice", "na", name), data, 0644))
+		assert.NoError(t, index.DB.Put(index.Record{Hash: name, Path: "/alice/na/" + name, Owner: "alice", Size: int64(len(data))}))
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/photos/"+name+"/original", nil))
+		assert.Equal(t, http.StatusOK, w.Code, source)
+		assert.Equal(t, contentType, w.Header().Get("Content-Type"), source)
+		assert.Equal(t, data, w.Body.Bytes(), source)
+	}
+}
+
+func TestDownloadPhoto(t *testing.T) {
+	r, data, modTime := setupDownload(t, "alice")
+
+	w := download(r, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, data, w.Body.Bytes())
+	assert.Equal(t, `"lenahash"`, w.Header().Get("ETag"))
+	// Sniffed from the content, not taken from the .png extension
+	assert.Equal(t, "image/jpeg", w.Header().Get("Content-Type"))
+
+	w = download(r, map[string]string{"Range": "bytes=100-199"})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, data[100:200], w.Body.Bytes())
+	assert.Contains(t, w.Header().Get("Content-Range"), "bytes 100-199/")
+
+	w = download(r, map[string]string{"If-None-Match": `"lenahash"`})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	w = download(r, map[string]string{"If-Modified-Since": modTime.Add(time.Hour).Format(http.TimeFormat)})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	// A stale If-Range validator returns the whole file
+	w = download(r, map[string]string{"Range": "bytes=0-9", "If-Range": `"otherhash"`})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, len(data), w.Body.Len())
+}
+
+func TestDownloadPhotoOfAnotherUser(t *testing.T) {
+	r, _, _ := setupDownload(t, "bob")
+
+	w := download(r, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestDownloadPhotoStripsMetadata(t *testing.T) {
+	r, _, _ := setupDownload(t, "alice")
+	uploadsDir := useStorage(t)
+	r.GET("/photos/:hash/stripped", func(c *gin.Context) {
+		c.Set("username", "alice")
+		c.Next()
+	}, HandleDownloadPhoto)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(uploadsDir, "alice", "na"), 0755))
+	for hash, source := range map[string]string{
+		"camerahash": "../testdata/privacy/camera.jpg",
+		"gifhash":    "../testdata/formats/animation.gif",
+	} {
+		data, err := os.ReadFile(source)
+		assert.NoError(t, err)
+		name := filepath.Base(source)
+		assert.NoError(t, os.WriteFile(filepath.Join(uploadsDir, "alice", "na", name), data, 0644))
+		assert.NoError(t, index.DB.Put(index.Record{Hash: hash, Path: "/alice/na/" + name, Owner: "alice", Size: int64(len(data))}))
+	}
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	w := get("/photos/camerahash/stripped?strip=gps,serial_numbers")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/jpeg", w.Header().Get("Content-Type"))
+	assert.Equal(t, `"camerahash-gps+serial_numbers"`, w.Header().Get("ETag"))
+	assert.NotContains(t, w.Body.String(), "083021001234")
+	assert.NotContains(t, w.Body.String(), "http://ns.adobe.com/xap/1.0/")
+
+	// Without the parameter the original is served as it is
+	w = get("/photos/camerahash/stripped")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "083021001234")
+
+	w = get("/photos/camerahash/stripped?strip=faces")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = get("/photos/gifhash/stripped?strip=all")
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), CodeMetadataNotRemovable)
+}
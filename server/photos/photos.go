@@ -0,0 +1,344 @@
+package photos
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"image-upload-server/apikey"
+	"image-upload-server/derivatives"
+	"image-upload-server/exif"
+	"image-upload-server/index"
+	"image-upload-server/video"
+)
+
+const (
+	// Default and maximum number of photos per page
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// Photo is a single entry of the photo library. CaptureDate is the local
+// time in the zone named by CaptureTimeZone; CaptureDateUTC is the same
+// instant in UTC.
+type Photo struct {
+	Hash            string          `json:"hash"`
+	Path            string          `json:"path"`
+	Type            string          `json:"type"`
+	MediaType       string          `json:"media_type"`
+	Size            int64           `json:"size"`
+	CaptureDate     *time.Time      `json:"capture_date"`
+	CaptureDateUTC  *time.Time      `json:"capture_date_utc"`
+	CaptureTimeZone string          `json:"capture_time_zone,omitempty"`
+	DateResolver    string          `json:"date_resolver,omitempty"`
+	DateConfidence  string          `json:"date_confidence,omitempty"`
+	UploadedAt      time.Time       `json:"uploaded_at"`
+	Width           int             `json:"width"`
+	Height          int             `json:"height"`
+	Uploader        string          `json:"uploader"`
+	BlurHash        string          `json:"blurhash,omitempty"`
+	Exif            *exif.Metadata  `json:"exif,omitempty"`
+	Video           *video.Metadata `json:"video,omitempty"`
+	// Stack names the kind of asset for files stacked with others, e.g. a
+	// Live Photo, and Resources lists the other files of the asset
+	Stack     string     `json:"stack,omitempty"`
+	Resources []Resource `json:"resources,omitempty"`
+}
+
+// newPhoto converts an index record into a library entry
+func newPhoto(record *index.Record) Photo {
+	photo := Photo{
+		Hash:       record.Hash,
+		Path:       record.Path,
+		Type:       fileType(record.Path),
+		MediaType:  mediaType(record),
+		Size:       record.Size,
+		UploadedAt: record.UploadedAt,
+		Width:      record.Width,
+		Height:     record.Height,
+		Uploader:   record.Uploader,
+		BlurHash:   derivatives.BlurHash(record.Hash),
+		Exif:       record.Exif,
+		Video:      record.Video,
+	}
+	if !record.CaptureDate.IsZero() {
+		captureDate := record.CaptureDate
+		captureDateUTC := record.CaptureDate.UTC()
+		photo.CaptureDate = &captureDate
+		photo.CaptureDateUTC = &captureDateUTC
+		photo.CaptureTimeZone = record.CaptureTimeZone
+		photo.DateResolver = record.CaptureDateResolver
+		photo.DateConfidence = record.CaptureDateConfidence
+	}
+	return photo
+}
+
+// HandleListPhotos lists the authenticated user's photos from the upload
+// index, newest first unless order=asc is given. Supported filters are
+// captured_from/captured_to, uploaded_from/uploaded_to (YYYY-MM-DD or
+// RFC 3339), undated=true|false, type (comma separated file extensions),
+// media_type=image|video and min_size/max_size in bytes. Pages are
+// requested with limit and cursor. Stacked assets such as Live Photos are
+// listed once, as their primary file with the others as resources.
+func HandleListPhotos(c *gin.Context) {
+	username := c.GetString("username")
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	query, err := parseListQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query", "message": err.Error()})
+		return
+	}
+	query.Owner = username
+
+	// Keys limited to photos only list those
+	if key := apikey.FromContext(c); key != nil && key.Restricted() {
+		filter := query.Filter
+		query.Filter = func(record *index.Record) bool {
+			return key.AllowsPhoto(record.Hash) && (filter == nil || filter(record))
+		}
+	}
+
+	records, next, err := index.DB.List(query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+		return
+	}
+
+	photos := make([]Photo, 0, len(records))
+	for i := range records {
+		photo, err := stackedPhoto(&records[i])
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+			return
+		}
+		photos = append(photos, photo)
+	}
+
+	response := gin.H{"photos": photos, "next_cursor": nil}
+	if next != "" {
+		response["next_cursor"] = base64.RawURLEncoding.EncodeToString([]byte(next))
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// HandleGetPhoto returns a single photo of the authenticated user by its
+// content hash
+func HandleGetPhoto(c *gin.Context) {
+	record, ok := lookupOwnedPhoto(c)
+	if !ok {
+		return
+	}
+
+	photo, err := stackedPhoto(record)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, photo)
+}
+
+// lookupOwnedPhoto loads the photo named by the :hash route parameter,
+// answering 404 unless it belongs to the authenticated user
+func lookupOwnedPhoto(c *gin.Context) (*index.Record, bool) {
+	username := c.GetString("username")
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return nil, false
+	}
+
+	record, found, err := index.DB.LookupOwned(username, c.Param("hash"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+		return nil, false
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Photo not found"})
+		return nil, false
+	}
+	return record, true
+}
+
+// parseListQuery builds an index query from the request's query string
+func parseListQuery(c *gin.Context) (index.ListQuery, error) {
+	query := index.ListQuery{
+		Limit:      defaultPageSize,
+		Descending: c.DefaultQuery("order", "desc") != "asc",
+	}
+
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return query, fmt.Errorf("limit must be a positive number")
+		}
+		if limit > maxPageSize {
+			limit = maxPageSize
+		}
+		query.Limit = limit
+	}
+
+	if value := c.Query("cursor"); value != "" {
+		cursor, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			return query, fmt.Errorf("invalid cursor")
+		}
+		query.Cursor = string(cursor)
+	}
+
+	// The other files of stacked assets are listed with their primary file
+	filters := []func(record *index.Record) bool{
+		func(record *index.Record) bool { return !isHiddenResource(record) },
+	}
+
+	capturedFrom, capturedTo, err := parseRange(c, "captured_from", "captured_to")
+	if err != nil {
+		return query, err
+	}
+	if !capturedFrom.IsZero() || !capturedTo.IsZero() {
+		filters = append(filters, func(record *index.Record) bool {
+			return !record.CaptureDate.IsZero() && inRange(record.CaptureDate, capturedFrom, capturedTo)
+		})
+	}
+
+	uploadedFrom, uploadedTo, err := parseRange(c, "uploaded_from", "uploaded_to")
+	if err != nil {
+		return query, err
+	}
+	if !uploadedFrom.IsZero() || !uploadedTo.IsZero() {
+		filters = append(filters, func(record *index.Record) bool {
+			return inRange(record.UploadedAt, uploadedFrom, uploadedTo)
+		})
+	}
+
+	if value := c.Query("undated"); value != "" {
+		undated, err := strconv.ParseBool(value)
+		if err != nil {
+			return query, fmt.Errorf("undated must be true or false")
+		}
+		filters = append(filters, func(record *index.Record) bool {
+			return record.CaptureDate.IsZero() == undated
+		})
+	}
+
+	if value := c.Query("type"); value != "" {
+		types := make(map[string]bool)
+		for _, t := range strings.Split(value, ",") {
+			types[strings.ToLower(strings.TrimPrefix(strings.TrimSpace(t), "."))] = true
+		}
+		filters = append(filters, func(record *index.Record) bool {
+			return types[fileType(record.Path)]
+		})
+	}
+
+	if value := c.Query("media_type"); value != "" {
+		if value != index.MediaImage && value != index.MediaVideo {
+			return query, fmt.Errorf("media_type must be image or video")
+		}
+		filters = append(filters, func(record *index.Record) bool {
+			return mediaType(record) == value
+		})
+	}
+
+	minSize, err := parseSize(c, "min_size")
+	if err != nil {
+		return query, err
+	}
+	maxSize, err := parseSize(c, "max_size")
+	if err != nil {
+		return query, err
+	}
+	if minSize > 0 || maxSize > 0 {
+		filters = append(filters, func(record *index.Record) bool {
+			return record.Size >= minSize && (maxSize == 0 || record.Size <= maxSize)
+		})
+	}
+
+	query.Filter = func(record *index.Record) bool {
+		for _, filter := range filters {
+			if !filter(record) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return query, nil
+}
+
+// parseRange parses a pair of date query parameters. A date without a time
+// as upper bound includes the whole day.
+func parseRange(c *gin.Context, fromKey, toKey string) (time.Time, time.Time, error) {
+	from, _, err := parseTime(c.Query(fromKey))
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid %s: %v", fromKey, err)
+	}
+
+	to, dateOnly, err := parseTime(c.Query(toKey))
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid %s: %v", toKey, err)
+	}
+	if dateOnly {
+		to = to.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+
+	return from, to, nil
+}
+
+// parseTime parses a YYYY-MM-DD date or an RFC 3339 timestamp and reports
+// whether only a date was given
+func parseTime(value string) (time.Time, bool, error) {
+	if value == "" {
+		return time.Time{}, false, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	return t, false, err
+}
+
+func parseSize(c *gin.Context, key string) (int64, error) {
+	value := c.Query(key)
+	if value == "" {
+		return 0, nil
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("%s must be a number of bytes", key)
+	}
+	return size, nil
+}
+
+// inRange reports whether t lies within [from, to]; zero bounds are open
+func inRange(t, from, to time.Time) bool {
+	if !from.IsZero() && t.Before(from) {
+		return false
+	}
+	if !to.IsZero() && t.After(to) {
+		return false
+	}
+	return true
+}
+
+// fileType returns the lowercase file extension without the dot
+func fileType(relativePath string) string {
+	return strings.ToLower(strings.TrimPrefix(path.Ext(relativePath), "."))
+}
+
+// mediaType returns whether a record is an image or a video. Records
+// indexed before videos were supported are images.
+func mediaType(record *index.Record) string {
+	if record.MediaType == "" {
+		return index.MediaImage
+	}
+	return record.MediaType
+}
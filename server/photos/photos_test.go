@@ -0,0 +1,250 @@
+package photos
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"image-upload-server/apikey"
+	"image-upload-server/index"
+	"image-upload-server/storage"
+)
+
+// useStorage stores the library in a temporary directory, which is returned
+func useStorage(t *testing.T) string {
+	dir := t.TempDir()
+	previous := storage.Files
+	storage.Files = storage.NewLocal(dir)
+	t.Cleanup(func() { storage.Files = previous })
+	return dir
+}
+
+// setupTestLibrary fills a fresh index with photos of two users
+func setupTestLibrary(t *testing.T) {
+	db, err := index.Open(filepath.Join(t.TempDir(), "index.db"))
+	assert.NoError(t, err)
+	index.DB = db
+	t.Cleanup(func() { db.Close() })
+
+	uploaded := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	for i := 1; i <= 5; i++ {
+		assert.NoError(t, db.Put(index.Record{
+			Hash:        fmt.Sprintf("hash%d", i),
+			Path:        fmt.Sprintf("/alice/2023/%02d/photo%d.jpg", i, i),
+			Owner:       "alice",
+			Uploader:    "alice",
+			Size:        int64(i * 1000),
+			CaptureDate: time.Date(2023, time.Month(i), 15, 10, 0, 0, 0, time.UTC),
+			UploadedAt:  uploaded.AddDate(0, 0, i),
+			Width:       640,
+			Height:      480,
+		}))
+	}
+	assert.NoError(t, db.Put(index.Record{
+		Hash:       "undated",
+		Path:       "/alice/na/screenshot.png",
+		Owner:      "alice",
+		Uploader:   "alice",
+		Size:       500,
+		UploadedAt: uploaded,
+	}))
+	assert.NoError(t, db.Put(index.Record{
+		Hash:        "bobs",
+		Path:        "/bob/2023/03/photo.jpg",
+		Owner:       "bob",
+		Uploader:    "bob",
+		CaptureDate: time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC),
+	}))
+}
+
+func listPhotos(t *testing.T, username, query string) (int, []Photo, string) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/photos", func(c *gin.Context) {
+		c.Set("username", username)
+		c.Next()
+	}, HandleListPhotos)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/photos?"+query, nil))
+
+	var response struct {
+		Photos     []Photo `json:"photos"`
+		NextCursor *string `json:"next_cursor"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	next := ""
+	if response.NextCursor != nil {
+		next = *response.NextCursor
+	}
+	return w.Code, response.Photos, next
+}
+
+func hashes(photos []Photo) []string {
+	var result []string
+	for _, photo := range photos {
+		result = append(result, photo.Hash)
+	}
+	return result
+}
+
+func TestListPhotosPaginates(t *testing.T) {
+	setupTestLibrary(t)
+
+	// Newest first, undated last, only the user's own photos
+	code, page, next := listPhotos(t, "alice", "limit=4")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"hash5", "hash4", "hash3", "hash2"}, hashes(page))
+	assert.NotEmpty(t, next)
+
+	code, page, next = listPhotos(t, "alice", "limit=4&cursor="+next)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"hash1", "undated"}, hashes(page))
+	assert.Empty(t, next)
+
+	_, page, _ = listPhotos(t, "alice", "order=asc&limit=2")
+	assert.Equal(t, []string{"undated", "hash1"}, hashes(page))
+
+	_, page, _ = listPhotos(t, "bob", "")
+	assert.Equal(t, []string{"bobs"}, hashes(page))
+	assert.Equal(t, "/bob/2023/03/photo.jpg", page[0].Path)
+}
+
+func TestListPhotosFilters(t *testing.T) {
+	setupTestLibrary(t)
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"capture date range", "captured_from=2023-02-01&captured_to=2023-03-15", []string{"hash3", "hash2"}},
+		{"upload date range", "uploaded_from=2024-01-14", []string{"hash5", "hash4"}},
+		{"undated only", "undated=true", []string{"undated"}},
+		{"dated only", "undated=false&order=asc&limit=1", []string{"hash1"}},
+		{"file type", "type=PNG", []string{"undated"}},
+		{"size", "min_size=2000&max_size=3000", []string{"hash3", "hash2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, page, _ := listPhotos(t, "alice", tt.query)
+			assert.Equal(t, http.StatusOK, code)
+			assert.Equal(t, tt.want, hashes(page))
+		})
+	}
+
+	// No cursor is returned when the remaining records are all filtered out
+	_, page, next := listPhotos(t, "alice", "captured_from=2023-02-01&limit=4")
+	assert.Equal(t, []string{"hash5", "hash4", "hash3", "hash2"}, hashes(page))
+	assert.Empty(t, next)
+	_, page, next = listPhotos(t, "alice", "captured_from=2023-02-01&limit=3")
+	assert.Equal(t, []string{"hash5", "hash4", "hash3"}, hashes(page))
+	assert.NotEmpty(t, next)
+
+	code, _, _ := listPhotos(t, "alice", "captured_from=yesterday")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestListPhotosWithLimitedKey(t *testing.T) {
+	setupTestLibrary(t)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/photos", func(c *gin.Context) {
+		c.Set("username", "alice")
+		c.Set(apikey.ContextKey, &apikey.Key{Owner: "alice", Photos: []string{"hash2", "hash4", "bobs"}})
+		c.Next()
+	}, HandleListPhotos)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/photos?captured_from=2023-03-01", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response struct {
+		Photos []Photo `json:"photos"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, []string{"hash4"}, hashes(response.Photos))
+}
+
+func TestGetPhotoChecksOwner(t *testing.T) {
+	setupTestLibrary(t)
+
+	gin.SetMode(gin.TestMode)
+	get := func(username, hash string) *httptest.ResponseRecorder {
+		r := gin.New()
+		r.GET("/photos/:hash", func(c *gin.Context) {
+			c.Set("username", username)
+			c.Next()
+		}, HandleGetPhoto)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/photos/"+hash, nil))
+		return w
+	}
+
+	w := get("alice", "hash2")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var photo Photo
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &photo))
+	assert.Equal(t, "jpg", photo.Type)
+	assert.Equal(t, 640, photo.Width)
+
+	assert.Equal(t, http.StatusNotFound, get("alice", "bobs").Code)
+}
+
+func TestListPhotosStacksLivePhotos(t *testing.T) {
+	setupTestLibrary(t)
+
+	captured := time.Date(2024, 5, 18, 17, 20, 31, 0, time.UTC)
+	assert.NoError(t, index.DB.Put(index.Record{
+		Hash:        "live-video",
+		Path:        "/alice/2024/05/IMG_4211.MOV",
+		Owner:       "alice",
+		Size:        917,
+		CaptureDate: captured,
+		MediaType:   index.MediaVideo,
+		PairKey:     "live:5A7F3E2C",
+		PairRole:    index.RoleLiveVideo,
+	}))
+
+	// Until the photo arrives the video is listed on its own
+	_, page, _ := listPhotos(t, "alice", "captured_from=2024-01-01")
+	assert.Equal(t, []string{"live-video"}, hashes(page))
+	assert.Empty(t, page[0].Stack)
+
+	assert.NoError(t, index.DB.Put(index.Record{
+		Hash:        "live-photo",
+		Path:        "/alice/2024/05/IMG_4211.HEIC",
+		Owner:       "alice",
+		Size:        820,
+		CaptureDate: captured,
+		MediaType:   index.MediaImage,
+		PairKey:     "live:5A7F3E2C",
+		PairRole:    index.RolePrimary,
+	}))
+
+	_, page, _ = listPhotos(t, "alice", "captured_from=2024-01-01")
+	assert.Equal(t, []string{"live-photo"}, hashes(page))
+	assert.Equal(t, stackLivePhoto, page[0].Stack)
+	assert.Equal(t, []Resource{{
+		Hash:      "live-video",
+		Path:      "/alice/2024/05/IMG_4211.MOV",
+		Type:      "mov",
+		MediaType: index.MediaVideo,
+		Role:      index.RoleLiveVideo,
+		Size:      917,
+	}}, page[0].Resources)
+
+	// Deleting the photo unstacks the video
+	assert.NoError(t, index.DB.Remove("/alice/2024/05/IMG_4211.HEIC"))
+	_, page, _ = listPhotos(t, "alice", "captured_from=2024-01-01")
+	assert.Equal(t, []string{"live-video"}, hashes(page))
+	assert.Empty(t, page[0].Resources)
+}
@@ -0,0 +1,75 @@
+package photos
+
+import (
+	"strings"
+
+	"image-upload-server/index"
+	"image-upload-server/video"
+)
+
+// Kinds of stacked assets, named after the prefix of their pair key
+const (
+	stackLivePhoto = "live_photo"
+	stackRawJPEG   = "raw_jpeg"
+)
+
+// Resource is another file of a stacked asset, such as the video of a Live
+// Photo or the RAW file next to a JPEG
+type Resource struct {
+	Hash      string          `json:"hash"`
+	Path      string          `json:"path"`
+	Type      string          `json:"type"`
+	MediaType string          `json:"media_type"`
+	Role      string          `json:"role"`
+	Size      int64           `json:"size"`
+	Video     *video.Metadata `json:"video,omitempty"`
+}
+
+// isHiddenResource reports whether a record is listed as a resource of its
+// asset's primary file rather than on its own
+func isHiddenResource(record *index.Record) bool {
+	return record.Stacked && record.PairRole != index.RolePrimary
+}
+
+// stackedPhoto converts an index record into a library entry, with the
+// other files of its asset if it is stacked
+func stackedPhoto(record *index.Record) (Photo, error) {
+	photo := newPhoto(record)
+	if !record.Stacked || record.PairRole != index.RolePrimary {
+		return photo, nil
+	}
+
+	members, err := index.DB.Stack(record.Owner, record.PairKey)
+	if err != nil {
+		return photo, err
+	}
+	photo.Stack = stackKind(record.PairKey)
+	for i := range members {
+		member := &members[i]
+		if member.Path == record.Path || member.PairRole == index.RolePrimary {
+			continue
+		}
+		photo.Resources = append(photo.Resources, Resource{
+			Hash:      member.Hash,
+			Path:      member.Path,
+			Type:      fileType(member.Path),
+			MediaType: mediaType(member),
+			Role:      member.PairRole,
+			Size:      member.Size,
+			Video:     member.Video,
+		})
+	}
+	return photo, nil
+}
+
+// stackKind names the kind of asset from its pair key
+func stackKind(pairKey string) string {
+	switch {
+	case strings.HasPrefix(pairKey, "live:"):
+		return stackLivePhoto
+	case strings.HasPrefix(pairKey, "raw:"):
+		return stackRawJPEG
+	default:
+		return ""
+	}
+}
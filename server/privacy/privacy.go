@@ -0,0 +1,165 @@
+// Package privacy removes personal metadata from images before they leave
+// the server, e.g. through a share link: the location, the camera maker's
+// notes, device serial numbers and the owner's name. The EXIF structure is
+// rebuilt without the selected tags while the image data is copied as it
+// is, never re-encoded.
+package privacy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	exifcommon "github.com/dsoprea/go-exif/v3/common"
+
+	"image-upload-server/exifwrite"
+	"image-upload-server/sniff"
+)
+
+// Group is a set of related metadata tags that are removed together
+type Group string
+
+const (
+	// GPS is the GPS IFD with the location, altitude and direction
+	GPS Group = "gps"
+	// MakerNote is the camera maker's private data, which often holds
+	// serial numbers and other identifying details in undocumented formats
+	MakerNote Group = "maker_note"
+	// SerialNumbers are the serial numbers of the camera body and the lens
+	SerialNumbers Group = "serial_numbers"
+	// OwnerName is the camera owner's name and the artist
+	OwnerName Group = "owner_name"
+)
+
+// AllGroups are the groups that can be removed
+var AllGroups = []Group{GPS, MakerNote, SerialNumbers, OwnerName}
+
+// groupTags are the tags removed for each group, in IFD0 and in the EXIF
+// IFD. Removing the GPS IFD pointer from IFD0 drops the whole GPS IFD.
+var groupTags = map[Group]struct{ ifd0, exif []uint16 }{
+	GPS:           {ifd0: []uint16{0x8825}},
+	MakerNote:     {exif: []uint16{0x927C}, ifd0: []uint16{0xC634}},
+	SerialNumbers: {exif: []uint16{0xA431, 0xA435}, ifd0: []uint16{0xC62F}},
+	OwnerName:     {exif: []uint16{0xA430}, ifd0: []uint16{0x013B}},
+}
+
+// ErrUnsupported is returned for files whose metadata can't be rewritten
+var ErrUnsupported = exifwrite.ErrUnsupported
+
+// ParseGroups validates group names. "all" selects every group; the result
+// is sorted and free of duplicates.
+func ParseGroups(names []string) ([]Group, error) {
+	seen := make(map[Group]bool)
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if name == "all" {
+			for _, group := range AllGroups {
+				seen[group] = true
+			}
+			continue
+		}
+		if _, ok := groupTags[Group(name)]; !ok {
+			return nil, fmt.Errorf("unknown metadata group %q", name)
+		}
+		seen[Group(name)] = true
+	}
+
+	groups := make([]Group, 0, len(seen))
+	for group := range seen {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i] < groups[j] })
+	return groups, nil
+}
+
+// Strip returns a copy of an image without the metadata of the given
+// groups. JPEG, PNG, WebP and HEIF images are supported; XMP and IPTC
+// packets, which can repeat the location, serial numbers and owner, are
+// dropped unless only the maker notes are removed. Other files are
+// rejected with ErrUnsupported unless groups is empty, in which case the
+// data is returned unchanged.
+func Strip(data []byte, groups []Group) ([]byte, error) {
+	if len(groups) == 0 {
+		return data, nil
+	}
+
+	edit := func(tiffData []byte) ([]byte, bool, error) {
+		return stripTIFF(tiffData, groups)
+	}
+	return exifwrite.Rewrite(data, edit, exifwrite.Options{DropPackets: dropsPackets(groups)})
+}
+
+// Supports reports whether Strip can rewrite files of the given type
+func Supports(kind sniff.Type) bool {
+	return exifwrite.Supports(kind)
+}
+
+// Key names a selection of groups, e.g. in cache validators. Groups are
+// expected in the order returned by ParseGroups.
+func Key(groups []Group) string {
+	names := make([]string, len(groups))
+	for i, group := range groups {
+		names[i] = string(group)
+	}
+	return strings.Join(names, "+")
+}
+
+// dropsPackets reports whether XMP and IPTC packets must go for the groups
+func dropsPackets(groups []Group) bool {
+	for _, group := range groups {
+		if group != MakerNote {
+			return true
+		}
+	}
+	return false
+}
+
+// stripTIFF rebuilds a TIFF structure without the tags of the groups. It
+// reports false, and returns nothing, if none of them were present.
+func stripTIFF(tiffData []byte, groups []Group) ([]byte, bool, error) {
+	if tiffData == nil {
+		return nil, false, nil
+	}
+	root, err := exifwrite.Builder(tiffData)
+	if err != nil {
+		return nil, false, err
+	}
+	exifIFD, err := root.ChildWithTagId(exifcommon.IfdExifStandardIfdIdentity.TagId())
+	if err != nil {
+		exifIFD = nil
+	}
+
+	removed := 0
+	for _, group := range groups {
+		tags := groupTags[group]
+		for _, tag := range tags.ifd0 {
+			n, err := root.DeleteAll(tag)
+			if err != nil {
+				return nil, false, err
+			}
+			removed += n
+		}
+		if exifIFD == nil {
+			continue
+		}
+		for _, tag := range tags.exif {
+			n, err := exifIFD.DeleteAll(tag)
+			if err != nil {
+				return nil, false, err
+			}
+			removed += n
+		}
+	}
+	if removed == 0 {
+		return nil, false, nil
+	}
+
+	encoded, err := exifwrite.Encode(root)
+	if err != nil {
+		return nil, false, err
+	}
+	return encoded, true, nil
+}
@@ -0,0 +1,180 @@
+package privacy
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"os"
+	"testing"
+
+	exif "github.com/dsoprea/go-exif/v3"
+	exifcommon "github.com/dsoprea/go-exif/v3/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "golang.org/x/image/webp"
+
+	"image-upload-server/isobmff"
+	"image-upload-server/sniff"
+)
+
+// exifTags lists the tags of IFD0 and of the EXIF IFD found in a file
+func exifTags(t *testing.T, data []byte) (ifd0, exifIFD map[uint16]bool) {
+	t.Helper()
+	rawExif, err := exif.SearchAndExtractExif(data)
+	require.NoError(t, err)
+	mapping, err := exifcommon.NewIfdMappingWithStandard()
+	require.NoError(t, err)
+	_, index, err := exif.Collect(mapping, exif.NewTagIndex(), rawExif)
+	require.NoError(t, err)
+
+	ifd0 = make(map[uint16]bool)
+	for _, entry := range index.RootIfd.Entries() {
+		ifd0[entry.TagId()] = true
+	}
+	exifIFD = make(map[uint16]bool)
+	if child, err := index.RootIfd.ChildWithIfdPath(exifcommon.IfdExifStandardIfdIdentity); err == nil {
+		for _, entry := range child.Entries() {
+			exifIFD[entry.TagId()] = true
+		}
+	}
+	return ifd0, exifIFD
+}
+
+func readFixture(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return data
+}
+
+func TestStripJPEG(t *testing.T) {
+	data := readFixture(t, "../testdata/privacy/camera.jpg")
+
+	stripped, err := Strip(data, AllGroups)
+	require.NoError(t, err)
+
+	ifd0, exifIFD := exifTags(t, stripped)
+	assert.False(t, ifd0[0x8825], "GPS IFD")
+	assert.False(t, ifd0[0x013B], "Artist")
+	assert.False(t, exifIFD[0x927C], "MakerNote")
+	assert.False(t, exifIFD[0xA430], "CameraOwnerName")
+	assert.False(t, exifIFD[0xA431], "BodySerialNumber")
+	assert.False(t, exifIFD[0xA435], "LensSerialNumber")
+	assert.True(t, ifd0[0x010F], "Make")
+	assert.True(t, ifd0[0x8298], "Copyright")
+	assert.True(t, exifIFD[0x9003], "DateTimeOriginal")
+	assert.True(t, exifIFD[0xA434], "LensModel")
+
+	assert.NotContains(t, string(stripped), "http://ns.adobe.com/xap/1.0/")
+	assert.NotContains(t, string(stripped), "Photoshop 3.0")
+	assert.NotContains(t, string(stripped), "083021001234")
+
+	// The image data is copied, not re-encoded
+	before, err := jpeg.Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	after, err := jpeg.Decode(bytes.NewReader(stripped))
+	require.NoError(t, err)
+	assert.Equal(t, before.(*image.YCbCr).Y, after.(*image.YCbCr).Y)
+	assert.True(t, bytes.HasSuffix(data, stripped[bytes.LastIndex(stripped, []byte{0xFF, 0xDA}):]))
+}
+
+func TestStripSelectedGroups(t *testing.T) {
+	data := readFixture(t, "../testdata/privacy/camera.jpg")
+
+	stripped, err := Strip(data, []Group{MakerNote})
+	require.NoError(t, err)
+	ifd0, exifIFD := exifTags(t, stripped)
+	assert.False(t, exifIFD[0x927C], "MakerNote")
+	assert.True(t, ifd0[0x8825], "GPS IFD")
+	assert.True(t, exifIFD[0xA431], "BodySerialNumber")
+	// Only removing the maker notes keeps the XMP packet
+	assert.Contains(t, string(stripped), "http://ns.adobe.com/xap/1.0/")
+
+	stripped, err = Strip(data, []Group{GPS})
+	require.NoError(t, err)
+	ifd0, exifIFD = exifTags(t, stripped)
+	assert.False(t, ifd0[0x8825], "GPS IFD")
+	assert.True(t, exifIFD[0x927C], "MakerNote")
+	assert.True(t, ifd0[0x013B], "Artist")
+	assert.NotContains(t, string(stripped), "http://ns.adobe.com/xap/1.0/")
+}
+
+func TestStripPNGAndWebP(t *testing.T) {
+	for _, path := range []string{"../testdata/privacy/location.png", "../testdata/privacy/location.webp"} {
+		t.Run(path, func(t *testing.T) {
+			data := readFixture(t, path)
+			stripped, err := Strip(data, AllGroups)
+			require.NoError(t, err)
+
+			ifd0, exifIFD := exifTags(t, stripped)
+			assert.False(t, ifd0[0x8825], "GPS IFD")
+			assert.False(t, exifIFD[0xA431], "BodySerialNumber")
+			assert.True(t, ifd0[0x010F], "Make")
+			assert.NotContains(t, string(stripped), "GPSLatitude")
+
+			_, format, err := image.DecodeConfig(bytes.NewReader(stripped))
+			require.NoError(t, err)
+			assert.Contains(t, path, format)
+		})
+	}
+}
+
+func TestStripHEIF(t *testing.T) {
+	for _, path := range []string{"../testdata/heic/ios14.heic", "../testdata/heic/ios17.heic"} {
+		t.Run(path, func(t *testing.T) {
+			data := readFixture(t, path)
+			stripped, err := Strip(data, AllGroups)
+			require.NoError(t, err)
+
+			// The EXIF item is rewritten in place, so the item locations
+			// stay valid
+			assert.Len(t, stripped, len(data))
+			ifd0, _ := exifTags(t, stripped)
+			assert.False(t, ifd0[0x8825], "GPS IFD")
+			assert.True(t, ifd0[0x010F], "Make")
+
+			heif, err := isobmff.ParseHEIF(bytes.NewReader(stripped), int64(len(stripped)))
+			require.NoError(t, err)
+			assert.True(t, heif.HasExif())
+		})
+	}
+}
+
+func TestStripUnsupported(t *testing.T) {
+	data := readFixture(t, "../testdata/formats/animation.gif")
+
+	_, err := Strip(data, AllGroups)
+	assert.ErrorIs(t, err, ErrUnsupported)
+
+	// Nothing to remove, nothing to rewrite
+	unchanged, err := Strip(data, nil)
+	require.NoError(t, err)
+	assert.Equal(t, data, unchanged)
+}
+
+func TestParseGroups(t *testing.T) {
+	groups, err := ParseGroups([]string{"owner_name", " GPS ", "gps", ""})
+	require.NoError(t, err)
+	assert.Equal(t, []Group{GPS, OwnerName}, groups)
+
+	groups, err = ParseGroups([]string{"all"})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, AllGroups, groups)
+
+	groups, err = ParseGroups(nil)
+	require.NoError(t, err)
+	assert.Empty(t, groups)
+
+	_, err = ParseGroups([]string{"gps", "faces"})
+	assert.Error(t, err)
+}
+
+func TestSupports(t *testing.T) {
+	assert.True(t, Supports(sniff.JPEG))
+	assert.True(t, Supports(sniff.HEIC))
+	assert.True(t, Supports(sniff.AVIF))
+	assert.False(t, Supports(sniff.GIF))
+	assert.False(t, Supports(sniff.CR2))
+	assert.False(t, Supports(sniff.MP4))
+}
@@ -0,0 +1,136 @@
+package raw
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"image-upload-server/isobmff"
+)
+
+// User types of the uuid boxes of CR3 files
+var (
+	// canonMetadataUUID is the uuid box in moov holding the CMT1 to CMT4
+	// TIFF structures with the EXIF metadata and the THMB thumbnail
+	canonMetadataUUID = []byte{0x85, 0xc0, 0xb6, 0x87, 0x82, 0x0f, 0x11, 0xe0, 0x81, 0x11, 0xf4, 0xce, 0x46, 0x2b, 0x6a, 0x48}
+	// canonPreviewUUID is the top level uuid box holding the PRVW preview
+	canonPreviewUUID = []byte{0xea, 0xf4, 0x2b, 0x5e, 0x1c, 0x98, 0x4b, 0x88, 0xb9, 0xfb, 0xb7, 0xdc, 0x40, 0x6e, 0x4d, 0x16}
+)
+
+// cr3Exif combines IFD0 from CMT1, the EXIF IFD from CMT2 and the GPS IFD
+// from CMT4 into a single TIFF structure
+func cr3Exif(r io.ReaderAt, size int64) ([]byte, error) {
+	moov, err := cr3Moov(r, size)
+	if err != nil {
+		return nil, err
+	}
+	boxes, err := uuidChildren(r, moov, canonMetadataUUID, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var t0 *tiffFile
+	var ifds [3]*ifd
+	for i, boxType := range []string{"CMT1", "CMT2", "CMT4"} {
+		box, ok := isobmff.Find(boxes, boxType)
+		if !ok {
+			continue
+		}
+		t, err := newTIFF(r, box.Offset, box.Offset+box.Size)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s box: %w", boxType, err)
+		}
+		if i == 0 {
+			t0 = t
+		} else if t0 == nil || t.order != t0.order {
+			// Values are copied as they are, so they must share a byte order
+			continue
+		}
+		if ifds[i], err = t.readIFD(t.first); err != nil {
+			return nil, fmt.Errorf("error reading %s box: %w", boxType, err)
+		}
+	}
+	if t0 == nil {
+		return nil, errors.New("CMT1 box not found")
+	}
+	return compactTIFF(t0.order, ifds[0], ifds[1], ifds[2]), nil
+}
+
+// cr3Previews returns the locations of the JPEG data of the PRVW preview
+// and the THMB thumbnail of a CR3 file
+func cr3Previews(r io.ReaderAt, size int64) []location {
+	var previews []location
+	top, _ := isobmff.ReadBoxes(r, 0, size)
+	for _, box := range top {
+		if box.Type != "uuid" {
+			continue
+		}
+		// The PRVW box follows 8 bytes of unknown purpose
+		if children, err := uuidChildren(r, box, canonPreviewUUID, 8); err == nil {
+			if prvw, ok := isobmff.Find(children, "PRVW"); ok {
+				previews = appendJPEG(r, previews, prvw)
+			}
+		}
+	}
+
+	if moov, err := cr3Moov(r, size); err == nil {
+		if children, err := uuidChildren(r, moov, canonMetadataUUID, 0); err == nil {
+			if thmb, ok := isobmff.Find(children, "THMB"); ok {
+				previews = appendJPEG(r, previews, thmb)
+			}
+		}
+	}
+	return previews
+}
+
+// cr3Moov returns the moov box of a CR3 file
+func cr3Moov(r io.ReaderAt, size int64) (isobmff.Box, error) {
+	boxes, err := isobmff.ReadBoxes(r, 0, size)
+	moov, ok := isobmff.Find(boxes, "moov")
+	if !ok {
+		if err == nil {
+			err = errors.New("moov box not found")
+		}
+		return isobmff.Box{}, err
+	}
+	return moov, nil
+}
+
+// uuidChildren lists the boxes in the first uuid box with the given user
+// type among the children of parent, or in parent itself if it is one,
+// skipping skip bytes after the user type
+func uuidChildren(r io.ReaderAt, parent isobmff.Box, userType []byte, skip int64) ([]isobmff.Box, error) {
+	candidates := []isobmff.Box{parent}
+	if parent.Type != "uuid" {
+		candidates, _ = isobmff.Children(r, parent, 0)
+	}
+	for _, box := range candidates {
+		if box.Type != "uuid" || box.Size < 16 {
+			continue
+		}
+		head := make([]byte, 16)
+		if _, err := r.ReadAt(head, box.Offset); err != nil || !bytes.Equal(head, userType) {
+			continue
+		}
+		return isobmff.Children(r, box, 16+skip)
+	}
+	return nil, errors.New("uuid box not found")
+}
+
+// appendJPEG adds the JPEG data in a preview box, which starts after a
+// short header giving its size, to previews
+func appendJPEG(r io.ReaderAt, previews []location, box isobmff.Box) []location {
+	head := make([]byte, 64)
+	if box.Size < int64(len(head)) {
+		return previews
+	}
+	if _, err := r.ReadAt(head, box.Offset); err != nil {
+		return previews
+	}
+	start := bytes.Index(head, soi)
+	if start < 0 {
+		return previews
+	}
+	return append(previews, location{offset: box.Offset + int64(start), length: box.Size - int64(start)})
+}
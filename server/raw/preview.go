@@ -0,0 +1,128 @@
+package raw
+
+import (
+	"image/jpeg"
+	"io"
+)
+
+const (
+	// Compression values of JPEG compressed strips. Lossless JPEG sensor
+	// data uses them too; image/jpeg can't decode it, so it is skipped.
+	compressionOldJPEG = 6
+	compressionJPEG    = 7
+	// maxIFDs bounds the number of IFDs visited while looking for previews
+	maxIFDs = 32
+)
+
+// Preview is a JPEG image embedded in a RAW file
+type Preview struct {
+	// Offset and Length locate the JPEG data in the file
+	Offset int64
+	Length int64
+	Width  int
+	Height int
+}
+
+// soi is the start of image marker of JPEG data and the first byte of the
+// segment marker that follows it
+var soi = []byte{0xFF, 0xD8, 0xFF}
+
+// location is the offset and length of possible JPEG data
+type location struct {
+	offset int64
+	length int64
+}
+
+// Reader returns the JPEG data of the preview in r
+func (p *Preview) Reader(r io.ReaderAt) *io.SectionReader {
+	return io.NewSectionReader(r, p.Offset, p.Length)
+}
+
+// LargestPreview returns the largest embedded JPEG preview of a RAW file
+// that the image/jpeg package can decode. Most cameras embed one at the
+// full sensor resolution, next to smaller thumbnails.
+func LargestPreview(r io.ReaderAt, size int64) (*Preview, error) {
+	format, ok := Detect(r, size)
+	if !ok {
+		return nil, ErrNotRaw
+	}
+
+	var candidates []location
+	switch format {
+	case RAF:
+		if offset, length, err := rafJPEG(r, size); err == nil {
+			candidates = append(candidates, location{offset: offset, length: length})
+		}
+	case CR3:
+		candidates = cr3Previews(r, size)
+	default:
+		candidates = tiffPreviews(r, size)
+	}
+
+	var largest *Preview
+	for _, candidate := range candidates {
+		if candidate.offset < 0 || candidate.length <= 0 || candidate.offset+candidate.length > size {
+			continue
+		}
+		config, err := jpeg.DecodeConfig(io.NewSectionReader(r, candidate.offset, candidate.length))
+		if err != nil {
+			continue
+		}
+		if largest == nil || config.Width*config.Height > largest.Width*largest.Height {
+			largest = &Preview{Offset: candidate.offset, Length: candidate.length, Width: config.Width, Height: config.Height}
+		}
+	}
+	if largest == nil {
+		return nil, ErrNoPreview
+	}
+	return largest, nil
+}
+
+// tiffPreviews returns the locations of the JPEG images referenced by the
+// IFD chain of a TIFF based RAW file and by the IFDs in their SubIFDs tags,
+// either as JPEGInterchangeFormat or as a single JPEG compressed strip
+func tiffPreviews(r io.ReaderAt, size int64) []location {
+	t, err := newTIFF(r, 0, size)
+	if err != nil {
+		return nil
+	}
+
+	var previews []location
+	visited := make(map[uint32]bool)
+	queue := []uint32{t.first}
+	for len(queue) > 0 && len(visited) < maxIFDs {
+		offset := queue[0]
+		queue = queue[1:]
+		if offset == 0 || visited[offset] {
+			continue
+		}
+		visited[offset] = true
+		dir, err := t.readIFD(offset)
+		if err != nil {
+			continue
+		}
+
+		queue = append(queue, dir.next)
+		if subIFDs, ok := dir.find(tagSubIFDs); ok {
+			for i := 0; i < int(subIFDs.count); i++ {
+				if sub, ok := t.uint(dir, tagSubIFDs, i); ok {
+					queue = append(queue, sub)
+				}
+			}
+		}
+
+		if offset, ok := t.uint(dir, tagJPEGOffset, 0); ok {
+			if length, ok := t.uint(dir, tagJPEGLength, 0); ok {
+				previews = append(previews, location{offset: int64(offset), length: int64(length)})
+			}
+		}
+		compression, _ := t.uint(dir, tagCompression, 0)
+		strips, _ := dir.find(tagStripOffsets)
+		if (compression == compressionOldJPEG || compression == compressionJPEG) && strips.count == 1 {
+			offset, _ := t.uint(dir, tagStripOffsets, 0)
+			length, _ := t.uint(dir, tagStripByteCounts, 0)
+			previews = append(previews, location{offset: int64(offset), length: int64(length)})
+		}
+	}
+	return previews
+}
@@ -0,0 +1,183 @@
+// Package raw reads camera RAW files without external tools: it detects
+// the format by its magic bytes, collects the EXIF metadata from the
+// format's IFDs and locates the JPEG previews embedded by the camera
+package raw
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"image-upload-server/isobmff"
+)
+
+// Format is a camera RAW file format
+type Format string
+
+const (
+	// DNG is Adobe's Digital Negative, written by some cameras and phones
+	// and by converters
+	DNG Format = "dng"
+	// CR2 is the TIFF based format of older Canon cameras
+	CR2 Format = "cr2"
+	// CR3 is the ISOBMFF based format of newer Canon cameras
+	CR3 Format = "cr3"
+	// NEF is Nikon's TIFF based format
+	NEF Format = "nef"
+	// ARW is Sony's TIFF based format
+	ARW Format = "arw"
+	// RAF is Fujifilm's format, which wraps a JPEG and the sensor data
+	RAF Format = "raf"
+)
+
+var (
+	// ErrNotRaw is returned for files that aren't in a supported RAW format
+	ErrNotRaw = errors.New("not a RAW file")
+	// ErrNoPreview is returned when a RAW file has no decodable JPEG preview
+	ErrNoPreview = errors.New("no embedded JPEG preview found")
+)
+
+// Magic bytes of the formats that have a signature of their own
+var (
+	rafMagic = []byte("FUJIFILMCCD-RAW ")
+	cr2Magic = []byte("CR\x02\x00")
+)
+
+// cr3Brand is the ftyp brand of Canon CR3 files
+const cr3Brand = "crx "
+
+// Detect returns the format of a RAW file from its magic bytes. The TIFF
+// based formats without a signature of their own are told apart by the
+// DNGVersion tag and the camera make in IFD0.
+func Detect(r io.ReaderAt, size int64) (Format, bool) {
+	head := make([]byte, 16)
+	if size < int64(len(head)) {
+		return "", false
+	}
+	if _, err := r.ReadAt(head, 0); err != nil {
+		return "", false
+	}
+	if bytes.Equal(head, rafMagic) {
+		return RAF, true
+	}
+	if brands, err := isobmff.Brands(r, size); err == nil {
+		if len(brands) > 0 && brands[0] == cr3Brand {
+			return CR3, true
+		}
+		return "", false
+	}
+
+	t, err := newTIFF(r, 0, size)
+	if err != nil {
+		return "", false
+	}
+	if t.order == binary.LittleEndian && bytes.Equal(head[8:12], cr2Magic) {
+		return CR2, true
+	}
+	ifd0, err := t.readIFD(t.first)
+	if err != nil {
+		return "", false
+	}
+	if _, ok := ifd0.find(tagDNGVersion); ok {
+		return DNG, true
+	}
+	cameraMake := strings.ToUpper(t.ascii(ifd0, tagMake))
+	switch {
+	case strings.HasPrefix(cameraMake, "NIKON"):
+		return NEF, true
+	case strings.HasPrefix(cameraMake, "SONY"):
+		return ARW, true
+	}
+	return "", false
+}
+
+// Exif returns the EXIF metadata of a RAW file as a TIFF structure holding
+// IFD0 and the EXIF and GPS IFDs, like the payload of a JPEG APP1 segment.
+// Image data, previews and pointers to other parts of the file are left
+// out, so the result stays small however large the file is.
+func Exif(r io.ReaderAt, size int64) ([]byte, error) {
+	format, ok := Detect(r, size)
+	if !ok {
+		return nil, ErrNotRaw
+	}
+
+	switch format {
+	case RAF:
+		// The EXIF data is the one of the embedded JPEG
+		offset, length, err := rafJPEG(r, size)
+		if err != nil {
+			return nil, err
+		}
+		return jpegExif(io.NewSectionReader(r, offset, length))
+	case CR3:
+		return cr3Exif(r, size)
+	}
+
+	t, err := newTIFF(r, 0, size)
+	if err != nil {
+		return nil, err
+	}
+	ifd0, err := t.readIFD(t.first)
+	if err != nil {
+		return nil, fmt.Errorf("error reading IFD0: %w", err)
+	}
+	exifIFD, err := t.subIFD(ifd0, tagExifIFD)
+	if err != nil {
+		return nil, fmt.Errorf("error reading EXIF IFD: %w", err)
+	}
+	gpsIFD, err := t.subIFD(ifd0, tagGPSIFD)
+	if err != nil {
+		return nil, fmt.Errorf("error reading GPS IFD: %w", err)
+	}
+	return compactTIFF(t.order, ifd0, exifIFD, gpsIFD), nil
+}
+
+// rafJPEG returns the location of the JPEG embedded in a RAF file, which
+// the header gives after the model name and format version
+func rafJPEG(r io.ReaderAt, size int64) (int64, int64, error) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 84); err != nil {
+		return 0, 0, fmt.Errorf("error reading RAF header: %w", err)
+	}
+	offset := int64(binary.BigEndian.Uint32(header[0:4]))
+	length := int64(binary.BigEndian.Uint32(header[4:8]))
+	if offset < 92 || length == 0 || offset+length > size {
+		return 0, 0, fmt.Errorf("invalid RAF JPEG location %d+%d", offset, length)
+	}
+	return offset, length, nil
+}
+
+// jpegExif returns the TIFF structure of the EXIF APP1 segment of a JPEG
+func jpegExif(r io.ReaderAt) ([]byte, error) {
+	marker := make([]byte, 4)
+	if _, err := r.ReadAt(marker[:2], 0); err != nil || marker[0] != 0xFF || marker[1] != 0xD8 {
+		return nil, errors.New("embedded image is not a JPEG")
+	}
+
+	// Segments follow the start of image marker up to the start of scan
+	for offset := int64(2); ; {
+		if _, err := r.ReadAt(marker, offset); err != nil {
+			return nil, errors.New("EXIF segment not found")
+		}
+		if marker[0] != 0xFF || marker[1] == 0xDA {
+			return nil, errors.New("EXIF segment not found")
+		}
+		length := int64(binary.BigEndian.Uint16(marker[2:4]))
+		if length < 2 {
+			return nil, errors.New("invalid JPEG segment")
+		}
+		if marker[1] == 0xE1 && length > 8 {
+			segment := make([]byte, length-2)
+			if _, err := r.ReadAt(segment, offset+4); err != nil {
+				return nil, err
+			}
+			if bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+				return segment[6:], nil
+			}
+		}
+		offset += 2 + length
+	}
+}
@@ -0,0 +1,100 @@
+package raw
+
+import (
+	"bytes"
+	"image/jpeg"
+	"os"
+	"testing"
+
+	goexif "github.com/rwcarlsen/goexif/exif"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readFile(t *testing.T, path string) (*bytes.Reader, int64) {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return bytes.NewReader(data), int64(len(data))
+}
+
+func TestRawFiles(t *testing.T) {
+	tests := []struct {
+		path          string
+		format        Format
+		model         string
+		date          string
+		width, height int
+	}{
+		{"../testdata/raw/canon.cr2", CR2, "Canon EOS 5D Mark IV", "2022:09:03 11:07:45", 480, 320},
+		{"../testdata/raw/canon.cr3", CR3, "Canon EOS R5", "2024:02:10 09:41:27", 480, 320},
+		{"../testdata/raw/nikon.nef", NEF, "NIKON Z 6_2", "2021:07:14 06:32:10", 480, 320},
+		{"../testdata/raw/sony.arw", ARW, "ILCE-7M3", "2019:12:24 18:05:00", 320, 212},
+		{"../testdata/raw/pixel.dng", DNG, "Pixel 7 Pro", "2023:08:19 14:22:05", 480, 320},
+		{"../testdata/raw/fuji.raf", RAF, "X-T4", "2020:10:31 16:45:12", 480, 320},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			r, size := readFile(t, tt.path)
+
+			format, ok := Detect(r, size)
+			assert.True(t, ok)
+			assert.Equal(t, tt.format, format)
+
+			tiffData, err := Exif(r, size)
+			require.NoError(t, err)
+			x, err := goexif.Decode(bytes.NewReader(tiffData))
+			require.NoError(t, err)
+			model, err := x.Get(goexif.Model)
+			require.NoError(t, err)
+			value, _ := model.StringVal()
+			assert.Equal(t, tt.model, value)
+			date, err := x.Get(goexif.DateTimeOriginal)
+			require.NoError(t, err)
+			value, _ = date.StringVal()
+			assert.Equal(t, tt.date, value)
+
+			// The largest preview wins over thumbnails and lossless sensor data
+			preview, err := LargestPreview(r, size)
+			require.NoError(t, err)
+			assert.Equal(t, tt.width, preview.Width)
+			assert.Equal(t, tt.height, preview.Height)
+			img, err := jpeg.Decode(preview.Reader(r))
+			require.NoError(t, err)
+			assert.Equal(t, tt.width, img.Bounds().Dx())
+		})
+	}
+}
+
+func TestDetectRejectsOtherFiles(t *testing.T) {
+	for _, path := range []string{"../testdata/exif_gps.jpg", "../testdata/heic/ios14.heic", "../testdata/video/iphone.mov"} {
+		r, size := readFile(t, path)
+		_, ok := Detect(r, size)
+		assert.False(t, ok, path)
+		_, err := LargestPreview(r, size)
+		assert.ErrorIs(t, err, ErrNotRaw)
+	}
+}
+
+func TestExifLeavesOutImageData(t *testing.T) {
+	r, size := readFile(t, "../testdata/raw/nikon.nef")
+	tiffData, err := Exif(r, size)
+	require.NoError(t, err)
+
+	compact, err := newTIFF(bytes.NewReader(tiffData), 0, int64(len(tiffData)))
+	require.NoError(t, err)
+	ifd0, err := compact.readIFD(compact.first)
+	require.NoError(t, err)
+	for _, tag := range []uint16{tagSubIFDs, tagStripOffsets, tagJPEGOffset} {
+		_, found := ifd0.find(tag)
+		assert.False(t, found, "tag %#04x", tag)
+	}
+	assert.Equal(t, "NIKON CORPORATION", compact.ascii(ifd0, tagMake))
+
+	x, err := goexif.Decode(bytes.NewReader(tiffData))
+	require.NoError(t, err)
+	lat, long, err := x.LatLong()
+	require.NoError(t, err)
+	assert.InDelta(t, 46.55, lat, 1e-6)
+	assert.InDelta(t, 7+58.0/60+30.0/3600, long, 1e-6)
+}
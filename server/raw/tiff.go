@@ -0,0 +1,299 @@
+package raw
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// TIFF tags of interest
+const (
+	tagCompression     = 0x0103
+	tagMake            = 0x010F
+	tagStripOffsets    = 0x0111
+	tagStripByteCounts = 0x0117
+	tagTileOffsets     = 0x0144
+	tagTileByteCounts  = 0x0145
+	tagSubIFDs         = 0x014A
+	tagJPEGOffset      = 0x0201
+	tagJPEGLength      = 0x0202
+	tagXMP             = 0x02BC
+	tagExifIFD         = 0x8769
+	tagGPSIFD          = 0x8825
+	tagInteropIFD      = 0xA005
+	tagDNGVersion      = 0xC612
+	tagDNGPrivateData  = 0xC634
+)
+
+// Field types whose values are offsets or counts
+const (
+	typeShort = 3
+	typeLong  = 4
+	typeIFD   = 13
+)
+
+const (
+	// maxEntries bounds the number of entries of an IFD
+	maxEntries = 1000
+	// maxValueSize bounds the values that are read; larger ones such as
+	// strip tables of the sensor data are not needed and left empty
+	maxValueSize = 256 << 10
+)
+
+// typeSizes are the sizes in bytes of the TIFF field types
+var typeSizes = map[uint16]uint64{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4,
+}
+
+// skippedTags are left out of the compact EXIF structure: they point to
+// image data or other IFDs, or hold large blobs nobody reads from it
+var skippedTags = map[uint16]bool{
+	tagStripOffsets: true, tagStripByteCounts: true, tagTileOffsets: true, tagTileByteCounts: true,
+	tagSubIFDs: true, tagJPEGOffset: true, tagJPEGLength: true, tagXMP: true,
+	tagExifIFD: true, tagGPSIFD: true, tagInteropIFD: true, tagDNGPrivateData: true,
+}
+
+// tiffFile reads the IFDs of a TIFF structure that starts at base
+type tiffFile struct {
+	r     io.ReaderAt
+	base  int64
+	size  int64
+	order binary.ByteOrder
+	// first is the offset of IFD0
+	first uint32
+}
+
+// entry is an IFD entry with its value in the byte order of the file
+type entry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	// value is nil when it is larger than maxValueSize or out of bounds
+	value []byte
+}
+
+// ifd is an image file directory
+type ifd struct {
+	entries []entry
+	next    uint32
+}
+
+// newTIFF reads the TIFF header at base; size is the size of r
+func newTIFF(r io.ReaderAt, base, size int64) (*tiffFile, error) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, base); err != nil {
+		return nil, errors.New("not a TIFF structure")
+	}
+	t := &tiffFile{r: r, base: base, size: size}
+	switch string(header[:4]) {
+	case "II*\x00":
+		t.order = binary.LittleEndian
+	case "MM\x00*":
+		t.order = binary.BigEndian
+	default:
+		return nil, errors.New("not a TIFF structure")
+	}
+	t.first = t.order.Uint32(header[4:8])
+	return t, nil
+}
+
+// readIFD reads the IFD at an offset from the start of the TIFF structure
+func (t *tiffFile) readIFD(offset uint32) (*ifd, error) {
+	start := t.base + int64(offset)
+	if offset < 8 || start+2 > t.size {
+		return nil, fmt.Errorf("IFD offset %d out of bounds", offset)
+	}
+	head := make([]byte, 2)
+	if _, err := t.r.ReadAt(head, start); err != nil {
+		return nil, err
+	}
+	count := int(t.order.Uint16(head))
+	if count == 0 || count > maxEntries {
+		return nil, fmt.Errorf("invalid IFD entry count %d", count)
+	}
+	data := make([]byte, count*12+4)
+	if _, err := t.r.ReadAt(data, start+2); err != nil {
+		return nil, fmt.Errorf("truncated IFD at %d", offset)
+	}
+
+	dir := &ifd{next: t.order.Uint32(data[count*12:])}
+	for i := 0; i < count; i++ {
+		raw := data[i*12 : i*12+12]
+		e := entry{tag: t.order.Uint16(raw[0:]), typ: t.order.Uint16(raw[2:]), count: t.order.Uint32(raw[4:])}
+		typeSize, ok := typeSizes[e.typ]
+		if !ok {
+			continue
+		}
+		size := typeSize * uint64(e.count)
+		if size <= 4 {
+			e.value = append([]byte(nil), raw[8:8+size]...)
+		} else if size <= maxValueSize {
+			valueOffset := t.base + int64(t.order.Uint32(raw[8:]))
+			if valueOffset+int64(size) <= t.size {
+				e.value = make([]byte, size)
+				if _, err := t.r.ReadAt(e.value, valueOffset); err != nil {
+					e.value = nil
+				}
+			}
+		}
+		dir.entries = append(dir.entries, e)
+	}
+	return dir, nil
+}
+
+// subIFD reads the IFD a pointer tag of dir points to, nil if it has none
+func (t *tiffFile) subIFD(dir *ifd, tag uint16) (*ifd, error) {
+	offset, ok := t.uint(dir, tag, 0)
+	if !ok {
+		return nil, nil
+	}
+	return t.readIFD(offset)
+}
+
+// find returns the entry for a tag
+func (d *ifd) find(tag uint16) (entry, bool) {
+	for _, e := range d.entries {
+		if e.tag == tag {
+			return e, true
+		}
+	}
+	return entry{}, false
+}
+
+// uint returns the i-th value of a SHORT, LONG or IFD entry
+func (t *tiffFile) uint(dir *ifd, tag uint16, i int) (uint32, bool) {
+	e, ok := dir.find(tag)
+	if !ok || i >= int(e.count) {
+		return 0, false
+	}
+	switch e.typ {
+	case typeShort:
+		if len(e.value) >= 2*i+2 {
+			return uint32(t.order.Uint16(e.value[2*i:])), true
+		}
+	case typeLong, typeIFD:
+		if len(e.value) >= 4*i+4 {
+			return t.order.Uint32(e.value[4*i:]), true
+		}
+	}
+	return 0, false
+}
+
+// ascii returns the value of an ASCII entry, empty if missing
+func (t *tiffFile) ascii(dir *ifd, tag uint16) string {
+	e, ok := dir.find(tag)
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+}
+
+// compactTIFF writes IFD0 and the EXIF and GPS IFDs, any of the latter may
+// be nil, into a new TIFF structure in the given byte order, which must be
+// the one the values were read in
+func compactTIFF(order binary.ByteOrder, ifd0, exifIFD, gpsIFD *ifd) []byte {
+	pointer := func(tag uint16, offset uint32) entry {
+		value := make([]byte, 4)
+		order.PutUint32(value, offset)
+		return entry{tag: tag, typ: typeLong, count: 1, value: value}
+	}
+
+	entries0 := compactEntries(ifd0)
+	exifEntries := compactEntries(exifIFD)
+	gpsEntries := compactEntries(gpsIFD)
+	if len(exifEntries) > 0 {
+		entries0 = append(entries0, pointer(tagExifIFD, 0))
+	}
+	if len(gpsEntries) > 0 {
+		entries0 = append(entries0, pointer(tagGPSIFD, 0))
+	}
+
+	// Place the IFDs one after the other to know the pointer values
+	exifOffset := 8 + ifdSize(entries0)
+	gpsOffset := exifOffset + ifdSize(exifEntries)
+	for i := range entries0 {
+		switch entries0[i].tag {
+		case tagExifIFD:
+			entries0[i] = pointer(tagExifIFD, exifOffset)
+		case tagGPSIFD:
+			entries0[i] = pointer(tagGPSIFD, gpsOffset)
+		}
+	}
+	sortEntries(entries0)
+
+	buf := new(bytes.Buffer)
+	if order == binary.LittleEndian {
+		buf.WriteString("II*\x00")
+	} else {
+		buf.WriteString("MM\x00*")
+	}
+	binary.Write(buf, order, uint32(8))
+	writeIFD(buf, order, entries0)
+	if len(exifEntries) > 0 {
+		writeIFD(buf, order, exifEntries)
+	}
+	if len(gpsEntries) > 0 {
+		writeIFD(buf, order, gpsEntries)
+	}
+	return buf.Bytes()
+}
+
+// compactEntries returns the entries of dir worth keeping, in tag order
+func compactEntries(dir *ifd) []entry {
+	if dir == nil {
+		return nil
+	}
+	var entries []entry
+	for _, e := range dir.entries {
+		if e.value != nil && !skippedTags[e.tag] {
+			entries = append(entries, e)
+		}
+	}
+	sortEntries(entries)
+	return entries
+}
+
+func sortEntries(entries []entry) {
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+}
+
+// ifdSize returns the size of an IFD with its out of line values
+func ifdSize(entries []entry) uint32 {
+	size := uint32(2 + 12*len(entries) + 4)
+	for _, e := range entries {
+		if len(e.value) > 4 {
+			size += uint32(len(e.value)+1) &^ 1
+		}
+	}
+	return size
+}
+
+// writeIFD appends an IFD at the end of buf, followed by its values
+func writeIFD(buf *bytes.Buffer, order binary.ByteOrder, entries []entry) {
+	valuesOffset := uint32(buf.Len()) + 2 + 12*uint32(len(entries)) + 4
+	values := new(bytes.Buffer)
+
+	binary.Write(buf, order, uint16(len(entries)))
+	for _, e := range entries {
+		binary.Write(buf, order, e.tag)
+		binary.Write(buf, order, e.typ)
+		binary.Write(buf, order, e.count)
+		if len(e.value) <= 4 {
+			field := make([]byte, 4)
+			copy(field, e.value)
+			buf.Write(field)
+			continue
+		}
+		binary.Write(buf, order, valuesOffset+uint32(values.Len()))
+		values.Write(e.value)
+		if values.Len()%2 == 1 {
+			values.WriteByte(0)
+		}
+	}
+	binary.Write(buf, order, uint32(0))
+	buf.Write(values.Bytes())
+}
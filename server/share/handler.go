@@ -0,0 +1,214 @@
+package share
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"image-upload-server/derivatives"
+	"image-upload-server/index"
+	"image-upload-server/photos"
+	"image-upload-server/privacy"
+	"image-upload-server/sniff"
+	"image-upload-server/storage"
+	"image-upload-server/user"
+)
+
+// PathPrefix is where shared photos are served, followed by the token
+const PathPrefix = "/s/"
+
+// shareResponse is a share as returned by the API, with the path it is
+// served under
+type shareResponse struct {
+	Share
+	URL string `json:"url"`
+}
+
+func newShareResponse(share Share) shareResponse {
+	return shareResponse{Share: share, URL: PathPrefix + share.Token}
+}
+
+// HandleCreateShare creates a link to one of the authenticated user's
+// photos. The request may name the metadata groups to remove, which
+// default to the user's preference, and the number of seconds after which
+// the link expires.
+func HandleCreateShare(c *gin.Context) {
+	username := c.GetString("username")
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var request struct {
+		StripMetadata *[]string `json:"strip_metadata"`
+		ExpiresIn     int64     `json:"expires_in"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if request.ExpiresIn < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in must not be negative"})
+		return
+	}
+
+	record, found, err := index.DB.LookupOwned(username, c.Param("hash"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Photo not found"})
+		return
+	}
+
+	var groups []privacy.Group
+	if request.StripMetadata != nil {
+		groups, err = privacy.ParseGroups(*request.StripMetadata)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	} else {
+		owner, _ := user.UserDB.GetUser(username)
+		groups = owner.ShareStripGroups()
+	}
+
+	if len(groups) > 0 {
+		supported, err := canStrip(record)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+			return
+		}
+		if !supported {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Metadata can't be removed from this file format", "code": photos.CodeMetadataNotRemovable})
+			return
+		}
+	}
+
+	share := Share{
+		Owner:         username,
+		Hash:          record.Hash,
+		StripMetadata: groups,
+		CreatedAt:     time.Now().UTC(),
+	}
+	if request.ExpiresIn > 0 {
+		expiresAt := share.CreatedAt.Add(time.Duration(request.ExpiresIn) * time.Second)
+		share.ExpiresAt = &expiresAt
+	}
+	if err := DB.Create(&share); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, newShareResponse(share))
+}
+
+// HandleListShares lists the authenticated user's share links
+func HandleListShares(c *gin.Context) {
+	username := c.GetString("username")
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	shares, err := DB.List(username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+		return
+	}
+
+	response := make([]shareResponse, len(shares))
+	for i, share := range shares {
+		response[i] = newShareResponse(share)
+	}
+	c.JSON(http.StatusOK, gin.H{"shares": response})
+}
+
+// HandleDeleteShare revokes one of the authenticated user's share links
+func HandleDeleteShare(c *gin.Context) {
+	username := c.GetString("username")
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	deleted, err := DB.Delete(username, c.Param("token"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// HandleSharedOriginal serves the original of a shared photo without the
+// metadata the share removes. It needs no authentication.
+func HandleSharedOriginal(c *gin.Context) {
+	share, record, ok := lookupShare(c)
+	if !ok {
+		return
+	}
+	photos.ServeOriginal(c, record, share.StripMetadata)
+}
+
+// HandleSharedThumbnail serves the thumbnail of a shared photo
+func HandleSharedThumbnail(c *gin.Context) {
+	serveSharedDerivative(c, derivatives.Thumbnail)
+}
+
+// HandleSharedPreview serves the preview of a shared photo
+func HandleSharedPreview(c *gin.Context) {
+	serveSharedDerivative(c, derivatives.Preview)
+}
+
+func serveSharedDerivative(c *gin.Context, kind derivatives.Kind) {
+	_, record, ok := lookupShare(c)
+	if !ok {
+		return
+	}
+	photos.ServeDerivative(c, record, kind)
+}
+
+// lookupShare loads the share named by the :token route parameter and the
+// photo it links to, answering 404 if either is gone or the link expired
+func lookupShare(c *gin.Context) (*Share, *index.Record, bool) {
+	share, found, err := DB.Get(c.Param("token"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+		return nil, nil, false
+	}
+	if !found || share.Expired(time.Now()) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share not found"})
+		return nil, nil, false
+	}
+
+	record, found, err := index.DB.LookupOwned(share.Owner, share.Hash)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error", "message": err.Error()})
+		return nil, nil, false
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share not found"})
+		return nil, nil, false
+	}
+	return share, record, true
+}
+
+// canStrip reports whether metadata can be removed from the record's file
+func canStrip(record *index.Record) (bool, error) {
+	file, err := storage.Open(storage.Files, storage.Key(record.Path))
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	kind, ok := sniff.Detect(file, file.Size)
+	return ok && privacy.Supports(kind), nil
+}
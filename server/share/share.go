@@ -0,0 +1,220 @@
+// Package share manages links that give people without an account access to
+// a single photo. Each link names the metadata groups removed from the
+// original before it is served, so a shared photo doesn't reveal where it
+// was taken or which camera took it.
+package share
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"image-upload-server/privacy"
+	"image-upload-server/tokenutil"
+)
+
+var (
+	// sharesBucket maps a token to its JSON encoded Share
+	sharesBucket = []byte("shares")
+	// byOwnerBucket lists each owner's shares; keys are owner + "\x00" +
+	// token
+	byOwnerBucket = []byte("by_owner")
+)
+
+// tokenBytes is the number of random bytes in a token
+const tokenBytes = 24
+
+var (
+	// DB is the global share store
+	DB *Store
+)
+
+// Share is a link to one of a user's photos
+type Share struct {
+	Token string `json:"token"`
+	Owner string `json:"owner"`
+	Hash  string `json:"hash"`
+	// StripMetadata are the metadata groups removed from the original
+	StripMetadata []privacy.Group `json:"strip_metadata"`
+	CreatedAt     time.Time       `json:"created_at"`
+	// ExpiresAt is nil for links that don't expire
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Expired reports whether the link can no longer be used at the given time
+func (s *Share) Expired(now time.Time) bool {
+	return s.ExpiresAt != nil && !now.Before(*s.ExpiresAt)
+}
+
+// Store keeps share links in an embedded bbolt database
+type Store struct {
+	db *bolt.DB
+}
+
+// Init opens the share store in the data directory
+func Init(dataDir string) error {
+	dbPath := filepath.Join(dataDir, "shares.db")
+	var err error
+	DB, err = Open(dbPath)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Share store initialized at %s", dbPath)
+	return nil
+}
+
+// Open opens or creates the share database at path. The share tokens are
+// stored as they are, so only the server may read the file.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening share store: %w", err)
+	}
+	// Databases created before were readable by everyone
+	if err := os.Chmod(path, 0600); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error opening share store: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{sharesBucket, byOwnerBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error initializing share store: %w", err)
+	}
+
+	return &Store{db: db}, nil
+}
+
+// Close closes the underlying database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Create stores a new share with a random token, which is set in share
+func (s *Store) Create(share *Share) error {
+	token, err := tokenutil.Random(tokenBytes)
+	if err != nil {
+		return err
+	}
+	share.Token = token
+
+	data, err := json.Marshal(share)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(sharesBucket).Put([]byte(share.Token), data); err != nil {
+			return err
+		}
+		return tx.Bucket(byOwnerBucket).Put(ownerKey(share.Owner, share.Token), nil)
+	})
+}
+
+// Get returns the share with the given token
+func (s *Store) Get(token string) (*Share, bool, error) {
+	var share *Share
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		share, err = getShare(tx, []byte(token))
+		return err
+	})
+	return share, share != nil, err
+}
+
+// List returns the owner's shares, newest first
+func (s *Store) List(owner string) ([]Share, error) {
+	shares := []Share{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := ownerKey(owner, "")
+		cursor := tx.Bucket(byOwnerBucket).Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && strings.HasPrefix(string(key), string(prefix)); key, _ = cursor.Next() {
+			share, err := getShare(tx, key[len(prefix):])
+			if err != nil {
+				return err
+			}
+			if share != nil {
+				shares = append(shares, *share)
+			}
+		}
+		return nil
+	})
+	sort.SliceStable(shares, func(i, j int) bool { return shares[i].CreatedAt.After(shares[j].CreatedAt) })
+	return shares, err
+}
+
+// Delete removes one of the owner's shares. It reports false if the owner
+// has no share with the token.
+func (s *Store) Delete(owner, token string) (bool, error) {
+	deleted := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		share, err := getShare(tx, []byte(token))
+		if err != nil || share == nil || share.Owner != owner {
+			return err
+		}
+		if err := tx.Bucket(sharesBucket).Delete([]byte(token)); err != nil {
+			return err
+		}
+		deleted = true
+		return tx.Bucket(byOwnerBucket).Delete(ownerKey(owner, token))
+	})
+	return deleted, err
+}
+
+// Rehash points the owner's shares of a photo to its new content hash,
+// after the file was rewritten
+func (s *Store) Rehash(owner, oldHash, newHash string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		prefix := ownerKey(owner, "")
+		cursor := tx.Bucket(byOwnerBucket).Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && strings.HasPrefix(string(key), string(prefix)); key, _ = cursor.Next() {
+			token := key[len(prefix):]
+			share, err := getShare(tx, token)
+			if err != nil {
+				return err
+			}
+			if share == nil || share.Hash != oldHash {
+				continue
+			}
+			share.Hash = newHash
+			data, err := json.Marshal(share)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(sharesBucket).Put(token, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func getShare(tx *bolt.Tx, token []byte) (*Share, error) {
+	data := tx.Bucket(sharesBucket).Get(token)
+	if data == nil {
+		return nil, nil
+	}
+	var share Share
+	if err := json.Unmarshal(data, &share); err != nil {
+		return nil, fmt.Errorf("error decoding share %s: %w", token, err)
+	}
+	return &share, nil
+}
+
+func ownerKey(owner, token string) []byte {
+	return []byte(owner + "\x00" + token)
+}
@@ -0,0 +1,226 @@
+package share
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"image-upload-server/index"
+	"image-upload-server/privacy"
+	"image-upload-server/storage"
+	"image-upload-server/user"
+)
+
+// setupShares stores camera.jpg and a GIF for alice and returns a router
+// serving the share routes, authenticated as alice
+func setupShares(t *testing.T) *gin.Engine {
+	dir := t.TempDir()
+	uploadsDir := filepath.Join(dir, "uploads")
+
+	store, err := Open(filepath.Join(dir, "shares.db"))
+	require.NoError(t, err)
+	DB = store
+	t.Cleanup(func() { store.Close() })
+
+	idx, err := index.Open(filepath.Join(dir, "index.db"))
+	require.NoError(t, err)
+	index.DB = idx
+	t.Cleanup(func() { idx.Close() })
+
+	user.UserDB, err = user.NewUserDatabase(filepath.Join(dir, "users.json"))
+	require.NoError(t, err)
+	require.NoError(t, user.UserDB.AddUser("alice", "secret", "alice@example.com"))
+
+	previous := storage.Files
+	storage.Files = storage.NewLocal(uploadsDir)
+	t.Cleanup(func() { storage.Files = previous })
+
+	require.NoError(t, os.MkdirAll(filepath.Join(uploadsDir, "alice", "na"), 0755))
+	for hash, source := range map[string]string{
+		"camerahash": "../testdata/privacy/camera.jpg",
+		"gifhash":    "../testdata/formats/animation.gif",
+	} {
+		data, err := os.ReadFile(source)
+		require.NoError(t, err)
+		name := filepath.Base(source)
+		require.NoError(t, os.WriteFile(filepath.Join(uploadsDir, "alice", "na", name), data, 0644))
+		require.NoError(t, idx.Put(index.Record{Hash: hash, Path: "/alice/na/" + name, Owner: "alice", Size: int64(len(data))}))
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET(PathPrefix+":token", HandleSharedOriginal)
+	authorized := r.Group("/", func(c *gin.Context) {
+		c.Set("username", "alice")
+		c.Next()
+	})
+	authorized.POST("/photos/:hash/shares", HandleCreateShare)
+	authorized.GET("/shares", HandleListShares)
+	authorized.DELETE("/shares/:token", HandleDeleteShare)
+	return r
+}
+
+func request(r *gin.Engine, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func createShare(t *testing.T, r *gin.Engine, hash, body string) shareResponse {
+	w := request(r, http.MethodPost, "/photos/"+hash+"/shares", body)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created shareResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	return created
+}
+
+func TestShareRemovesMetadata(t *testing.T) {
+	r := setupShares(t)
+
+	// Without a choice in the request, the owner's preference applies,
+	// which removes everything by default
+	created := createShare(t, r, "camerahash", "")
+	assert.Equal(t, privacy.AllGroups, created.StripMetadata)
+	assert.Equal(t, PathPrefix+created.Token, created.URL)
+	assert.Nil(t, created.ExpiresAt)
+
+	w := request(r, http.MethodGet, created.URL, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/jpeg", w.Header().Get("Content-Type"))
+	assert.NotContains(t, w.Body.String(), "083021001234")
+	assert.NotContains(t, w.Body.String(), "http://ns.adobe.com/xap/1.0/")
+	assert.Contains(t, w.Body.String(), "Canon")
+
+	// An explicit empty list shares the original as it is
+	created = createShare(t, r, "camerahash", `{"strip_metadata": []}`)
+	assert.Empty(t, created.StripMetadata)
+	w = request(r, http.MethodGet, created.URL, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "083021001234")
+}
+
+func TestShareUsesPreference(t *testing.T) {
+	r := setupShares(t)
+	require.NoError(t, user.UserDB.SetStripMetadata("alice", []privacy.Group{privacy.GPS}))
+
+	created := createShare(t, r, "camerahash", "{}")
+	assert.Equal(t, []privacy.Group{privacy.GPS}, created.StripMetadata)
+
+	w := request(r, http.MethodGet, created.URL, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "083021001234")
+	assert.NotContains(t, w.Body.String(), "http://ns.adobe.com/xap/1.0/")
+}
+
+func TestCreateShareValidation(t *testing.T) {
+	r := setupShares(t)
+
+	w := request(r, http.MethodPost, "/photos/missing/shares", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = request(r, http.MethodPost, "/photos/camerahash/shares", `{"strip_metadata": ["faces"]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request(r, http.MethodPost, "/photos/camerahash/shares", `{"expires_in": -1}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// GIF metadata can't be rewritten, so it can only be shared as it is
+	w = request(r, http.MethodPost, "/photos/gifhash/shares", `{"strip_metadata": ["gps"]}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	createShare(t, r, "gifhash", `{"strip_metadata": []}`)
+}
+
+func TestShareExpiresAndIsRevoked(t *testing.T) {
+	r := setupShares(t)
+
+	expiring := createShare(t, r, "camerahash", `{"expires_in": 3600}`)
+	require.NotNil(t, expiring.ExpiresAt)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *expiring.ExpiresAt, time.Minute)
+	assert.True(t, expiring.Expired(time.Now().Add(2*time.Hour)))
+	assert.False(t, expiring.Expired(time.Now()))
+
+	other := createShare(t, r, "camerahash", "")
+
+	w := request(r, http.MethodGet, "/shares", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var listed struct {
+		Shares []shareResponse `json:"shares"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	assert.Len(t, listed.Shares, 2)
+
+	w = request(r, http.MethodDelete, "/shares/"+other.Token, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = request(r, http.MethodGet, other.URL, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = request(r, http.MethodDelete, "/shares/"+other.Token, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = request(r, http.MethodGet, PathPrefix+"unknown", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestStoreRejectsOtherOwners(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "shares.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	share := Share{Owner: "alice", Hash: "hash", CreatedAt: time.Now()}
+	require.NoError(t, store.Create(&share))
+	assert.NotEmpty(t, share.Token)
+
+	deleted, err := store.Delete("bob", share.Token)
+	require.NoError(t, err)
+	assert.False(t, deleted)
+
+	shares, err := store.List("bob")
+	require.NoError(t, err)
+	assert.Empty(t, shares)
+
+	got, found, err := store.Get(share.Token)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "alice", got.Owner)
+
+	// Only the owner's shares follow a rewritten photo
+	require.NoError(t, store.Rehash("bob", "hash", "other"))
+	got, _, err = store.Get(share.Token)
+	require.NoError(t, err)
+	assert.Equal(t, "hash", got.Hash)
+	require.NoError(t, store.Rehash("alice", "hash", "rewritten"))
+	got, _, err = store.Get(share.Token)
+	require.NoError(t, err)
+	assert.Equal(t, "rewritten", got.Hash)
+}
+
+func TestOpenRestrictsFileMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shares.db")
+	store, err := Open(path)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// A database created readable by everyone is tightened
+	require.NoError(t, os.Chmod(path, 0644))
+	store, err = Open(path)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
@@ -0,0 +1,142 @@
+// Package sniff identifies uploaded files by their magic numbers. Only the
+// image and video formats the server knows how to read are recognized, so
+// anything else, whatever its name, is turned away.
+package sniff
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"image-upload-server/isobmff"
+	"image-upload-server/raw"
+)
+
+// Kind groups the accepted formats by how their content is read
+type Kind string
+
+const (
+	// Image formats are decoded with the image package
+	Image Kind = "image"
+	// HEIF images can't be decoded; their size is read from the meta box
+	HEIF Kind = "heif"
+	// Raw camera files are decoded from their embedded JPEG preview
+	Raw Kind = "raw"
+	// Video files are never decoded
+	Video Kind = "video"
+)
+
+// Type is an accepted media type
+type Type struct {
+	// MIME is the media type, e.g. "image/jpeg"
+	MIME string
+	// Extension is the lowercase extension, with the dot, files of the
+	// type are stored with
+	Extension string
+	Kind      Kind
+}
+
+// The accepted media types
+var (
+	JPEG = Type{MIME: "image/jpeg", Extension: ".jpg", Kind: Image}
+	PNG  = Type{MIME: "image/png", Extension: ".png", Kind: Image}
+	GIF  = Type{MIME: "image/gif", Extension: ".gif", Kind: Image}
+	WebP = Type{MIME: "image/webp", Extension: ".webp", Kind: Image}
+
+	HEIC = Type{MIME: "image/heic", Extension: ".heic", Kind: HEIF}
+	AVIF = Type{MIME: "image/avif", Extension: ".avif", Kind: HEIF}
+	// HEIFImage is a HEIF image in a codec other than HEVC or AV1
+	HEIFImage = Type{MIME: "image/heif", Extension: ".heif", Kind: HEIF}
+
+	DNG = Type{MIME: "image/x-adobe-dng", Extension: ".dng", Kind: Raw}
+	CR2 = Type{MIME: "image/x-canon-cr2", Extension: ".cr2", Kind: Raw}
+	CR3 = Type{MIME: "image/x-canon-cr3", Extension: ".cr3", Kind: Raw}
+	NEF = Type{MIME: "image/x-nikon-nef", Extension: ".nef", Kind: Raw}
+	ARW = Type{MIME: "image/x-sony-arw", Extension: ".arw", Kind: Raw}
+	RAF = Type{MIME: "image/x-fuji-raf", Extension: ".raf", Kind: Raw}
+
+	MP4       = Type{MIME: "video/mp4", Extension: ".mp4", Kind: Video}
+	QuickTime = Type{MIME: "video/quicktime", Extension: ".mov", Kind: Video}
+	M4V       = Type{MIME: "video/x-m4v", Extension: ".m4v", Kind: Video}
+	ThreeGPP  = Type{MIME: "video/3gpp", Extension: ".3gp", Kind: Video}
+)
+
+// rawTypes maps the RAW formats to their media types
+var rawTypes = map[raw.Format]Type{
+	raw.DNG: DNG, raw.CR2: CR2, raw.CR3: CR3, raw.NEF: NEF, raw.ARW: ARW, raw.RAF: RAF,
+}
+
+// Magic numbers of the formats recognized by their first bytes
+var (
+	jpegMagic     = []byte{0xFF, 0xD8, 0xFF}
+	pngMagic      = []byte("\x89PNG\r\n\x1a\n")
+	gifMagics     = [][]byte{[]byte("GIF87a"), []byte("GIF89a")}
+	riffMagic     = []byte("RIFF")
+	webpFormMagic = []byte("WEBP")
+)
+
+// Detect identifies the media type of a file of the given size from its
+// content. It reports false for files that aren't in an accepted format.
+func Detect(r io.ReaderAt, size int64) (Type, bool) {
+	head := make([]byte, 12)
+	n, _ := r.ReadAt(head, 0)
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, jpegMagic):
+		return JPEG, true
+	case bytes.HasPrefix(head, pngMagic):
+		return PNG, true
+	case bytes.HasPrefix(head, gifMagics[0]) || bytes.HasPrefix(head, gifMagics[1]):
+		return GIF, true
+	case len(head) == 12 && bytes.Equal(head[0:4], riffMagic) && bytes.Equal(head[8:12], webpFormMagic):
+		return WebP, true
+	}
+
+	// RAW files come first: CR3 files are ISOBMFF files listing movie
+	// brands, and the other TIFF based formats have no magic of their own
+	if format, ok := raw.Detect(r, size); ok {
+		return rawTypes[format], true
+	}
+	if isobmff.IsHEIF(r, size) {
+		return heifType(r, size), true
+	}
+	if isobmff.IsMovie(r, size) {
+		return movieType(r, size), true
+	}
+	return Type{}, false
+}
+
+// heifType tells HEIC and AVIF images from other HEIF images by their
+// major brand
+func heifType(r io.ReaderAt, size int64) Type {
+	brands, _ := isobmff.Brands(r, size)
+	if len(brands) == 0 {
+		return HEIFImage
+	}
+	switch brands[0] {
+	case "heic", "heix", "heim", "heis":
+		return HEIC
+	case "avif", "avis":
+		return AVIF
+	}
+	return HEIFImage
+}
+
+// movieType tells the video containers apart by their major brand.
+// QuickTime files written before ftyp was introduced have none.
+func movieType(r io.ReaderAt, size int64) Type {
+	brands, err := isobmff.Brands(r, size)
+	if err != nil || len(brands) == 0 {
+		return QuickTime
+	}
+	switch major := brands[0]; {
+	case major == "qt  ":
+		return QuickTime
+	case major == "M4V " || major == "M4VP":
+		return M4V
+	case strings.HasPrefix(major, "3gp") || strings.HasPrefix(major, "3g2"):
+		return ThreeGPP
+	}
+	return MP4
+}
@@ -0,0 +1,78 @@
+package sniff
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		path string
+		want Type
+	}{
+		{"../testdata/lena.jpeg", JPEG},
+		{"../testdata/exif_gps.jpg", JPEG},
+		{"../testdata/formats/screenshot.png", PNG},
+		{"../testdata/formats/animation.gif", GIF},
+		{"../testdata/formats/photo.webp", WebP},
+		{"../testdata/heic/ios17.heic", HEIC},
+		{"../testdata/raw/canon.cr2", CR2},
+		{"../testdata/raw/canon.cr3", CR3},
+		{"../testdata/raw/nikon.nef", NEF},
+		{"../testdata/raw/sony.arw", ARW},
+		{"../testdata/raw/pixel.dng", DNG},
+		{"../testdata/raw/fuji.raf", RAF},
+		{"../testdata/video/android.mp4", MP4},
+		{"../testdata/video/iphone.mov", QuickTime},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			data, err := os.ReadFile(tt.path)
+			require.NoError(t, err)
+
+			got, ok := Detect(bytes.NewReader(data), int64(len(data)))
+			assert.True(t, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestDetectRejectsOtherContent(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"empty":      nil,
+		"HTML":       []byte("<!DOCTYPE html><html><script>alert(1)</script></html>"),
+		"text":       []byte("just some text"),
+		"PDF":        []byte("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n"),
+		"plain TIFF": []byte("II*\x00\x08\x00\x00\x00\x00\x00\x00\x00"),
+		"WAV":        []byte("RIFF\x24\x00\x00\x00WAVEfmt "),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, ok := Detect(bytes.NewReader(data), int64(len(data)))
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestDetectBrands(t *testing.T) {
+	ftyp := func(major string) []byte {
+		return append([]byte("\x00\x00\x00\x14ftyp"+major+"\x00\x00\x00\x00"), []byte("isom")...)
+	}
+	for major, want := range map[string]Type{
+		"mp42": MP4,
+		"qt  ": QuickTime,
+		"M4V ": M4V,
+		"3gp5": ThreeGPP,
+		"avif": AVIF,
+		"mif1": HEIFImage,
+	} {
+		data := ftyp(major)
+		got, ok := Detect(bytes.NewReader(data), int64(len(data)))
+		assert.True(t, ok, major)
+		assert.Equal(t, want, got, major)
+	}
+}
@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// localTempDir is the directory inside the root where Put writes files
+// before they are renamed into place, on the same filesystem so the rename
+// is atomic
+const localTempDir = ".tmp"
+
+// Local keeps the library in a directory on the local filesystem. Files are
+// written to a temporary file and renamed into place, and directory changes
+// are synced so they survive a crash. Directories left empty by Delete and
+// Move are removed.
+type Local struct {
+	root string
+}
+
+// NewLocal returns a backend storing files under root
+func NewLocal(root string) *Local {
+	return &Local{root: root}
+}
+
+// Root returns the directory holding the files
+func (l *Local) Root() string {
+	return l.root
+}
+
+// path returns the location of a key on disk
+func (l *Local) path(key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
+
+// Put writes the content to a temporary file first, so readers never see a
+// partially written file
+func (l *Local) Put(key string, r io.Reader, size int64) error {
+	filePath, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	tmpDir := filepath.Join(l.root, localTempDir)
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(tmpDir, "put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, r)
+	if err == nil && written != size {
+		err = fmt.Errorf("storing %s: read %d bytes, expected %d", key, written, size)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return l.rename(tmp.Name(), filePath)
+}
+
+// Import renames a local file into place. The file must be on the same
+// filesystem as the root, e.g. in a directory inside it.
+func (l *Local) Import(key, localPath string) error {
+	filePath, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	return l.rename(localPath, filePath)
+}
+
+// Link hard links an existing file to another key
+func (l *Local) Link(existing, key string) error {
+	existingPath, err := l.path(existing)
+	if err != nil {
+		return err
+	}
+	filePath, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	if err := os.Link(existingPath, filePath); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(filePath))
+}
+
+func (l *Local) Get(key string, offset, length int64) (io.ReadCloser, error) {
+	file, err := l.open(key)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if length < 0 {
+		return file, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, length), file}, nil
+}
+
+// open opens the file of a key for reading
+func (l *Local) open(key string) (*os.File, error) {
+	filePath, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filePath)
+}
+
+func (l *Local) Stat(key string) (Info, error) {
+	filePath, err := l.path(key)
+	if err != nil {
+		return Info{}, err
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return Info{}, err
+	}
+	if info.IsDir() {
+		return Info{}, notExist("stat", key)
+	}
+	return Info{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// List walks the directory the prefix lies in, so listing a user's files
+// doesn't read the whole library
+func (l *Local) List(prefix string, fn func(info Info) error) error {
+	start := l.root
+	if dir := path.Dir(prefix + "x"); dir != "." {
+		start = filepath.Join(l.root, filepath.FromSlash(dir))
+	}
+
+	err := filepath.Walk(start, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if filePath != l.root && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.root, filePath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		return fn(Info{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+	})
+	if os.IsNotExist(err) && start != l.root {
+		// Nothing was stored under the prefix yet
+		return nil
+	}
+	return err
+}
+
+func (l *Local) Delete(key string) error {
+	filePath, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filePath); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	l.removeEmptyParents(filePath)
+	return nil
+}
+
+// Move renames the file, which keeps its modification time
+func (l *Local) Move(from, to string) error {
+	fromPath, err := l.path(from)
+	if err != nil {
+		return err
+	}
+	toPath, err := l.path(to)
+	if err != nil {
+		return err
+	}
+	if err := l.rename(fromPath, toPath); err != nil {
+		return err
+	}
+	l.removeEmptyParents(fromPath)
+	return nil
+}
+
+// rename moves a file into place, creating its directory, and syncs the
+// directory so the new entry survives a crash
+func (l *Local) rename(oldPath, newPath string) error {
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(newPath))
+}
+
+// removeEmptyParents removes the directories a file was removed from, if
+// they are empty now, up to the root
+func (l *Local) removeEmptyParents(filePath string) {
+	root := filepath.Clean(l.root) + string(filepath.Separator)
+	for dir := filepath.Dir(filePath); strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		// Fails harmlessly when the directory still has content
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+}
+
+// syncDir flushes a directory entry change to disk
+func syncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
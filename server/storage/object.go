@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+const (
+	// blockSize is the amount read from remote backends at once for
+	// ReadAt, as metadata parsers make many small reads close together
+	blockSize = 64 << 10
+	// maxBlocks is the number of blocks kept for ReadAt
+	maxBlocks = 16
+)
+
+// Object is a stored file opened for reading. It supports sequential reads
+// with seeking, for serving downloads, and random access through ReadAt,
+// for reading metadata. Files of the local backend are read directly; other
+// backends are read with ranged Gets.
+type Object struct {
+	Info
+
+	file    *os.File
+	backend Backend
+
+	// Sequential reading: the open body starts at bodyOffset
+	offset     int64
+	body       io.ReadCloser
+	bodyOffset int64
+
+	// Blocks read for ReadAt, by block number, oldest first in order
+	blocks map[int64][]byte
+	order  []int64
+}
+
+// localOpener is implemented by backends whose files can be opened directly
+type localOpener interface {
+	open(key string) (*os.File, error)
+}
+
+// Open opens a stored file for reading
+func Open(b Backend, key string) (*Object, error) {
+	if opener, ok := b.(localOpener); ok {
+		file, err := opener.open(key)
+		if err != nil {
+			return nil, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &Object{Info: Info{Key: key, Size: info.Size(), ModTime: info.ModTime()}, file: file}, nil
+	}
+
+	info, err := b.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Object{Info: info, backend: b, blocks: make(map[int64][]byte)}, nil
+}
+
+func (o *Object) Read(p []byte) (int, error) {
+	if o.file != nil {
+		return o.file.Read(p)
+	}
+	if o.offset >= o.Size {
+		return 0, io.EOF
+	}
+	if o.body == nil || o.bodyOffset != o.offset {
+		o.closeBody()
+		body, err := o.backend.Get(o.Key, o.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		o.body, o.bodyOffset = body, o.offset
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	o.bodyOffset += int64(n)
+	if err == io.EOF && o.offset < o.Size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (o *Object) Seek(offset int64, whence int) (int64, error) {
+	if o.file != nil {
+		return o.file.Seek(offset, whence)
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.Size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	// The open body is kept for reads continuing where it left off
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *Object) ReadAt(p []byte, off int64) (int, error) {
+	if o.file != nil {
+		return o.file.ReadAt(p, off)
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(p) {
+		if off+int64(n) >= o.Size {
+			return n, io.EOF
+		}
+		number := (off + int64(n)) / blockSize
+		block, err := o.block(number)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], block[off+int64(n)-number*blockSize:])
+	}
+	return n, nil
+}
+
+// block returns a block of the file, reading it if it is not kept
+func (o *Object) block(number int64) ([]byte, error) {
+	if block, ok := o.blocks[number]; ok {
+		return block, nil
+	}
+	body, err := o.backend.Get(o.Key, number*blockSize, blockSize)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	block, err := io.ReadAll(io.LimitReader(body, blockSize))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(block)) < blockSize && number*blockSize+int64(len(block)) < o.Size {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	if len(o.order) >= maxBlocks {
+		delete(o.blocks, o.order[0])
+		o.order = o.order[1:]
+	}
+	o.blocks[number] = block
+	o.order = append(o.order, number)
+	return block, nil
+}
+
+func (o *Object) Close() error {
+	if o.file != nil {
+		return o.file.Close()
+	}
+	o.closeBody()
+	o.blocks = nil
+	return nil
+}
+
+func (o *Object) closeBody() {
+	if o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+}
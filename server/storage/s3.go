@@ -0,0 +1,477 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// s3PartSize is the size of the parts of multipart uploads and copies.
+	// S3 requires at least 5MB for all but the last part.
+	s3PartSize = 64 << 20
+	// s3MaxParts is the maximum number of parts of a multipart upload
+	s3MaxParts = 10000
+	// s3MaxCopySize is the largest object CopyObject can copy, larger ones
+	// are copied part by part
+	s3MaxCopySize = 5 << 30
+	// unsignedPayload is sent instead of the hash of streamed bodies
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	// emptyPayload is the SHA-256 of an empty body
+	emptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Config holds the settings of an S3-compatible object store
+type S3Config struct {
+	// Endpoint is the URL of the service, e.g. "https://s3.eu-central-1.amazonaws.com"
+	// or "http://localhost:9000" for MinIO
+	Endpoint string
+	// Region signed into requests, "us-east-1" if empty
+	Region string
+	Bucket string
+	// Prefix is prepended to all keys, to keep the library in a part of
+	// the bucket
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// VirtualHosted addresses the bucket as a subdomain of the endpoint
+	// instead of the first path segment, which MinIO expects by default
+	VirtualHosted bool
+	// Client sends the requests, http.DefaultClient if nil
+	Client *http.Client
+}
+
+// S3 stores the library in a bucket of an S3-compatible object store such
+// as Amazon S3 or MinIO. Requests are signed with AWS Signature Version 4.
+// Large files are uploaded in parts, and Move is a copy followed by a
+// delete, so moving a file changes its modification time.
+type S3 struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+
+	partSize    int64
+	maxCopySize int64
+}
+
+// NewS3 returns a backend storing files in the configured bucket
+func NewS3(config S3Config) (*S3, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", config.Endpoint)
+	}
+	if config.Bucket == "" {
+		return nil, errors.New("no S3 bucket configured")
+	}
+	if config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return nil, errors.New("no S3 credentials configured")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	config.Prefix = strings.Trim(config.Prefix, "/")
+	if config.Prefix != "" {
+		config.Prefix += "/"
+	}
+
+	client := config.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &S3{
+		config:      config,
+		endpoint:    endpoint,
+		client:      client,
+		partSize:    s3PartSize,
+		maxCopySize: s3MaxCopySize,
+	}, nil
+}
+
+// s3Error is the error document returned by S3
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// s3Request describes a request to the bucket or one of its objects
+type s3Request struct {
+	method string
+	// key of the object, empty for requests to the bucket
+	key    string
+	query  url.Values
+	header http.Header
+	body   io.Reader
+	size   int64
+	// payloadHash is the hex SHA-256 of the body, emptyPayload if empty
+	payloadHash string
+}
+
+func (s *S3) Put(key string, r io.Reader, size int64) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if size <= s.partSize {
+		resp, err := s.do(s3Request{method: http.MethodPut, key: key, body: r, size: size, payloadHash: unsignedPayload})
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	partSize := s.partSize
+	for (size+partSize-1)/partSize > s3MaxParts {
+		partSize *= 2
+	}
+	parts := int((size + partSize - 1) / partSize)
+	return s.multipart(key, parts, func(number int, uploadID string) (string, error) {
+		length := partSize
+		if remaining := size - int64(number-1)*partSize; remaining < length {
+			length = remaining
+		}
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		resp, err := s.do(s3Request{method: http.MethodPut, key: key, query: query, body: io.LimitReader(r, length), size: length, payloadHash: unsignedPayload})
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		return resp.Header.Get("ETag"), nil
+	})
+}
+
+func (s *S3) Get(key string, offset, length int64) (io.ReadCloser, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	header := http.Header{}
+	if length > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := s.do(s3Request{method: http.MethodGet, key: key, header: header})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3) Stat(key string) (Info, error) {
+	if err := checkKey(key); err != nil {
+		return Info{}, err
+	}
+	resp, err := s.do(s3Request{method: http.MethodHead, key: key})
+	if err != nil {
+		return Info{}, err
+	}
+	resp.Body.Close()
+
+	modTime, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return Info{}, fmt.Errorf("stat %s: invalid Last-Modified: %w", key, err)
+	}
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return Info{}, fmt.Errorf("stat %s: invalid Content-Length: %w", key, err)
+	}
+	return Info{Key: key, Size: size, ModTime: modTime.Truncate(time.Second)}, nil
+}
+
+// List pages through ListObjectsV2. Modification times are truncated to
+// seconds, the precision of Stat.
+func (s *S3) List(prefix string, fn func(info Info) error) error {
+	var result struct {
+		IsTruncated           bool   `xml:"IsTruncated"`
+		NextContinuationToken string `xml:"NextContinuationToken"`
+		Contents              []struct {
+			Key          string    `xml:"Key"`
+			Size         int64     `xml:"Size"`
+			LastModified time.Time `xml:"LastModified"`
+		} `xml:"Contents"`
+	}
+
+	query := url.Values{"list-type": {"2"}, "prefix": {s.config.Prefix + prefix}}
+	for {
+		resp, err := s.do(s3Request{method: http.MethodGet, query: query})
+		if err != nil {
+			return err
+		}
+		result.IsTruncated, result.NextContinuationToken, result.Contents = false, "", nil
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("listing %s: %w", prefix, err)
+		}
+
+		for _, object := range result.Contents {
+			key := strings.TrimPrefix(object.Key, s.config.Prefix)
+			if strings.HasSuffix(key, "/") || hidden(key) {
+				continue
+			}
+			if err := fn(Info{Key: key, Size: object.Size, ModTime: object.LastModified.Truncate(time.Second)}); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s *S3) Delete(key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	resp, err := s.do(s3Request{method: http.MethodDelete, key: key})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Move copies the object within the bucket and deletes the original.
+// Objects larger than 5GB are copied in parts.
+func (s *S3) Move(from, to string) error {
+	if err := checkKey(to); err != nil {
+		return err
+	}
+	info, err := s.Stat(from)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		return nil
+	}
+
+	source := s.config.Bucket + "/" + escapePath(s.config.Prefix+from)
+	if info.Size <= s.maxCopySize {
+		header := http.Header{"X-Amz-Copy-Source": {source}}
+		resp, err := s.do(s3Request{method: http.MethodPut, key: to, header: header})
+		if err == nil {
+			err = checkBody(resp)
+		}
+		if err != nil {
+			return fmt.Errorf("copying %s to %s: %w", from, to, err)
+		}
+	} else {
+		parts := int((info.Size + s.partSize - 1) / s.partSize)
+		err := s.multipart(to, parts, func(number int, uploadID string) (string, error) {
+			first := int64(number-1) * s.partSize
+			last := first + s.partSize - 1
+			if last >= info.Size {
+				last = info.Size - 1
+			}
+			header := http.Header{
+				"X-Amz-Copy-Source":       {source},
+				"X-Amz-Copy-Source-Range": {fmt.Sprintf("bytes=%d-%d", first, last)},
+			}
+			query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+			resp, err := s.do(s3Request{method: http.MethodPut, key: to, query: query, header: header})
+			if err != nil {
+				return "", err
+			}
+			defer resp.Body.Close()
+			var result struct {
+				ETag string `xml:"ETag"`
+			}
+			if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+				return "", err
+			}
+			return result.ETag, nil
+		})
+		if err != nil {
+			return fmt.Errorf("copying %s to %s: %w", from, to, err)
+		}
+	}
+	return s.Delete(from)
+}
+
+// multipart runs a multipart upload of the given number of parts. Each part
+// is sent by upload, which returns the part's ETag. Failed uploads are
+// aborted so their parts don't linger in the bucket.
+func (s *S3) multipart(key string, parts int, upload func(number int, uploadID string) (string, error)) error {
+	resp, err := s.do(s3Request{method: http.MethodPost, key: key, query: url.Values{"uploads": {""}}})
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("starting upload of %s: %w", key, err)
+	}
+	uploadID := initiated.UploadID
+
+	type completedPart struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	completed := struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{}
+	err = func() error {
+		for number := 1; number <= parts; number++ {
+			etag, err := upload(number, uploadID)
+			if err != nil {
+				return fmt.Errorf("part %d: %w", number, err)
+			}
+			completed.Parts = append(completed.Parts, completedPart{PartNumber: number, ETag: etag})
+		}
+
+		body, err := xml.Marshal(completed)
+		if err != nil {
+			return err
+		}
+		resp, err := s.do(s3Request{
+			method:      http.MethodPost,
+			key:         key,
+			query:       url.Values{"uploadId": {uploadID}},
+			body:        bytes.NewReader(body),
+			size:        int64(len(body)),
+			payloadHash: hashHex(body),
+		})
+		if err != nil {
+			return err
+		}
+		return checkBody(resp)
+	}()
+	if err != nil {
+		if resp, abortErr := s.do(s3Request{method: http.MethodDelete, key: key, query: url.Values{"uploadId": {uploadID}}}); abortErr == nil {
+			resp.Body.Close()
+		}
+		return fmt.Errorf("uploading %s: %w", key, err)
+	}
+	return nil
+}
+
+// do signs and sends a request. Responses other than 2xx are turned into
+// errors; for objects that don't exist the error matches fs.ErrNotExist.
+func (s *S3) do(r s3Request) (*http.Response, error) {
+	u := *s.endpoint
+	objectPath := ""
+	if r.key != "" {
+		objectPath = s.config.Prefix + r.key
+	}
+	if s.config.VirtualHosted {
+		u.Host = s.config.Bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + objectPath
+	} else {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.config.Bucket + "/" + objectPath
+	}
+	u.RawPath = escapePath(u.Path)
+	u.RawQuery = canonicalQuery(r.query)
+
+	var body io.Reader
+	if r.size > 0 {
+		body = r.body
+	}
+	req, err := http.NewRequest(r.method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = r.size
+	for name, values := range r.header {
+		req.Header[name] = values
+	}
+	if r.payloadHash == "" {
+		r.payloadHash = emptyPayload
+	}
+	signV4(req, r.payloadHash, s.config.AccessKeyID, s.config.SecretAccessKey, s.config.Region, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var e s3Error
+	xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&e)
+	if resp.StatusCode == http.StatusNotFound && r.key != "" && r.query == nil && e.Code != "NoSuchBucket" {
+		return nil, notExist(strings.ToLower(r.method), r.key)
+	}
+	if e.Code == "" {
+		e.Code = resp.Status
+	}
+	return nil, fmt.Errorf("S3 %s %s: %s %s", r.method, objectPath, e.Code, e.Message)
+}
+
+// checkBody reads the body of a response that can report an error despite
+// its 200 status, as CopyObject and CompleteMultipartUpload do
+func checkBody(resp *http.Response) error {
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	var e struct {
+		XMLName xml.Name
+		s3Error
+	}
+	if xml.Unmarshal(data, &e) == nil && e.XMLName.Local == "Error" {
+		return fmt.Errorf("S3 error: %s %s", e.Code, e.Message)
+	}
+	return nil
+}
+
+// escapePath encodes a path as S3 expects it in the signature: everything
+// but unreserved characters and slashes is percent-encoded
+func escapePath(p string) string {
+	return strings.ReplaceAll(uriEncode(p), "%2F", "/")
+}
+
+// uriEncode percent-encodes everything but the unreserved characters of
+// RFC 3986
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes query parameters sorted by name, then value
+func canonicalQuery(query url.Values) string {
+	var pairs [][2]string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, [2]string{uriEncode(name), uriEncode(value)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+	encoded := make([]string, len(pairs))
+	for i, pair := range pairs {
+		encoded[i] = pair[0] + "=" + pair[1]
+	}
+	return strings.Join(encoded, "&")
+}
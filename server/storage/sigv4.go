@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat = "20060102T150405Z"
+	sigV4DateFormat = "20060102"
+)
+
+// signV4 signs a request for S3 with AWS Signature Version 4, setting the
+// X-Amz-Date, X-Amz-Content-Sha256 and Authorization headers. The host,
+// the range and all X-Amz- headers are signed.
+func signV4(req *http.Request, payloadHash, accessKeyID, secretAccessKey, region string, now time.Time) {
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format(sigV4TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Del("Authorization")
+
+	signedHeaders, canonicalHeaders := canonicalHeaders(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := now.Format(sigV4DateFormat) + "/" + region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		now.Format(sigV4TimeFormat),
+		scope,
+		hashHex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), now.Format(sigV4DateFormat))
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", sigV4Algorithm+" Credential="+accessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// canonicalHeaders returns the names of the signed headers and their
+// canonical form, lowercase and sorted by name
+func canonicalHeaders(req *http.Request) (string, string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			trimmed := make([]string, len(values))
+			for i, value := range values {
+				trimmed[i] = strings.Join(strings.Fields(value), " ")
+			}
+			headers[name] = strings.Join(trimmed, ",")
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + ":" + headers[name] + "\n")
+	}
+	return strings.Join(names, ";"), b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,169 @@
+// Package storage abstracts where the photo library is kept. Files are
+// addressed by slash separated keys relative to the root of the library,
+// such as "alice/2023/06/1681568943783-9f86d081.jpg", which is the index
+// path without its leading slash. The local filesystem and S3-compatible
+// object stores are supported.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"image-upload-server/config"
+)
+
+// Names of the backends selected by STORAGE_BACKEND
+const (
+	BackendLocal = "local"
+	BackendS3    = "s3"
+)
+
+var (
+	// Files is the backend holding the photo library
+	Files Backend
+
+	// ErrInvalidKey is returned for keys that are empty, absolute or
+	// contain "." or ".." segments
+	ErrInvalidKey = errors.New("invalid storage key")
+)
+
+// Info describes a stored file
+type Info struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Backend stores the files of the library. Errors for keys that don't
+// exist match fs.ErrNotExist.
+type Backend interface {
+	// Put stores size bytes read from r under key, replacing any file
+	// stored there. Readers never see a partially written file.
+	Put(key string, r io.Reader, size int64) error
+	// Get returns length bytes of the file starting at offset, or the rest
+	// of the file if length is negative
+	Get(key string, offset, length int64) (io.ReadCloser, error)
+	// Stat describes a file
+	Stat(key string) (Info, error)
+	// List calls fn for every file whose key starts with prefix. Files in
+	// directories whose name starts with a dot, such as temporary files,
+	// are left out. An error returned by fn stops the listing.
+	List(prefix string, fn func(info Info) error) error
+	// Delete removes a file. Deleting a file that doesn't exist is not an
+	// error.
+	Delete(key string) error
+	// Move renames a file, replacing any file stored under the new key
+	Move(from, to string) error
+}
+
+// Linker is implemented by backends that can store the content of one file
+// under another key without a copy, such as hard links on the local
+// filesystem
+type Linker interface {
+	Link(existing, key string) error
+}
+
+// Importer is implemented by backends that can take over a file on the
+// local filesystem without copying it
+type Importer interface {
+	Import(key, path string) error
+}
+
+// Init selects the backend configured by STORAGE_BACKEND. The local backend
+// keeps the library in uploadsDir.
+func Init(uploadsDir string) error {
+	switch config.StorageBackend {
+	case "", BackendLocal:
+		Files = NewLocal(uploadsDir)
+	case BackendS3:
+		s3, err := NewS3(S3Config{
+			Endpoint:        config.S3Endpoint,
+			Region:          config.S3Region,
+			Bucket:          config.S3Bucket,
+			Prefix:          config.S3Prefix,
+			AccessKeyID:     config.S3AccessKeyID,
+			SecretAccessKey: config.S3SecretAccessKey,
+			VirtualHosted:   config.S3VirtualHosted,
+		})
+		if err != nil {
+			return err
+		}
+		Files = s3
+	default:
+		return fmt.Errorf("unknown storage backend %q", config.StorageBackend)
+	}
+	return nil
+}
+
+// Key returns the storage key of a path relative to the library root, such
+// as an index path
+func Key(relativePath string) string {
+	return strings.TrimPrefix(relativePath, "/")
+}
+
+// PutFile moves a file from the local filesystem into the backend, without
+// copying it if the backend can import it
+func PutFile(b Backend, key, localPath string) error {
+	if importer, ok := b.(Importer); ok {
+		return importer.Import(key, localPath)
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := b.Put(key, file, info.Size()); err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(localPath)
+}
+
+// Exists reports whether a file is stored under key
+func Exists(b Backend, key string) (bool, error) {
+	_, err := b.Stat(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// checkKey rejects keys that could escape the root of the library
+func checkKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.ContainsAny(key, "\\\x00") {
+		return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+		}
+	}
+	return nil
+}
+
+// hidden reports whether a key lies in a directory whose name starts with a
+// dot
+func hidden(key string) bool {
+	for _, segment := range strings.Split(path.Dir(key), "/") {
+		if strings.HasPrefix(segment, ".") && segment != "." {
+			return true
+		}
+	}
+	return false
+}
+
+// notExist returns the error for a missing key
+func notExist(op, key string) error {
+	return &fs.PathError{Op: op, Path: key, Err: fs.ErrNotExist}
+}
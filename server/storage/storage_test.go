@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBackend checks the behavior every backend shares
+func testBackend(t *testing.T, b Backend) {
+	put := func(key, content string) {
+		require.NoError(t, b.Put(key, strings.NewReader(content), int64(len(content))))
+	}
+	get := func(key string, offset, length int64) string {
+		body, err := b.Get(key, offset, length)
+		require.NoError(t, err)
+		defer body.Close()
+		data, err := io.ReadAll(body)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	put("alice/2023/06/photo.jpg", "0123456789")
+	put("alice/na/screen shot+1.png", "png")
+	put("bob/2023/06/photo.jpg", "bob's")
+
+	info, err := b.Stat("alice/2023/06/photo.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, "alice/2023/06/photo.jpg", info.Key)
+	assert.EqualValues(t, 10, info.Size)
+	assert.False(t, info.ModTime.IsZero())
+
+	assert.Equal(t, "0123456789", get("alice/2023/06/photo.jpg", 0, -1))
+	assert.Equal(t, "3456", get("alice/2023/06/photo.jpg", 3, 4))
+	assert.Equal(t, "789", get("alice/2023/06/photo.jpg", 7, -1))
+	assert.Equal(t, "png", get("alice/na/screen shot+1.png", 0, -1))
+
+	// Put replaces the file
+	put("bob/2023/06/photo.jpg", "bob's new")
+	assert.Equal(t, "bob's new", get("bob/2023/06/photo.jpg", 0, -1))
+
+	listed := map[string]Info{}
+	require.NoError(t, b.List("alice/", func(info Info) error {
+		listed[info.Key] = info
+		return nil
+	}))
+	assert.Len(t, listed, 2)
+	assert.EqualValues(t, 3, listed["alice/na/screen shot+1.png"].Size)
+	assert.True(t, listed["alice/2023/06/photo.jpg"].ModTime.Equal(info.ModTime))
+
+	var all []string
+	require.NoError(t, b.List("", func(info Info) error {
+		all = append(all, info.Key)
+		return nil
+	}))
+	assert.ElementsMatch(t, []string{"alice/2023/06/photo.jpg", "alice/na/screen shot+1.png", "bob/2023/06/photo.jpg"}, all)
+	require.NoError(t, b.List("carol/", func(info Info) error {
+		t.Errorf("unexpected file %s", info.Key)
+		return nil
+	}))
+
+	require.NoError(t, b.Move("alice/na/screen shot+1.png", "alice/2023/07/screen shot+1.png"))
+	assert.Equal(t, "png", get("alice/2023/07/screen shot+1.png", 0, -1))
+	_, err = b.Stat("alice/na/screen shot+1.png")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.True(t, os.IsNotExist(err))
+
+	require.NoError(t, b.Delete("bob/2023/06/photo.jpg"))
+	require.NoError(t, b.Delete("bob/2023/06/photo.jpg"))
+	exists, err := Exists(b, "bob/2023/06/photo.jpg")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	_, err = b.Get("bob/2023/06/photo.jpg", 0, -1)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	for _, key := range []string{"", "/alice/photo.jpg", "alice/../bob/photo.jpg", "alice//photo.jpg", `alice\photo.jpg`} {
+		assert.ErrorIs(t, b.Put(key, strings.NewReader("x"), 1), ErrInvalidKey, key)
+	}
+
+	// Open reads sequentially with seeking and at random offsets
+	object, err := Open(b, "alice/2023/06/photo.jpg")
+	require.NoError(t, err)
+	defer object.Close()
+	assert.EqualValues(t, 10, object.Size)
+	buf := make([]byte, 4)
+	n, err := object.ReadAt(buf, 8)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "89", string(buf[:n]))
+	_, err = object.Seek(5, io.SeekStart)
+	require.NoError(t, err)
+	rest, err := io.ReadAll(object)
+	require.NoError(t, err)
+	assert.Equal(t, "56789", string(rest))
+	section, err := io.ReadAll(io.NewSectionReader(object, 1, 3))
+	require.NoError(t, err)
+	assert.Equal(t, "123", string(section))
+}
+
+func TestLocalBackend(t *testing.T) {
+	root := t.TempDir()
+	testBackend(t, NewLocal(root))
+
+	// Directories left empty are removed, the root is kept
+	_, err := os.Stat(filepath.Join(root, "alice", "na"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(root, "bob"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(root)
+	assert.NoError(t, err)
+}
+
+func TestLocalBackendSkipsHiddenDirectories(t *testing.T) {
+	root := t.TempDir()
+	b := NewLocal(root)
+	require.NoError(t, os.MkdirAll(filepath.Join(root, ".tmp"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, ".tmp", "upload-1"), []byte("partial"), 0644))
+	require.NoError(t, b.Put("alice/photo.jpg", strings.NewReader("x"), 1))
+
+	var keys []string
+	require.NoError(t, b.List("", func(info Info) error {
+		keys = append(keys, info.Key)
+		return nil
+	}))
+	assert.Equal(t, []string{"alice/photo.jpg"}, keys)
+}
+
+func TestPutFile(t *testing.T) {
+	for name, b := range map[string]Backend{"local": NewLocal(t.TempDir()), "s3": newFakeS3(t).backend(t, "")} {
+		staged := filepath.Join(t.TempDir(), "upload")
+		require.NoError(t, os.WriteFile(staged, []byte("content"), 0644))
+
+		require.NoError(t, PutFile(b, "alice/photo.jpg", staged), name)
+		_, err := os.Stat(staged)
+		assert.True(t, os.IsNotExist(err), name)
+		body, err := b.Get("alice/photo.jpg", 0, -1)
+		require.NoError(t, err)
+		data, _ := io.ReadAll(body)
+		body.Close()
+		assert.Equal(t, "content", string(data), name)
+	}
+}
+
+func TestLocalLink(t *testing.T) {
+	root := t.TempDir()
+	b := NewLocal(root)
+	require.NoError(t, b.Put("alice/photo.jpg", strings.NewReader("shared"), 6))
+	require.NoError(t, b.Link("alice/photo.jpg", "bob/2023/photo.jpg"))
+
+	alice, err := os.Stat(filepath.Join(root, "alice", "photo.jpg"))
+	require.NoError(t, err)
+	bob, err := os.Stat(filepath.Join(root, "bob", "2023", "photo.jpg"))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(alice, bob))
+}
+
+func TestObjectReadsRemoteFilesInBlocks(t *testing.T) {
+	fake := newFakeS3(t)
+	b := fake.backend(t, "")
+	content := bytes.Repeat([]byte("0123456789abcdef"), blockSize/8)
+	require.NoError(t, b.Put("large.bin", bytes.NewReader(content), int64(len(content))))
+
+	object, err := Open(b, "large.bin")
+	require.NoError(t, err)
+	defer object.Close()
+
+	// A read across the block boundary
+	buf := make([]byte, 32)
+	n, err := object.ReadAt(buf, blockSize-16)
+	require.NoError(t, err)
+	assert.Equal(t, content[blockSize-16:blockSize+16], buf[:n])
+	assert.Len(t, object.blocks, 2)
+
+	data, err := io.ReadAll(object)
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+}
@@ -0,0 +1,27 @@
+// Package tokenutil generates the random tokens handed out by the server,
+// such as share links, refresh tokens, API keys and emailed tokens, and
+// hashes them for storage.
+package tokenutil
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// Random returns size random bytes, URL-safe base64 encoded
+func Random(size int) (string, error) {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		return "", fmt.Errorf("error generating token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// Hash returns the key a token is stored under. The tokens are random, so a
+// plain SHA-256 is enough to make a leaked database useless.
+func Hash(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
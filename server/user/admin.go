@@ -0,0 +1,85 @@
+package user
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"image-upload-server/auth"
+)
+
+// ChangeRole gives the user another role. Tokens carry the role they were
+// issued with, so when the new role loses a permission the user's sessions
+// are revoked; otherwise the role applies from the next token refresh.
+func ChangeRole(username, role string) error {
+	current, exists := UserDB.GetUser(username)
+	if !exists {
+		return ErrUserNotFound
+	}
+	if err := UserDB.SetRole(username, role); err != nil {
+		return err
+	}
+
+	for _, permission := range auth.Permissions(current.Role) {
+		if !auth.HasPermission(role, permission) {
+			count, err := auth.Sessions.RevokeAll(username)
+			if err != nil {
+				return err
+			}
+			log.Printf("Role of %s changed from %s to %s, revoked %d sessions", username, current.Role, role, count)
+			return nil
+		}
+	}
+	log.Printf("Role of %s changed from %s to %s", username, current.Role, role)
+	return nil
+}
+
+// HandleListUsers returns all users with their roles
+func HandleListUsers(c *gin.Context) {
+	users := UserDB.ListUsers()
+	result := make([]gin.H, len(users))
+	for i, user := range users {
+		result[i] = gin.H{
+			"username":   user.Username,
+			"email":      user.Email,
+			"role":       user.Role,
+			"created_at": user.CreatedAt,
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"users": result, "roles": auth.Roles})
+}
+
+// HandleSetRole changes a user's role
+func HandleSetRole(c *gin.Context) {
+	var request struct {
+		Role string `json:"role" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if !auth.ValidRole(request.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role", "roles": auth.Roles})
+		return
+	}
+
+	username := c.Param("username")
+	err := ChangeRole(username, request.Role)
+	if errors.Is(err, ErrUserNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if errors.Is(err, ErrLastAdmin) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Error changing role of %s: %v", username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change role"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"username": username, "role": request.Role, "permissions": auth.Permissions(request.Role)})
+}
@@ -0,0 +1,363 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"image-upload-server/apikey"
+	"image-upload-server/auth"
+	"image-upload-server/config"
+	"image-upload-server/mailer"
+)
+
+// Paths of the web app that links in emails open. The app posts the token
+// from the link to the matching API endpoint.
+const (
+	verifyEmailPath   = "/verify-email"
+	resetPasswordPath = "/reset-password"
+	confirmEmailPath  = "/confirm-email"
+)
+
+// tokenLink returns the link to a page of the web app with the token
+func tokenLink(path, token string) string {
+	return config.PublicURL + path + "?token=" + url.QueryEscape(token)
+}
+
+// SendVerificationEmail sends the user a link to confirm their email
+func SendVerificationEmail(user User) error {
+	token, err := Tokens.Issue(PurposeVerifyEmail, user.Username, user.Email, time.Now())
+	if err != nil {
+		return err
+	}
+	return mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Hello %s,\n\nplease confirm your email address by opening this link:\n\n%s\n\n"+
+			"The link is valid for 48 hours. If you didn't create an account, you can ignore this email.\n",
+			user.Username, tokenLink(verifyEmailPath, token)),
+	})
+}
+
+// sendPasswordReset sends the user a link to set a new password
+func sendPasswordReset(user User) error {
+	token, err := Tokens.Issue(PurposeResetPassword, user.Username, user.Email, time.Now())
+	if err != nil {
+		return err
+	}
+	return mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hello %s,\n\nsomeone asked to reset the password of your account. To choose a new password, open this link:\n\n%s\n\n"+
+			"The link is valid for one hour and can be used once. If you didn't ask for this, you can ignore this email.\n",
+			user.Username, tokenLink(resetPasswordPath, token)),
+	})
+}
+
+// sendEmailChange sends a link to confirm the user's new address to that
+// address, and tells the current address about it
+func sendEmailChange(user User, email string) error {
+	token, err := Tokens.Issue(PurposeChangeEmail, user.Username, email, time.Now())
+	if err != nil {
+		return err
+	}
+	err = mailer.Send(mailer.Message{
+		To:      email,
+		Subject: "Confirm your new email address",
+		Body: fmt.Sprintf("Hello %s,\n\nto use this address for your account, open this link:\n\n%s\n\n"+
+			"The link is valid for 24 hours. If you didn't ask for this, you can ignore this email.\n",
+			user.Username, tokenLink(confirmEmailPath, token)),
+	})
+	if err != nil {
+		return err
+	}
+
+	notice := mailer.Message{
+		To:      user.Email,
+		Subject: "Your email address is being changed",
+		Body: fmt.Sprintf("Hello %s,\n\nsomeone asked to change the email address of your account to %s. "+
+			"It changes once the new address is confirmed. If this wasn't you, change your password.\n",
+			user.Username, email),
+	}
+	if err := mailer.Send(notice); err != nil {
+		log.Printf("Error notifying %s of email change: %v", user.Username, err)
+	}
+	return nil
+}
+
+// sendPasswordChanged tells the user their password was reset
+func sendPasswordChanged(user User) {
+	err := mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Your password was changed",
+		Body: fmt.Sprintf("Hello %s,\n\nthe password of your account was reset, all devices were logged out and all API keys were revoked. "+
+			"If this wasn't you, reset your password again and contact an administrator.\n", user.Username),
+	})
+	if err != nil {
+		log.Printf("Error notifying %s of password reset: %v", user.Username, err)
+	}
+}
+
+// respondMailError responds to a failed send, which is either rate limited
+// or a server error
+func respondMailError(c *gin.Context, err error, action string) {
+	if errors.Is(err, mailer.ErrRateLimited) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("Error sending %s email: %v", action, err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send email"})
+}
+
+// HandleVerifyEmail confirms the email of the user a verification token
+// was sent to
+func HandleVerifyEmail(c *gin.Context) {
+	var request struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	token, err := Tokens.Consume(PurposeVerifyEmail, request.Token, time.Now())
+	if errors.Is(err, ErrInvalidToken) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Error verifying email: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+
+	verified, err := UserDB.MarkEmailVerified(token.Username, token.Email)
+	if errors.Is(err, ErrUserNotFound) || (err == nil && !verified) {
+		// The user was deleted or has changed their email since
+		c.JSON(http.StatusBadRequest, gin.H{"error": ErrInvalidToken.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Error verifying email of %s: %v", token.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "username": token.Username, "email": token.Email})
+}
+
+// HandleResendVerification sends the authenticated user another link to
+// confirm their email
+func HandleResendVerification(c *gin.Context) {
+	username := c.GetString("username")
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	user, exists := UserDB.GetUser(username)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if user.EmailVerified {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email is already verified"})
+		return
+	}
+
+	if err := SendVerificationEmail(user); err != nil {
+		respondMailError(c, err, "verification")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// HandleForgotPassword emails a link to reset the password to the users
+// with the address, of which older databases may hold several. The response is the same whether or not there are any,
+// so it can't be used to find out who has an account.
+func HandleForgotPassword(c *gin.Context) {
+	var request struct {
+		Email string `json:"email" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	email, err := mailer.ValidateAddress(request.Email)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, user := range UserDB.FindByEmail(email) {
+		if err := sendPasswordReset(user); err != nil {
+			log.Printf("Error sending password reset email to %s: %v", user.Username, err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "If an account uses this address, a link to reset its password was sent",
+	})
+}
+
+// HandleResetPassword sets a new password with a reset token. All of the
+// user's sessions and API keys are revoked, locking out whoever knew the old
+// password.
+func HandleResetPassword(c *gin.Context) {
+	var request struct {
+		Token    string `json:"token" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	token, err := Tokens.Consume(PurposeResetPassword, request.Token, time.Now())
+	if errors.Is(err, ErrInvalidToken) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Error resetting password: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	err = UserDB.SetPassword(token.Username, request.Password)
+	if errors.Is(err, ErrUserNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": ErrInvalidToken.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Error resetting password of %s: %v", token.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+	count, err := auth.Sessions.RevokeAll(token.Username)
+	if err != nil {
+		log.Printf("Error revoking sessions of %s: %v", token.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out sessions"})
+		return
+	}
+	keys, err := apikey.DB.RevokeAll(token.Username)
+	if err != nil {
+		log.Printf("Error revoking API keys of %s: %v", token.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API keys"})
+		return
+	}
+	log.Printf("Password of %s reset, revoked %d sessions and %d API keys", token.Username, count, keys)
+
+	// The reset link was received, so the address works
+	user, _ := UserDB.GetUser(token.Username)
+	if _, err := UserDB.MarkEmailVerified(token.Username, token.Email); err != nil {
+		log.Printf("Error verifying email of %s: %v", token.Username, err)
+	}
+	sendPasswordChanged(user)
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "username": token.Username})
+}
+
+// HandleChangeEmail starts changing the authenticated user's email. The
+// request must include the password. The new address only replaces the
+// current one once it is confirmed with the link sent to it.
+func HandleChangeEmail(c *gin.Context) {
+	username := c.GetString("username")
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var request struct {
+		Email    string `json:"email" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if !UserDB.ValidateCredentials(username, request.Password) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid password"})
+		return
+	}
+	email, err := mailer.ValidateAddress(request.Email)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user, exists := UserDB.GetUser(username)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if strings.EqualFold(user.Email, email) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "This is already your email address"})
+		return
+	}
+	if len(UserDB.FindByEmail(email)) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": ErrEmailInUse.Error()})
+		return
+	}
+
+	if err := sendEmailChange(user, email); err != nil {
+		respondMailError(c, err, "email change")
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{
+		"success": true,
+		"message": "Open the link sent to the new address to confirm it",
+	})
+}
+
+// HandleConfirmEmailChange replaces the user's email with the new address
+// an email change token was sent to
+func HandleConfirmEmailChange(c *gin.Context) {
+	var request struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	token, err := Tokens.Consume(PurposeChangeEmail, request.Token, time.Now())
+	if errors.Is(err, ErrInvalidToken) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Error confirming email change: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change email"})
+		return
+	}
+
+	// Another user may have taken the address since the change was asked
+	// for
+	err = UserDB.SetEmail(token.Username, token.Email)
+	if errors.Is(err, ErrUserNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": ErrInvalidToken.Error()})
+		return
+	}
+	if errors.Is(err, ErrEmailInUse) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Error changing email of %s: %v", token.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change email"})
+		return
+	}
+	// A verification link sent to the old address no longer applies
+	if err := Tokens.Revoke(token.Username, PurposeVerifyEmail); err != nil {
+		log.Printf("Error revoking verification token of %s: %v", token.Username, err)
+	}
+	log.Printf("Email of %s changed", token.Username)
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "username": token.Username, "email": token.Email})
+}
@@ -0,0 +1,296 @@
+package user
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"image-upload-server/apikey"
+	"image-upload-server/auth"
+	"image-upload-server/mailer"
+)
+
+// recordingMailer keeps the messages it is asked to send
+type recordingMailer struct {
+	mu   sync.Mutex
+	sent []mailer.Message
+}
+
+func (r *recordingMailer) Send(msg mailer.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, msg)
+	return nil
+}
+
+// take returns the messages sent since the last call
+func (r *recordingMailer) take() []mailer.Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sent := r.sent
+	r.sent = nil
+	return sent
+}
+
+var tokenPattern = regexp.MustCompile(`token=([A-Za-z0-9_-]+)`)
+
+// linkToken returns the token in the link of a message
+func linkToken(t *testing.T, msg mailer.Message) string {
+	match := tokenPattern.FindStringSubmatch(msg.Body)
+	require.NotNil(t, match, msg.Body)
+	return match[1]
+}
+
+// setupEmailTest swaps the global user database, token store, session
+// store, API key store and mailer for temporary ones and returns a router
+// with the email flows. Requests are authenticated as the user in the
+// X-User header.
+func setupEmailTest(t *testing.T) (*gin.Engine, *recordingMailer) {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	users, err := NewUserDatabase(filepath.Join(dir, "users.json"))
+	require.NoError(t, err)
+	tokens, err := OpenTokens(filepath.Join(dir, "email_tokens.db"))
+	require.NoError(t, err)
+	sessions, err := auth.OpenSessions(filepath.Join(dir, "sessions.db"))
+	require.NoError(t, err)
+	keys, err := apikey.Open(filepath.Join(dir, "api_keys.db"))
+	require.NoError(t, err)
+	outbox := &recordingMailer{}
+
+	previousUsers, previousTokens, previousSessions, previousKeys, previousMailer := UserDB, Tokens, auth.Sessions, apikey.DB, mailer.Default
+	UserDB, Tokens, auth.Sessions, apikey.DB = users, tokens, sessions, keys
+	mailer.Default = mailer.RateLimited(outbox, 3, time.Hour)
+	t.Cleanup(func() {
+		UserDB, Tokens, auth.Sessions, apikey.DB, mailer.Default = previousUsers, previousTokens, previousSessions, previousKeys, previousMailer
+		tokens.Close()
+		sessions.Close()
+		keys.Close()
+	})
+
+	router := gin.New()
+	router.POST("/register", HandleRegister)
+	router.POST("/login", HandleLogin)
+	router.POST("/email/verify", HandleVerifyEmail)
+	router.POST("/email/change/confirm", HandleConfirmEmailChange)
+	router.POST("/password/forgot", HandleForgotPassword)
+	router.POST("/password/reset", HandleResetPassword)
+	authorized := router.Group("/", func(c *gin.Context) { c.Set("username", c.GetHeader("X-User")) })
+	authorized.POST("/email/verify/resend", HandleResendVerification)
+	authorized.POST("/email/change", HandleChangeEmail)
+	return router, outbox
+}
+
+func post(router *gin.Engine, path, username string, body gin.H) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-User", username)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestEmailTokens(t *testing.T) {
+	store, err := OpenTokens(filepath.Join(t.TempDir(), "email_tokens.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	now := time.Now()
+
+	token, err := store.Issue(PurposeResetPassword, "alice", "alice@example.com", now)
+	require.NoError(t, err)
+
+	// Tokens are bound to their purpose
+	_, err = store.Consume(PurposeVerifyEmail, token, now)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	consumed, err := store.Consume(PurposeResetPassword, token, now)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", consumed.Username)
+	assert.Equal(t, "alice@example.com", consumed.Email)
+
+	// And can be used once
+	_, err = store.Consume(PurposeResetPassword, token, now)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	// A new token replaces the previous one
+	first, err := store.Issue(PurposeVerifyEmail, "alice", "alice@example.com", now)
+	require.NoError(t, err)
+	second, err := store.Issue(PurposeVerifyEmail, "alice", "alice@example.com", now)
+	require.NoError(t, err)
+	_, err = store.Consume(PurposeVerifyEmail, first, now)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, err = store.Consume(PurposeVerifyEmail, second, now)
+	assert.NoError(t, err)
+
+	// Reset tokens expire after an hour
+	expired, err := store.Issue(PurposeResetPassword, "alice", "alice@example.com", now)
+	require.NoError(t, err)
+	_, err = store.Consume(PurposeResetPassword, expired, now.Add(time.Hour))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	pruned, err := store.Issue(PurposeChangeEmail, "alice", "new@example.com", now)
+	require.NoError(t, err)
+	require.NoError(t, store.Prune(now.Add(25*time.Hour)))
+	_, err = store.Consume(PurposeChangeEmail, pruned, now)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestRegisterVerifiesEmail(t *testing.T) {
+	router, outbox := setupEmailTest(t)
+
+	w := post(router, "/register", "", gin.H{"username": "alice", "password": "secret", "email": "not an address"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	_, exists := UserDB.GetUser("alice")
+	assert.False(t, exists)
+
+	w = post(router, "/register", "", gin.H{"username": "alice", "password": "secret", "email": "alice@example.com"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"email_verification_sent":true`)
+	sent := outbox.take()
+	require.Len(t, sent, 1)
+	assert.Equal(t, "alice@example.com", sent[0].To)
+	user, _ := UserDB.GetUser("alice")
+	assert.False(t, user.EmailVerified)
+
+	// Another account can't use the address
+	w = post(router, "/register", "", gin.H{"username": "bob", "password": "secret", "email": "Alice@Example.com"})
+	assert.Equal(t, http.StatusConflict, w.Code)
+	_, exists = UserDB.GetUser("bob")
+	assert.False(t, exists)
+	assert.Empty(t, outbox.take())
+
+	// A new link replaces the first
+	w = post(router, "/email/verify/resend", "alice", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	resent := outbox.take()
+	require.Len(t, resent, 1)
+	assert.Equal(t, http.StatusBadRequest, post(router, "/email/verify", "", gin.H{"token": linkToken(t, sent[0])}).Code)
+
+	token := linkToken(t, resent[0])
+	w = post(router, "/email/verify", "", gin.H{"token": token})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	user, _ = UserDB.GetUser("alice")
+	assert.True(t, user.EmailVerified)
+
+	assert.Equal(t, http.StatusBadRequest, post(router, "/email/verify", "", gin.H{"token": token}).Code)
+	assert.Equal(t, http.StatusConflict, post(router, "/email/verify/resend", "alice", nil).Code)
+}
+
+func TestPasswordReset(t *testing.T) {
+	router, outbox := setupEmailTest(t)
+	require.NoError(t, UserDB.AddUser("alice", "old-password", "alice@example.com"))
+	session, err := auth.Sessions.Login("alice", auth.RoleMember)
+	require.NoError(t, err)
+	key, err := apikey.DB.Create(&apikey.Key{Owner: "alice", Name: "backdoor", Scopes: []auth.Permission{auth.PermissionRead}})
+	require.NoError(t, err)
+
+	// Unknown addresses get the same response
+	w := post(router, "/password/forgot", "", gin.H{"email": "nobody@example.com"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, outbox.take())
+
+	w = post(router, "/password/forgot", "", gin.H{"email": "Alice@Example.com"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	sent := outbox.take()
+	require.Len(t, sent, 1)
+	token := linkToken(t, sent[0])
+
+	w = post(router, "/password/reset", "", gin.H{"token": token, "password": "new-password"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.True(t, UserDB.ValidateCredentials("alice", "new-password"))
+	assert.False(t, UserDB.ValidateCredentials("alice", "old-password"))
+
+	// Every session is logged out and every API key revoked, and the user
+	// is told
+	_, err = auth.Sessions.Refresh(session.RefreshToken, lookupRole)
+	assert.ErrorIs(t, err, auth.ErrInvalidRefreshToken)
+	_, err = apikey.DB.Authenticate(key, "192.0.2.1", time.Now())
+	assert.ErrorIs(t, err, apikey.ErrInvalidKey)
+	notices := outbox.take()
+	require.Len(t, notices, 1)
+	assert.Equal(t, "Your password was changed", notices[0].Subject)
+
+	// The token is single-use
+	w = post(router, "/password/reset", "", gin.H{"token": token, "password": "another-password"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.True(t, UserDB.ValidateCredentials("alice", "new-password"))
+}
+
+func TestForgotPasswordIsRateLimited(t *testing.T) {
+	router, outbox := setupEmailTest(t)
+	require.NoError(t, UserDB.AddUser("alice", "secret", "alice@example.com"))
+
+	for i := 0; i < 5; i++ {
+		w := post(router, "/password/forgot", "", gin.H{"email": "alice@example.com"})
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	assert.Len(t, outbox.take(), 3)
+
+	// Sends the user asks for report the limit
+	w := post(router, "/email/verify/resend", "alice", nil)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+}
+
+func TestChangeEmail(t *testing.T) {
+	router, outbox := setupEmailTest(t)
+	require.NoError(t, UserDB.AddUser("alice", "secret", "alice@example.com"))
+
+	w := post(router, "/email/change", "alice", gin.H{"email": "alice@example.org", "password": "wrong"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = post(router, "/email/change", "alice", gin.H{"email": "alice@example.com", "password": "secret"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, outbox.take())
+
+	w = post(router, "/email/change", "alice", gin.H{"email": "alice@example.org", "password": "secret"})
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	sent := outbox.take()
+	require.Len(t, sent, 2)
+	assert.Equal(t, "alice@example.org", sent[0].To)
+	assert.Equal(t, "alice@example.com", sent[1].To)
+	assert.NotRegexp(t, tokenPattern, sent[1].Body)
+
+	// The address only changes once the new one is confirmed
+	user, _ := UserDB.GetUser("alice")
+	assert.Equal(t, "alice@example.com", user.Email)
+
+	token := linkToken(t, sent[0])
+	w = post(router, "/email/change/confirm", "", gin.H{"token": token})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	user, _ = UserDB.GetUser("alice")
+	assert.Equal(t, "alice@example.org", user.Email)
+	assert.True(t, user.EmailVerified)
+
+	assert.Equal(t, http.StatusBadRequest, post(router, "/email/change/confirm", "", gin.H{"token": token}).Code)
+}
+
+func TestChangeEmailRejectsAddressesInUse(t *testing.T) {
+	router, outbox := setupEmailTest(t)
+	require.NoError(t, UserDB.AddUser("alice", "secret", "alice@example.com"))
+	require.NoError(t, UserDB.AddUser("bob", "secret", "bob@example.com"))
+
+	w := post(router, "/email/change", "alice", gin.H{"email": "Bob@Example.com", "password": "secret"})
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Empty(t, outbox.take())
+
+	// Or taken before the change is confirmed
+	w = post(router, "/email/change", "alice", gin.H{"email": "shared@example.com", "password": "secret"})
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	token := linkToken(t, outbox.take()[0])
+	require.NoError(t, UserDB.SetEmail("bob", "shared@example.com"))
+
+	w = post(router, "/email/change/confirm", "", gin.H{"token": token})
+	assert.Equal(t, http.StatusConflict, w.Code)
+	user, _ := UserDB.GetUser("alice")
+	assert.Equal(t, "alice@example.com", user.Email)
+}
@@ -0,0 +1,57 @@
+package user
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"image-upload-server/privacy"
+)
+
+// HandleGetPreferences returns the authenticated user's preferences
+func HandleGetPreferences(c *gin.Context) {
+	username := c.GetString("username")
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	user, exists := UserDB.GetUser(username)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"strip_metadata": user.ShareStripGroups()})
+}
+
+// HandleUpdatePreferences changes the authenticated user's preferences. The
+// metadata groups removed from shared photos are given as a list of group
+// names, or "all"; an empty list shares photos with all their metadata.
+func HandleUpdatePreferences(c *gin.Context) {
+	username := c.GetString("username")
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var request struct {
+		StripMetadata *[]string `json:"strip_metadata"`
+	}
+	if err := c.BindJSON(&request); err != nil || request.StripMetadata == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	groups, err := privacy.ParseGroups(*request.StripMetadata)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := UserDB.SetStripMetadata(username, groups); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save preferences"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"strip_metadata": groups})
+}
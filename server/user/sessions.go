@@ -0,0 +1,145 @@
+package user
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"image-upload-server/auth"
+)
+
+// HandleRefreshToken exchanges a refresh token for a new access token and
+// refresh token. Each refresh token can be used once.
+func HandleRefreshToken(c *gin.Context) {
+	var request struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	tokens, err := auth.Sessions.Refresh(request.RefreshToken, lookupRole)
+	if errors.Is(err, auth.ErrInvalidRefreshToken) || errors.Is(err, auth.ErrRefreshTokenReused) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Error refreshing token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+	})
+}
+
+// lookupRole returns the current role of a user whose session is refreshed
+func lookupRole(username string) (string, bool) {
+	user, exists := UserDB.GetUser(username)
+	return user.Role, exists
+}
+
+// HandleLogout ends the session of the access token the request was made
+// with, revoking its refresh token and access tokens
+func HandleLogout(c *gin.Context) {
+	username := c.GetString("username")
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	claims, err := auth.GetUserClaimsFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+
+	if claims.SessionID != "" {
+		_, err = auth.Sessions.Revoke(username, claims.SessionID)
+	} else {
+		err = auth.Sessions.RevokeToken(claims.ID, claims.ExpiresAt.Time)
+	}
+	if err != nil {
+		log.Printf("Error logging out %s: %v", username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// HandleLogoutAll ends all of the user's sessions, logging out every device
+func HandleLogoutAll(c *gin.Context) {
+	username := c.GetString("username")
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	count, err := auth.Sessions.RevokeAll(username)
+	if err != nil {
+		log.Printf("Error logging out all sessions of %s: %v", username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "sessions": count})
+}
+
+// HandleListSessions returns the user's active sessions, marking the one the
+// request was made from
+func HandleListSessions(c *gin.Context) {
+	username := c.GetString("username")
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	sessions, err := auth.Sessions.List(username)
+	if err != nil {
+		log.Printf("Error listing sessions of %s: %v", username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list sessions"})
+		return
+	}
+
+	current := c.GetString("session_id")
+	result := make([]gin.H, len(sessions))
+	for i, session := range sessions {
+		result[i] = gin.H{
+			"id":           session.ID,
+			"created_at":   session.CreatedAt,
+			"last_used_at": session.LastUsedAt,
+			"expires_at":   session.ExpiresAt,
+			"current":      session.ID == current,
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": result})
+}
+
+// HandleRevokeSession logs out one of the user's sessions, such as that of a
+// lost phone
+func HandleRevokeSession(c *gin.Context) {
+	username := c.GetString("username")
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	revoked, err := auth.Sessions.Revoke(username, c.Param("id"))
+	if err != nil {
+		log.Printf("Error revoking session of %s: %v", username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+	if !revoked {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
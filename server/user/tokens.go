@@ -0,0 +1,247 @@
+package user
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"image-upload-server/tokenutil"
+)
+
+var (
+	// emailTokensBucket maps the SHA-256 hash of a token to its JSON encoded
+	// EmailToken. The tokens themselves are never stored.
+	emailTokensBucket = []byte("tokens")
+	// tokensByUserBucket maps username + "\x00" + purpose to the hash of the
+	// user's current token for the purpose
+	tokensByUserBucket = []byte("by_user")
+)
+
+// TokenPurpose is what an emailed token can be used for
+type TokenPurpose string
+
+const (
+	// PurposeVerifyEmail confirms the address a user registered with
+	PurposeVerifyEmail TokenPurpose = "verify_email"
+	// PurposeResetPassword sets a new password for a user who forgot theirs
+	PurposeResetPassword TokenPurpose = "reset_password"
+	// PurposeChangeEmail confirms the new address of a user
+	PurposeChangeEmail TokenPurpose = "change_email"
+)
+
+// tokenTTLs is how long a token of each purpose can be used. Reset tokens
+// grant access to the account, so they are short-lived.
+var tokenTTLs = map[TokenPurpose]time.Duration{
+	PurposeVerifyEmail:   48 * time.Hour,
+	PurposeResetPassword: time.Hour,
+	PurposeChangeEmail:   24 * time.Hour,
+}
+
+// emailTokenBytes is the number of random bytes in a token
+const emailTokenBytes = 32
+
+// ErrInvalidToken is returned for unknown, used and expired tokens
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+var (
+	// Tokens is the global store of emailed tokens
+	Tokens *TokenStore
+)
+
+// EmailToken is the stored state of a token sent by email
+type EmailToken struct {
+	Purpose  TokenPurpose `json:"purpose"`
+	Username string       `json:"username"`
+	// Email is the address the token was sent to, which it confirms
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// TokenStore keeps the hashes of single-use tokens sent by email in an
+// embedded bbolt database. A user has at most one token per purpose;
+// issuing another replaces it.
+type TokenStore struct {
+	db *bolt.DB
+}
+
+// InitTokens opens the token store in the data directory
+func InitTokens(dataDir string) error {
+	dbPath := filepath.Join(dataDir, "email_tokens.db")
+	var err error
+	Tokens, err = OpenTokens(dbPath)
+	if err != nil {
+		return err
+	}
+	if err := Tokens.Prune(time.Now()); err != nil {
+		log.Printf("Error pruning email tokens: %v", err)
+	}
+
+	log.Printf("Email token store initialized at %s", dbPath)
+	return nil
+}
+
+// OpenTokens opens or creates the token database at path
+func OpenTokens(path string) (*TokenStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening email token store: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{emailTokensBucket, tokensByUserBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error initializing email token store: %w", err)
+	}
+
+	return &TokenStore{db: db}, nil
+}
+
+// Close closes the underlying database
+func (s *TokenStore) Close() error {
+	return s.db.Close()
+}
+
+// Issue creates a token for the user, replacing any earlier token for the
+// same purpose, and returns it
+func (s *TokenStore) Issue(purpose TokenPurpose, username, email string, now time.Time) (string, error) {
+	ttl, ok := tokenTTLs[purpose]
+	if !ok {
+		return "", fmt.Errorf("unknown token purpose %s", purpose)
+	}
+	token, err := tokenutil.Random(emailTokenBytes)
+	if err != nil {
+		return "", err
+	}
+
+	stored, err := json.Marshal(EmailToken{
+		Purpose:   purpose,
+		Username:  username,
+		Email:     email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		tokens := tx.Bucket(emailTokensBucket)
+		byUser := tx.Bucket(tokensByUserBucket)
+		key := tokenUserKey(username, purpose)
+		if previous := byUser.Get(key); previous != nil {
+			if err := tokens.Delete(previous); err != nil {
+				return err
+			}
+		}
+		hash := tokenutil.Hash(token)
+		if err := tokens.Put(hash, stored); err != nil {
+			return err
+		}
+		return byUser.Put(key, hash)
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Consume returns the state of a token for the purpose and deletes it, so
+// it can't be used again
+func (s *TokenStore) Consume(purpose TokenPurpose, token string, now time.Time) (*EmailToken, error) {
+	var consumed *EmailToken
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		tokens := tx.Bucket(emailTokensBucket)
+		hash := tokenutil.Hash(token)
+		data := tokens.Get(hash)
+		if data == nil {
+			return ErrInvalidToken
+		}
+		var stored EmailToken
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return fmt.Errorf("error decoding email token: %w", err)
+		}
+		if stored.Purpose != purpose {
+			return ErrInvalidToken
+		}
+		if err := tokens.Delete(hash); err != nil {
+			return err
+		}
+		if err := tx.Bucket(tokensByUserBucket).Delete(tokenUserKey(stored.Username, stored.Purpose)); err != nil {
+			return err
+		}
+		// An expired token is deleted all the same
+		if !now.Before(stored.ExpiresAt) {
+			return nil
+		}
+		consumed = &stored
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if consumed == nil {
+		return nil, ErrInvalidToken
+	}
+	return consumed, nil
+}
+
+// Revoke deletes the user's token for the purpose, if any
+func (s *TokenStore) Revoke(username string, purpose TokenPurpose) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		byUser := tx.Bucket(tokensByUserBucket)
+		key := tokenUserKey(username, purpose)
+		hash := byUser.Get(key)
+		if hash == nil {
+			return nil
+		}
+		if err := tx.Bucket(emailTokensBucket).Delete(hash); err != nil {
+			return err
+		}
+		return byUser.Delete(key)
+	})
+}
+
+// Prune deletes expired tokens
+func (s *TokenStore) Prune(now time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		tokens := tx.Bucket(emailTokensBucket)
+		byUser := tx.Bucket(tokensByUserBucket)
+		var expired [][]byte
+		err := tokens.ForEach(func(hash, data []byte) error {
+			var stored EmailToken
+			if err := json.Unmarshal(data, &stored); err != nil {
+				return err
+			}
+			if !now.Before(stored.ExpiresAt) {
+				expired = append(expired, append([]byte(nil), hash...))
+				return byUser.Delete(tokenUserKey(stored.Username, stored.Purpose))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, hash := range expired {
+			if err := tokens.Delete(hash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func tokenUserKey(username string, purpose TokenPurpose) []byte {
+	return []byte(username + "\x00" + string(purpose))
+}
@@ -2,22 +2,73 @@ package user
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
+
+	"image-upload-server/auth"
+	"image-upload-server/privacy"
 )
 
 // User represents a user in the system
 type User struct {
-	Username  string    `json:"username"`
-	Password  string    `json:"password"` // Hashed password
-	Email     string    `json:"email"`
+	Username string `json:"username"`
+	Password string `json:"password"` // Hashed password
+	Email    string `json:"email"`
+	// EmailVerified is set once the user confirmed they receive mail at
+	// Email
+	EmailVerified bool `json:"email_verified"`
+	// Role is one of auth.Roles and decides what the user may do
 	Role      string    `json:"role"`
 	CreatedAt time.Time `json:"created_at"`
+	// StripMetadata are the metadata groups removed from photos the user
+	// shares unless a share says otherwise; nil removes all of them
+	StripMetadata []privacy.Group `json:"strip_metadata"`
+}
+
+// ShareStripGroups returns the metadata groups removed from the user's
+// shared photos by default
+func (u User) ShareStripGroups() []privacy.Group {
+	if u.StripMetadata == nil {
+		return privacy.AllGroups
+	}
+	return u.StripMetadata
+}
+
+// ErrUserNotFound is returned for operations on a user that doesn't exist
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrEmailInUse is returned when another user already has the email address
+var ErrEmailInUse = errors.New("email address is already in use")
+
+// ErrLastAdmin is returned when the only admin would lose the role
+var ErrLastAdmin = errors.New("the last admin can't be given another role")
+
+// usernamePattern limits usernames to characters that are safe to use as the
+// name of the user's uploads directory
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]{0,63}$`)
+
+// legacyDirPattern matches the top-level directories of the shared uploads
+// layout (YYYY and na), which usernames must not collide with
+var legacyDirPattern = regexp.MustCompile(`^([0-9]{4}|na)$`)
+
+// ValidateUsername checks that a username can be used as a storage namespace
+func ValidateUsername(username string) error {
+	if !usernamePattern.MatchString(username) {
+		return fmt.Errorf("username must be 1-64 letters, digits, '.', '_' or '-' and must not start with '.'")
+	}
+	if legacyDirPattern.MatchString(username) {
+		return fmt.Errorf("username %s is reserved", username)
+	}
+	return nil
 }
 
 // UserDatabase represents an in-memory database of users with persistence
@@ -46,8 +97,13 @@ func NewUserDatabase(path string) (*UserDatabase, error) {
 	return db, nil
 }
 
-// AddUser adds a new user to the database
+// AddUser adds a new user to the database. It returns ErrEmailInUse if
+// another user has the email address.
 func (db *UserDatabase) AddUser(username, password, email string) error {
+	if err := ValidateUsername(username); err != nil {
+		return err
+	}
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
@@ -55,19 +111,22 @@ func (db *UserDatabase) AddUser(username, password, email string) error {
 	if _, exists := db.Users[username]; exists {
 		return fmt.Errorf("user %s already exists", username)
 	}
+	if db.emailInUse(email, username) {
+		return ErrEmailInUse
+	}
 
 	// Hash the password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashedPassword, err := hashPassword(password)
 	if err != nil {
-		return fmt.Errorf("error hashing password: %w", err)
+		return err
 	}
 
 	// Create the user
 	db.Users[username] = User{
 		Username:  username,
-		Password:  string(hashedPassword),
+		Password:  hashedPassword,
 		Email:     email,
-		Role:      "user", // Default role
+		Role:      auth.RoleMember, // Default role
 		CreatedAt: time.Now(),
 	}
 
@@ -99,6 +158,172 @@ func (db *UserDatabase) GetUser(username string) (User, bool) {
 	return user, exists
 }
 
+// SetStripMetadata changes the metadata groups removed from the user's
+// shared photos by default
+func (db *UserDatabase) SetStripMetadata(username string, groups []privacy.Group) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	user, exists := db.Users[username]
+	if !exists {
+		return fmt.Errorf("user %s not found", username)
+	}
+	if groups == nil {
+		groups = []privacy.Group{}
+	}
+	user.StripMetadata = groups
+	db.Users[username] = user
+
+	return db.SaveToDisk()
+}
+
+// SetRole changes the user's role. The last admin can't be demoted, so
+// there is always someone left to manage users.
+func (db *UserDatabase) SetRole(username, role string) error {
+	if !auth.ValidRole(role) {
+		return fmt.Errorf("unknown role %s", role)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	user, exists := db.Users[username]
+	if !exists {
+		return ErrUserNotFound
+	}
+	if user.Role == auth.RoleAdmin && role != auth.RoleAdmin {
+		admins := 0
+		for _, other := range db.Users {
+			if other.Role == auth.RoleAdmin {
+				admins++
+			}
+		}
+		if admins == 1 {
+			return ErrLastAdmin
+		}
+	}
+	user.Role = role
+	db.Users[username] = user
+
+	return db.SaveToDisk()
+}
+
+// SetPassword replaces the user's password
+func (db *UserDatabase) SetPassword(username, password string) error {
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	user, exists := db.Users[username]
+	if !exists {
+		return ErrUserNotFound
+	}
+	user.Password = hashedPassword
+	db.Users[username] = user
+
+	return db.SaveToDisk()
+}
+
+// SetEmail changes the user's email to an address they confirmed. It
+// returns ErrEmailInUse if another user has the address.
+func (db *UserDatabase) SetEmail(username, email string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	user, exists := db.Users[username]
+	if !exists {
+		return ErrUserNotFound
+	}
+	if db.emailInUse(email, username) {
+		return ErrEmailInUse
+	}
+	user.Email = email
+	user.EmailVerified = true
+	db.Users[username] = user
+
+	return db.SaveToDisk()
+}
+
+// MarkEmailVerified records that the user confirmed the address. It reports
+// false if the user's email has changed since the confirmation was sent.
+func (db *UserDatabase) MarkEmailVerified(username, email string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	user, exists := db.Users[username]
+	if !exists {
+		return false, ErrUserNotFound
+	}
+	if !strings.EqualFold(user.Email, email) {
+		return false, nil
+	}
+	if user.EmailVerified {
+		return true, nil
+	}
+	user.EmailVerified = true
+	db.Users[username] = user
+
+	return true, db.SaveToDisk()
+}
+
+// FindByEmail returns the users with the email address, ignoring case,
+// sorted by username. Addresses are unique, but databases from before they
+// were may hold several users with one.
+func (db *UserDatabase) FindByEmail(email string) []User {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var users []User
+	for _, user := range db.Users {
+		if strings.EqualFold(user.Email, email) {
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+// emailInUse reports whether a user other than username has the email
+// address, ignoring case. Users without an address don't collide. The
+// caller holds the lock.
+func (db *UserDatabase) emailInUse(email, username string) bool {
+	if email == "" {
+		return false
+	}
+	for _, other := range db.Users {
+		if other.Username != username && strings.EqualFold(other.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListUsers returns all users sorted by username
+func (db *UserDatabase) ListUsers() []User {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	users := make([]User, 0, len(db.Users))
+	for _, user := range db.Users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+// hashPassword returns the bcrypt hash a password is stored as
+func hashPassword(password string) (string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("error hashing password: %w", err)
+	}
+	return string(hashedPassword), nil
+}
+
 // SaveToDisk saves the user database to a JSON file
 func (db *UserDatabase) SaveToDisk() error {
 
@@ -129,6 +354,12 @@ func (db *UserDatabase) LoadFromDisk() error {
 		return fmt.Errorf("error unmarshaling user database: %w", err)
 	}
 
+	// Users stored before roles had permissions have the role "user"
+	for username, user := range tempDB.Users {
+		user.Role = auth.NormalizeRole(user.Role)
+		tempDB.Users[username] = user
+	}
+
 	// Update the current database
 	db.mu.Lock()
 	db.Users = tempDB.Users
@@ -0,0 +1,55 @@
+package user
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"image-upload-server/auth"
+)
+
+func TestRoles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	db, err := NewUserDatabase(path)
+	require.NoError(t, err)
+	require.NoError(t, db.AddUser("alice", "secret", "alice@example.com"))
+	require.NoError(t, db.AddUser("bob", "secret", "bob@example.com"))
+
+	alice, _ := db.GetUser("alice")
+	assert.Equal(t, auth.RoleMember, alice.Role)
+
+	assert.Error(t, db.SetRole("alice", "superuser"))
+	assert.ErrorIs(t, db.SetRole("carol", auth.RoleAdmin), ErrUserNotFound)
+	require.NoError(t, db.SetRole("alice", auth.RoleAdmin))
+
+	// The last admin keeps the role
+	assert.ErrorIs(t, db.SetRole("alice", auth.RoleMember), ErrLastAdmin)
+	require.NoError(t, db.SetRole("bob", auth.RoleAdmin))
+	require.NoError(t, db.SetRole("alice", auth.RoleUploader))
+
+	reloaded, err := NewUserDatabase(path)
+	require.NoError(t, err)
+	var roles []string
+	for _, user := range reloaded.ListUsers() {
+		roles = append(roles, user.Username+":"+user.Role)
+	}
+	assert.Equal(t, []string{"alice:" + auth.RoleUploader, "bob:" + auth.RoleAdmin}, roles)
+}
+
+func TestLegacyRolesLoadAsMember(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"users": {
+		"alice": {"username": "alice", "role": "user"},
+		"bob": {"username": "bob"}
+	}}`), 0644))
+
+	db, err := NewUserDatabase(path)
+	require.NoError(t, err)
+	for _, username := range []string{"alice", "bob"} {
+		user, _ := db.GetUser(username)
+		assert.Equal(t, auth.RoleMember, user.Role, username)
+	}
+}
@@ -2,7 +2,9 @@
 package user
 
 import (
+	"errors"
 	"image-upload-server/auth"
+	"image-upload-server/mailer"
 	"log"
 	"net/http"
 	"path/filepath"
@@ -42,16 +44,36 @@ func HandleRegister(c *gin.Context) {
 		return
 	}
 
+	email, err := mailer.ValidateAddress(registerRequest.Email)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "success": false})
+		return
+	}
+
 	// Add the user to the database
-	err := UserDB.AddUser(registerRequest.Username, registerRequest.Password, registerRequest.Email)
+	err = UserDB.AddUser(registerRequest.Username, registerRequest.Password, email)
+	if errors.Is(err, ErrEmailInUse) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "success": false})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "success": false})
 		return
 	}
 
+	// Ask the user to confirm their email. The account works without, so a
+	// failure doesn't fail the registration; the link can be sent again.
+	user, _ := UserDB.GetUser(registerRequest.Username)
+	verificationSent := true
+	if err := SendVerificationEmail(user); err != nil {
+		log.Printf("Error sending verification email to %s: %v", user.Username, err)
+		verificationSent = false
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"success": true,
-		"message": "User registered successfully",
+		"success":                 true,
+		"message":                 "User registered successfully",
+		"email_verification_sent": verificationSent,
 	})
 }
 
@@ -76,13 +98,24 @@ func HandleLogin(c *gin.Context) {
 	// Get the user
 	user, _ := UserDB.GetUser(loginRequest.Username)
 
-	// Generate a token for the user
-	token, err := auth.GenerateToken(loginRequest.Username)
+	// Start a session, which issues an access token and a refresh token
+	tokens, err := auth.Sessions.Login(loginRequest.Username, user.Role)
 	if err != nil {
+		log.Printf("Error starting session for %s: %v", loginRequest.Username, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
-	// Return the token to the client
-	c.JSON(http.StatusOK, gin.H{"token": token, "identity": gin.H{"username": loginRequest.Username, "role": user.Role}})
+	// Return the tokens to the client
+	c.JSON(http.StatusOK, gin.H{
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+		"identity": gin.H{
+			"username":       loginRequest.Username,
+			"role":           user.Role,
+			"permissions":    auth.Permissions(user.Role),
+			"email_verified": user.EmailVerified,
+		},
+	})
 }
@@ -0,0 +1,147 @@
+// Package video extracts the metadata of MP4 and QuickTime videos as
+// recorded by phones and cameras
+package video
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"image-upload-server/exif"
+	"image-upload-server/isobmff"
+)
+
+// Metadata keys written by iPhones and the user data atom written by
+// Android phones
+const (
+	keyCreationDate  = "com.apple.quicktime.creationdate"
+	keyContentID     = "com.apple.quicktime.content.identifier"
+	keyLocation      = "com.apple.quicktime.location.ISO6709"
+	keyMake          = "com.apple.quicktime.make"
+	keyModel         = "com.apple.quicktime.model"
+	userDataLocation = "©xyz"
+)
+
+// creationDateLayouts are the ISO 8601 forms of the QuickTime creation date
+var creationDateLayouts = []string{
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02T15:04:05Z07:00",
+}
+
+// iso6709Pattern matches a position in decimal degrees with an optional
+// altitude, e.g. "+35.6586+139.7454+041.000/"
+var iso6709Pattern = regexp.MustCompile(`^([+-]\d+(?:\.\d+)?)([+-]\d+(?:\.\d+)?)([+-]\d+(?:\.\d+)?)?`)
+
+// Metadata is the descriptive metadata of a video
+type Metadata struct {
+	// Duration in seconds
+	Duration float64 `json:"duration"`
+	Width    int     `json:"width,omitempty"`
+	Height   int     `json:"height,omitempty"`
+	// Rotation in degrees clockwise to apply when playing the video
+	Rotation int `json:"rotation,omitempty"`
+	// Codec is the sample entry type of the video track, e.g. "avc1" for
+	// H.264 or "hvc1" for HEVC
+	Codec string `json:"codec,omitempty"`
+	Make  string `json:"make,omitempty"`
+	Model string `json:"model,omitempty"`
+	// CreationDate is the local capture time with its offset as recorded
+	// by iPhones, e.g. "2023-10-07T19:48:12+0900"
+	CreationDate string `json:"creation_date,omitempty"`
+	// CreationTime is the creation time of the movie header in UTC
+	CreationTime *time.Time `json:"creation_time,omitempty"`
+	GPS          *exif.GPS  `json:"gps,omitempty"`
+	// ContentIdentifier links the video of an iPhone Live Photo to its
+	// photo
+	ContentIdentifier string `json:"content_identifier,omitempty"`
+}
+
+// IsVideo reports whether the file is an MP4 or QuickTime video
+func IsVideo(r io.ReaderAt, size int64) bool {
+	return isobmff.IsMovie(r, size)
+}
+
+// ExtractMetadataFromReaderAt extracts the metadata of a video of the given
+// size. Only the movie box is read, wherever it is in the file.
+func ExtractMetadataFromReaderAt(r io.ReaderAt, size int64) (*Metadata, error) {
+	movie, err := isobmff.ParseMovie(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse video: %v", err)
+	}
+
+	metadata := &Metadata{
+		Duration:          math.Round(movie.Duration.Seconds()*1000) / 1000,
+		Width:             movie.Width,
+		Height:            movie.Height,
+		Rotation:          movie.Rotation,
+		Codec:             strings.TrimSpace(movie.Codec),
+		Make:              strings.TrimSpace(movie.Metadata[keyMake]),
+		Model:             strings.TrimSpace(movie.Metadata[keyModel]),
+		CreationDate:      strings.TrimSpace(movie.Metadata[keyCreationDate]),
+		ContentIdentifier: strings.TrimSpace(movie.Metadata[keyContentID]),
+	}
+	if !movie.CreationTime.IsZero() {
+		creationTime := movie.CreationTime
+		metadata.CreationTime = &creationTime
+	}
+
+	location := movie.Metadata[keyLocation]
+	if location == "" {
+		location = movie.Metadata[userDataLocation]
+	}
+	if gps, ok := parseISO6709(location); ok {
+		metadata.GPS = gps
+	}
+	return metadata, nil
+}
+
+// ResolveCaptureTime returns the capture time in the time zone the video
+// was recorded in. The iPhone creation date carries its offset; the movie
+// header creation time is in UTC and is shown in the zone at the GPS
+// position, or in defaultZone without one.
+func (m *Metadata) ResolveCaptureTime(defaultZone *time.Location) (exif.CaptureTime, error) {
+	if m.CreationDate != "" {
+		for _, layout := range creationDateLayouts {
+			if t, err := time.Parse(layout, m.CreationDate); err == nil {
+				return exif.CaptureTime{Time: t, Zone: t.Format("-07:00"), Source: exif.ZoneFromOffset}, nil
+			}
+		}
+	}
+
+	if m.CreationTime == nil {
+		return exif.CaptureTime{}, fmt.Errorf("creation time not found")
+	}
+	zone, name, source := defaultZone, defaultZone.String(), exif.ZoneFromDefault
+	if location, zoneName, ok := exif.LookupZone(m.GPS); ok {
+		zone, name, source = location, zoneName, exif.ZoneFromGPS
+	}
+	return exif.CaptureTime{Time: m.CreationTime.In(zone), Zone: name, Source: source}, nil
+}
+
+// parseISO6709 parses a position in ISO 6709 decimal degrees notation
+func parseISO6709(value string) (*exif.GPS, bool) {
+	match := iso6709Pattern.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil {
+		return nil, false
+	}
+	lat, err := strconv.ParseFloat(match[1], 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return nil, false
+	}
+	long, err := strconv.ParseFloat(match[2], 64)
+	if err != nil || long < -180 || long > 180 {
+		return nil, false
+	}
+
+	gps := &exif.GPS{Latitude: lat, Longitude: long}
+	if match[3] != "" {
+		if altitude, err := strconv.ParseFloat(match[3], 64); err == nil {
+			gps.Altitude = &altitude
+		}
+	}
+	return gps, true
+}
@@ -0,0 +1,87 @@
+package video
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"image-upload-server/exif"
+)
+
+func readMetadata(t *testing.T, path string) *Metadata {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	metadata, err := ExtractMetadataFromReaderAt(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	return metadata
+}
+
+func TestExtractMetadataIPhone(t *testing.T) {
+	metadata := readMetadata(t, "../testdata/video/iphone.mov")
+
+	altitude := 41.0
+	created := time.Date(2023, 10, 7, 10, 48, 12, 0, time.UTC)
+	assert.Equal(t, &Metadata{
+		Duration:     12.5,
+		Width:        1920,
+		Height:       1080,
+		Rotation:     90,
+		Codec:        "hvc1",
+		Make:         "Apple",
+		Model:        "iPhone 15 Pro",
+		CreationDate: "2023-10-07T19:48:12+0900",
+		CreationTime: &created,
+		GPS:          &exif.GPS{Latitude: 35.6586, Longitude: 139.7454, Altitude: &altitude},
+	}, metadata)
+
+	// The creation date carries the offset of the time zone it was taken in
+	captureTime, err := metadata.ResolveCaptureTime(time.UTC)
+	require.NoError(t, err)
+	assert.Equal(t, "+09:00", captureTime.Zone)
+	assert.Equal(t, exif.ZoneFromOffset, captureTime.Source)
+	assert.True(t, created.Equal(captureTime.Time))
+	assert.Equal(t, 19, captureTime.Time.Hour())
+}
+
+func TestExtractMetadataAndroid(t *testing.T) {
+	metadata := readMetadata(t, "../testdata/video/android.mp4")
+	assert.Equal(t, 4.321, metadata.Duration)
+	assert.Equal(t, "avc1", metadata.Codec)
+	assert.Empty(t, metadata.CreationDate)
+	require.NotNil(t, metadata.GPS)
+	assert.Nil(t, metadata.GPS.Altitude)
+
+	// The UTC movie header time is shown in the zone at the location
+	captureTime, err := metadata.ResolveCaptureTime(time.UTC)
+	require.NoError(t, err)
+	assert.Equal(t, "Europe/Warsaw", captureTime.Zone)
+	assert.Equal(t, exif.ZoneFromGPS, captureTime.Source)
+	assert.Equal(t, 16, captureTime.Time.Hour())
+}
+
+func TestExtractMetadataLivePhoto(t *testing.T) {
+	metadata := readMetadata(t, "../testdata/stack/IMG_4211.MOV")
+	assert.Equal(t, "5A7F3E2C-9B41-4D8E-A6C2-3F1E0B9D7C44", metadata.ContentIdentifier)
+	assert.Equal(t, 3.0, metadata.Duration)
+}
+
+func TestResolveCaptureTimeWithoutDates(t *testing.T) {
+	_, err := (&Metadata{Duration: 3}).ResolveCaptureTime(time.UTC)
+	assert.Error(t, err)
+}
+
+func TestParseISO6709(t *testing.T) {
+	gps, ok := parseISO6709("-33.8688+151.2093/")
+	require.True(t, ok)
+	assert.Equal(t, -33.8688, gps.Latitude)
+	assert.Equal(t, 151.2093, gps.Longitude)
+
+	for _, value := range []string{"", "garbage", "+95.0000+010.0000/"} {
+		_, ok := parseISO6709(value)
+		assert.False(t, ok, value)
+	}
+}